@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/metric/noop"
+
+	"github.com/joaopenteado/firesync/internal/backfill"
+	"github.com/joaopenteado/firesync/internal/config"
+	"github.com/joaopenteado/firesync/internal/scan"
+)
+
+// runBackfill propagates the documents that already exist in the configured
+// database, e.g. before a new region starts receiving changes. It is
+// configured by the same environment as the service, plus flags:
+//
+//	firesync backfill [-job name] [-collections users,users/*/sessions] [-rate 100] ...
+//
+// Interrupted backfills resume from their saved cursor when run again.
+func runBackfill(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	var (
+		job              = flags.String("job", "default", "name of the backfill, whose cursor is saved under it")
+		collections      = flags.String("collections", "", "comma separated collection patterns to backfill, all collections if empty")
+		batchSize        = flags.Int("batch-size", 100, "number of documents read at once")
+		concurrency      = flags.Int("concurrency", 4, "number of documents propagated concurrently")
+		rate             = flags.Float64("rate", 50, "maximum documents propagated per second, unlimited if zero")
+		progressInterval = flags.Duration("progress-interval", 10*time.Second, "how often progress is logged")
+		restart          = flags.Bool("restart", false, "ignore the saved cursor and start over")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	setupLogging(cfg)
+	if !cfg.Propagates() {
+		return fmt.Errorf("standby region %s doesn't propagate its documents", cfg.TopologyRegion().Name)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx = log.Logger.WithContext(ctx)
+
+	pubsubClient, err := pubsub.NewClient(ctx, cfg.ProjectID)
+	if err != nil {
+		return fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+	defer pubsubClient.Close()
+
+	topic, err := openTopic(ctx, pubsubClient, cfg.TopicProjectID(), cfg.TopicID())
+	if err != nil {
+		return err
+	}
+
+	firestoreClient, err := firestore.NewClientWithDatabase(ctx, cfg.DatabaseProjectID(), cfg.DatabaseID())
+	if err != nil {
+		return fmt.Errorf("failed to create firestore client: %w", err)
+	}
+	defer firestoreClient.Close()
+
+	patterns, err := parseCollections(*collections)
+	if err != nil {
+		return err
+	}
+
+	transformer, err := newTransformer(cfg)
+	if err != nil {
+		return err
+	}
+
+	b := backfill.New(
+		firestoreClient,
+		newPropagator(cfg, topic, firestoreClient, noop.Meter{}, nil, transformer),
+		scan.NewFirestoreCursorStore(firestoreClient, backfill.CursorCollection),
+		backfill.Config{
+			Job:              *job,
+			Collections:      patterns,
+			BatchSize:        *batchSize,
+			Concurrency:      *concurrency,
+			Rate:             *rate,
+			ProgressInterval: *progressInterval,
+			Restart:          *restart,
+		},
+	)
+
+	stats, err := b.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("backfill interrupted, run again to resume: %w", err)
+	}
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d documents failed to backfill", stats.Failed)
+	}
+	return nil
+}
+
+// parseCollections parses a comma separated list of collection patterns, in
+// path.Match syntax.
+func parseCollections(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid collection pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
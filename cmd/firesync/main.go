@@ -7,10 +7,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
@@ -20,14 +23,25 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/joaopenteado/firesync/internal/auth"
 	"github.com/joaopenteado/firesync/internal/cloudlogging"
 	"github.com/joaopenteado/firesync/internal/config"
 	"github.com/joaopenteado/firesync/internal/handler"
+	"github.com/joaopenteado/firesync/internal/health"
+	"github.com/joaopenteado/firesync/internal/heartbeat"
+	"github.com/joaopenteado/firesync/internal/limiter"
+	"github.com/joaopenteado/firesync/internal/middleware"
+	"github.com/joaopenteado/firesync/internal/model"
 	"github.com/joaopenteado/firesync/internal/router"
 	"github.com/joaopenteado/firesync/internal/service"
 	"github.com/joaopenteado/firesync/internal/telemetry"
+	"github.com/joaopenteado/firesync/internal/worker"
 )
 
 const (
@@ -35,9 +49,145 @@ const (
 )
 
 func main() {
-	if err := run(context.Background()); err != nil {
-		log.Fatal().Err(err).Msg("failed to run service")
+	ctx := context.Background()
+
+	// without a command, the service is run
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = run(ctx)
+	case "backfill":
+		err = runBackfill(ctx, args)
+	case "verify":
+		err = runVerify(ctx, args)
+	case "repair":
+		err = runRepair(ctx, args)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("command", cmd).Msg("failed to run command")
+	}
+}
+
+func setupLogging(cfg *config.Config) {
+	zerolog.SetGlobalLevel(cfg.LogLevel)
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	zerolog.LevelFieldName = "severity"
+	zerolog.LevelFieldMarshalFunc = cloudlogging.LevelFieldMarshalFunc
+	log.Logger = log.Hook(cloudlogging.Hook(cfg.ProjectID))
+	if cfg.LogPretty {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	}
+}
+
+// newPropagator returns the propagator of changes to the topic. The controller
+// may be nil if pausing collections is disabled, and the transformer if there
+// are no schema migrations.
+func newPropagator(cfg *config.Config, topic *pubsub.Topic, firestoreClient *firestore.Client, meter metric.Meter, controller *service.Controller, transformer service.Transformer) handler.Propagator {
+	tombstoneTTLRules := make([]service.TombstoneTTLRule, len(cfg.TombstoneTTLOverrides))
+	for i, o := range cfg.TombstoneTTLOverrides {
+		tombstoneTTLRules[i] = service.TombstoneTTLRule{Pattern: o.Pattern, TTL: o.TTL}
+	}
+
+	return service.NewPropagator(
+		service.NewPubSubTopicAdapter(topic),
+		service.NewFirestoreClientAdapter(firestoreClient),
+		cfg.TombstoneTTL,
+		meter,
+		service.WithTombstoneTTLRules(tombstoneTTLRules...),
+		service.WithSubtreeDeleteCollections(cfg.SubtreeDeleteCollections...),
+		service.WithPriorities(priorities(cfg)),
+		service.WithController(controller),
+		service.WithSchema(transformer, cfg.SchemaVersion),
+		service.WithPublishedSchemaVersion(cfg.PublishedSchemaVersion),
+	)
+}
+
+// newTransformer returns the schema migrations of the transforms file, nil
+// without one.
+func newTransformer(cfg *config.Config) (service.Transformer, error) {
+	if cfg.Transforms == nil {
+		return nil, nil
+	}
+
+	convert := func(transforms []config.FieldTransform) ([]service.FieldTransform, error) {
+		converted := make([]service.FieldTransform, len(transforms))
+		for i, t := range transforms {
+			switch {
+			case t.Rename != nil:
+				converted[i] = service.RenameField(t.Rename.From, t.Rename.To)
+			case t.Drop != "":
+				converted[i] = service.DropField(t.Drop)
+			case t.Default != nil:
+				value, err := model.EncodeValue(t.Default.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid default value of field %s: %w", t.Default.Field, err)
+				}
+				converted[i] = service.DefaultField(t.Default.Field, value)
+			case t.Convert != nil:
+				converted[i] = service.ConvertField(t.Convert.Field, t.Convert.Type)
+			}
+		}
+		return converted, nil
+	}
+
+	migrations := make(service.Migrations, len(cfg.Transforms.Migrations))
+	for i, m := range cfg.Transforms.Migrations {
+		upgrade, err := convert(m.Upgrade)
+		if err != nil {
+			return nil, err
+		}
+		downgrade, err := convert(m.Downgrade)
+		if err != nil {
+			return nil, err
+		}
+		migrations[i] = service.Migration{
+			Collection: m.Collection,
+			Version:    m.Version,
+			Upgrade:    upgrade,
+			Downgrade:  downgrade,
+		}
+	}
+	return migrations, nil
+}
+
+// openTopic returns the topic with the given ID, in the given project, which
+// may differ from the one of the client. It fails if the topic doesn't exist,
+// so a misconfigured topic is reported at startup rather than on the first
+// change. The check requires the pubsub.topics.get permission, granted by
+// roles/pubsub.viewer but not by roles/pubsub.publisher; without it the check
+// is skipped with a warning.
+func openTopic(ctx context.Context, client *pubsub.Client, projectID, id string) (*pubsub.Topic, error) {
+	topic := client.TopicInProject(id, projectID)
+	exists, err := topic.Exists(ctx)
+	if status.Code(err) == codes.PermissionDenied {
+		log.Warn().Err(err).
+			Str("topic", topic.String()).
+			Msg("not allowed to check whether the topic exists, grant pubsub.topics.get to report a missing topic at startup")
+		return topic, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check topic %s: %w", topic, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("topic %s not found", topic)
+	}
+	return topic, nil
+}
+
+// priorities returns the tie-breaking priorities of the topology, nil without
+// one.
+func priorities(cfg *config.Config) model.Priorities {
+	if cfg.Topology == nil {
+		return nil
 	}
+	return cfg.Topology.Priorities()
 }
 
 func run(ctx context.Context) error {
@@ -53,18 +203,24 @@ func run(ctx context.Context) error {
 	}
 
 	// Logging
-	zerolog.SetGlobalLevel(cfg.LogLevel)
-	zerolog.TimeFieldFormat = time.RFC3339Nano
-	zerolog.LevelFieldName = "severity"
-	zerolog.LevelFieldMarshalFunc = cloudlogging.LevelFieldMarshalFunc
-	log.Logger = log.Hook(cloudlogging.Hook(cfg.ProjectID))
-	if cfg.LogPretty {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	}
+	setupLogging(cfg)
 
 	log.Info().
 		Str("environment", cfg.Environment).
 		Msg("environment")
+	if region := cfg.TopologyRegion(); region != nil {
+		log.Info().
+			Str("region", region.Name).
+			Str("role", region.Role).
+			Int("regions", len(cfg.Topology.Regions)).
+			Msg("topology loaded")
+	}
+	if cfg.Transforms != nil || cfg.SchemaVersion != 0 {
+		log.Info().
+			Int("schema_version", cfg.SchemaVersion).
+			Int("published_schema_version", cfg.PublishedSchemaVersion).
+			Msg("schema versioning enabled")
+	}
 
 	// Profiling
 	if cfg.GoogleCloudProfilerEnabled {
@@ -90,6 +246,8 @@ func run(ctx context.Context) error {
 		TracingExporter:            cfg.TracingExporter,
 		MetricsExporter:            cfg.MetricsExporter,
 		OTLPProtocol:               cfg.OTLPProtocol,
+		OTLPTracesProtocol:         cfg.OTLPTracesProtocol,
+		OTLPMetricsProtocol:        cfg.OTLPMetricsProtocol,
 		ConsoleExporterPrettyPrint: cfg.ConsoleExporterPrettyPrint,
 		TraceSampleRatio:           cfg.TraceSampleRatio,
 	})
@@ -128,20 +286,251 @@ func run(ctx context.Context) error {
 		}
 	}()
 
-	propagator := service.NewPropagator(service.NewPubSubTopicAdapter(pubsubClient.Topic(cfg.Topic)), service.NewFirestoreClientAdapter(firestoreClient), cfg.TombstoneTTL, meter)
-	replicator := service.NewReplicator(meter, firestoreClient)
+	var controller *service.Controller
+	if cfg.PauseControlEnabled {
+		controller = service.NewController(service.NewFirestoreControlStore(firestoreClient), cfg.PauseControlCacheTTL, meter)
+	}
+
+	topic, err := openTopic(initCtx, pubsubClient, cfg.TopicProjectID(), cfg.TopicID())
+	if err != nil {
+		return err
+	}
+
+	transformer, err := newTransformer(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Every served database gets its own propagator and replicator, opened on
+	// its first change. DATABASE reuses the client and topic opened above,
+	// the other databases propagate to the topic of their region, unless
+	// it's a standby one.
+	pathMappings := make([]model.PathMapping, len(cfg.PathMappings))
+	for i, m := range cfg.PathMappings {
+		pathMappings[i] = model.PathMapping{
+			SourceDatabase: m.SourceDatabase,
+			Source:         m.Source,
+			TargetDatabase: m.TargetDatabase,
+			Target:         m.Target,
+		}
+	}
+	pool, err := service.NewPool(cfg.ServedDatabases(), func(ctx context.Context, database string) (*service.Services, error) {
+		client, closeClient := firestoreClient, func() error { return nil }
+		if database != cfg.DatabaseName() {
+			projectID, databaseID, err := model.ParseDatabaseName(database)
+			if err != nil {
+				return nil, err
+			}
+			// the client outlives the request opening it
+			client, err = firestore.NewClientWithDatabase(context.WithoutCancel(ctx), projectID, databaseID)
+			if err != nil {
+				return nil, err
+			}
+			closeClient = client.Close
+		}
+
+		var propagator handler.Propagator
+		if cfg.DatabasePropagates(database) {
+			dbTopic := topic
+			if projectID, id := cfg.DatabaseTopicProjectID(database), cfg.DatabaseTopicID(database); projectID != cfg.TopicProjectID() || id != cfg.TopicID() {
+				if dbTopic, err = openTopic(ctx, pubsubClient, projectID, id); err != nil {
+					return nil, errors.Join(err, closeClient())
+				}
+				closeDatabase := closeClient
+				closeClient = func() error {
+					dbTopic.Stop()
+					return closeDatabase()
+				}
+			}
+			propagator = newPropagator(cfg, dbTopic, client, meter, controller, transformer)
+		}
+
+		return &service.Services{
+			Propagator: propagator,
+			Replicator: service.NewReplicator(
+				meter,
+				service.NewFirestoreClientAdapter(client),
+				service.WithSubtreeDeleteCollections(cfg.SubtreeDeleteCollections...),
+				service.WithController(controller),
+				service.WithPriorities(priorities(cfg)),
+				service.WithDatabaseName(database),
+				service.WithPathMappings(pathMappings...),
+				service.WithSchema(transformer, cfg.SchemaVersion),
+			),
+			Check: health.FirestoreChecker(client).Check,
+			Close: closeClient,
+		}, nil
+	}, meter, service.WithPathMappings(pathMappings...))
+	if err != nil {
+		return fmt.Errorf("failed to create database pool: %w", err)
+	}
+	defer func() {
+		if err := pool.Close(); err != nil {
+			log.Err(err).Msg("failed to close database pool")
+		}
+	}()
+
+	var deadLetterTopic service.PubSubTopic
+	if cfg.DeadLetterTopic != "" {
+		topic, err := openTopic(initCtx, pubsubClient, cfg.DeadLetterTopicProjectID(), cfg.DeadLetterTopicID())
+		if err != nil {
+			return err
+		}
+		deadLetterTopic = service.NewPubSubTopicAdapter(topic)
+	}
+	deadLetterQueue := service.NewDeadLetterQueue(deadLetterTopic, meter)
+
+	handlerOpts := []handler.Option{
+		handler.WithHTTP200Acknowledgement(cfg.ForceHTTP200Acknowledgement),
+		handler.WithDeadLetterSink(deadLetterQueue),
+	}
+	if cfg.ConcurrencyLimit > 0 || cfg.ConcurrencyLimitPerDocument > 0 {
+		handlerOpts = append(handlerOpts, handler.WithConcurrencyLimiter(limiter.New(limiter.Config{
+			Global:       cfg.ConcurrencyLimit,
+			PerDocument:  cfg.ConcurrencyLimitPerDocument,
+			QueueTimeout: cfg.ConcurrencyQueueTimeout,
+		}, meter), cfg.ConcurrencyRetryAfter))
+	}
+	switch cfg.DedupStore {
+	case "memory":
+		handlerOpts = append(handlerOpts, handler.WithDeduplicator(service.NewDeduplicator(
+			service.NewMemoryDedupStore(cfg.DedupCacheSize, cfg.DedupTTL), meter,
+		)))
+	case "firestore":
+		handlerOpts = append(handlerOpts, handler.WithDeduplicator(service.NewDeduplicator(
+			service.NewTieredDedupStore(
+				service.NewMemoryDedupStore(cfg.DedupCacheSize, cfg.DedupTTL),
+				service.NewFirestoreDedupStore(firestoreClient, cfg.DedupTTL),
+			), meter,
+		)))
+	}
 
-	r := router.New(router.Config{
-		PropagateHandler: handler.Propagate(propagator, handler.WithHTTP200Acknowledgement(cfg.ForceHTTP200Acknowledgement)),
-		ReplicateHandler: handler.Replicate(replicator),
+	var (
+		verifier      middleware.TokenVerifier
+		authenticator func(http.Handler) http.Handler
+	)
+	if cfg.OIDCEnabled {
+		var keys auth.KeySet
+		if cfg.OIDCJWKSFile != "" {
+			keys, err = auth.NewFileKeySet(cfg.OIDCJWKSFile)
+			if err != nil {
+				return fmt.Errorf("failed to load oidc jwks file: %w", err)
+			}
+		} else {
+			keys = auth.NewRemoteKeySet(cfg.OIDCJWKSURL, http.DefaultClient, time.Hour)
+		}
+		if len(cfg.OIDCAllowedEmails) == 0 {
+			log.Warn().
+				Str("audience", cfg.OIDCAudience).
+				Msg("OIDC_ALLOWED_EMAILS is empty, any Google account with a verified email and a token for the audience is allowed to push messages")
+		}
+		verifier = auth.NewVerifier(auth.VerifierConfig{
+			Keys:          keys,
+			Issuers:       cfg.OIDCIssuers,
+			Audience:      cfg.OIDCAudience,
+			AllowedEmails: cfg.OIDCAllowedEmails,
+			ClockSkew:     time.Minute,
+		})
+		authenticator = middleware.OIDC(verifier)
+	}
+
+	checkers := []health.Checker{
+		health.FirestoreChecker(firestoreClient),
+		health.PubSubTopicChecker(topic),
+	}
+	for _, database := range cfg.ServedDatabases()[1:] {
+		checkers = append(checkers, health.CheckerFunc("firestore:"+database, func(ctx context.Context) error {
+			return pool.Check(ctx, database)
+		}))
+	}
+	readiness := health.NewReadiness(cfg.ReadinessCacheTTL, checkers...)
+
+	routerCfg := router.Config{
 		ServiceName:      cfg.ServiceName,
 		TracingEnabled:   cfg.TracingExporter != "none",
-	})
+		Meter:            meter,
+		RequestTimeout:   cfg.RequestTimeout,
+		MaxBodyBytes:     cfg.MaxBodyBytes,
+		ReadinessHandler: readiness,
+		Authenticator:    authenticator,
+	}
+	if cfg.AdminAPIEnabled {
+		routerCfg.PausesHandler = handler.Pauses(controller)
+	}
+
+	// Prometheus scrapes /metrics on PORT, or on its own port, out of reach
+	// of the public endpoints.
+	var metricsSrv *http.Server
+	if metrics := telemetryManager.MetricsHandler(); metrics != nil {
+		if cfg.MetricsPort == 0 {
+			routerCfg.MetricsHandler = metrics
+			routerCfg.MetricsAuthEnabled = cfg.MetricsAuthEnabled
+		} else {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", metrics)
+			metricsSrv = &http.Server{
+				Addr:              fmt.Sprintf(":%d", cfg.MetricsPort),
+				Handler:           mux,
+				ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			}
+		}
+	}
+
+	var (
+		wrk     *worker.Worker
+		grpcSrv *grpc.Server
+	)
+	switch cfg.Mode {
+	case config.ModeServer:
+		// standby regions don't propagate their changes
+		var grpcPropagator handler.Propagator
+		if cfg.PropagatesAny() {
+			routerCfg.PropagateHandler = handler.Propagate(pool, handlerOpts...)
+			grpcPropagator = pool
+		}
+		routerCfg.ReplicateHandler = handler.Replicate(pool, handlerOpts...)
+
+		if cfg.GRPCPort != 0 {
+			grpcSrv = router.NewGRPC(router.GRPCConfig{
+				Register: func(s grpc.ServiceRegistrar) {
+					opts := append(slices.Clip(handlerOpts), handler.WithStreamMessageTimeout(cfg.RequestTimeout))
+					handler.RegisterGRPC(s, grpcPropagator, pool, opts...)
+				},
+				TracingEnabled: cfg.TracingExporter != "none",
+				Verifier:       verifier,
+				MaxRecvMsgSize: int(cfg.MaxBodyBytes),
+				Meter:          meter,
+				RequestTimeout: cfg.RequestTimeout,
+			})
+		}
+
+	case config.ModeWorker:
+		subscription := func(projectID, id string) *pubsub.Subscription {
+			sub := pubsubClient.SubscriptionInProject(id, projectID)
+			sub.ReceiveSettings.MaxOutstandingMessages = cfg.WorkerMaxOutstandingMessages
+			sub.ReceiveSettings.MaxOutstandingBytes = cfg.WorkerMaxOutstandingBytes
+			return sub
+		}
+
+		wrk = worker.New(meter)
+		if cfg.PropagateSubscription != "" {
+			wrk.Handle(subscription(cfg.PropagateSubscriptionProjectID(), cfg.PropagateSubscriptionID()), handler.PropagateMessage(pool, handlerOpts...))
+		}
+		if cfg.ReplicateSubscription != "" {
+			wrk.Handle(subscription(cfg.ReplicateSubscriptionProjectID(), cfg.ReplicateSubscriptionID()), handler.ReplicateMessage(pool, handlerOpts...))
+		}
+	}
+
+	r := router.New(routerCfg)
 
-	// TODO: configuration for the http server
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: r,
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
 	}
 
 	errCh := make(chan error)
@@ -153,14 +542,93 @@ func run(ctx context.Context) error {
 		}
 	}()
 
+	metricsErrCh := make(chan error)
+	if metricsSrv != nil {
+		go func() {
+			defer close(metricsErrCh)
+			log.Debug().Msg("starting metrics server")
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				metricsErrCh <- err
+			}
+		}()
+	}
+
+	grpcErrCh := make(chan error)
+	if grpcSrv != nil {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCPort))
+		if err != nil {
+			return fmt.Errorf("failed to listen for grpc: %w", err)
+		}
+		go func() {
+			defer close(grpcErrCh)
+			log.Debug().Msg("starting grpc server")
+			if err := grpcSrv.Serve(lis); err != nil {
+				grpcErrCh <- err
+			}
+		}()
+	}
+
 	sig, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// Every served database writes its heartbeat and reads the ones
+	// replicated to it, so the lag to each of them is measured.
+	if cfg.HeartbeatInterval > 0 {
+		for _, database := range cfg.ServedDatabases() {
+			client := firestoreClient
+			if database != cfg.DatabaseName() {
+				projectID, databaseID, err := model.ParseDatabaseName(database)
+				if err != nil {
+					return err
+				}
+				client, err = firestore.NewClientWithDatabase(ctx, projectID, databaseID)
+				if err != nil {
+					return fmt.Errorf("failed to create heartbeat firestore client for %s: %w", database, err)
+				}
+				defer func() {
+					if err := client.Close(); err != nil {
+						log.Err(err).Str("database", database).Msg("failed to close heartbeat firestore client")
+					}
+				}()
+			}
+
+			hb := heartbeat.New(
+				heartbeat.NewFirestoreStore(client),
+				database,
+				cfg.HeartbeatInterval,
+				meter,
+			)
+			logger := log.Logger.With().Str("database", database).Logger()
+			go hb.Run(logger.WithContext(sig))
+		}
+	}
+
+	// The worker stops pulling messages as soon as the shutdown signal is
+	// received, and drains the ones being processed.
+	workerCtx, stopWorker := context.WithCancel(log.Logger.WithContext(ctx))
+	defer stopWorker()
+	workerErrCh := make(chan error)
+	if wrk != nil {
+		go func() {
+			defer close(workerErrCh)
+			log.Debug().Msg("starting worker")
+			if err := wrk.Run(workerCtx); err != nil {
+				workerErrCh <- err
+			}
+		}()
+	}
+
 	select {
 	case err := <-errCh:
 		if err != nil {
 			return err // Server failed to start
 		}
+	case err := <-workerErrCh:
+		return err // Worker failed to receive messages
+	case err := <-grpcErrCh:
+		return fmt.Errorf("grpc server failed: %w", err)
+	case err := <-metricsErrCh:
+		return fmt.Errorf("metrics server failed: %w", err)
 	case <-sig.Done(): // Graceful shutdown signal received
 		shutdownDeadline = time.Now().Add(cfg.ShutdownTimeout)
 	}
@@ -176,6 +644,42 @@ func run(ctx context.Context) error {
 	shutdownCtx, cancel := context.WithDeadline(ctx, shutdownDeadline)
 	defer cancel()
 
+	// keep serving while probes observe the service as not ready
+	if err := readiness.Drain(shutdownCtx, cfg.ShutdownReadinessDelay); err != nil {
+		return fmt.Errorf("failed to drain readiness: %w", err)
+	}
+
+	if wrk != nil {
+		stopWorker()
+		select {
+		case err := <-workerErrCh:
+			if err != nil {
+				return fmt.Errorf("failed to drain worker: %w", err)
+			}
+		case <-shutdownCtx.Done():
+			return fmt.Errorf("failed to drain worker: %w", shutdownCtx.Err())
+		}
+	}
+
+	if grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			grpcSrv.GracefulStop()
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcSrv.Stop()
+			return fmt.Errorf("failed to gracefully shutdown grpc server: %w", shutdownCtx.Err())
+		}
+	}
+
+	if metricsSrv != nil {
+		// metrics are scraped until the end of the shutdown
+		defer metricsSrv.Close()
+	}
+
 	errCh = make(chan error)
 	go func() {
 		defer close(errCh)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/joaopenteado/firesync/internal/config"
+	"github.com/joaopenteado/firesync/internal/repair"
+)
+
+// runRepair writes the last-writer-wins version of diverged documents to the
+// databases where it lost. The documents are read from the findings of the
+// verify command, or a list of paths, one per line:
+//
+//	firesync verify -databases a,b -output findings.jsonl
+//	firesync repair -databases a,b -input findings.jsonl [-dry-run]
+func runRepair(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+	var (
+		databases = flags.String("databases", "", "comma separated database resource names to repair, every region of the topology if empty")
+		input     = flags.String("input", "", "file with the findings or document paths to repair, standard input if empty")
+		dryRun    = flags.Bool("dry-run", false, "only report the repairs that would be made")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("failed to open input: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	paths, err := repair.ReadPaths(r)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	setupLogging(cfg)
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx = log.Logger.WithContext(ctx)
+
+	dbs, err := openDatabases(ctx, cfg, *databases)
+	if err != nil {
+		return err
+	}
+	defer closeDatabases(dbs)
+
+	summary, err := repair.New(dbs, repair.Config{DryRun: *dryRun, Priorities: priorities(cfg)}).Run(ctx, paths)
+	log.Info().
+		Int64("consistent", summary.Consistent).
+		Int64("repaired", summary.Repaired).
+		Int64("conflicts", summary.Conflicts).
+		Int64("failed", summary.Failed).
+		Bool("dry_run", *dryRun).
+		Msg("repair finished")
+	if err != nil {
+		return fmt.Errorf("repair interrupted: %w", err)
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d documents failed to repair", summary.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/rs/zerolog/log"
+
+	"github.com/joaopenteado/firesync/internal/config"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/scan"
+	"github.com/joaopenteado/firesync/internal/verify"
+)
+
+// runVerify compares the documents of two or more databases, reporting the
+// ones that differ as JSON lines:
+//
+//	firesync verify -databases projects/p/databases/a,projects/p/databases/b [-sample 0.01] [-output findings.jsonl] ...
+//
+// The first database is the reference findings are classified against, and
+// stores the verification cursor. Interrupted verifications resume from their
+// saved cursor when run again.
+func runVerify(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var (
+		databases        = flags.String("databases", "", "comma separated database resource names to compare, the first being the reference, every region of the topology if empty")
+		job              = flags.String("job", "default", "name of the verification, whose cursor is saved under it")
+		collections      = flags.String("collections", "", "comma separated collection patterns to verify, all collections if empty")
+		batchSize        = flags.Int("batch-size", 100, "number of documents read at once")
+		sample           = flags.Float64("sample", 1, "fraction of documents verified, in (0, 1]")
+		output           = flags.String("output", "", "file findings are appended to, standard output if empty")
+		progressInterval = flags.Duration("progress-interval", 10*time.Second, "how often progress is logged")
+		restart          = flags.Bool("restart", false, "ignore the saved cursor and start over")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *sample <= 0 || *sample > 1 {
+		return fmt.Errorf("sample must be in (0, 1], got %v", *sample)
+	}
+	patterns, err := parseCollections(*collections)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	setupLogging(cfg)
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx = log.Logger.WithContext(ctx)
+
+	dbs, err := openDatabases(ctx, cfg, *databases)
+	if err != nil {
+		return err
+	}
+	defer closeDatabases(dbs)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open output: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	v := verify.New(
+		dbs,
+		scan.NewFirestoreCursorStore(dbs[0].Client, verify.CursorCollection),
+		verify.Config{
+			Job:              *job,
+			Collections:      patterns,
+			BatchSize:        *batchSize,
+			SampleRate:       *sample,
+			ProgressInterval: *progressInterval,
+			Restart:          *restart,
+		},
+	)
+
+	summary, err := v.Run(ctx, w)
+	if err != nil {
+		return fmt.Errorf("verification interrupted, run again to resume: %w", err)
+	}
+	if n := summary.Inconsistent(); n > 0 {
+		return fmt.Errorf("%d documents differ across databases", n)
+	}
+	return nil
+}
+
+// openDatabases opens a client for each of a comma separated list of database
+// resource names, or for every region of the topology if the list is empty.
+// At least two databases are required.
+func openDatabases(ctx context.Context, cfg *config.Config, list string) ([]verify.Database, error) {
+	names := strings.Split(list, ",")
+	if list == "" && cfg.Topology != nil {
+		names = cfg.Topology.Databases()
+	}
+	if len(names) < 2 {
+		return nil, fmt.Errorf("at least two databases must be given")
+	}
+
+	var dbs []verify.Database
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		projectID, databaseID, err := model.ParseDatabaseName(name)
+		if err != nil {
+			closeDatabases(dbs)
+			return nil, err
+		}
+		client, err := firestore.NewClientWithDatabase(ctx, projectID, databaseID)
+		if err != nil {
+			closeDatabases(dbs)
+			return nil, fmt.Errorf("failed to create firestore client for %s: %w", name, err)
+		}
+		dbs = append(dbs, verify.Database{Name: name, Client: client})
+	}
+	return dbs, nil
+}
+
+func closeDatabases(dbs []verify.Database) {
+	for _, db := range dbs {
+		db.Client.Close()
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/pubsub"
+	firesyncconfig "github.com/joaopenteado/firesync/internal/config"
 	"github.com/joaopenteado/firesync/internal/simulator"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -24,9 +27,123 @@ type config struct {
 	PropagatorURLs       []string      `env:"PROPAGATOR_URLS, default=http://firesync:8080/v1/propagate"`
 	FirestoreCollections []string      `env:"FIRESTORE_COLLECTIONS, default=projects/firesync/databases/(default)/documents/test"`
 	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT, default=10s"`
+
+	// TopologyFile, if set, replaces the URL and collection lists above with
+	// the regions of the topology file FireSync is configured with. The
+	// Collections are watched in the database of every active region, and
+	// the topic of every region is pushed to the others.
+	TopologyFile string   `env:"TOPOLOGY_FILE"`
+	Collections  []string `env:"COLLECTIONS, default=test"`
+}
+
+// watch is a collection watched for changes, which are pushed to the
+// propagate endpoint of its region.
+type watch struct {
+	projectID    string
+	databaseID   string
+	path         string
+	propagateURL string
+}
+
+// watchesFromCollections returns the watches of the FIRESTORE_COLLECTIONS,
+// pushed to the PROPAGATOR_URLS of the same index.
+func watchesFromCollections(cfg *config) ([]watch, error) {
+	if len(cfg.PropagatorURLs) < len(cfg.FirestoreCollections) {
+		return nil, fmt.Errorf("missing propagator urls for %d firestore collections", len(cfg.FirestoreCollections))
+	}
+
+	watches := make([]watch, len(cfg.FirestoreCollections))
+	for i, collectionPath := range cfg.FirestoreCollections {
+		matches := collectionPathRegex.FindStringSubmatch(collectionPath)
+		if len(matches) != 4 {
+			return nil, fmt.Errorf("invalid firestore collection path format: %s", collectionPath)
+		}
+		watches[i] = watch{
+			projectID:    matches[1],
+			databaseID:   matches[2],
+			path:         matches[3],
+			propagateURL: cfg.PropagatorURLs[i],
+		}
+	}
+	return watches, nil
+}
+
+// watchesFromTopology returns the watches of the collections in every active
+// region of the topology.
+func watchesFromTopology(topology *firesyncconfig.Topology, collections []string) ([]watch, error) {
+	var watches []watch
+	for _, region := range topology.Regions {
+		if region.Role != firesyncconfig.RoleActive {
+			continue
+		}
+		if region.Endpoint == "" {
+			return nil, fmt.Errorf("region %s has no endpoint", region.Name)
+		}
+		matches := databaseNameRegex.FindStringSubmatch(region.Database)
+		for _, collection := range collections {
+			watches = append(watches, watch{
+				projectID:    matches[1],
+				databaseID:   matches[2],
+				path:         collection,
+				propagateURL: strings.TrimSuffix(region.Endpoint, "/") + "/v1/propagate",
+			})
+		}
+	}
+	return watches, nil
+}
+
+// replicationTopics creates the topic of every region of the topology, with a
+// push subscription to the replicate endpoint of each other region. The
+// topics are created in the simulator's project, by ID.
+func replicationTopics(ctx context.Context, client *pubsub.Client, topology *firesyncconfig.Topology) ([]*simulator.Topic, error) {
+	var (
+		topicIDs    []string
+		subscribers = make(map[string][]string)
+	)
+	for _, publisher := range topology.Regions {
+		topicID := publisher.Topic[strings.LastIndexByte(publisher.Topic, '/')+1:]
+		if _, ok := subscribers[topicID]; !ok {
+			topicIDs = append(topicIDs, topicID)
+			subscribers[topicID] = nil
+		}
+		for _, region := range topology.Regions {
+			if region.Name == publisher.Name || slices.Contains(subscribers[topicID], region.Name) {
+				continue
+			}
+			if region.Endpoint == "" {
+				return nil, fmt.Errorf("region %s has no endpoint", region.Name)
+			}
+			subscribers[topicID] = append(subscribers[topicID], region.Name)
+		}
+	}
+
+	endpoints := make(map[string]string, len(topology.Regions))
+	for _, region := range topology.Regions {
+		endpoints[region.Name] = strings.TrimSuffix(region.Endpoint, "/")
+	}
+
+	var topics []*simulator.Topic
+	for _, topicID := range topicIDs {
+		var opts []simulator.Option
+		for _, name := range subscribers[topicID] {
+			opts = append(opts, simulator.WithPushSubscription(endpoints[name]+"/v1/replicate"))
+		}
+		topic, err := simulator.NewPubSub(ctx, client, topicID, opts...)
+		if err != nil {
+			for _, t := range topics {
+				t.Close(ctx)
+			}
+			return nil, fmt.Errorf("failed to create topic %s: %w", topicID, err)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
 }
 
-var collectionPathRegex = regexp.MustCompile(`^projects/([^/]+)/databases/([^/]+)/documents/(.+)`)
+var (
+	collectionPathRegex = regexp.MustCompile(`^projects/([^/]+)/databases/([^/]+)/documents/(.+)`)
+	databaseNameRegex   = regexp.MustCompile(`^projects/([^/]+)/databases/([^/]+)$`)
+)
 
 func main() {
 	if err := run(context.Background()); err != nil {
@@ -54,14 +171,44 @@ func run(ctx context.Context) error {
 	}
 	defer pubsubClient.Close()
 
-	for i, collectionPath := range cfg.FirestoreCollections {
-		matches := collectionPathRegex.FindStringSubmatch(collectionPath)
-		if len(matches) != 4 {
-			return fmt.Errorf("invalid firestore collection path format: %s", collectionPath)
+	var watches []watch
+	if cfg.TopologyFile != "" {
+		log.Debug().Str("topology_file", cfg.TopologyFile).Msg("loading topology")
+		topology, err := firesyncconfig.LoadTopology(cfg.TopologyFile)
+		if err != nil {
+			return err
 		}
-		projectID := matches[1]
-		databaseID := matches[2]
-		path := matches[3]
+
+		topics, err := replicationTopics(initCtx, pubsubClient, topology)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ctx, cancel := context.WithDeadline(ctx, shutdownDeadline)
+			defer cancel()
+			for _, topic := range topics {
+				if err := topic.Close(ctx); err != nil {
+					log.Error().Err(err).Msg("failed to close topic")
+				}
+			}
+		}()
+
+		watches, err = watchesFromTopology(topology, cfg.Collections)
+		if err != nil {
+			return err
+		}
+	} else {
+		watches, err = watchesFromCollections(&cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, w := range watches {
+		projectID := w.projectID
+		databaseID := w.databaseID
+		path := w.path
+		collectionPath := fmt.Sprintf("projects/%s/databases/%s/documents/%s", projectID, databaseID, path)
 
 		firestoreClient, err := firestore.NewClientWithDatabase(initCtx, projectID, databaseID)
 		if err != nil {
@@ -81,7 +228,7 @@ func run(ctx context.Context) error {
 			}
 		}(firestoreClient, projectID, databaseID)
 
-		watcher, err := simulator.WatchFirestoreCollection(initCtx, pubsubClient, projectID, databaseID, firestoreClient.Collection(path), cfg.PropagatorURLs[i])
+		watcher, err := simulator.WatchFirestoreCollection(initCtx, pubsubClient, projectID, databaseID, firestoreClient.Collection(path), w.propagateURL)
 		if err != nil {
 			return fmt.Errorf("failed to watch firestore collection %s: %w", collectionPath, err)
 		}
@@ -99,7 +246,7 @@ func run(ctx context.Context) error {
 		go func() {
 			time.Sleep(10 * time.Second)
 			log.Info().
-				Str("propagator_url", cfg.PropagatorURLs[i]).
+				Str("propagator_url", w.propagateURL).
 				Str("project_id", projectID).
 				Str("database_id", databaseID).
 				Str("collection_path", path).
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// GoogleJWKSURL is the JWKS endpoint for the keys Google signs OIDC tokens
+// with, including the ones attached to Pub/Sub push requests.
+const GoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+var ErrKeyNotFound = errors.New("signing key not found")
+
+// KeySet resolves the public key a token was signed with from its key ID.
+type KeySet interface {
+	Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// ParseJWKS parses a JSON Web Key Set document into public keys indexed by key
+// ID. Only RSA and P-256 EC signing keys are supported, others are ignored.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modulus for key %q: %w", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exponent for key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("invalid x coordinate for key %q: %w", k.Kid, err)
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("invalid y coordinate for key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// staticKeySet is a KeySet loaded once, e.g. from a local file.
+type staticKeySet map[string]crypto.PublicKey
+
+// NewFileKeySet loads a JWKS document from the local filesystem. This allows
+// verifying tokens offline, e.g. ones minted by a stand-in signer in tests or
+// local development.
+func NewFileKeySet(path string) (KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks file: %w", err)
+	}
+
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return staticKeySet(keys), nil
+}
+
+func (s staticKeySet) Key(_ context.Context, kid string) (crypto.PublicKey, error) {
+	if key, ok := s[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// remoteKeySet is a KeySet fetched from a JWKS endpoint. Keys are cached and
+// refreshed once they are older than the refresh interval or when an unknown
+// key ID is requested, which happens whenever the issuer rotates its keys.
+type remoteKeySet struct {
+	url     string
+	client  *http.Client
+	refresh time.Duration
+
+	// fetches are shared by concurrent requests and run without holding mu,
+	// so requests for cached keys are not blocked by a slow endpoint.
+	fetches singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewRemoteKeySet returns a KeySet backed by the JWKS endpoint at url.
+func NewRemoteKeySet(url string, client *http.Client, refresh time.Duration) KeySet {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &remoteKeySet{
+		url:     url,
+		client:  client,
+		refresh: refresh,
+	}
+}
+
+// minRefetchInterval bounds how often unknown key IDs can trigger a fetch, so
+// tokens with bogus key IDs cannot be used to hammer the JWKS endpoint.
+const minRefetchInterval = 10 * time.Second
+
+func (s *remoteKeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	fetched := s.keys != nil
+	age := time.Since(s.fetchedAt)
+	s.mu.Unlock()
+
+	if ok && age < s.refresh {
+		return key, nil
+	}
+
+	if !fetched || age >= minRefetchInterval {
+		_, err, _ := s.fetches.Do(s.url, func() (interface{}, error) {
+			return nil, s.fetch(ctx)
+		})
+		if err != nil {
+			// serve stale keys rather than failing every request while the
+			// endpoint is unavailable
+			if ok {
+				return key, nil
+			}
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (s *remoteKeySet) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create jwks request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch jwks: unexpected status %s", resp.Status)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("failed to decode jwks: %w", err)
+	}
+
+	keys, err := ParseJWKS(raw)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,207 @@
+// Package auth verifies the OIDC tokens Pub/Sub attaches to push requests.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedToken       = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrInvalidSignature     = errors.New("invalid token signature")
+	ErrExpiredToken         = errors.New("token is expired")
+	ErrTokenNotYetValid     = errors.New("token is not valid yet")
+	ErrInvalidIssuer        = errors.New("invalid token issuer")
+	ErrInvalidAudience      = errors.New("invalid token audience")
+	ErrEmailNotAllowed      = errors.New("token email is not allowed")
+)
+
+// GoogleIssuers are the issuers of the OIDC tokens Google signs.
+var GoogleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// Claims are the token claims relevant to Pub/Sub push authentication.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	NotBefore     int64    `json:"nbf,omitempty"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+}
+
+// audience accepts both the single string and the array forms of the "aud"
+// claim.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type VerifierConfig struct {
+	// Keys resolves the keys tokens are signed with.
+	Keys KeySet
+
+	// Issuers are the accepted token issuers.
+	Issuers []string
+
+	// Audience is the expected token audience. It is configured on the push
+	// subscription and defaults to the push endpoint URL. It is required:
+	// Google signs tokens for any audience, so without it a token minted for
+	// another service would be accepted.
+	Audience string
+
+	// AllowedEmails restricts the service accounts allowed to push messages.
+	// If empty, any verified email is accepted.
+	AllowedEmails []string
+
+	// ClockSkew is the leeway applied to the time based claims.
+	ClockSkew time.Duration
+}
+
+type Verifier struct {
+	cfg VerifierConfig
+	now func() time.Time
+}
+
+func NewVerifier(cfg VerifierConfig) *Verifier {
+	return &Verifier{cfg: cfg, now: time.Now}
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks the signature and claims of a compact serialized JWT and
+// returns its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedToken, err)
+	}
+
+	key, err := v.cfg.Keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedToken, err)
+	}
+
+	if err := v.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) verifyClaims(claims *Claims) error {
+	now := v.now()
+
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(v.cfg.ClockSkew)) {
+		return ErrExpiredToken
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-v.cfg.ClockSkew)) {
+		return ErrTokenNotYetValid
+	}
+	if claims.IssuedAt != 0 && now.Before(time.Unix(claims.IssuedAt, 0).Add(-v.cfg.ClockSkew)) {
+		return ErrTokenNotYetValid
+	}
+
+	if !slices.Contains(v.cfg.Issuers, claims.Issuer) {
+		return ErrInvalidIssuer
+	}
+
+	if v.cfg.Audience == "" || !slices.Contains(claims.Audience, v.cfg.Audience) {
+		return ErrInvalidAudience
+	}
+
+	if !claims.EmailVerified {
+		return ErrEmailNotAllowed
+	}
+	if len(v.cfg.AllowedEmails) > 0 && !slices.Contains(v.cfg.AllowedEmails, claims.Email) {
+		return ErrEmailNotAllowed
+	}
+
+	return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, alg)
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSigner is a stand-in for Google's token signer.
+type testSigner struct {
+	kid string
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newRSASigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	return &testSigner{kid: kid, rsa: key}
+}
+
+func newECSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	return &testSigner{kid: kid, ec: key}
+}
+
+func (s *testSigner) jwk() jsonWebKey {
+	enc := base64.RawURLEncoding.EncodeToString
+	if s.rsa != nil {
+		return jsonWebKey{
+			Kty: "RSA",
+			Kid: s.kid,
+			Use: "sig",
+			N:   enc(s.rsa.N.Bytes()),
+			E:   enc(big.NewInt(int64(s.rsa.E)).Bytes()),
+		}
+	}
+	return jsonWebKey{
+		Kty: "EC",
+		Kid: s.kid,
+		Crv: "P-256",
+		X:   enc(s.ec.X.FillBytes(make([]byte, 32))),
+		Y:   enc(s.ec.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	if s.ec != nil {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": s.kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	if s.rsa != nil {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("rsa.SignPKCS1v15: %v", err)
+		}
+	} else {
+		r, ss, err := ecdsa.Sign(rand.Reader, s.ec, digest[:])
+		if err != nil {
+			t.Fatalf("ecdsa.Sign: %v", err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJWKS(t *testing.T, signers ...*testSigner) string {
+	t.Helper()
+	set := jsonWebKeySet{}
+	for _, s := range signers {
+		set.Keys = append(set.Keys, s.jwk())
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	return path
+}
+
+func validClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            "https://firesync.example.com/v1/replicate",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"email":          "pusher@p.iam.gserviceaccount.com",
+		"email_verified": true,
+	}
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	rsaSigner := newRSASigner(t, "rsa")
+	ecSigner := newECSigner(t, "ec")
+	rogue := newRSASigner(t, "rsa") // same key ID, different key
+	keys, err := NewFileKeySet(writeJWKS(t, rsaSigner, ecSigner))
+	if err != nil {
+		t.Fatalf("NewFileKeySet: %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	v := NewVerifier(VerifierConfig{
+		Keys:          keys,
+		Issuers:       GoogleIssuers,
+		Audience:      "https://firesync.example.com/v1/replicate",
+		AllowedEmails: []string{"pusher@p.iam.gserviceaccount.com"},
+		ClockSkew:     time.Minute,
+	})
+	v.now = func() time.Time { return now }
+
+	with := func(k string, val interface{}) map[string]interface{} {
+		c := validClaims(now)
+		c[k] = val
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid rsa", rsaSigner.sign(t, validClaims(now)), nil},
+		{"valid ec", ecSigner.sign(t, validClaims(now)), nil},
+		{"audience array", rsaSigner.sign(t, with("aud", []string{"other", "https://firesync.example.com/v1/replicate"})), nil},
+		{"within clock skew", rsaSigner.sign(t, with("exp", now.Add(-30*time.Second).Unix())), nil},
+		{"malformed", "not-a-token", ErrMalformedToken},
+		{"unknown key", newRSASigner(t, "other").sign(t, validClaims(now)), ErrKeyNotFound},
+		{"bad signature", rogue.sign(t, validClaims(now)), ErrInvalidSignature},
+		{"expired", rsaSigner.sign(t, with("exp", now.Add(-time.Hour).Unix())), ErrExpiredToken},
+		{"not yet valid", rsaSigner.sign(t, with("nbf", now.Add(time.Hour).Unix())), ErrTokenNotYetValid},
+		{"wrong issuer", rsaSigner.sign(t, with("iss", "https://evil.example.com")), ErrInvalidIssuer},
+		{"wrong audience", rsaSigner.sign(t, with("aud", "https://other.example.com")), ErrInvalidAudience},
+		{"missing audience", rsaSigner.sign(t, with("aud", nil)), ErrInvalidAudience},
+		{"email not allowed", rsaSigner.sign(t, with("email", "someone@example.com")), ErrEmailNotAllowed},
+		{"email not verified", rsaSigner.sign(t, with("email_verified", false)), ErrEmailNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(context.Background(), tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && claims.Email != "pusher@p.iam.gserviceaccount.com" {
+				t.Fatalf("Email = %q", claims.Email)
+			}
+		})
+	}
+}
+
+func TestVerifier_EmptyAllowlist(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	keys, err := NewFileKeySet(writeJWKS(t, signer))
+	if err != nil {
+		t.Fatalf("NewFileKeySet: %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	v := NewVerifier(VerifierConfig{
+		Keys:     keys,
+		Issuers:  GoogleIssuers,
+		Audience: "https://firesync.example.com/v1/replicate",
+	})
+	v.now = func() time.Time { return now }
+
+	claims := validClaims(now)
+	claims["email"] = "someone@example.com"
+	if _, err := v.Verify(context.Background(), signer.sign(t, claims)); err != nil {
+		t.Fatalf("Verify() error = %v, want any verified email", err)
+	}
+	claims["email_verified"] = false
+	if _, err := v.Verify(context.Background(), signer.sign(t, claims)); !errors.Is(err, ErrEmailNotAllowed) {
+		t.Fatalf("Verify() error = %v, want %v", err, ErrEmailNotAllowed)
+	}
+}
+
+func TestVerifier_RequiresAudience(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	keys, err := NewFileKeySet(writeJWKS(t, signer))
+	if err != nil {
+		t.Fatalf("NewFileKeySet: %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	v := NewVerifier(VerifierConfig{Keys: keys, Issuers: GoogleIssuers})
+	v.now = func() time.Time { return now }
+
+	for _, aud := range []interface{}{"https://other.example.com", ""} {
+		claims := validClaims(now)
+		claims["aud"] = aud
+		if _, err := v.Verify(context.Background(), signer.sign(t, claims)); !errors.Is(err, ErrInvalidAudience) {
+			t.Fatalf("Verify(aud=%q) error = %v, want %v", aud, err, ErrInvalidAudience)
+		}
+	}
+}
+
+func TestRemoteKeySet(t *testing.T) {
+	first := newRSASigner(t, "first")
+	second := newRSASigner(t, "second")
+
+	var fetches atomic.Int32
+	current := []*testSigner{first}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		set := jsonWebKeySet{}
+		for _, s := range current {
+			set.Keys = append(set.Keys, s.jwk())
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	ks := NewRemoteKeySet(srv.URL, srv.Client(), time.Hour).(*remoteKeySet)
+	ctx := context.Background()
+
+	if _, err := ks.Key(ctx, "first"); err != nil {
+		t.Fatalf("Key(first): %v", err)
+	}
+	if _, err := ks.Key(ctx, "first"); err != nil {
+		t.Fatalf("Key(first): %v", err)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("fetches = %d, want 1 (cached)", got)
+	}
+
+	// unknown key IDs within the minimum refetch interval don't hit the
+	// endpoint
+	if _, err := ks.Key(ctx, "second"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Key(second) error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("fetches = %d, want 1", got)
+	}
+
+	// key rotation
+	current = []*testSigner{first, second}
+	ks.fetchedAt = time.Now().Add(-minRefetchInterval)
+	if _, err := ks.Key(ctx, "second"); err != nil {
+		t.Fatalf("Key(second) after rotation: %v", err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("fetches = %d, want 2", got)
+	}
+}
+
+func TestRemoteKeySet_FetchDoesNotBlockCachedKeys(t *testing.T) {
+	first := newRSASigner(t, "first")
+
+	block := make(chan struct{})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-block
+		}
+		_ = json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{first.jwk()}})
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	ks := NewRemoteKeySet(srv.URL, srv.Client(), time.Hour).(*remoteKeySet)
+	ctx := context.Background()
+	if _, err := ks.Key(ctx, "first"); err != nil {
+		t.Fatalf("Key(first): %v", err)
+	}
+
+	// an unknown key ID triggers a fetch that hangs
+	ks.mu.Lock()
+	ks.fetchedAt = time.Now().Add(-minRefetchInterval)
+	ks.mu.Unlock()
+	go func() { _, _ = ks.Key(ctx, "unknown") }()
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ks.Key(ctx, "first")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Key(first): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Key(first) blocked by a pending fetch")
+	}
+}
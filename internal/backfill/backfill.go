@@ -0,0 +1,392 @@
+// Package backfill propagates the documents that already exist in a database,
+// which FireSync would otherwise only replicate once they change.
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/scan"
+	"github.com/joaopenteado/firesync/internal/service"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Propagator propagates a change to the other regions.
+type Propagator interface {
+	Propagate(ctx context.Context, event *model.Event) (service.PropagationResult, error)
+}
+
+type Config struct {
+	// Job names the backfill, whose cursor is saved under that name.
+	Job string
+
+	// Collections restricts the backfill to documents in collections matching
+	// the given patterns, in path.Match syntax (e.g. users/*/sessions). Empty
+	// backfills every collection.
+	Collections []string
+
+	// BatchSize is how many documents are read at once. The cursor is saved
+	// after every batch. Zero means scan.DefaultBatchSize.
+	BatchSize int
+
+	// Concurrency is how many documents are propagated concurrently.
+	Concurrency int
+
+	// Rate limits how many documents are propagated per second. Zero means
+	// unlimited.
+	Rate float64
+
+	// ProgressInterval is how often progress is logged. Zero disables
+	// progress reports.
+	ProgressInterval time.Duration
+
+	// Restart ignores the saved cursor and starts over.
+	Restart bool
+}
+
+// Stats counts the documents processed by a backfill, across resumed runs.
+type Stats struct {
+	// Scanned documents were read from the database.
+	Scanned int64 `firestore:"scanned" json:"scanned"`
+
+	// Propagated documents were stamped and published.
+	Propagated int64 `firestore:"propagated" json:"propagated"`
+
+	// Skipped documents were replicated from another region, or changed
+	// while being backfilled and are propagated by the live path instead.
+	Skipped int64 `firestore:"skipped" json:"skipped"`
+
+	// Failed documents failed permanently and were not propagated.
+	Failed int64 `firestore:"failed" json:"failed"`
+}
+
+// Cursor is the saved progress of a backfill.
+type Cursor struct {
+	// Path is the path of the last document processed, relative to the
+	// database root.
+	Path string `firestore:"path"`
+
+	// Done is set once every document was processed.
+	Done bool `firestore:"done"`
+
+	Stats Stats `firestore:"stats"`
+
+	Updated time.Time `firestore:"updated"`
+}
+
+type stats struct {
+	scanned, propagated, skipped, failed atomic.Int64
+}
+
+func (s *stats) load(st Stats) {
+	s.scanned.Store(st.Scanned)
+	s.propagated.Store(st.Propagated)
+	s.skipped.Store(st.Skipped)
+	s.failed.Store(st.Failed)
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Scanned:    s.scanned.Load(),
+		Propagated: s.propagated.Load(),
+		Skipped:    s.skipped.Load(),
+		Failed:     s.failed.Load(),
+	}
+}
+
+// CursorCollection is the internal collection backfill cursors are saved in.
+const CursorCollection = model.InternalCollectionPrefix + "backfill"
+
+// Backfiller propagates the existing documents of a database as synthetic
+// create events, through the same propagator live changes go through.
+type Backfiller struct {
+	db         *firestore.Client
+	walker     *scan.Walker
+	propagator Propagator
+	cursors    scan.CursorStore
+	cfg        Config
+	limiter    *rate.Limiter
+
+	mu     sync.Mutex
+	cursor string
+	stats  stats
+}
+
+func New(db *firestore.Client, propagator Propagator, cursors scan.CursorStore, cfg Config) *Backfiller {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+
+	limit := rate.Inf
+	if cfg.Rate > 0 {
+		limit = rate.Limit(cfg.Rate)
+	}
+
+	return &Backfiller{
+		db:         db,
+		walker:     scan.NewWalker(db, cfg.BatchSize, cfg.Collections...),
+		propagator: propagator,
+		cursors:    cursors,
+		cfg:        cfg,
+		limiter:    rate.NewLimiter(limit, cfg.Concurrency),
+	}
+}
+
+// Run backfills every matching document after the saved cursor. If it fails
+// or ctx is canceled, the cursor points to the last batch that completed, so
+// running again resumes from there.
+func (b *Backfiller) Run(ctx context.Context) (Stats, error) {
+	logger := zerolog.Ctx(ctx)
+
+	if !b.cfg.Restart {
+		saved := &Cursor{}
+		found, err := b.cursors.Load(ctx, b.cfg.Job, saved)
+		if err != nil {
+			return Stats{}, fmt.Errorf("failed to load cursor: %w", err)
+		}
+		if found && saved.Done {
+			logger.Info().Str("job", b.cfg.Job).Msg("backfill already complete")
+			return saved.Stats, nil
+		}
+		if found {
+			logger.Info().
+				Str("job", b.cfg.Job).
+				Str("cursor", saved.Path).
+				Msg("resuming backfill")
+			b.cursor = saved.Path
+			b.stats.load(saved.Stats)
+		}
+	}
+
+	stop := b.reportProgress(ctx)
+	defer stop()
+
+	if err := b.walker.Walk(ctx, b.cursor, b.backfill); err != nil {
+		return b.stats.snapshot(), err
+	}
+	if err := b.save(ctx, true); err != nil {
+		return b.stats.snapshot(), err
+	}
+	return b.stats.snapshot(), nil
+}
+
+// backfill propagates a batch of documents and saves the cursor past it.
+func (b *Backfiller) backfill(ctx context.Context, refs []*firestore.DocumentRef) error {
+	snaps, err := b.db.GetAll(ctx, refs)
+	if err != nil {
+		return fmt.Errorf("failed to read documents: %w", err)
+	}
+
+	docs := make([]*document, 0, len(snaps))
+	for _, snap := range snaps {
+		// documents that only exist as the parent of subcollections
+		if !snap.Exists() {
+			continue
+		}
+		doc, err := documentFromSnapshot(snap)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+
+	if err := b.propagateAll(ctx, docs); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.cursor = scan.RelativePath(refs[len(refs)-1].Path)
+	b.mu.Unlock()
+
+	return b.save(ctx, false)
+}
+
+func (b *Backfiller) save(ctx context.Context, done bool) error {
+	b.mu.Lock()
+	cursor := &Cursor{
+		Path:    b.cursor,
+		Done:    done,
+		Stats:   b.stats.snapshot(),
+		Updated: time.Now(),
+	}
+	b.mu.Unlock()
+
+	if err := b.cursors.Save(ctx, b.cfg.Job, cursor); err != nil {
+		return fmt.Errorf("failed to save cursor: %w", err)
+	}
+	return nil
+}
+
+// propagateAll propagates docs concurrently. Permanent failures are counted
+// and logged, any other failure stops the backfill.
+func (b *Backfiller) propagateAll(ctx context.Context, docs []*document) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(b.cfg.Concurrency)
+
+	for _, doc := range docs {
+		g.Go(func() error {
+			if err := b.limiter.Wait(ctx); err != nil {
+				return err
+			}
+			return b.propagate(ctx, doc)
+		})
+	}
+	return g.Wait()
+}
+
+func (b *Backfiller) propagate(ctx context.Context, doc *document) error {
+	logger := zerolog.Ctx(ctx).With().Str("document_path", doc.name.Path).Logger()
+	b.stats.scanned.Add(1)
+
+	if src := doc.replicatedFrom(); src != "" && src != doc.source() {
+		logger.Debug().Str("source", src).Msg("document replicated from another database, skipping")
+		b.stats.skipped.Add(1)
+		return nil
+	}
+
+	event, err := doc.createEvent()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to build backfill event")
+		b.stats.failed.Add(1)
+		return nil
+	}
+
+	result, err := b.propagator.Propagate(logger.WithContext(ctx), event)
+	if err != nil {
+		if service.ClassifyError(err) == service.ErrorClassPermanent {
+			logger.Error().Err(err).Msg("failed to backfill document")
+			b.stats.failed.Add(1)
+			return nil
+		}
+		return fmt.Errorf("failed to backfill %s: %w", doc.name.Path, err)
+	}
+
+	switch result {
+	case service.PropagationResultSuccess:
+		b.stats.propagated.Add(1)
+	case service.PropagationResultPaused:
+		// stop before the cursor moves past the document, so it is
+		// backfilled when the run is resumed
+		return fmt.Errorf("failed to backfill %s: collection paused", doc.name.Path)
+	default:
+		b.stats.skipped.Add(1)
+	}
+	return nil
+}
+
+// reportProgress logs the backfill progress periodically until the returned
+// function is called.
+func (b *Backfiller) reportProgress(ctx context.Context) (stop func()) {
+	logger := zerolog.Ctx(ctx)
+	start := time.Now()
+	initial := b.stats.snapshot()
+
+	report := func(msg string) {
+		b.mu.Lock()
+		cursor := b.cursor
+		b.mu.Unlock()
+
+		st := b.stats.snapshot()
+		elapsed := time.Since(start)
+		logger.Info().
+			Str("job", b.cfg.Job).
+			Str("cursor", cursor).
+			Int64("scanned", st.Scanned).
+			Int64("propagated", st.Propagated).
+			Int64("skipped", st.Skipped).
+			Int64("failed", st.Failed).
+			Float64("docs_per_second", float64(st.Scanned-initial.Scanned)/elapsed.Seconds()).
+			Dur("elapsed", elapsed).
+			Msg(msg)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if b.cfg.ProgressInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(b.cfg.ProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					report("backfill progress")
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return func() {
+		close(done)
+		wg.Wait()
+		report("backfill finished")
+	}
+}
+
+// document is an existing document to backfill.
+type document struct {
+	name       model.DocumentName
+	data       map[string]interface{}
+	createTime time.Time
+	updateTime time.Time
+}
+
+func documentFromSnapshot(snap *firestore.DocumentSnapshot) (*document, error) {
+	name := model.NewDocumentFromPath(snap.Ref.Path)
+	if name == nil {
+		return nil, fmt.Errorf("invalid document name %q", snap.Ref.Path)
+	}
+	return &document{
+		name:       *name,
+		data:       snap.Data(),
+		createTime: snap.CreateTime,
+		updateTime: snap.UpdateTime,
+	}, nil
+}
+
+func (d *document) source() string {
+	return fmt.Sprintf("projects/%s/databases/%s", d.name.ProjectID, d.name.DatabaseID)
+}
+
+// replicatedFrom returns the database the document was last written by, as
+// recorded in its FireSync metadata, if any.
+func (d *document) replicatedFrom() string {
+	md, _ := d.data["_firesync"].(map[string]interface{})
+	src, _ := md["src"].(string)
+	return src
+}
+
+// createEvent returns a synthetic create event for the document, as Eventarc
+// would have delivered it when the document was last written.
+func (d *document) createEvent() (*model.Event, error) {
+	fields, err := model.EncodeFields(d.data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.Event{
+		Type:      model.EventTypeCreated,
+		Name:      d.name,
+		Timestamp: d.updateTime,
+		Data: &firestoredata.DocumentEventData{
+			Value: &firestoredata.Document{
+				Name:       d.name.String(),
+				Fields:     fields,
+				CreateTime: timestamppb.New(d.createTime),
+				UpdateTime: timestamppb.New(d.updateTime),
+			},
+		},
+	}, nil
+}
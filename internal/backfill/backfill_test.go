@@ -0,0 +1,137 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type stubPropagator struct {
+	result service.PropagationResult
+	err    error
+	event  *model.Event
+}
+
+func (s *stubPropagator) Propagate(ctx context.Context, event *model.Event) (service.PropagationResult, error) {
+	s.event = event
+	return s.result, s.err
+}
+
+func testDocument(data map[string]interface{}) *document {
+	return &document{
+		name:       model.DocumentName{ProjectID: "p", DatabaseID: "d", Path: "users/1"},
+		data:       data,
+		createTime: time.Unix(1, 0),
+		updateTime: time.Unix(2, 0),
+	}
+}
+
+func TestBackfiller_Propagate(t *testing.T) {
+	permanent := &service.Error{Class: service.ErrorClassPermanent, Err: errors.New("bad document")}
+
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		result  service.PropagationResult
+		err     error
+		want    Stats
+		called  bool
+		wantErr bool
+	}{
+		{
+			name:   "propagated",
+			data:   map[string]interface{}{"name": "a"},
+			result: service.PropagationResultSuccess,
+			want:   Stats{Scanned: 1, Propagated: 1},
+			called: true,
+		},
+		{
+			name:   "stamped by this database",
+			data:   map[string]interface{}{"_firesync": map[string]interface{}{"src": "projects/p/databases/d"}},
+			result: service.PropagationResultSuccess,
+			want:   Stats{Scanned: 1, Propagated: 1},
+			called: true,
+		},
+		{
+			name:   "replicated from another database",
+			data:   map[string]interface{}{"_firesync": map[string]interface{}{"src": "projects/p/databases/other"}},
+			want:   Stats{Scanned: 1, Skipped: 1},
+			called: false,
+		},
+		{
+			name:   "changed concurrently",
+			data:   map[string]interface{}{},
+			result: service.PropagationResultSkipped,
+			want:   Stats{Scanned: 1, Skipped: 1},
+			called: true,
+		},
+		{
+			name:   "unsupported value",
+			data:   map[string]interface{}{"n": 1},
+			want:   Stats{Scanned: 1, Failed: 1},
+			called: false,
+		},
+		{
+			name:   "permanent error",
+			data:   map[string]interface{}{},
+			err:    permanent,
+			want:   Stats{Scanned: 1, Failed: 1},
+			called: true,
+		},
+		{
+			name:    "transient error",
+			data:    map[string]interface{}{},
+			err:     status.Error(codes.Unavailable, "unavailable"),
+			want:    Stats{Scanned: 1},
+			called:  true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &stubPropagator{result: tt.result, err: tt.err}
+			b := New(nil, svc, nil, Config{})
+
+			err := b.propagate(context.Background(), testDocument(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("propagate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := b.stats.snapshot(); got != tt.want {
+				t.Fatalf("stats = %+v, want %+v", got, tt.want)
+			}
+			if (svc.event != nil) != tt.called {
+				t.Fatalf("propagator called = %v, want %v", svc.event != nil, tt.called)
+			}
+		})
+	}
+}
+
+func TestDocument_CreateEvent(t *testing.T) {
+	doc := testDocument(map[string]interface{}{"name": "a"})
+
+	event, err := doc.createEvent()
+	if err != nil {
+		t.Fatalf("createEvent() unexpected error: %v", err)
+	}
+	if event.Type != model.EventTypeCreated || !event.Timestamp.Equal(doc.updateTime) {
+		t.Fatalf("event = %v at %v, want a create event at the update time", event.Type, event.Timestamp)
+	}
+
+	// the synthetic event must parse like the ones Eventarc delivers
+	parsed, err := model.ParseEvent(event.Data, time.Now())
+	if err != nil {
+		t.Fatalf("ParseEvent() unexpected error: %v", err)
+	}
+	if parsed.Type != model.EventTypeCreated || parsed.Name != doc.name || !parsed.Timestamp.Equal(doc.updateTime) {
+		t.Fatalf("parsed event = %+v", parsed)
+	}
+	if parsed.Data.GetValue().GetFields()["name"].GetStringValue() != "a" {
+		t.Fatalf("fields = %v", parsed.Data.GetValue().GetFields())
+	}
+}
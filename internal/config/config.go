@@ -2,15 +2,24 @@ package config
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path"
+	"slices"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
+	"github.com/joaopenteado/firesync/internal/model"
 	"github.com/rs/zerolog"
 	"github.com/sethvargo/go-envconfig"
 )
 
+const (
+	ModeServer = "server"
+	ModeWorker = "worker"
+)
+
 const (
 	EnvironmentLocal       = "local"
 	EnvironmentDevelopment = "development"
@@ -31,6 +40,11 @@ type Config struct {
 	// listen on port 8080.
 	Port uint16 `env:"PORT, default=8080"`
 
+	// GRPCPort is the port the gRPC transport listens on, next to the HTTP
+	// server. It serves the same propagate and replicate operations as the /v1
+	// endpoints, in server mode only. Zero (default) disables it.
+	GRPCPort uint16 `env:"GRPC_PORT, default=0"`
+
 	// The name of the Cloud Run service being run.
 	ServiceName string `env:"K_SERVICE, required"`
 
@@ -43,15 +57,61 @@ type Config struct {
 	// Environment of the Cloud Run service.
 	Environment string `env:"ENVIRONMENT, default=production"`
 
+	// Mode selects how events are received. In "server" mode (default),
+	// Pub/Sub and Eventarc push them to the HTTP endpoints. In "worker" mode,
+	// they are pulled from PropagateSubscription and ReplicateSubscription and
+	// the HTTP server only serves health checks.
+	Mode string `env:"MODE, default=server"`
+
 	// GracefulShutdownTimeout represents how long the service has to gracefully
 	// terminate after receiving a SIGTERM or SIGINT signal.
 	// Cloud Run will forcefully terminate the application after 10 seconds.
 	// https://cloud.google.com/run/docs/reference/container-contract#instance-shutdown
 	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT, default=8s"`
 
-	// ServiceTimeout is the timeout for the service.
+	// ShutdownReadinessDelay is how long /readyz reports the service as not
+	// ready before the servers stop accepting requests on shutdown. It should
+	// cover the readiness probe period and the load balancer propagation
+	// delay on GKE and other platforms routing by readiness. Not needed on
+	// Cloud Run, which stops routing to instances before signaling them. It
+	// counts towards ShutdownTimeout.
+	ShutdownReadinessDelay time.Duration `env:"SHUTDOWN_READINESS_DELAY, default=0s"`
+
+	// RequestTimeout is how long a request to the /v1 endpoints may take
+	// before its context is canceled. Canceled work, such as an in-flight
+	// Firestore transaction, is rolled back and reported as a transient
+	// failure so Pub/Sub redelivers the message.
 	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT, default=10s"`
 
+	// ReadHeaderTimeout is how long the server waits for request headers.
+	ReadHeaderTimeout time.Duration `env:"HTTP_READ_HEADER_TIMEOUT, default=5s"`
+
+	// ReadTimeout is how long the server waits for the whole request,
+	// including the body.
+	ReadTimeout time.Duration `env:"HTTP_READ_TIMEOUT, default=15s"`
+
+	// WriteTimeout is how long the server waits for a response to be
+	// written, counted from the end of the request headers. It must be longer
+	// than RequestTimeout, otherwise timed out requests can't be answered.
+	WriteTimeout time.Duration `env:"HTTP_WRITE_TIMEOUT, default=15s"`
+
+	// IdleTimeout is how long keep-alive connections are kept open between
+	// requests.
+	IdleTimeout time.Duration `env:"HTTP_IDLE_TIMEOUT, default=60s"`
+
+	// MaxHeaderBytes is the maximum size of the request headers.
+	MaxHeaderBytes int `env:"HTTP_MAX_HEADER_BYTES, default=1048576"`
+
+	// MaxBodyBytes is the maximum size of the request bodies of the /v1
+	// endpoints. Larger requests are rejected with 413 Request Entity Too
+	// Large. The default fits the largest Pub/Sub message, base64 encoded in a
+	// push request.
+	MaxBodyBytes int64 `env:"HTTP_MAX_BODY_BYTES, default=16777216"`
+
+	// ReadinessCacheTTL is how long the result of the readiness checks is
+	// reused before the dependencies are probed again.
+	ReadinessCacheTTL time.Duration `env:"READINESS_CACHE_TTL, default=5s"`
+
 	// GoogleCloudProfilerEnabled enables profiling of the service.
 	GoogleCloudProfilerEnabled bool `env:"GOOGLE_CLOUD_PROFILER_ENABLED, default=false"`
 
@@ -61,12 +121,81 @@ type Config struct {
 	// or "{database_id}".
 	Database string `env:"DATABASE, default=(default)"`
 
+	// Databases is a comma separated list of additional databases served by
+	// the instance, by resource name. Changes are propagated from the database
+	// they were made in and replicated to the served database with the same
+	// ID as their source, so the IDs must be unique. Clients are opened on
+	// the first change of each database. DATABASE is always served, and also
+	// holds the state shared by the instances, such as the control state.
+	Databases []string `env:"DATABASES"`
+
 	// Topic is the name of the Cloud Pub/Sub topic to propagate changes to.
-	// If not provided, the "firesync" topic will be used.
+	// If not provided, the "firesync" topic will be used. Publishing requires
+	// roles/pubsub.publisher on the topic, and reporting a missing topic at
+	// startup also requires pubsub.topics.get, e.g. from roles/pubsub.viewer.
 	// Can be in the format of "projects/{project_id}/topics/{topic_id}" or
 	// "{topic_id}".
 	Topic string `env:"TOPIC, default=firesync"`
 
+	// TopologyFile is the path of a YAML file declaring every region of the
+	// cluster, see Topology. The regions of Database and Databases must be
+	// part of it. The region topic and subscription of Database replace TOPIC
+	// and REPLICATE_SUBSCRIPTION, which must match them if they are set. The
+	// region priorities break ties between concurrent changes, and changes
+	// to the databases of standby regions aren't propagated.
+	TopologyFile string `env:"TOPOLOGY_FILE"`
+
+	// Topology is loaded from TopologyFile, nil if there's none.
+	Topology *Topology `env:",noinit"`
+
+	// DeadLetterTopic is the Cloud Pub/Sub topic events that fail permanently
+	// are published to before being acknowledged. If empty, they are only
+	// logged. Uses the same format as Topic.
+	DeadLetterTopic string `env:"DEAD_LETTER_TOPIC"`
+
+	// PropagateSubscription is the Cloud Pub/Sub subscription the worker
+	// pulls Firestore CloudEvents to propagate from. Messages must use the
+	// CloudEvents binary content mode, with the CloudEvent attributes as
+	// message attributes.
+	// Can be in the format of
+	// "projects/{project_id}/subscriptions/{subscription_id}" or
+	// "{subscription_id}".
+	PropagateSubscription string `env:"PROPAGATE_SUBSCRIPTION"`
+
+	// ReplicateSubscription is the Cloud Pub/Sub subscription to Topic the
+	// worker pulls changes to replicate from. Uses the same format as
+	// PropagateSubscription, so it can live in the project of a topic shared
+	// by every region.
+	ReplicateSubscription string `env:"REPLICATE_SUBSCRIPTION"`
+
+	// WorkerMaxOutstandingMessages is the maximum number of messages the
+	// worker processes concurrently per subscription.
+	WorkerMaxOutstandingMessages int `env:"WORKER_MAX_OUTSTANDING_MESSAGES, default=1000"`
+
+	// WorkerMaxOutstandingBytes is the maximum size of the messages the worker
+	// processes concurrently per subscription.
+	WorkerMaxOutstandingBytes int `env:"WORKER_MAX_OUTSTANDING_BYTES, default=104857600"`
+
+	// ConcurrencyLimit is the maximum number of messages processed
+	// concurrently by the instance. Messages over the limit are rejected with
+	// 429 Too Many Requests, which Pub/Sub retries with backoff. Zero disables
+	// the limit.
+	ConcurrencyLimit int `env:"CONCURRENCY_LIMIT, default=0"`
+
+	// ConcurrencyLimitPerDocument is the maximum number of messages processed
+	// concurrently for the same document, limiting Firestore transaction
+	// contention. Documents are grouped by the hash of their path, so
+	// unrelated documents occasionally share a limit. Zero disables the limit.
+	ConcurrencyLimitPerDocument int `env:"CONCURRENCY_LIMIT_PER_DOCUMENT, default=0"`
+
+	// ConcurrencyQueueTimeout is how long a message over a concurrency limit
+	// waits for a slot before being rejected.
+	ConcurrencyQueueTimeout time.Duration `env:"CONCURRENCY_QUEUE_TIMEOUT, default=1s"`
+
+	// ConcurrencyRetryAfter is the delay suggested in the Retry-After header
+	// of rejected messages.
+	ConcurrencyRetryAfter time.Duration `env:"CONCURRENCY_RETRY_AFTER, default=5s"`
+
 	// ForceHTTP200Acknowledgement forces the handler to return a 200 OK instead
 	// of semantically correct status codes for successful message acknowledgements
 	// from the Pub/Sub API. This is necessary for the simulator to work, since it
@@ -78,6 +207,117 @@ type Config struct {
 	// TombstoneTTL is the time to live for tombstones.
 	TombstoneTTL time.Duration `env:"TOMBSTONE_TTL, default=24h"`
 
+	// TombstoneTTLOverrides overrides TombstoneTTL for documents in collections
+	// matching a pattern. Entries are comma separated "{pattern}={ttl}" pairs,
+	// evaluated in order, where a "*" in the pattern matches exactly one path
+	// segment (e.g. "users/*/sessions=1m,devices=720h").
+	TombstoneTTLOverrides []TombstoneTTLOverride `env:"TOMBSTONE_TTL_OVERRIDES"`
+
+	// PathMappings replicate the documents under a path of the source
+	// database to another path, and possibly another served database. Entries
+	// are comma separated "{source}={target}" pairs, evaluated in order, where
+	// each side is a collection or document path, optionally qualified with a
+	// database as "databases/{database_id}/documents/{path}", or
+	// "databases/{database_id}" for the whole database. The target path
+	// replaces the source path in the documents nested under it, including
+	// the references they hold (e.g. "tenants=mirror" replicates
+	// tenants/acme/users/1 to mirror/acme/users/1).
+	PathMappings []PathMapping `env:"PATH_MAPPINGS"`
+
+	// SchemaVersion is the schema version of the documents of the local
+	// database. Changes are published with it, and replicated changes of other
+	// versions are converted to it with the migrations of TransformsFile.
+	SchemaVersion int `env:"SCHEMA_VERSION, default=0"`
+
+	// PublishedSchemaVersion is the schema version changes are converted to
+	// before being published, so upgraded regions can keep publishing the
+	// previous version until every region is upgraded. Negative values publish
+	// SchemaVersion.
+	PublishedSchemaVersion int `env:"PUBLISHED_SCHEMA_VERSION, default=-1"`
+
+	// TransformsFile is the path of a YAML file declaring the migrations
+	// between schema versions, see Transforms. Without it, changes are
+	// replicated as they are, whatever their version.
+	TransformsFile string `env:"TRANSFORMS_FILE"`
+
+	// Transforms is loaded from TransformsFile, nil if there's none.
+	Transforms *Transforms `env:",noinit"`
+
+	// SubtreeDeleteCollections is a comma separated list of collection patterns
+	// whose document deletes are propagated recursively. Deleting a document in
+	// one of them writes a subtree tombstone that also covers every document
+	// nested under it. Uses the same pattern syntax as TombstoneTTLOverrides.
+	SubtreeDeleteCollections []string `env:"SUBTREE_DELETE_COLLECTIONS"`
+
+	// DedupStore selects where the IDs of processed messages are remembered to
+	// acknowledge redeliveries without processing them again.
+	// Supported values: "none", "memory" (default), "firestore"
+	// The firestore store is shared by all instances and also keeps an
+	// in-memory cache. Its records expire through the "exp" field, which
+	// should be configured as the TTL policy of the _firesync_dedup
+	// collection.
+	// With "none", every event of a batched mode request that is redelivered
+	// because another event of the batch failed is processed again.
+	DedupStore string `env:"DEDUP_STORE, default=memory"`
+
+	// DedupCacheSize is the maximum number of message IDs kept in memory. It
+	// must be positive unless DedupStore is "none".
+	DedupCacheSize int `env:"DEDUP_CACHE_SIZE, default=10000"`
+
+	// DedupTTL is how long the IDs of processed messages are remembered. It
+	// should cover the longest expected redelivery delay.
+	DedupTTL time.Duration `env:"DEDUP_TTL, default=24h"`
+
+	// PauseControlEnabled has the propagator and replicator consult the
+	// _firesync_control/state document, leaving changes to paused collections
+	// unprocessed. They are nacked and redelivered by Pub/Sub and Eventarc
+	// once the collection is resumed, as long as it is resumed within the
+	// subscription's message retention.
+	PauseControlEnabled bool `env:"PAUSE_CONTROL_ENABLED, default=false"`
+
+	// PauseControlCacheTTL is how long the control state is cached. Pausing or
+	// resuming a collection takes effect on every instance within it.
+	PauseControlCacheTTL time.Duration `env:"PAUSE_CONTROL_CACHE_TTL, default=10s"`
+
+	// AdminAPIEnabled serves the /admin/v1/pauses endpoint, which pauses and
+	// resumes collections. It requires PAUSE_CONTROL_ENABLED and OIDC_ENABLED,
+	// and is protected by the same authentication as the /v1 endpoints.
+	AdminAPIEnabled bool `env:"ADMIN_API_ENABLED, default=false"`
+
+	// HeartbeatInterval is how often every served database writes its
+	// heartbeat to the _firesync_heartbeat collection and reads the ones
+	// replicated from the other regions, recording their age in the
+	// firesync.replication.heartbeat_age metric. Zero disables heartbeats.
+	HeartbeatInterval time.Duration `env:"HEARTBEAT_INTERVAL, default=0"`
+
+	// OIDCEnabled requires requests to the propagate and replicate endpoints to
+	// carry a valid OIDC bearer token, such as the ones Pub/Sub push
+	// subscriptions attach when configured with a service account. Not needed
+	// on Cloud Run, where IAM authenticates requests before they reach the
+	// service.
+	OIDCEnabled bool `env:"OIDC_ENABLED, default=false"`
+
+	// OIDCAudience is the expected token audience. It must match the audience
+	// configured on the push subscriptions, which defaults to the push
+	// endpoint URL. Required when OIDC_ENABLED is set.
+	OIDCAudience string `env:"OIDC_AUDIENCE"`
+
+	// OIDCIssuers is a comma separated list of the accepted token issuers.
+	OIDCIssuers []string `env:"OIDC_ISSUERS, default=https://accounts.google.com,accounts.google.com"`
+
+	// OIDCAllowedEmails is a comma separated list of the service account
+	// emails allowed to push messages. If empty, any verified email is
+	// accepted, so any Google account can push messages with a token for
+	// OIDCAudience.
+	OIDCAllowedEmails []string `env:"OIDC_ALLOWED_EMAILS"`
+
+	// OIDCJWKSURL is the JWKS endpoint of the keys tokens are signed with.
+	OIDCJWKSURL string `env:"OIDC_JWKS_URL, default=https://www.googleapis.com/oauth2/v3/certs"`
+
+	// OIDCJWKSFile is the path of a local JWKS file to load signing keys from
+	// instead of OIDCJWKSURL, e.g. to test offline with a stand-in signer.
+	OIDCJWKSFile string `env:"OIDC_JWKS_FILE"`
+
 	// LogLevel controls the verbosity of the logs.
 	LogLevel zerolog.Level `env:"LOG_LEVEL, default=info"`
 
@@ -88,19 +328,38 @@ type Config struct {
 	// Supported values: "none" (default), "console", "otlp"
 	// If Google Cloud Tracing's OTLP endpoint (telemetry.googleapis.com) is
 	// configured with the OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or
-	// OTEL_EXPORTER_OTLP_ENDPOINT environment variables, per grpc credentials
-	// will be used automatically.
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variables, the application
+	// default credentials will be used automatically, with either protocol.
 	TracingExporter string `env:"OTEL_TRACES_EXPORTER, default=none"`
 
 	// MetricsExporter specifies the OpenTelemetry metrics exporter to use.
-	// Supported values: "none" (default), "console", "otlp", "googlecloudmetrics"
+	// Supported values: "none" (default), "console", "otlp",
+	// "googlecloudmetrics", "prometheus"
+	// The prometheus exporter serves the metrics on /metrics instead, along
+	// with the Go runtime and process metrics, see MetricsPort.
 	MetricsExporter string `env:"OTEL_METRICS_EXPORTER, default=none"`
 
+	// MetricsPort is the port /metrics is served on with the prometheus
+	// exporter. Zero serves it on PORT, next to the other endpoints.
+	MetricsPort uint16 `env:"METRICS_PORT, default=0"`
+
+	// MetricsAuthEnabled protects /metrics with the same authentication as the
+	// /v1 endpoints when it is served on PORT. It requires OIDC_ENABLED.
+	MetricsAuthEnabled bool `env:"METRICS_AUTH_ENABLED, default=false"`
+
 	// OTLPProtocol specifies the protocol to use for OTLP export.
-	// Currently only supports "grpc" which is the default when OTLP is
-	// specified.
+	// Supported values: "grpc" (default), "http/protobuf". The exporters
+	// don't encode JSON, so "http/json" disables the signal with a warning.
+	// The endpoints are configured with the OTEL_EXPORTER_OTLP_ENDPOINT or
+	// per signal OTEL_EXPORTER_OTLP_{TRACES,METRICS}_ENDPOINT environment
+	// variables.
 	OTLPProtocol string `env:"OTEL_EXPORTER_OTLP_PROTOCOL, default=grpc"`
 
+	// OTLPTracesProtocol and OTLPMetricsProtocol override OTLPProtocol for
+	// traces and metrics.
+	OTLPTracesProtocol  string `env:"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"`
+	OTLPMetricsProtocol string `env:"OTEL_EXPORTER_OTLP_METRICS_PROTOCOL"`
+
 	// ConsoleExporterPrettyPrint enables pretty printing for the console
 	// exporter.
 	ConsoleExporterPrettyPrint bool `env:"OTEL_EXPORTER_CONSOLE_PRETTY, default=true"`
@@ -109,6 +368,103 @@ type Config struct {
 	TraceSampleRatio float64 `env:"OTEL_TRACES_SAMPLER_ARG, default=0.1"`
 }
 
+// TombstoneTTLOverride is a single entry of Config.TombstoneTTLOverrides.
+type TombstoneTTLOverride struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+func (o *TombstoneTTLOverride) EnvDecode(val string) error {
+	idx := strings.LastIndexByte(val, '=')
+	if idx == -1 {
+		return fmt.Errorf("invalid tombstone ttl override %q: expected {pattern}={ttl}", val)
+	}
+
+	pattern := strings.TrimSpace(val[:idx])
+	if pattern == "" {
+		return fmt.Errorf("invalid tombstone ttl override %q: empty pattern", val)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid tombstone ttl override %q: %w", val, err)
+	}
+
+	ttl, err := time.ParseDuration(strings.TrimSpace(val[idx+1:]))
+	if err != nil {
+		return fmt.Errorf("invalid tombstone ttl override %q: %w", val, err)
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid tombstone ttl override %q: ttl must be positive", val)
+	}
+
+	o.Pattern = pattern
+	o.TTL = ttl
+	return nil
+}
+
+// PathMapping is a single entry of Config.PathMappings. The databases are IDs,
+// empty if the side isn't qualified with one.
+type PathMapping struct {
+	SourceDatabase string
+	Source         string
+	TargetDatabase string
+	Target         string
+}
+
+func (m *PathMapping) EnvDecode(val string) error {
+	source, target, ok := strings.Cut(val, "=")
+	if !ok {
+		return fmt.Errorf("invalid path mapping %q: expected {source}={target}", val)
+	}
+
+	var err error
+	if m.SourceDatabase, m.Source, err = parseNamespace(strings.TrimSpace(source)); err != nil {
+		return fmt.Errorf("invalid path mapping %q: %w", val, err)
+	}
+	if m.TargetDatabase, m.Target, err = parseNamespace(strings.TrimSpace(target)); err != nil {
+		return fmt.Errorf("invalid path mapping %q: %w", val, err)
+	}
+
+	if m.SourceDatabase == "" && m.Source == "" {
+		return fmt.Errorf("invalid path mapping %q: empty source", val)
+	}
+	if segments(m.Source)%2 != segments(m.Target)%2 {
+		return fmt.Errorf("invalid path mapping %q: source and target must both be collection or document paths", val)
+	}
+	return nil
+}
+
+// parseNamespace parses a side of a path mapping, a path optionally qualified
+// with a database.
+func parseNamespace(val string) (database, p string, err error) {
+	p = val
+	if rest, ok := strings.CutPrefix(val, "databases/"); ok {
+		database, p, _ = strings.Cut(rest, "/")
+		switch {
+		case p == "" || p == "documents":
+			p = ""
+		case strings.HasPrefix(p, "documents/"):
+			p = p[len("documents/"):]
+		default:
+			return "", "", fmt.Errorf("expected databases/{database_id}/documents/{path}, got %q", val)
+		}
+		if database == "" {
+			return "", "", fmt.Errorf("empty database in %q", val)
+		}
+	}
+
+	if p != "" && slices.Contains(strings.Split(p, "/"), "") {
+		return "", "", fmt.Errorf("empty path segment in %q", val)
+	}
+	return database, p, nil
+}
+
+func segments(p string) int {
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
 func environmentDefaults(env string) envconfig.Lookuper {
 	switch env {
 	case EnvironmentLocal:
@@ -140,6 +496,21 @@ func environmentDefaults(env string) envconfig.Lookuper {
 	}
 }
 
+// cloudRunJobLookuper fills in the Cloud Run service variables from the ones
+// Cloud Run jobs set instead, so commands like backfill can run as jobs.
+// See https://cloud.google.com/run/docs/container-contract#jobs-env-vars
+func cloudRunJobLookuper() envconfig.Lookuper {
+	return envconfig.LookuperFunc(func(key string) (string, bool) {
+		switch key {
+		case "K_SERVICE", "K_CONFIGURATION":
+			return os.LookupEnv("CLOUD_RUN_JOB")
+		case "K_REVISION":
+			return os.LookupEnv("CLOUD_RUN_EXECUTION")
+		}
+		return "", false
+	})
+}
+
 func metadataLookuper(ctx context.Context) envconfig.Lookuper {
 	return envconfig.LookuperFunc(func(key string) (string, bool) {
 		if !metadata.OnGCEWithContext(ctx) {
@@ -177,6 +548,7 @@ func Load(ctx context.Context) (*Config, error) {
 		Lookuper: envconfig.MultiLookuper(
 			envconfig.OsLookuper(),
 			environmentDefaults(os.Getenv("ENVIRONMENT")),
+			cloudRunJobLookuper(),
 			metadataLookuper(ctx),
 		),
 	}
@@ -185,6 +557,141 @@ func Load(ctx context.Context) (*Config, error) {
 		return nil, err
 	}
 
+	for _, pattern := range cfg.SubtreeDeleteCollections {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid subtree delete collection %q: %w", pattern, err)
+		}
+	}
+
+	if cfg.WriteTimeout > 0 && cfg.WriteTimeout <= cfg.RequestTimeout {
+		return nil, fmt.Errorf("http write timeout %v must be longer than the request timeout %v", cfg.WriteTimeout, cfg.RequestTimeout)
+	}
+
+	if cfg.ShutdownReadinessDelay < 0 || cfg.ShutdownReadinessDelay >= cfg.ShutdownTimeout {
+		return nil, fmt.Errorf("shutdown readiness delay %v must be between zero and the shutdown timeout %v", cfg.ShutdownReadinessDelay, cfg.ShutdownTimeout)
+	}
+
+	if cfg.GRPCPort != 0 && cfg.GRPCPort == cfg.Port {
+		return nil, fmt.Errorf("grpc port %d must differ from the http port", cfg.GRPCPort)
+	}
+
+	if cfg.MetricsPort != 0 && (cfg.MetricsPort == cfg.Port || cfg.MetricsPort == cfg.GRPCPort) {
+		return nil, fmt.Errorf("metrics port %d must differ from the http and grpc ports", cfg.MetricsPort)
+	}
+
+	if cfg.OIDCEnabled && cfg.OIDCAudience == "" {
+		return nil, fmt.Errorf("oidc authentication requires OIDC_AUDIENCE")
+	}
+
+	if cfg.MetricsAuthEnabled && (!cfg.OIDCEnabled || cfg.MetricsPort != 0) {
+		return nil, fmt.Errorf("metrics authentication requires OIDC_ENABLED and metrics served on PORT")
+	}
+
+	if cfg.AdminAPIEnabled && !cfg.PauseControlEnabled {
+		return nil, fmt.Errorf("the admin api requires PAUSE_CONTROL_ENABLED")
+	}
+	if cfg.AdminAPIEnabled && !cfg.OIDCEnabled {
+		return nil, fmt.Errorf("the admin api requires OIDC_ENABLED, it would be unauthenticated otherwise")
+	}
+
+	ids := make(map[string]string)
+	for _, name := range cfg.ServedDatabases() {
+		_, id, err := model.ParseDatabaseName(name)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := ids[id]; ok {
+			return nil, fmt.Errorf("databases %s and %s have the same id", other, name)
+		}
+		ids[id] = name
+	}
+
+	for _, m := range cfg.PathMappings {
+		if m.TargetDatabase == "" {
+			continue
+		}
+		if _, ok := ids[m.TargetDatabase]; !ok {
+			return nil, fmt.Errorf("path mapping target database %s is not served", m.TargetDatabase)
+		}
+	}
+
+	if cfg.SchemaVersion < 0 {
+		return nil, fmt.Errorf("invalid schema version %d", cfg.SchemaVersion)
+	}
+	if cfg.PublishedSchemaVersion < 0 {
+		cfg.PublishedSchemaVersion = cfg.SchemaVersion
+	}
+	if cfg.TransformsFile != "" {
+		transforms, err := LoadTransforms(cfg.TransformsFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Transforms = transforms
+	}
+
+	if cfg.TopologyFile != "" {
+		topology, err := LoadTopology(cfg.TopologyFile)
+		if err != nil {
+			return nil, err
+		}
+		region := topology.Region(cfg.DatabaseName())
+		if region == nil {
+			return nil, fmt.Errorf("database %s is not part of the topology", cfg.DatabaseName())
+		}
+		if region.Role == RoleStandby && cfg.PropagateSubscription != "" {
+			return nil, fmt.Errorf("standby region %s can't have a PROPAGATE_SUBSCRIPTION", region.Name)
+		}
+
+		for _, database := range cfg.ServedDatabases()[1:] {
+			if topology.Region(database) == nil {
+				return nil, fmt.Errorf("database %s is not part of the topology", database)
+			}
+		}
+		if topic, ok := os.LookupEnv("TOPIC"); ok && !cfg.sameResource(topic, region.Topic) {
+			return nil, fmt.Errorf("TOPIC %q conflicts with the topic %q of region %s", topic, region.Topic, region.Name)
+		}
+		if sub, ok := os.LookupEnv("REPLICATE_SUBSCRIPTION"); ok && region.Subscription != "" && !cfg.sameResource(sub, region.Subscription) {
+			return nil, fmt.Errorf("REPLICATE_SUBSCRIPTION %q conflicts with the subscription %q of region %s", sub, region.Subscription, region.Name)
+		}
+
+		cfg.Topology = topology
+		cfg.Topic = region.Topic
+		if region.Subscription != "" {
+			cfg.ReplicateSubscription = region.Subscription
+		}
+	}
+
+	resources := []struct{ name, kind string }{
+		{cfg.Topic, "topics"},
+		{cfg.DeadLetterTopic, "topics"},
+		{cfg.PropagateSubscription, "subscriptions"},
+		{cfg.ReplicateSubscription, "subscriptions"},
+	}
+	for _, r := range resources {
+		if r.name != "" && !validResourceName(r.name, r.kind) {
+			return nil, fmt.Errorf("invalid pubsub resource %q, expected projects/{project_id}/%s/{id} or {id}", r.name, r.kind)
+		}
+	}
+
+	switch cfg.Mode {
+	case ModeServer:
+	case ModeWorker:
+		if cfg.PropagateSubscription == "" && cfg.ReplicateSubscription == "" {
+			return nil, fmt.Errorf("worker mode requires PROPAGATE_SUBSCRIPTION or REPLICATE_SUBSCRIPTION")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode %q", cfg.Mode)
+	}
+
+	switch cfg.DedupStore {
+	case "none", "memory", "firestore":
+	default:
+		return nil, fmt.Errorf("invalid dedup store %q", cfg.DedupStore)
+	}
+	if cfg.DedupStore != "none" && cfg.DedupCacheSize <= 0 {
+		return nil, fmt.Errorf("dedup cache size must be positive, got %d", cfg.DedupCacheSize)
+	}
+
 	return cfg, nil
 }
 
@@ -212,21 +719,123 @@ func (c *Config) DatabaseProjectID() string {
 	return c.ProjectID
 }
 
-func (c *Config) TopicID() string {
-	topicID := c.Topic
+// DatabaseName returns the resource name of the database,
+// "projects/{project_id}/databases/{database_id}".
+func (c *Config) DatabaseName() string {
+	return fmt.Sprintf("projects/%s/databases/%s", c.DatabaseProjectID(), c.DatabaseID())
+}
+
+// ServedDatabases returns the resource names of every database served by the
+// instance, DATABASE first.
+func (c *Config) ServedDatabases() []string {
+	databases := []string{c.DatabaseName()}
+	for _, name := range c.Databases {
+		if name = strings.TrimSpace(name); !slices.Contains(databases, name) {
+			databases = append(databases, name)
+		}
+	}
+	return databases
+}
+
+// TopologyRegion returns the region of the database in the topology, or nil
+// if no topology is configured.
+func (c *Config) TopologyRegion() *Region {
+	return c.DatabaseRegion(c.DatabaseName())
+}
 
-	if strings.HasPrefix(topicID, "projects/") {
-		return topicID[strings.LastIndexByte(topicID, '/')+1:]
+// DatabaseRegion returns the region of a served database in the topology, or
+// nil if no topology is configured.
+func (c *Config) DatabaseRegion(database string) *Region {
+	if c.Topology == nil {
+		return nil
 	}
+	return c.Topology.Region(database)
+}
+
+// Propagates reports whether changes to the database are propagated to the
+// other regions, which standby regions don't do.
+func (c *Config) Propagates() bool {
+	return c.DatabasePropagates(c.DatabaseName())
+}
+
+// DatabasePropagates reports whether changes to a served database are
+// propagated to the other regions.
+func (c *Config) DatabasePropagates(database string) bool {
+	r := c.DatabaseRegion(database)
+	return r == nil || r.Role != RoleStandby
+}
+
+// PropagatesAny reports whether changes to any of the served databases are
+// propagated to the other regions.
+func (c *Config) PropagatesAny() bool {
+	return slices.ContainsFunc(c.ServedDatabases(), c.DatabasePropagates)
+}
 
-	return topicID
+func (c *Config) TopicID() string {
+	return resourceID(c.Topic)
 }
 
 func (c *Config) TopicProjectID() string {
-	topicID := c.Topic
+	return c.resourceProjectID(c.Topic)
+}
+
+// DatabaseTopicID returns the ID of the topic changes to a served database
+// are propagated to, the topic of its region if there's a topology.
+func (c *Config) DatabaseTopicID(database string) string {
+	if r := c.DatabaseRegion(database); r != nil {
+		return resourceID(r.Topic)
+	}
+	return c.TopicID()
+}
+
+// DatabaseTopicProjectID returns the project of the topic changes to a served
+// database are propagated to.
+func (c *Config) DatabaseTopicProjectID(database string) string {
+	if r := c.DatabaseRegion(database); r != nil {
+		return c.resourceProjectID(r.Topic)
+	}
+	return c.TopicProjectID()
+}
+
+func (c *Config) DeadLetterTopicID() string {
+	return resourceID(c.DeadLetterTopic)
+}
 
-	if strings.HasPrefix(topicID, "projects/") {
-		pj := topicID[len("projects/"):]
+func (c *Config) DeadLetterTopicProjectID() string {
+	return c.resourceProjectID(c.DeadLetterTopic)
+}
+
+func (c *Config) PropagateSubscriptionID() string {
+	return resourceID(c.PropagateSubscription)
+}
+
+func (c *Config) PropagateSubscriptionProjectID() string {
+	return c.resourceProjectID(c.PropagateSubscription)
+}
+
+func (c *Config) ReplicateSubscriptionID() string {
+	return resourceID(c.ReplicateSubscription)
+}
+
+func (c *Config) ReplicateSubscriptionProjectID() string {
+	return c.resourceProjectID(c.ReplicateSubscription)
+}
+
+// resourceID returns the ID of a Cloud Pub/Sub resource name, in the format
+// of "projects/{project_id}/{kind}/{id}" or "{id}".
+func resourceID(name string) string {
+	if strings.HasPrefix(name, "projects/") {
+		return name[strings.LastIndexByte(name, '/')+1:]
+	}
+
+	return name
+}
+
+// resourceProjectID returns the project of a Cloud Pub/Sub resource name,
+// ProjectID if it isn't fully qualified.
+func (c *Config) resourceProjectID(name string) string {
+	if strings.HasPrefix(name, "projects/") {
+		pj := name[len("projects/"):]
 		if idx := strings.IndexByte(pj, '/'); idx != -1 {
 			return pj[:idx]
 		}
@@ -235,3 +844,19 @@ func (c *Config) TopicProjectID() string {
 
 	return c.ProjectID
 }
+
+// sameResource reports whether the Cloud Pub/Sub resource names a and b refer
+// to the same resource once resolved against ProjectID.
+func (c *Config) sameResource(a, b string) bool {
+	return resourceID(a) == resourceID(b) && c.resourceProjectID(a) == c.resourceProjectID(b)
+}
+
+// validResourceName reports whether name is a valid Cloud Pub/Sub resource
+// name of the given kind, either fully qualified or just the ID.
+func validResourceName(name, kind string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) == 1 {
+		return name != ""
+	}
+	return len(parts) == 4 && parts[0] == "projects" && parts[2] == kind && parts[1] != "" && parts[3] != ""
+}
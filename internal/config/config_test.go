@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -182,3 +185,620 @@ func TestDatabaseID(t *testing.T) {
 		t.Fatalf("got %q, want %q", got, "simple")
 	}
 }
+
+func TestTombstoneTTLOverride_EnvDecode(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    TombstoneTTLOverride
+		wantErr bool
+	}{
+		{val: "users=1h", want: TombstoneTTLOverride{Pattern: "users", TTL: time.Hour}},
+		{val: "users/*/sessions = 30s", want: TombstoneTTLOverride{Pattern: "users/*/sessions", TTL: 30 * time.Second}},
+		{val: "users", wantErr: true},
+		{val: "=1h", wantErr: true},
+		{val: "users=forever", wantErr: true},
+		{val: "users=-1h", wantErr: true},
+		{val: "[=1h", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			var got TombstoneTTLOverride
+			err := got.EnvDecode(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EnvDecode(%q) error = %v, wantErr %v", tt.val, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("EnvDecode(%q) = %+v, want %+v", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_TombstoneTTLOverrides(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+	t.Setenv("TOMBSTONE_TTL_OVERRIDES", "users/*/sessions=1m,devices=720h")
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	want := []TombstoneTTLOverride{
+		{Pattern: "users/*/sessions", TTL: time.Minute},
+		{Pattern: "devices", TTL: 720 * time.Hour},
+	}
+	if len(cfg.TombstoneTTLOverrides) != len(want) {
+		t.Fatalf("TombstoneTTLOverrides = %+v, want %+v", cfg.TombstoneTTLOverrides, want)
+	}
+	for i := range want {
+		if cfg.TombstoneTTLOverrides[i] != want[i] {
+			t.Fatalf("TombstoneTTLOverrides[%d] = %+v, want %+v", i, cfg.TombstoneTTLOverrides[i], want[i])
+		}
+	}
+}
+
+func TestLoad_SubtreeDeleteCollections(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	t.Setenv("SUBTREE_DELETE_COLLECTIONS", "users,tenants/*/projects")
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.SubtreeDeleteCollections) != 2 || cfg.SubtreeDeleteCollections[1] != "tenants/*/projects" {
+		t.Fatalf("SubtreeDeleteCollections = %v", cfg.SubtreeDeleteCollections)
+	}
+
+	t.Setenv("SUBTREE_DELETE_COLLECTIONS", "users/[")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for malformed pattern")
+	}
+}
+
+func TestLoad_OIDCDefaults(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.OIDCEnabled {
+		t.Fatalf("OIDCEnabled = true")
+	}
+	if len(cfg.OIDCIssuers) != 2 || cfg.OIDCIssuers[0] != "https://accounts.google.com" || cfg.OIDCIssuers[1] != "accounts.google.com" {
+		t.Fatalf("OIDCIssuers = %v", cfg.OIDCIssuers)
+	}
+	if cfg.OIDCJWKSURL != "https://www.googleapis.com/oauth2/v3/certs" {
+		t.Fatalf("OIDCJWKSURL = %q", cfg.OIDCJWKSURL)
+	}
+
+	t.Setenv("OIDC_ENABLED", "true")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for oidc without audience")
+	}
+	t.Setenv("OIDC_AUDIENCE", "https://firesync.example.com")
+	if _, err := Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+}
+
+func TestLoad_DedupStore(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DedupStore != "memory" || cfg.DedupCacheSize != 10000 || cfg.DedupTTL != 24*time.Hour {
+		t.Fatalf("dedup defaults = %q %d %v", cfg.DedupStore, cfg.DedupCacheSize, cfg.DedupTTL)
+	}
+
+	t.Setenv("DEDUP_CACHE_SIZE", "0")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for an empty dedup cache")
+	}
+	t.Setenv("DEDUP_STORE", "none")
+	if _, err := Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	t.Setenv("DEDUP_STORE", "redis")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for unsupported dedup store")
+	}
+}
+
+func TestLoad_Mode(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Mode != ModeServer {
+		t.Fatalf("Mode = %q, want %q", cfg.Mode, ModeServer)
+	}
+
+	t.Setenv("MODE", ModeWorker)
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for worker mode without subscriptions")
+	}
+
+	t.Setenv("REPLICATE_SUBSCRIPTION", "firesync-replicate")
+	if _, err := Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	t.Setenv("MODE", "lambda")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for unsupported mode")
+	}
+}
+
+func TestLoad_HTTPServer(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.RequestTimeout != 10*time.Second || cfg.WriteTimeout != 15*time.Second || cfg.MaxBodyBytes != 16<<20 || cfg.MaxHeaderBytes != 1<<20 {
+		t.Fatalf("http defaults = %v %v %d %d", cfg.RequestTimeout, cfg.WriteTimeout, cfg.MaxBodyBytes, cfg.MaxHeaderBytes)
+	}
+
+	t.Setenv("REQUEST_TIMEOUT", "30s")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for write timeout shorter than the request timeout")
+	}
+}
+
+func TestLoad_ShutdownReadinessDelay(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.ShutdownReadinessDelay != 0 {
+		t.Fatalf("ShutdownReadinessDelay = %v", cfg.ShutdownReadinessDelay)
+	}
+
+	t.Setenv("SHUTDOWN_READINESS_DELAY", "5s")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.ShutdownReadinessDelay != 5*time.Second {
+		t.Fatalf("ShutdownReadinessDelay = %v", cfg.ShutdownReadinessDelay)
+	}
+
+	t.Setenv("SHUTDOWN_READINESS_DELAY", "8s")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for a delay not shorter than the shutdown timeout")
+	}
+}
+
+func TestLoad_GRPCPort(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.GRPCPort != 0 {
+		t.Fatalf("GRPCPort = %d, want disabled", cfg.GRPCPort)
+	}
+
+	t.Setenv("GRPC_PORT", "8080")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for grpc port equal to the http port")
+	}
+
+	t.Setenv("GRPC_PORT", "9090")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.GRPCPort != 9090 {
+		t.Fatalf("GRPCPort = %d", cfg.GRPCPort)
+	}
+}
+
+func TestLoad_Metrics(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+	t.Setenv("OTEL_METRICS_EXPORTER", "prometheus")
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.MetricsExporter != "prometheus" || cfg.MetricsPort != 0 || cfg.MetricsAuthEnabled {
+		t.Fatalf("MetricsExporter = %q, MetricsPort = %d, MetricsAuthEnabled = %v", cfg.MetricsExporter, cfg.MetricsPort, cfg.MetricsAuthEnabled)
+	}
+
+	t.Setenv("METRICS_AUTH_ENABLED", "true")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for metrics authentication without oidc")
+	}
+	t.Setenv("OIDC_ENABLED", "true")
+	t.Setenv("OIDC_AUDIENCE", "https://firesync.example.com")
+	if _, err := Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	t.Setenv("METRICS_PORT", "9464")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for metrics authentication on the metrics port")
+	}
+	t.Setenv("METRICS_AUTH_ENABLED", "false")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.MetricsPort != 9464 {
+		t.Fatalf("MetricsPort = %d", cfg.MetricsPort)
+	}
+
+	t.Setenv("METRICS_PORT", "8080")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for metrics port equal to the http port")
+	}
+}
+
+func TestLoad_OTLPProtocol(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL", "http/protobuf")
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.OTLPProtocol != "grpc" || cfg.OTLPTracesProtocol != "" || cfg.OTLPMetricsProtocol != "http/protobuf" {
+		t.Fatalf("OTLPProtocol = %q, OTLPTracesProtocol = %q, OTLPMetricsProtocol = %q", cfg.OTLPProtocol, cfg.OTLPTracesProtocol, cfg.OTLPMetricsProtocol)
+	}
+}
+
+func TestLoad_AdminAPI(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+	t.Setenv("ADMIN_API_ENABLED", "true")
+
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for the admin api without pause control")
+	}
+
+	t.Setenv("PAUSE_CONTROL_ENABLED", "true")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for the admin api without authentication")
+	}
+
+	t.Setenv("OIDC_ENABLED", "true")
+	t.Setenv("OIDC_AUDIENCE", "https://firesync.example.com")
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !cfg.AdminAPIEnabled || cfg.PauseControlCacheTTL != 10*time.Second {
+		t.Fatalf("AdminAPIEnabled = %v, PauseControlCacheTTL = %v", cfg.AdminAPIEnabled, cfg.PauseControlCacheTTL)
+	}
+}
+
+func TestLoad_CloudRunJob(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "p")
+	t.Setenv("GOOGLE_CLOUD_REGION", "us-east4")
+	t.Setenv("CLOUD_RUN_INSTANCE_ID", "i")
+	t.Setenv("CLOUD_RUN_JOB", "firesync-backfill")
+	t.Setenv("CLOUD_RUN_EXECUTION", "firesync-backfill-abc")
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.ServiceName != "firesync-backfill" || cfg.ServiceConfiguration != "firesync-backfill" || cfg.ServiceRevision != "firesync-backfill-abc" {
+		t.Fatalf("service = %q %q %q", cfg.ServiceName, cfg.ServiceConfiguration, cfg.ServiceRevision)
+	}
+}
+
+func TestLoad_Topology(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Topology != nil || !cfg.Propagates() {
+		t.Fatalf("Topology = %+v, want none", cfg.Topology)
+	}
+
+	file := filepath.Join(t.TempDir(), "topology.yaml")
+	if err := os.WriteFile(file, []byte(testTopology), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TOPOLOGY_FILE", file)
+
+	t.Setenv("DATABASE", "projects/p/databases/other")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for a database missing from the topology")
+	}
+
+	t.Setenv("DATABASE", "projects/p/databases/us-east4")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Topic != "firesync" || cfg.ReplicateSubscription != "firesync-us-east4" || !cfg.Propagates() {
+		t.Fatalf("Topic = %q, ReplicateSubscription = %q, Propagates = %v", cfg.Topic, cfg.ReplicateSubscription, cfg.Propagates())
+	}
+	if r := cfg.TopologyRegion(); r == nil || r.Name != "us-east4" {
+		t.Fatalf("TopologyRegion() = %+v", r)
+	}
+
+	t.Setenv("DATABASE", "projects/p/databases/us-west1")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.TopicProjectID() != "hub" || cfg.Propagates() {
+		t.Fatalf("TopicProjectID() = %q, Propagates = %v", cfg.TopicProjectID(), cfg.Propagates())
+	}
+
+	t.Setenv("PROPAGATE_SUBSCRIPTION", "eventarc")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for a standby region propagating")
+	}
+}
+
+func TestLoad_TopologyConflicts(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	file := filepath.Join(t.TempDir(), "topology.yaml")
+	if err := os.WriteFile(file, []byte(testTopology), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TOPOLOGY_FILE", file)
+	t.Setenv("DATABASE", "projects/p/databases/us-east4")
+
+	tests := []struct {
+		env, value string
+		wantErr    bool
+	}{
+		{"TOPIC", "firesync", false},
+		{"TOPIC", "projects/firesync/topics/firesync", false},
+		{"TOPIC", "other", true},
+		{"TOPIC", "projects/hub/topics/firesync", true},
+		{"REPLICATE_SUBSCRIPTION", "firesync-us-east4", false},
+		{"REPLICATE_SUBSCRIPTION", "other", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			_, err := Load(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad_TopologyDatabases(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	file := filepath.Join(t.TempDir(), "topology.yaml")
+	if err := os.WriteFile(file, []byte(testTopology), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TOPOLOGY_FILE", file)
+	t.Setenv("DATABASE", "projects/p/databases/us-east4")
+
+	t.Setenv("DATABASES", "projects/p/databases/other")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for a served database missing from the topology")
+	}
+
+	t.Setenv("DATABASES", "projects/p/databases/us-west1")
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	standby := "projects/p/databases/us-west1"
+	if !cfg.Propagates() || cfg.DatabasePropagates(standby) || !cfg.PropagatesAny() {
+		t.Fatalf("Propagates = %v, DatabasePropagates = %v, PropagatesAny = %v", cfg.Propagates(), cfg.DatabasePropagates(standby), cfg.PropagatesAny())
+	}
+	if cfg.DatabaseTopicProjectID(standby) != "hub" || cfg.DatabaseTopicID(standby) != "firesync" {
+		t.Fatalf("DatabaseTopic = %s/%s", cfg.DatabaseTopicProjectID(standby), cfg.DatabaseTopicID(standby))
+	}
+
+	t.Setenv("DATABASE", standby)
+	t.Setenv("DATABASES", "")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.PropagatesAny() {
+		t.Fatalf("PropagatesAny = true, want false for a standby region")
+	}
+}
+
+func TestLoad_Transforms(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Transforms != nil || cfg.SchemaVersion != 0 || cfg.PublishedSchemaVersion != 0 {
+		t.Fatalf("Transforms = %+v, SchemaVersion = %d, PublishedSchemaVersion = %d", cfg.Transforms, cfg.SchemaVersion, cfg.PublishedSchemaVersion)
+	}
+
+	file := filepath.Join(t.TempDir(), "transforms.yaml")
+	if err := os.WriteFile(file, []byte(testTransforms), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TRANSFORMS_FILE", file)
+	t.Setenv("SCHEMA_VERSION", "3")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Transforms == nil || len(cfg.Transforms.Migrations) != 2 {
+		t.Fatalf("Transforms = %+v", cfg.Transforms)
+	}
+	if cfg.PublishedSchemaVersion != 3 {
+		t.Fatalf("PublishedSchemaVersion = %d, want 3", cfg.PublishedSchemaVersion)
+	}
+
+	t.Setenv("PUBLISHED_SCHEMA_VERSION", "2")
+	if cfg, err = Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.PublishedSchemaVersion != 2 {
+		t.Fatalf("PublishedSchemaVersion = %d, want 2", cfg.PublishedSchemaVersion)
+	}
+
+	t.Setenv("SCHEMA_VERSION", "-1")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for a negative schema version")
+	}
+}
+
+func TestLoad_Databases(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+	t.Setenv("DATABASE", "projects/p/databases/a")
+	t.Setenv("DATABASES", "projects/p/databases/b, projects/p/databases/a,projects/q/databases/c")
+
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want := []string{"projects/p/databases/a", "projects/p/databases/b", "projects/q/databases/c"}
+	if got := cfg.ServedDatabases(); !slices.Equal(got, want) {
+		t.Fatalf("ServedDatabases() = %v, want %v", got, want)
+	}
+
+	t.Setenv("DATABASES", "projects/q/databases/a")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for databases with the same id")
+	}
+
+	t.Setenv("DATABASES", "b")
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for an invalid database name")
+	}
+}
+
+func TestPathMapping_EnvDecode(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    PathMapping
+		wantErr bool
+	}{
+		{val: "tenants=mirror", want: PathMapping{Source: "tenants", Target: "mirror"}},
+		{val: "tenants/acme = databases/acme/documents/tenants/acme", want: PathMapping{Source: "tenants/acme", TargetDatabase: "acme", Target: "tenants/acme"}},
+		{val: "databases/a=databases/b/documents/regions/a", want: PathMapping{SourceDatabase: "a", TargetDatabase: "b", Target: "regions/a"}},
+		{val: "databases/a/documents/tenants/acme=", want: PathMapping{SourceDatabase: "a", Source: "tenants/acme"}},
+		{val: "tenants", wantErr: true},
+		{val: "=mirror", wantErr: true},
+		{val: "tenants=mirror/acme", wantErr: true},
+		{val: "tenants//acme=mirror/acme", wantErr: true},
+		{val: "databases//documents/tenants=mirror", wantErr: true},
+		{val: "databases/a/tenants=mirror", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			var got PathMapping
+			err := got.EnvDecode(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EnvDecode(%q) error = %v, wantErr %v", tt.val, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("EnvDecode(%q) = %+v, want %+v", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_PathMappings(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+	t.Setenv("DATABASE", "projects/p/databases/a")
+	t.Setenv("PATH_MAPPINGS", "tenants=mirror,tenants/acme=databases/acme/documents/tenants/acme")
+
+	if _, err := Load(context.Background()); err == nil {
+		t.Fatalf("expected error for a target database that isn't served")
+	}
+
+	t.Setenv("DATABASES", "projects/p/databases/acme")
+	cfg, err := Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.PathMappings) != 2 || cfg.PathMappings[1].TargetDatabase != "acme" {
+		t.Fatalf("PathMappings = %+v", cfg.PathMappings)
+	}
+}
+
+func TestPubSubResources(t *testing.T) {
+	cfg := &Config{
+		ProjectID:             "local",
+		Topic:                 "projects/hub/topics/firesync",
+		DeadLetterTopic:       "dead",
+		PropagateSubscription: "eventarc",
+		ReplicateSubscription: "projects/hub/subscriptions/firesync-us-east4",
+	}
+	got := [][2]string{
+		{cfg.TopicProjectID(), cfg.TopicID()},
+		{cfg.DeadLetterTopicProjectID(), cfg.DeadLetterTopicID()},
+		{cfg.PropagateSubscriptionProjectID(), cfg.PropagateSubscriptionID()},
+		{cfg.ReplicateSubscriptionProjectID(), cfg.ReplicateSubscriptionID()},
+	}
+	want := [][2]string{
+		{"hub", "firesync"},
+		{"local", "dead"},
+		{"local", "eventarc"},
+		{"hub", "firesync-us-east4"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("resources = %v, want %v", got, want)
+	}
+}
+
+func TestLoad_PubSubResources(t *testing.T) {
+	resetMetadataCache()
+	t.Setenv("ENVIRONMENT", EnvironmentLocal)
+
+	for _, env := range []struct{ key, val string }{
+		{"TOPIC", "projects/hub/topics/firesync"},
+		{"REPLICATE_SUBSCRIPTION", "projects/hub/subscriptions/firesync"},
+		{"DEAD_LETTER_TOPIC", "dead"},
+	} {
+		t.Setenv(env.key, env.val)
+	}
+	if _, err := Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	tests := []struct{ key, val string }{
+		{"TOPIC", "projects/hub"},
+		{"TOPIC", "projects/hub/subscriptions/firesync"},
+		{"DEAD_LETTER_TOPIC", "projects//topics/dead"},
+		{"REPLICATE_SUBSCRIPTION", "projects/hub/topics/firesync"},
+		{"PROPAGATE_SUBSCRIPTION", "hub/eventarc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.val, func(t *testing.T) {
+			t.Setenv(tt.key, tt.val)
+			if _, err := Load(context.Background()); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
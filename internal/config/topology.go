@@ -0,0 +1,178 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// RoleActive regions propagate their own changes and replicate the
+	// changes of the other regions.
+	RoleActive = "active"
+
+	// RoleStandby regions only replicate the changes of the other regions.
+	// Changes made to their database are not propagated.
+	RoleStandby = "standby"
+)
+
+// Topology declares every region of the cluster, so that all components
+// share one view of it. It is loaded from a YAML file:
+//
+//	regions:
+//	  - name: us-east4
+//	    database: projects/my-project/databases/us-east4
+//	    topic: firesync
+//	    subscription: firesync-us-east4
+//	    role: active
+//	    priority: 10
+//	    endpoint: https://firesync-us-east4-abc.a.run.app
+type Topology struct {
+	Regions []Region `yaml:"regions"`
+}
+
+// Region is a single region of the Topology.
+type Region struct {
+	// Name identifies the region, e.g. its Cloud Run region.
+	Name string `yaml:"name"`
+
+	// Database is the resource name of the region's Cloud Firestore database,
+	// "projects/{project_id}/databases/{database_id}".
+	Database string `yaml:"database"`
+
+	// Topic is the Cloud Pub/Sub topic the region propagates its changes to,
+	// in the same format as Config.Topic.
+	Topic string `yaml:"topic"`
+
+	// Subscription is the ID of the Cloud Pub/Sub subscription the region
+	// replicates changes from. Optional in server mode, where push
+	// subscriptions deliver the changes.
+	Subscription string `yaml:"subscription,omitempty"`
+
+	// Role is either "active" (default) or "standby".
+	Role string `yaml:"role,omitempty"`
+
+	// Priority breaks ties between concurrent changes, in favor of the region
+	// with the higher priority. Regions with the same priority are ordered by
+	// database name.
+	Priority int `yaml:"priority,omitempty"`
+
+	// Endpoint is the base URL of the region's FireSync service. It is only
+	// used by tools driving the cluster, such as the simulator.
+	Endpoint string `yaml:"endpoint,omitempty"`
+}
+
+// LoadTopology reads and validates the topology file at path.
+func LoadTopology(path string) (*Topology, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open topology file: %w", err)
+	}
+	defer f.Close()
+
+	t, err := ParseTopology(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topology file %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ParseTopology decodes and validates a YAML topology. Unknown fields are
+// rejected, so typos don't silently fall back to defaults.
+func ParseTopology(r io.Reader) (*Topology, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	t := &Topology{}
+	if err := dec.Decode(t); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for i := range t.Regions {
+		if t.Regions[i].Role == "" {
+			t.Regions[i].Role = RoleActive
+		}
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Topology) validate() error {
+	if len(t.Regions) == 0 {
+		return errors.New("no regions")
+	}
+
+	names := make(map[string]bool, len(t.Regions))
+	databases := make(map[string]bool, len(t.Regions))
+	active := 0
+	for i, r := range t.Regions {
+		if r.Name == "" {
+			return fmt.Errorf("region %d: missing name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("region %s: duplicate name", r.Name)
+		}
+		names[r.Name] = true
+
+		if _, _, err := model.ParseDatabaseName(r.Database); err != nil {
+			return fmt.Errorf("region %s: %w", r.Name, err)
+		}
+		if databases[r.Database] {
+			return fmt.Errorf("region %s: database %s is used by another region", r.Name, r.Database)
+		}
+		databases[r.Database] = true
+
+		if r.Topic == "" {
+			return fmt.Errorf("region %s: missing topic", r.Name)
+		}
+
+		switch r.Role {
+		case RoleActive:
+			active++
+		case RoleStandby:
+		default:
+			return fmt.Errorf("region %s: invalid role %q", r.Name, r.Role)
+		}
+	}
+
+	if active == 0 {
+		return errors.New("no active regions")
+	}
+	return nil
+}
+
+// Region returns the region of the database with the given resource name, or
+// nil if it isn't part of the topology.
+func (t *Topology) Region(database string) *Region {
+	for i := range t.Regions {
+		if t.Regions[i].Database == database {
+			return &t.Regions[i]
+		}
+	}
+	return nil
+}
+
+// Databases returns the database resource names of every region, in the
+// order they are declared.
+func (t *Topology) Databases() []string {
+	databases := make([]string, len(t.Regions))
+	for i, r := range t.Regions {
+		databases[i] = r.Database
+	}
+	return databases
+}
+
+// Priorities returns the priorities of the regions' databases, for
+// last-writer-wins tie-breaking.
+func (t *Topology) Priorities() model.Priorities {
+	p := make(model.Priorities, len(t.Regions))
+	for _, r := range t.Regions {
+		p[r.Database] = r.Priority
+	}
+	return p
+}
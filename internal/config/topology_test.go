@@ -0,0 +1,72 @@
+package config
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/joaopenteado/firesync/internal/model"
+)
+
+const testTopology = `
+regions:
+  - name: us-east4
+    database: projects/p/databases/us-east4
+    topic: firesync
+    subscription: firesync-us-east4
+    priority: 10
+  - name: us-west1
+    database: projects/p/databases/us-west1
+    topic: projects/hub/topics/firesync
+    role: standby
+`
+
+func TestParseTopology(t *testing.T) {
+	topology, err := ParseTopology(strings.NewReader(testTopology))
+	if err != nil {
+		t.Fatalf("ParseTopology: %v", err)
+	}
+	if len(topology.Regions) != 2 {
+		t.Fatalf("regions = %+v", topology.Regions)
+	}
+	if r := topology.Regions[0]; r.Role != RoleActive || r.Subscription != "firesync-us-east4" || r.Priority != 10 {
+		t.Fatalf("region = %+v", r)
+	}
+	if r := topology.Region("projects/p/databases/us-west1"); r == nil || r.Name != "us-west1" || r.Role != RoleStandby {
+		t.Fatalf("Region() = %+v", r)
+	}
+	if r := topology.Region("projects/p/databases/other"); r != nil {
+		t.Fatalf("Region() = %+v, want nil", r)
+	}
+
+	want := model.Priorities{"projects/p/databases/us-east4": 10, "projects/p/databases/us-west1": 0}
+	if got := topology.Priorities(); !maps.Equal(got, want) {
+		t.Fatalf("Priorities() = %v, want %v", got, want)
+	}
+}
+
+func TestParseTopology_Invalid(t *testing.T) {
+	const region = "\n  - name: a\n    database: projects/p/databases/a\n    topic: t"
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"empty", ""},
+		{"no regions", "regions: []"},
+		{"unknown field", "regions:" + region + "\n    color: blue"},
+		{"missing name", "regions:\n  - database: projects/p/databases/a\n    topic: t"},
+		{"duplicate name", "regions:" + region + "\n  - name: a\n    database: projects/p/databases/b\n    topic: t"},
+		{"invalid database", "regions:\n  - name: a\n    database: a\n    topic: t"},
+		{"duplicate database", "regions:" + region + "\n  - name: b\n    database: projects/p/databases/a\n    topic: t"},
+		{"missing topic", "regions:\n  - name: a\n    database: projects/p/databases/a"},
+		{"invalid role", "regions:" + region + "\n    role: primary"},
+		{"no active regions", "regions:" + region + "\n    role: standby"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseTopology(strings.NewReader(tt.yaml)); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
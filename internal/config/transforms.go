@@ -0,0 +1,215 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+// ValueTypes are the types a field can be converted to.
+var ValueTypes = []string{"string", "integer", "double", "boolean", "timestamp"}
+
+// Transforms declares how documents are converted between the schema versions
+// of the regions, so that regions running different versions of an
+// application keep replicating to each other during a rolling schema
+// migration. It is loaded from a YAML file:
+//
+//	migrations:
+//	  - collection: users
+//	    version: 2
+//	    upgrade:
+//	      - rename: {from: name, to: display_name}
+//	      - default: {field: locale, value: en}
+//	    downgrade:
+//	      - rename: {from: display_name, to: name}
+//	      - drop: locale
+//	  - collection: users/*/orders
+//	    version: 3
+//	    upgrade:
+//	      - convert: {field: total, type: double}
+//	    downgrade:
+//	      - convert: {field: total, type: integer}
+type Transforms struct {
+	Migrations []Migration `yaml:"migrations"`
+}
+
+// Migration changes the schema of the documents in the collections matching a
+// pattern from the version before Version to Version.
+type Migration struct {
+	// Collection is the collection pattern, where a "*" matches exactly one
+	// path segment.
+	Collection string `yaml:"collection"`
+
+	// Version is the schema version the migration upgrades to, starting at 1.
+	Version int `yaml:"version"`
+
+	// Upgrade converts documents from the previous version to Version.
+	Upgrade []FieldTransform `yaml:"upgrade,omitempty"`
+
+	// Downgrade converts documents from Version to the previous version.
+	Downgrade []FieldTransform `yaml:"downgrade,omitempty"`
+}
+
+// FieldTransform is a single change to the fields of a document, of which
+// exactly one is set. Fields are named by their path, where a dot separates
+// the fields of nested maps.
+type FieldTransform struct {
+	// Rename moves the value of a field to another one.
+	Rename *RenameTransform `yaml:"rename,omitempty"`
+
+	// Drop deletes a field.
+	Drop string `yaml:"drop,omitempty"`
+
+	// Default sets a field missing from the document.
+	Default *DefaultTransform `yaml:"default,omitempty"`
+
+	// Convert converts the value of a field to another type.
+	Convert *ConvertTransform `yaml:"convert,omitempty"`
+}
+
+type RenameTransform struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+type DefaultTransform struct {
+	Field string `yaml:"field"`
+
+	// Value is a YAML scalar, sequence or mapping, with timestamps as
+	// time.Time and integers as int64.
+	Value any `yaml:"value"`
+}
+
+type ConvertTransform struct {
+	Field string `yaml:"field"`
+
+	// Type is one of ValueTypes.
+	Type string `yaml:"type"`
+}
+
+// LoadTransforms reads and validates the transforms file at path.
+func LoadTransforms(path string) (*Transforms, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transforms file: %w", err)
+	}
+	defer f.Close()
+
+	t, err := ParseTransforms(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transforms file %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ParseTransforms decodes and validates YAML transforms. Unknown fields are
+// rejected, so typos don't silently skip a transform.
+func ParseTransforms(r io.Reader) (*Transforms, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	t := &Transforms{}
+	if err := dec.Decode(t); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for i := range t.Migrations {
+		m := &t.Migrations[i]
+		for _, ft := range slices.Concat(m.Upgrade, m.Downgrade) {
+			if ft.Default != nil {
+				ft.Default.Value = normalizeValue(ft.Default.Value)
+			}
+		}
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// normalizeValue converts the integers YAML decodes to int64, the type
+// Firestore values use.
+func normalizeValue(v any) any {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case []any:
+		for i := range v {
+			v[i] = normalizeValue(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = normalizeValue(v[k])
+		}
+	}
+	return v
+}
+
+func (t *Transforms) validate() error {
+	for i, m := range t.Migrations {
+		if m.Collection == "" {
+			return fmt.Errorf("migration %d: missing collection", i)
+		}
+		if _, err := path.Match(m.Collection, ""); err != nil {
+			return fmt.Errorf("migration %d: invalid collection %q: %w", i, m.Collection, err)
+		}
+		if m.Version < 1 {
+			return fmt.Errorf("migration %d: version must be at least 1", i)
+		}
+		if len(m.Upgrade) == 0 && len(m.Downgrade) == 0 {
+			return fmt.Errorf("migration %d: no transforms", i)
+		}
+		for j, ft := range m.Upgrade {
+			if err := ft.validate(); err != nil {
+				return fmt.Errorf("migration %d: upgrade %d: %w", i, j, err)
+			}
+		}
+		for j, ft := range m.Downgrade {
+			if err := ft.validate(); err != nil {
+				return fmt.Errorf("migration %d: downgrade %d: %w", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ft *FieldTransform) validate() error {
+	set := 0
+	if ft.Rename != nil {
+		set++
+		if ft.Rename.From == "" || ft.Rename.To == "" {
+			return errors.New("rename requires from and to")
+		}
+	}
+	if ft.Drop != "" {
+		set++
+	}
+	if ft.Default != nil {
+		set++
+		if ft.Default.Field == "" {
+			return errors.New("default requires a field")
+		}
+		if _, err := model.EncodeValue(ft.Default.Value); err != nil {
+			return fmt.Errorf("invalid default value: %w", err)
+		}
+	}
+	if ft.Convert != nil {
+		set++
+		if ft.Convert.Field == "" {
+			return errors.New("convert requires a field")
+		}
+		if !slices.Contains(ValueTypes, ft.Convert.Type) {
+			return fmt.Errorf("invalid convert type %q", ft.Convert.Type)
+		}
+	}
+
+	if set != 1 {
+		return errors.New("expected exactly one of rename, drop, default or convert")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTransforms = `
+migrations:
+  - collection: users
+    version: 2
+    upgrade:
+      - rename: {from: name, to: display_name}
+      - default: {field: tags, value: [a, 1, {b: 2}]}
+    downgrade:
+      - rename: {from: display_name, to: name}
+      - drop: tags
+  - collection: users/*/orders
+    version: 3
+    upgrade:
+      - convert: {field: total, type: double}
+`
+
+func TestParseTransforms(t *testing.T) {
+	transforms, err := ParseTransforms(strings.NewReader(testTransforms))
+	if err != nil {
+		t.Fatalf("ParseTransforms: %v", err)
+	}
+	if len(transforms.Migrations) != 2 {
+		t.Fatalf("migrations = %+v", transforms.Migrations)
+	}
+
+	m := transforms.Migrations[0]
+	if m.Collection != "users" || m.Version != 2 || len(m.Upgrade) != 2 || len(m.Downgrade) != 2 {
+		t.Fatalf("migration = %+v", m)
+	}
+	if r := m.Upgrade[0].Rename; r == nil || r.From != "name" || r.To != "display_name" {
+		t.Fatalf("rename = %+v", r)
+	}
+	want := []any{"a", int64(1), map[string]any{"b": int64(2)}}
+	if d := m.Upgrade[1].Default; d == nil || d.Field != "tags" || !reflect.DeepEqual(d.Value, want) {
+		t.Fatalf("default = %+v, want value %v", d, want)
+	}
+	if m.Downgrade[1].Drop != "tags" {
+		t.Fatalf("drop = %+v", m.Downgrade[1])
+	}
+
+	if c := transforms.Migrations[1].Upgrade[0].Convert; c == nil || c.Field != "total" || c.Type != "double" {
+		t.Fatalf("convert = %+v", c)
+	}
+}
+
+func TestParseTransforms_Invalid(t *testing.T) {
+	const migration = "migrations:\n  - collection: users\n    version: 1\n    upgrade:\n      - "
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"unknown field", migration + "drop: a\n    color: blue"},
+		{"unknown transform", migration + "uppercase: a"},
+		{"missing collection", "migrations:\n  - version: 1\n    upgrade:\n      - drop: a"},
+		{"invalid collection", "migrations:\n  - collection: '['\n    version: 1\n    upgrade:\n      - drop: a"},
+		{"invalid version", "migrations:\n  - collection: users\n    upgrade:\n      - drop: a"},
+		{"no transforms", "migrations:\n  - collection: users\n    version: 1"},
+		{"empty transform", migration + "{}"},
+		{"several transforms", migration + "{drop: a, rename: {from: b, to: c}}"},
+		{"incomplete rename", migration + "rename: {from: a}"},
+		{"default without field", migration + "default: {value: 1}"},
+		{"invalid convert type", migration + "convert: {field: a, type: bytes}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseTransforms(strings.NewReader(tt.yaml)); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+
+	"github.com/joaopenteado/firesync/internal/push"
+	"github.com/joaopenteado/firesync/internal/service"
+	"github.com/rs/zerolog"
+)
+
+// PauseController pauses and resumes the propagation and replication of
+// collections at runtime.
+type PauseController interface {
+	Pauses(ctx context.Context) ([]service.Pause, error)
+	Pause(ctx context.Context, pattern, reason string) ([]service.Pause, error)
+	Resume(ctx context.Context, pattern string) ([]service.Pause, bool, error)
+}
+
+// pauseRequest is the body of a request pausing a collection.
+type pauseRequest struct {
+	Collection string `json:"collection"`
+	Reason     string `json:"reason"`
+}
+
+// pausesResponse is the body of every pauses response.
+type pausesResponse struct {
+	Paused []service.Pause `json:"paused"`
+}
+
+// Pauses serves the admin API for pausing collections:
+//
+//	GET    lists the paused collections
+//	POST   pauses a collection, {"collection": "users/*/sessions", "reason": "migration"}
+//	DELETE resumes a collection, ?collection=users/*/sessions
+//
+// Every response lists the collections paused afterwards.
+func Pauses(ctrl PauseController) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		ctx := r.Context()
+		logger := zerolog.Ctx(ctx)
+
+		var (
+			paused []service.Pause
+			err    error
+		)
+		switch r.Method {
+		case http.MethodGet:
+			paused, err = ctrl.Pauses(ctx)
+
+		case http.MethodPost:
+			body, ok := push.ReadBody(w, r)
+			if !ok {
+				return
+			}
+			req := &pauseRequest{}
+			if err := json.Unmarshal(body, req); err != nil {
+				http.Error(w, "invalid pause request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !validCollectionPattern(req.Collection) {
+				http.Error(w, "invalid collection pattern", http.StatusBadRequest)
+				return
+			}
+
+			paused, err = ctrl.Pause(ctx, req.Collection, req.Reason)
+			if err == nil {
+				logger.Info().Str("collection", req.Collection).Str("reason", req.Reason).Msg("collection paused")
+			}
+
+		case http.MethodDelete:
+			collection := r.URL.Query().Get("collection")
+			if !validCollectionPattern(collection) {
+				http.Error(w, "invalid collection pattern", http.StatusBadRequest)
+				return
+			}
+
+			var found bool
+			paused, found, err = ctrl.Resume(ctx, collection)
+			if err == nil && !found {
+				http.Error(w, "collection not paused", http.StatusNotFound)
+				return
+			}
+			if err == nil {
+				logger.Info().Str("collection", collection).Msg("collection resumed")
+			}
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			logger.Err(err).Msg("failed to update paused collections")
+			w.WriteHeader(errorStatus(service.ClassifyError(err)))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if paused == nil {
+			paused = []service.Pause{}
+		}
+		if err := json.NewEncoder(w).Encode(&pausesResponse{Paused: paused}); err != nil {
+			logger.Err(err).Msg("failed to write pauses response")
+		}
+	})
+}
+
+func validCollectionPattern(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joaopenteado/firesync/internal/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type stubPauseController struct {
+	paused []service.Pause
+	err    error
+}
+
+func (s *stubPauseController) Pauses(ctx context.Context) ([]service.Pause, error) {
+	return s.paused, s.err
+}
+
+func (s *stubPauseController) Pause(ctx context.Context, pattern, reason string) ([]service.Pause, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.paused = append(s.paused, service.Pause{Collection: pattern, Reason: reason})
+	return s.paused, nil
+}
+
+func (s *stubPauseController) Resume(ctx context.Context, pattern string) ([]service.Pause, bool, error) {
+	if s.err != nil {
+		return nil, false, s.err
+	}
+	for i, p := range s.paused {
+		if p.Collection == pattern {
+			s.paused = append(s.paused[:i], s.paused[i+1:]...)
+			return s.paused, true, nil
+		}
+	}
+	return s.paused, false, nil
+}
+
+func TestPauses(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		paused     []service.Pause
+		err        error
+		want       int
+		wantPaused []string
+	}{
+		{"list", http.MethodGet, "/", "", []service.Pause{{Collection: "users"}}, nil, http.StatusOK, []string{"users"}},
+		{"list empty", http.MethodGet, "/", "", nil, nil, http.StatusOK, []string{}},
+		{"pause", http.MethodPost, "/", `{"collection":"users/*/sessions","reason":"migration"}`, nil, nil, http.StatusOK, []string{"users/*/sessions"}},
+		{"pause invalid pattern", http.MethodPost, "/", `{"collection":"users/["}`, nil, nil, http.StatusBadRequest, nil},
+		{"pause without collection", http.MethodPost, "/", `{}`, nil, nil, http.StatusBadRequest, nil},
+		{"pause invalid body", http.MethodPost, "/", `{`, nil, nil, http.StatusBadRequest, nil},
+		{"resume", http.MethodDelete, "/?collection=users", "", []service.Pause{{Collection: "users"}}, nil, http.StatusOK, []string{}},
+		{"resume not paused", http.MethodDelete, "/?collection=users", "", nil, nil, http.StatusNotFound, nil},
+		{"store unavailable", http.MethodGet, "/", "", nil, status.Error(codes.Unavailable, "unavailable"), http.StatusServiceUnavailable, nil},
+		{"store error", http.MethodPost, "/", `{"collection":"users"}`, nil, errors.New("boom"), http.StatusInternalServerError, nil},
+		{"method not allowed", http.MethodPut, "/", "", nil, nil, http.StatusMethodNotAllowed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := &stubPauseController{paused: tt.paused, err: tt.err}
+			rr := httptest.NewRecorder()
+			Pauses(ctrl).ServeHTTP(rr, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if tt.wantPaused == nil {
+				return
+			}
+
+			resp := &pausesResponse{}
+			if err := json.Unmarshal(rr.Body.Bytes(), resp); err != nil {
+				t.Fatalf("invalid response %q: %v", rr.Body.String(), err)
+			}
+			got := make([]string, 0, len(resp.Paused))
+			for _, p := range resp.Paused {
+				got = append(got, p.Collection)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantPaused, ",") {
+				t.Fatalf("paused = %v, want %v", got, tt.wantPaused)
+			}
+		})
+	}
+}
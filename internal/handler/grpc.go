@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/push"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fireSyncServer is the server API of the firesync.v1.FireSync service,
+// defined in api/firesync/v1/firesync.proto. Its messages are all well-known
+// Google Cloud types, so the service is registered by fireSyncServiceDesc
+// rather than generated code; clients generate their stubs from the .proto.
+type fireSyncServer interface {
+	Propagate(ctx context.Context, event *firestoredata.DocumentEventData) (*emptypb.Empty, error)
+	Replicate(ctx context.Context, msg *pubsubpb.PubsubMessage) (*emptypb.Empty, error)
+	PropagateStream(stream grpc.BidiStreamingServer[pubsubpb.PubsubMessage, status.Status]) error
+	ReplicateStream(stream grpc.BidiStreamingServer[pubsubpb.PubsubMessage, status.Status]) error
+}
+
+type grpcServer struct {
+	propagator Propagator
+	replicator Replicator
+	options    *options
+}
+
+// RegisterGRPC registers the firesync.v1.FireSync service on s, serving
+// propagate and replicate requests with the same semantics as the HTTP
+// handlers. Calls to a nil service fail with codes.Unimplemented.
+func RegisterGRPC(s grpc.ServiceRegistrar, propagator Propagator, replicator Replicator, opts ...Option) {
+	s.RegisterService(&fireSyncServiceDesc, &grpcServer{
+		propagator: propagator,
+		replicator: replicator,
+		options:    newOptions(opts...),
+	})
+}
+
+func (s *grpcServer) Propagate(ctx context.Context, event *firestoredata.DocumentEventData) (*emptypb.Empty, error) {
+	if s.propagator == nil {
+		return nil, grpcstatus.Error(codes.Unimplemented, "propagation is disabled")
+	}
+
+	data, err := proto.Marshal(event)
+	if err != nil {
+		return nil, grpcstatus.Errorf(codes.InvalidArgument, "failed to marshal event: %v", err)
+	}
+
+	attrs := cloudEventMetadata(ctx)
+	attrs["content-type"] = "application/protobuf"
+
+	if err := grpcStatus(propagate(ctx, s.propagator, s.options, attrs, data)).Err(); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *grpcServer) Replicate(ctx context.Context, msg *pubsubpb.PubsubMessage) (*emptypb.Empty, error) {
+	if s.replicator == nil {
+		return nil, grpcstatus.Error(codes.Unimplemented, "replication is disabled")
+	}
+
+	if err := grpcStatus(replicate(ctx, s.replicator, s.options, messageFromProto(msg))).Err(); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *grpcServer) PropagateStream(stream grpc.BidiStreamingServer[pubsubpb.PubsubMessage, status.Status]) error {
+	if s.propagator == nil {
+		return grpcstatus.Error(codes.Unimplemented, "propagation is disabled")
+	}
+
+	return serveStream(stream, s.options.streamMessageTimeout, func(ctx context.Context, msg *pubsubpb.PubsubMessage) *grpcstatus.Status {
+		return grpcStatus(propagate(ctx, s.propagator, s.options, msg.GetAttributes(), msg.GetData()))
+	})
+}
+
+func (s *grpcServer) ReplicateStream(stream grpc.BidiStreamingServer[pubsubpb.PubsubMessage, status.Status]) error {
+	if s.replicator == nil {
+		return grpcstatus.Error(codes.Unimplemented, "replication is disabled")
+	}
+
+	return serveStream(stream, s.options.streamMessageTimeout, func(ctx context.Context, msg *pubsubpb.PubsubMessage) *grpcstatus.Status {
+		return grpcStatus(replicate(ctx, s.replicator, s.options, messageFromProto(msg)))
+	})
+}
+
+// serveStream processes the messages of stream one at a time, replying with
+// the status of each. Callers wanting concurrency open several streams. The
+// processing of each message is canceled after timeout, unless it's zero.
+func serveStream(
+	stream grpc.BidiStreamingServer[pubsubpb.PubsubMessage, status.Status],
+	timeout time.Duration,
+	process func(ctx context.Context, msg *pubsubpb.PubsubMessage) *grpcstatus.Status,
+) error {
+	ctx := stream.Context()
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := stream.Send(processWithTimeout(ctx, timeout, msg, process).Proto()); err != nil {
+			return err
+		}
+	}
+}
+
+func processWithTimeout(
+	ctx context.Context,
+	timeout time.Duration,
+	msg *pubsubpb.PubsubMessage,
+	process func(ctx context.Context, msg *pubsubpb.PubsubMessage) *grpcstatus.Status,
+) *grpcstatus.Status {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return process(ctx, msg)
+}
+
+// cloudEventMetadata returns the CloudEvent attributes sent as request
+// metadata, as in binary content mode.
+func cloudEventMetadata(ctx context.Context) map[string]string {
+	attrs := make(map[string]string)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, v := range md {
+		if len(v) == 0 {
+			continue
+		}
+		// metadata keys are always lowercase
+		if strings.HasPrefix(k, "ce-") {
+			attrs[k] = v[0]
+		}
+	}
+	return attrs
+}
+
+func messageFromProto(msg *pubsubpb.PubsubMessage) *model.Message {
+	m := &model.Message{
+		ID:         msg.GetMessageId(),
+		Attributes: msg.GetAttributes(),
+		Data:       msg.GetData(),
+	}
+	if msg.GetPublishTime() != nil {
+		m.PublishTime = msg.GetPublishTime().AsTime()
+	}
+	return m
+}
+
+// grpcStatus translates the status code and failure cause of a processed
+// message into a gRPC status. Unlike push subscriptions, gRPC callers are told
+// about permanent failures even when they were dead-lettered and acknowledged.
+func grpcStatus(code int, err error) *grpcstatus.Status {
+	if err == nil {
+		return grpcstatus.New(codes.OK, "")
+	}
+
+	switch {
+	case push.Acknowledges(code), code == http.StatusBadRequest, code == http.StatusRequestEntityTooLarge:
+		return grpcstatus.New(codes.InvalidArgument, err.Error())
+	case code == http.StatusTooManyRequests:
+		return grpcstatus.New(codes.ResourceExhausted, err.Error())
+	case code == http.StatusConflict:
+		return grpcstatus.New(codes.Aborted, err.Error())
+	case code == http.StatusServiceUnavailable:
+		return grpcstatus.New(codes.Unavailable, err.Error())
+	default:
+		return grpcstatus.New(codes.Internal, err.Error())
+	}
+}
+
+var fireSyncServiceDesc = grpc.ServiceDesc{
+	ServiceName: "firesync.v1.FireSync",
+	HandlerType: (*fireSyncServer)(nil),
+	Metadata:    "api/firesync/v1/firesync.proto",
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Propagate",
+			Handler:    unaryHandler("/firesync.v1.FireSync/Propagate", fireSyncServer.Propagate),
+		},
+		{
+			MethodName: "Replicate",
+			Handler:    unaryHandler("/firesync.v1.FireSync/Replicate", fireSyncServer.Replicate),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PropagateStream",
+			Handler:       bidiStreamHandler(fireSyncServer.PropagateStream),
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ReplicateStream",
+			Handler:       bidiStreamHandler(fireSyncServer.ReplicateStream),
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// unaryHandler adapts a unary method of fireSyncServer to a grpc.MethodDesc
+// handler, as protoc-gen-go-grpc would generate it.
+func unaryHandler[Req, Res any](fullMethod string, method func(fireSyncServer, context.Context, *Req) (*Res, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		in := new(Req)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return method(srv.(fireSyncServer), ctx, in)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: fullMethod,
+		}
+		handler := func(ctx context.Context, req any) (any, error) {
+			return method(srv.(fireSyncServer), ctx, req.(*Req))
+		}
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
+// bidiStreamHandler adapts a bidirectional streaming method of fireSyncServer
+// to a grpc.StreamDesc handler, as protoc-gen-go-grpc would generate it.
+func bidiStreamHandler[Req, Res any](method func(fireSyncServer, grpc.BidiStreamingServer[Req, Res]) error) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		return method(srv.(fireSyncServer), &grpc.GenericServerStream[Req, Res]{ServerStream: stream})
+	}
+}
@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/service"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// dialGRPC serves the FireSync service in memory and returns a connection to
+// it.
+func dialGRPC(t *testing.T, propagator Propagator, replicator Replicator, opts ...Option) *grpc.ClientConn {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	RegisterGRPC(srv, propagator, replicator, opts...)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		err  error
+		want codes.Code
+	}{
+		{"success", 202, nil, codes.OK},
+		{"skipped", 204, nil, codes.OK},
+		{"dead-lettered", 200, errors.New("bad event"), codes.InvalidArgument},
+		{"shed", 429, errors.New("limit"), codes.ResourceExhausted},
+		{"contention", 409, errors.New("aborted"), codes.Aborted},
+		{"transient", 503, errors.New("unavailable"), codes.Unavailable},
+		{"dead letter failed", 500, errors.New("bad event"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := grpcStatus(tt.code, tt.err).Code(); got != tt.want {
+				t.Fatalf("code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPC_Propagate(t *testing.T) {
+	svc := &stubPropagator{result: service.PropagationResultSuccess}
+	conn := dialGRPC(t, svc, nil)
+
+	evt := &firestoredata.DocumentEventData{
+		OldValue: &firestoredata.Document{
+			Name: "projects/p/databases/d/documents/users/1",
+		},
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"ce-id", "1",
+		"ce-time", "1970-01-01T00:00:02Z",
+	)
+	if err := conn.Invoke(ctx, "/firesync.v1.FireSync/Propagate", evt, &emptypb.Empty{}); err != nil {
+		t.Fatalf("Propagate: %v", err)
+	}
+	if svc.event == nil || svc.event.Name.Path != "users/1" {
+		t.Fatalf("service called with %+v", svc.event)
+	}
+	if !svc.event.Timestamp.Equal(time.Unix(2, 0)) {
+		t.Fatalf("event time = %v, want the ce-time metadata", svc.event.Timestamp)
+	}
+
+	svc.err = status.Error(codes.Unavailable, "unavailable")
+	err := conn.Invoke(ctx, "/firesync.v1.FireSync/Propagate", evt, &emptypb.Empty{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Propagate error = %v, want Unavailable", err)
+	}
+}
+
+func TestGRPC_Replicate(t *testing.T) {
+	sink := &stubDeadLetterSink{}
+	svc := &stubReplicator{result: service.ReplicationResultSuccess}
+	conn := dialGRPC(t, nil, svc, WithDeadLetterSink(sink))
+
+	msg := &pubsubpb.PubsubMessage{
+		MessageId:   "42",
+		Attributes:  map[string]string{"document-path": "users/1"},
+		Data:        []byte("{}"),
+		PublishTime: timestamppb.New(time.Unix(1, 0)),
+	}
+	if err := conn.Invoke(context.Background(), "/firesync.v1.FireSync/Replicate", msg, &emptypb.Empty{}); err != nil {
+		t.Fatalf("Replicate: %v", err)
+	}
+	if svc.msg == nil || svc.msg.ID != "42" || !svc.msg.PublishTime.Equal(time.Unix(1, 0)) {
+		t.Fatalf("service called with %+v", svc.msg)
+	}
+
+	svc.err = &service.Error{Class: service.ErrorClassPermanent, Err: errors.New("bad message")}
+	err := conn.Invoke(context.Background(), "/firesync.v1.FireSync/Replicate", msg, &emptypb.Empty{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Replicate error = %v, want InvalidArgument", err)
+	}
+	if sink.dl == nil {
+		t.Fatalf("permanent failure was not dead-lettered")
+	}
+
+	err = conn.Invoke(context.Background(), "/firesync.v1.FireSync/Propagate", &firestoredata.DocumentEventData{}, &emptypb.Empty{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Propagate error = %v, want Unimplemented", err)
+	}
+}
+
+func TestGRPC_ReplicateStream(t *testing.T) {
+	dedup := &stubDeduplicator{}
+	svc := &stubReplicator{result: service.ReplicationResultSuccess}
+	conn := dialGRPC(t, nil, svc, WithDeduplicator(dedup))
+
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := conn.NewStream(context.Background(), desc, "/firesync.v1.FireSync/ReplicateStream")
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+
+	ids := []string{"1", "2"}
+	for _, id := range ids {
+		if err := stream.SendMsg(&pubsubpb.PubsubMessage{MessageId: id}); err != nil {
+			t.Fatalf("SendMsg: %v", err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+
+	for _, id := range ids {
+		st := &rpcstatus.Status{}
+		if err := stream.RecvMsg(st); err != nil {
+			t.Fatalf("RecvMsg: %v", err)
+		}
+		if codes.Code(st.GetCode()) != codes.OK {
+			t.Fatalf("status of %s = %v", id, st)
+		}
+	}
+	for _, id := range ids {
+		if !dedup.seen[dedupScopeReplicate+"/"+id] {
+			t.Fatalf("message %s not marked processed", id)
+		}
+	}
+}
+
+// deadlineReplicator records whether messages are replicated with a deadline.
+type deadlineReplicator struct {
+	deadlines chan bool
+}
+
+func (r *deadlineReplicator) Replicate(ctx context.Context, msg *model.Message) (service.ReplicationResult, error) {
+	_, ok := ctx.Deadline()
+	r.deadlines <- ok
+	return service.ReplicationResultSuccess, nil
+}
+
+func TestGRPC_StreamMessageTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		svc := &deadlineReplicator{deadlines: make(chan bool, 1)}
+		conn := dialGRPC(t, nil, svc, WithStreamMessageTimeout(timeout))
+
+		desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+		stream, err := conn.NewStream(context.Background(), desc, "/firesync.v1.FireSync/ReplicateStream")
+		if err != nil {
+			t.Fatalf("NewStream: %v", err)
+		}
+		if err := stream.SendMsg(&pubsubpb.PubsubMessage{MessageId: "1"}); err != nil {
+			t.Fatalf("SendMsg: %v", err)
+		}
+		if err := stream.RecvMsg(&rpcstatus.Status{}); err != nil {
+			t.Fatalf("RecvMsg: %v", err)
+		}
+		if got := <-svc.deadlines; got != (timeout > 0) {
+			t.Fatalf("timeout %v: message deadline = %v", timeout, got)
+		}
+		stream.CloseSend()
+	}
+}
+
+func TestGRPC_PropagateStream(t *testing.T) {
+	svc := &stubPropagator{result: service.PropagationResultSuccess}
+	conn := dialGRPC(t, svc, nil)
+
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	stream, err := conn.NewStream(context.Background(), desc, "/firesync.v1.FireSync/PropagateStream")
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+
+	data, err := proto.Marshal(&firestoredata.DocumentEventData{
+		Value: &firestoredata.Document{
+			Name:       "projects/p/databases/d/documents/users/1",
+			UpdateTime: timestamppb.New(time.Unix(1, 0)),
+		},
+	})
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	msgs := []*pubsubpb.PubsubMessage{
+		{Attributes: map[string]string{"ce-id": "1", "content-type": "application/protobuf"}, Data: data},
+		{Attributes: map[string]string{"ce-id": "2", "content-type": "text/plain"}, Data: []byte("nope")},
+	}
+	want := []codes.Code{codes.OK, codes.InvalidArgument}
+	for i, msg := range msgs {
+		if err := stream.SendMsg(msg); err != nil {
+			t.Fatalf("SendMsg: %v", err)
+		}
+		st := &rpcstatus.Status{}
+		if err := stream.RecvMsg(st); err != nil {
+			t.Fatalf("RecvMsg: %v", err)
+		}
+		if codes.Code(st.GetCode()) != want[i] {
+			t.Fatalf("status of message %d = %v, want %v", i, st, want[i])
+		}
+	}
+}
+
+// protoMessageName returns the full name of the proto message t points to.
+func protoMessageName(t reflect.Type) string {
+	return string(reflect.New(t.Elem()).Interface().(proto.Message).ProtoReflect().Descriptor().FullName())
+}
+
+// TestFireSyncServiceDesc checks that the service registered by hand matches
+// its definition in the .proto clients generate their stubs from.
+func TestFireSyncServiceDesc(t *testing.T) {
+	def, err := os.ReadFile(filepath.Join("..", "..", fireSyncServiceDesc.Metadata.(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^package firesync\.v1;`).Match(def) || !regexp.MustCompile(`(?m)^service FireSync \{`).Match(def) {
+		t.Fatalf("the .proto doesn't define the %s service", fireSyncServiceDesc.ServiceName)
+	}
+
+	unary := make(map[string]bool)
+	for _, m := range fireSyncServiceDesc.Methods {
+		unary[m.MethodName] = true
+	}
+	streams := make(map[string]grpc.StreamDesc)
+	for _, s := range fireSyncServiceDesc.Streams {
+		streams[s.StreamName] = s
+	}
+
+	server := reflect.TypeOf((*fireSyncServer)(nil)).Elem()
+	rpcs := regexp.MustCompile(`rpc\s+(\w+)\(\s*(stream\s+)?([\w.]+)\s*\)\s*returns\s*\(\s*(stream\s+)?([\w.]+)\s*\)`).FindAllSubmatch(def, -1)
+	if len(rpcs) != len(unary)+len(streams) || len(rpcs) != server.NumMethod() {
+		t.Fatalf("the .proto has %d rpcs, the service desc %d methods and %d streams, fireSyncServer %d methods", len(rpcs), len(unary), len(streams), server.NumMethod())
+	}
+
+	for _, rpc := range rpcs {
+		name, clientStream, in, serverStream, out := string(rpc[1]), len(rpc[2]) > 0, string(rpc[3]), len(rpc[4]) > 0, string(rpc[5])
+		method, ok := server.MethodByName(name)
+		if !ok {
+			t.Errorf("fireSyncServer has no %s method", name)
+			continue
+		}
+
+		var gotIn, gotOut string
+		if clientStream || serverStream {
+			s, ok := streams[name]
+			if !ok || s.ClientStreams != clientStream || s.ServerStreams != serverStream {
+				t.Errorf("stream %s = %+v, want client streams %v and server streams %v", name, s, clientStream, serverStream)
+				continue
+			}
+			stream := method.Type.In(0)
+			recv, _ := stream.MethodByName("Recv")
+			send, _ := stream.MethodByName("Send")
+			gotIn, gotOut = protoMessageName(recv.Type.Out(0)), protoMessageName(send.Type.In(0))
+		} else {
+			if !unary[name] {
+				t.Errorf("method %s isn't registered as unary", name)
+				continue
+			}
+			gotIn, gotOut = protoMessageName(method.Type.In(1)), protoMessageName(method.Type.Out(0))
+		}
+		if gotIn != in || gotOut != out {
+			t.Errorf("%s(%s) returns (%s), want %s(%s) returns (%s)", name, gotIn, gotOut, name, in, out)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/joaopenteado/firesync/internal/model"
+)
+
+// MessageHandler processes a message pulled from a Pub/Sub subscription and
+// reports whether it should be acknowledged. Messages are acknowledged in the
+// same cases the corresponding push handler would acknowledge them.
+type MessageHandler func(ctx context.Context, msg *model.Message) bool
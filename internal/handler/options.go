@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/service"
+	"github.com/rs/zerolog"
+)
+
+// Option configures the propagate and replicate handlers.
+type Option interface {
+	apply(*options)
+}
+
+// DeadLetterSink records messages that failed permanently before they are
+// acknowledged.
+type DeadLetterSink interface {
+	Send(ctx context.Context, dl *service.DeadLetter) error
+}
+
+type options struct {
+	forceHTTP200Acknowledgement bool
+	deadLetterSink              DeadLetterSink
+	deduplicator                Deduplicator
+	limiter                     ConcurrencyLimiter
+	retryAfter                  time.Duration
+	streamMessageTimeout        time.Duration
+}
+
+type funcOption func(*options)
+
+func (f funcOption) apply(o *options) { f(o) }
+
+// WithHTTP200Acknowledgement forces the handler to return 200 OK for successful
+// Pub/Sub message acknowledgements instead of semantically appropriate status
+// codes. This is necessary for the simulator, which only treats 200 OK as a
+// successful acknowledgement.
+// See https://issuetracker.google.com/issues/434641504
+func WithHTTP200Acknowledgement(enforce bool) Option {
+	return funcOption(func(o *options) {
+		o.forceHTTP200Acknowledgement = enforce
+	})
+}
+
+// WithDeadLetterSink records permanently failing events in the given sink
+// before acknowledging them, instead of having them redelivered until the
+// subscription's retention runs out.
+func WithDeadLetterSink(sink DeadLetterSink) Option {
+	return funcOption(func(o *options) {
+		o.deadLetterSink = sink
+	})
+}
+
+// Deduplicator detects redelivered messages that were already processed.
+type Deduplicator interface {
+	IsDuplicate(ctx context.Context, scope, key string) bool
+	MarkProcessed(ctx context.Context, scope, key string)
+}
+
+// WithDeduplicator acknowledges redelivered messages that were already
+// processed without processing them again. Propagate requests are identified
+// by their CloudEvent ID and replicate requests by their Pub/Sub message ID.
+func WithDeduplicator(d Deduplicator) Option {
+	return funcOption(func(o *options) {
+		o.deduplicator = d
+	})
+}
+
+// ConcurrencyLimiter bounds the number of messages processed concurrently.
+type ConcurrencyLimiter interface {
+	Acquire(ctx context.Context, path string) (release func(), err error)
+}
+
+// WithConcurrencyLimiter sheds messages over the limits of l with 429 Too Many
+// Requests, asking the sender to retry after the given duration, instead of
+// processing them.
+func WithConcurrencyLimiter(l ConcurrencyLimiter, retryAfter time.Duration) Option {
+	return funcOption(func(o *options) {
+		o.limiter = l
+		o.retryAfter = retryAfter
+	})
+}
+
+// WithStreamMessageTimeout cancels the processing of every message received
+// on a gRPC stream after d, as the router does for HTTP requests and unary
+// calls. Zero disables the timeout.
+func WithStreamMessageTimeout(d time.Duration) Option {
+	return funcOption(func(o *options) {
+		o.streamMessageTimeout = d
+	})
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		forceHTTP200Acknowledgement: false,
+	}
+	for _, opt := range opts {
+		opt.apply(o)
+	}
+	return o
+}
+
+// ackStatus returns the status code acknowledging a message, honoring
+// WithHTTP200Acknowledgement.
+func (o *options) ackStatus(code int) int {
+	if o.forceHTTP200Acknowledgement {
+		return http.StatusOK
+	}
+	return code
+}
+
+// deadLetter records a permanently failing message in the dead-letter sink and
+// returns the status code to reply with. The message is acknowledged unless it
+// could not be recorded.
+func (o *options) deadLetter(ctx context.Context, dl *service.DeadLetter) int {
+	if o.deadLetterSink != nil {
+		if err := o.deadLetterSink.Send(ctx, dl); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("failed to record dead letter")
+			return http.StatusInternalServerError
+		}
+	}
+	return http.StatusOK
+}
+
+const (
+	dedupScopePropagate = "propagate"
+	dedupScopeReplicate = "replicate"
+)
+
+func (o *options) isDuplicate(ctx context.Context, scope, key string) bool {
+	return o.deduplicator != nil && o.deduplicator.IsDuplicate(ctx, scope, key)
+}
+
+func (o *options) markProcessed(ctx context.Context, scope, key string) {
+	if o.deduplicator != nil {
+		o.deduplicator.MarkProcessed(ctx, scope, key)
+	}
+}
+
+// errorStatus returns the status code for a retryable service error, so Pub/Sub
+// redelivers the message.
+func errorStatus(class service.ErrorClass) int {
+	switch class {
+	case service.ErrorClassContention:
+		return http.StatusConflict
+	case service.ErrorClassTransient:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// acquire takes a concurrency slot for processing the document at path. If
+// the message should be shed it returns the limiter's error.
+func (o *options) acquire(ctx context.Context, path string) (release func(), err error) {
+	if o.limiter == nil {
+		return func() {}, nil
+	}
+
+	release, err = o.limiter.Acquire(ctx, path)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("shedding load")
+		return nil, err
+	}
+	return release, nil
+}
+
+// writeStatus replies with code, adding a Retry-After header to 429 Too Many
+// Requests responses.
+func (o *options) writeStatus(w http.ResponseWriter, code int) {
+	if code == http.StatusTooManyRequests && o.retryAfter > 0 {
+		secs := int(math.Ceil(o.retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	w.WriteHeader(code)
+}
@@ -1,14 +1,19 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
 	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/push"
 	"github.com/joaopenteado/firesync/internal/service"
 	"github.com/rs/zerolog"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -17,108 +22,155 @@ import (
 
 var (
 	unsupportedMediaType = errors.New(http.StatusText(http.StatusUnsupportedMediaType))
+
+	// errPaused is returned for changes to paused collections, which are
+	// nacked so they are redelivered once the collection is resumed.
+	errPaused = errors.New("collection paused")
 )
 
 type Propagator interface {
 	Propagate(ctx context.Context, event *model.Event) (service.PropagationResult, error)
 }
 
-type propagateOption interface {
-	apply(*propagateOptions)
-}
-
-type propagateOptions struct {
-	forceHTTP200Acknowledgement bool
-}
+func Propagate(svc Propagator, opts ...Option) http.Handler {
+	options := newOptions(opts...)
 
-type funcPropagateOption func(*propagateOptions)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		ctx := r.Context()
 
-func (f funcPropagateOption) apply(o *propagateOptions) { f(o) }
+		body, ok := push.ReadBody(w, r)
+		if !ok {
+			return
+		}
 
-// WithHTTP200Acknowledgement forces the handler to return 200 OK for successful
-// Pub/Sub message acknowledgements instead of semantically appropriate status
-// codes. This is necessary for the simulator, which only treats 200 OK as a
-// successful acknowledgement.
-// See https://issuetracker.google.com/issues/434641504
-func WithHTTP200Acknowledgement(enforce bool) propagateOption {
-	return funcPropagateOption(func(o *propagateOptions) {
-		o.forceHTTP200Acknowledgement = enforce
+		code, _ := propagate(ctx, svc, options, cloudEventAttributes(r.Header), body)
+		options.writeStatus(w, code)
 	})
 }
 
-func Propagate(svc Propagator, opts ...propagateOption) http.Handler {
-	options := &propagateOptions{
-		forceHTTP200Acknowledgement: false,
+// PropagateMessage returns a MessageHandler propagating binary mode CloudEvents
+// pulled from a Pub/Sub subscription, whose attributes carry the CloudEvent
+// attributes.
+func PropagateMessage(svc Propagator, opts ...Option) MessageHandler {
+	options := newOptions(opts...)
+
+	return func(ctx context.Context, msg *model.Message) bool {
+		code, _ := propagate(ctx, svc, options, msg.Attributes, msg.Data)
+		return push.Acknowledges(code)
 	}
-	for _, opt := range opts {
-		opt.apply(options)
+}
+
+// propagate propagates a binary mode CloudEvent and returns the status code
+// to reply with, along with the cause of the failure if it did not succeed.
+// Permanent failures are acknowledged once dead-lettered, but still report
+// their cause.
+func propagate(ctx context.Context, svc Propagator, options *options, attrs map[string]string, body []byte) (int, error) {
+	logger := zerolog.Ctx(ctx).With().Logger()
+
+	eventID := attrs["ce-id"]
+	if options.isDuplicate(ctx, dedupScopePropagate, eventID) {
+		logger.Debug().Str("event_id", eventID).Msg("duplicate event, skipping")
+		return options.ackStatus(http.StatusNoContent), nil
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-		ctx := r.Context()
-		logger := zerolog.Ctx(ctx).With().Logger()
+	// deadLetter records a permanently failing event and acknowledges it,
+	// since redelivering it would never succeed.
+	deadLetter := func(reason string, cause error) (int, error) {
+		err := fmt.Errorf("%s: %w", reason, cause)
+		return options.deadLetter(ctx, &service.DeadLetter{
+			Reason:     err.Error(),
+			Class:      service.ErrorClassPermanent,
+			Attributes: attrs,
+			Data:       body,
+		}), err
+	}
 
-		contentType := r.Header.Get("content-type")
-		if contentType == "" {
-			contentType = r.Header.Get("ce-datacontenttype")
-		}
-		rawEvent, err := parseFirestoreDocumentEventData(contentType, r.Body)
-		if err != nil {
-			logger.Err(err).
-				Str("content_type", contentType).
-				Msg("failed to parse firestore document event data")
-			if errors.Is(err, unsupportedMediaType) {
-				w.WriteHeader(http.StatusUnsupportedMediaType)
-				return
-			}
-
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	contentType := attrs["content-type"]
+	if contentType == "" {
+		contentType = attrs["ce-datacontenttype"]
+	}
+	rawEvent, err := parseFirestoreDocumentEventData(contentType, bytes.NewReader(body))
+	if err != nil {
+		logger.Err(err).
+			Str("content_type", contentType).
+			Msg("failed to parse firestore document event data")
+		if errors.Is(err, unsupportedMediaType) {
+			return deadLetter("unsupported media type "+contentType, err)
 		}
 
-		eventTime := time.Now()
-		if eventTimeStr := r.Header.Get("ce-time"); eventTimeStr != "" {
-			parsedTime, err := time.Parse(time.RFC3339Nano, eventTimeStr)
-			if err == nil && parsedTime.Before(eventTime) {
-				eventTime = parsedTime
-			}
-		}
+		return deadLetter("failed to parse firestore document event data", err)
+	}
 
-		modelEvent, err := model.ParseEvent(rawEvent, eventTime)
-		if err != nil {
-			logger.Err(err).Msg("failed to parse event")
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	eventTime := time.Now()
+	if eventTimeStr := attrs["ce-time"]; eventTimeStr != "" {
+		parsedTime, err := time.Parse(time.RFC3339Nano, eventTimeStr)
+		if err == nil && parsedTime.Before(eventTime) {
+			eventTime = parsedTime
 		}
+	}
 
-		result, err := svc.Propagate(ctx, modelEvent)
-		if err != nil || result == service.PropagationResultError {
-			logger.Error().Err(err).Msg("propagation failed")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	modelEvent, err := model.ParseEvent(rawEvent, eventTime)
+	if err != nil {
+		logger.Err(err).Msg("failed to parse event")
+		return deadLetter("failed to parse event", err)
+	}
+
+	release, err := options.acquire(ctx, modelEvent.Name.Path)
+	if err != nil {
+		return http.StatusTooManyRequests, err
+	}
+	defer release()
+
+	result, err := svc.Propagate(ctx, modelEvent)
+	if err != nil {
+		class := service.ClassifyError(err)
+		logger.Error().Err(err).
+			Stringer("error_class", class).
+			Msg("propagation failed")
+
+		if class == service.ErrorClassPermanent {
+			return deadLetter("propagation failed", err)
 		}
+		return errorStatus(class), err
+	}
+
+	switch result {
+	case service.PropagationResultSuccess:
+		options.markProcessed(ctx, dedupScopePropagate, eventID)
+		return options.ackStatus(http.StatusAccepted), nil
+
+	case service.PropagationResultSkipped:
+		options.markProcessed(ctx, dedupScopePropagate, eventID)
+		return options.ackStatus(http.StatusNoContent), nil
 
-		switch result {
-		case service.PropagationResultSuccess:
-			if options.forceHTTP200Acknowledgement {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			w.WriteHeader(http.StatusAccepted)
-
-		case service.PropagationResultSkipped:
-			if options.forceHTTP200Acknowledgement {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-
-			w.WriteHeader(http.StatusNoContent)
-		default:
-			logger.Error().Stringer("result", result).Msg("unhandled propagation result")
-			w.WriteHeader(http.StatusInternalServerError)
+	case service.PropagationResultPaused:
+		return http.StatusServiceUnavailable, errPaused
+
+	case service.PropagationResultError:
+		logger.Error().Msg("propagation failed")
+		return http.StatusInternalServerError, errors.New("propagation failed")
+
+	default:
+		logger.Error().Stringer("result", result).Msg("unhandled propagation result")
+		return http.StatusInternalServerError, fmt.Errorf("unhandled propagation result %s", result)
+	}
+}
+
+// cloudEventAttributes returns the CloudEvent attributes of a binary mode
+// request.
+func cloudEventAttributes(h http.Header) map[string]string {
+	attrs := make(map[string]string)
+	for k, v := range h {
+		if len(v) == 0 {
+			continue
 		}
-	})
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "ce-") || k == "content-type" {
+			attrs[k] = v[0]
+		}
+	}
+	return attrs
 }
 
 func parseFirestoreDocumentEventData(contentType string, r io.Reader) (event *firestoredata.DocumentEventData, err error) {
@@ -128,6 +180,11 @@ func parseFirestoreDocumentEventData(contentType string, r io.Reader) (event *fi
 		return nil, err
 	}
 
+	// structured mode events may carry media type parameters, e.g. a charset
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
 	event = &firestoredata.DocumentEventData{}
 	switch contentType {
 	case "application/protobuf":
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -13,6 +14,8 @@ import (
 	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
 	"github.com/joaopenteado/firesync/internal/model"
 	"github.com/joaopenteado/firesync/internal/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -30,6 +33,16 @@ func (s *stubPropagator) Propagate(ctx context.Context, e *model.Event) (service
 	return s.result, s.err
 }
 
+type stubDeadLetterSink struct {
+	dl  *service.DeadLetter
+	err error
+}
+
+func (s *stubDeadLetterSink) Send(ctx context.Context, dl *service.DeadLetter) error {
+	s.dl = dl
+	return s.err
+}
+
 type failingReader struct{ err error }
 
 func (f failingReader) Read(p []byte) (int, error) { return 0, f.err }
@@ -70,6 +83,7 @@ func TestParseFirestoreDocumentEventData(t *testing.T) {
 	}{
 		{"protobuf", "application/protobuf", bytes.NewReader(protoBody), evt, nil},
 		{"json", "application/json", bytes.NewReader(jsonBody), evt, nil},
+		{"json with charset", "application/json; charset=utf-8", bytes.NewReader(jsonBody), evt, nil},
 		{"unsupported", "text/plain", bytes.NewReader([]byte("foo")), nil, unsupportedMediaType},
 		{"read error", "application/json", failingReader{readErr}, nil, readErr},
 	}
@@ -92,16 +106,20 @@ func TestPropagate_StatusCodes(t *testing.T) {
 		name   string
 		result service.PropagationResult
 		err    error
-		opts   []propagateOption
+		opts   []Option
 		want   int
 	}{
 		{"success", service.PropagationResultSuccess, nil, nil, http.StatusAccepted},
-		{"success forced 200", service.PropagationResultSuccess, nil, []propagateOption{WithHTTP200Acknowledgement(true)}, http.StatusOK},
+		{"success forced 200", service.PropagationResultSuccess, nil, []Option{WithHTTP200Acknowledgement(true)}, http.StatusOK},
 		{"skipped", service.PropagationResultSkipped, nil, nil, http.StatusNoContent},
-		{"skipped forced 200", service.PropagationResultSkipped, nil, []propagateOption{WithHTTP200Acknowledgement(true)}, http.StatusOK},
+		{"skipped forced 200", service.PropagationResultSkipped, nil, []Option{WithHTTP200Acknowledgement(true)}, http.StatusOK},
 		{"error result", service.PropagationResultError, nil, nil, http.StatusInternalServerError},
 		{"svc error", service.PropagationResultSuccess, errors.New("svc error"), nil, http.StatusInternalServerError},
+		{"transient error", service.PropagationResultError, status.Error(codes.Unavailable, "unavailable"), nil, http.StatusServiceUnavailable},
+		{"contention error", service.PropagationResultError, fmt.Errorf("tx: %w", status.Error(codes.Aborted, "aborted")), nil, http.StatusConflict},
+		{"permanent error", service.PropagationResultError, &service.Error{Class: service.ErrorClassPermanent, Err: errors.New("bad tombstone")}, nil, http.StatusOK},
 		{"unknown result", service.PropagationResultUnknown, nil, nil, http.StatusInternalServerError},
+		{"paused", service.PropagationResultPaused, nil, []Option{WithHTTP200Acknowledgement(true)}, http.StatusServiceUnavailable},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -125,22 +143,27 @@ func TestPropagate_ParseErrors(t *testing.T) {
 	if err != nil {
 		t.Fatalf("protojson.Marshal: %v", err)
 	}
+	// parse errors are permanent, they are dead-lettered and acknowledged
 	tests := []struct {
 		name        string
 		contentType string
 		body        []byte
+		sinkErr     error
 		want        int
 	}{
-		{"unsupported content type", "text/plain", validBody, http.StatusUnsupportedMediaType},
-		{"invalid body", "application/json", invalidJSON, http.StatusBadRequest},
-		{"parse event error", "application/json", emptyEvent, http.StatusBadRequest},
+		{"unsupported content type", "text/plain", validBody, nil, http.StatusOK},
+		{"invalid body", "application/json", invalidJSON, nil, http.StatusOK},
+		{"parse event error", "application/json", emptyEvent, nil, http.StatusOK},
+		{"dead letter failure", "application/json", invalidJSON, errors.New("publish failed"), http.StatusInternalServerError},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			svc := &stubPropagator{result: service.PropagationResultSuccess}
-			handler := Propagate(svc)
+			sink := &stubDeadLetterSink{err: tt.sinkErr}
+			handler := Propagate(svc, WithDeadLetterSink(sink))
 			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
 			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("ce-id", "123")
 			rr := httptest.NewRecorder()
 			handler.ServeHTTP(rr, req)
 			if rr.Code != tt.want {
@@ -149,6 +172,12 @@ func TestPropagate_ParseErrors(t *testing.T) {
 			if svc.event != nil {
 				t.Fatalf("service should not be called on parse errors")
 			}
+			if sink.dl == nil {
+				t.Fatalf("dead letter not recorded")
+			}
+			if !bytes.Equal(sink.dl.Data, tt.body) || sink.dl.Attributes["ce-id"] != "123" {
+				t.Fatalf("unexpected dead letter: %+v", sink.dl)
+			}
 		})
 	}
 }
@@ -181,3 +210,167 @@ func TestPropagate_EventTimeHeader(t *testing.T) {
 		t.Fatalf("status = %d, want %d", rr.Code, http.StatusAccepted)
 	}
 }
+
+// stubDeduplicator is a test implementation of the Deduplicator interface.
+type stubDeduplicator struct {
+	seen map[string]bool
+}
+
+func (s *stubDeduplicator) IsDuplicate(ctx context.Context, scope, key string) bool {
+	return s.seen[scope+"/"+key]
+}
+
+func (s *stubDeduplicator) MarkProcessed(ctx context.Context, scope, key string) {
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	s.seen[scope+"/"+key] = true
+}
+
+func TestPropagate_Deduplication(t *testing.T) {
+	body := sampleCreateEvent(t)
+	dedup := &stubDeduplicator{}
+	svc := &stubPropagator{result: service.PropagationResultSuccess}
+	handler := Propagate(svc, WithDeduplicator(dedup))
+
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("ce-id", "123")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send(); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", code, http.StatusAccepted)
+	}
+	if !dedup.seen["propagate/123"] {
+		t.Fatalf("event not marked as processed")
+	}
+
+	svc.event = nil
+	if code := send(); code != http.StatusNoContent {
+		t.Fatalf("redelivery status = %d, want %d", code, http.StatusNoContent)
+	}
+	if svc.event != nil {
+		t.Fatalf("service should not be called for redeliveries")
+	}
+}
+
+func TestPropagateMessage(t *testing.T) {
+	body := sampleCreateEvent(t)
+	svc := &stubPropagator{result: service.PropagationResultSuccess}
+	h := PropagateMessage(svc)
+	msg := &model.Message{
+		ID: "1",
+		Attributes: map[string]string{
+			"content-type": "application/json",
+			"ce-id":        "123",
+			"ce-time":      time.Unix(10, 0).UTC().Format(time.RFC3339Nano),
+		},
+		Data: body,
+	}
+	if !h(context.Background(), msg) {
+		t.Fatalf("successful propagation not acknowledged")
+	}
+	if svc.event == nil || !svc.event.Timestamp.Equal(time.Unix(1, 0)) {
+		t.Fatalf("service called with %+v", svc.event)
+	}
+
+	svc.err = status.Error(codes.Unavailable, "unavailable")
+	if h(context.Background(), msg) {
+		t.Fatalf("transient failure acknowledged")
+	}
+}
+
+func TestPropagate_BodyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body func(w http.ResponseWriter) io.ReadCloser
+		want int
+	}{
+		{"read error", func(http.ResponseWriter) io.ReadCloser { return io.NopCloser(failingReader{errors.New("read error")}) }, http.StatusBadRequest},
+		{"too large", func(w http.ResponseWriter) io.ReadCloser {
+			return http.MaxBytesReader(w, io.NopCloser(bytes.NewReader(sampleCreateEvent(t))), 8)
+		}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &stubPropagator{result: service.PropagationResultSuccess}
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			req.Body = tt.body(rr)
+			Propagate(svc).ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if svc.event != nil {
+				t.Fatalf("service should not be called")
+			}
+		})
+	}
+}
+
+func TestPropagate_Timeout(t *testing.T) {
+	svc := &stubPropagator{err: fmt.Errorf("transaction: %w", context.DeadlineExceeded)}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(sampleCreateEvent(t)))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	Propagate(svc).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+type stubLimiter struct {
+	path     string
+	err      error
+	released bool
+}
+
+func (s *stubLimiter) Acquire(ctx context.Context, path string) (func(), error) {
+	s.path = path
+	if s.err != nil {
+		return nil, s.err
+	}
+	return func() { s.released = true }, nil
+}
+
+func TestPropagate_ConcurrencyLimit(t *testing.T) {
+	body := sampleCreateEvent(t)
+	tests := []struct {
+		name           string
+		err            error
+		want           int
+		wantRetryAfter string
+	}{
+		{"acquired", nil, http.StatusAccepted, ""},
+		{"shed", errors.New("limit reached"), http.StatusTooManyRequests, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &stubPropagator{result: service.PropagationResultSuccess}
+			limiter := &stubLimiter{err: tt.err}
+			handler := Propagate(svc, WithConcurrencyLimiter(limiter, 1500*time.Millisecond))
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if got := rr.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Fatalf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if limiter.path != "users/1" {
+				t.Fatalf("limited path = %q", limiter.path)
+			}
+			if (svc.event != nil) != (tt.err == nil) || limiter.released != (tt.err == nil) {
+				t.Fatalf("service called = %v, released = %v", svc.event != nil, limiter.released)
+			}
+		})
+	}
+}
@@ -2,18 +2,214 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/push"
 	"github.com/joaopenteado/firesync/internal/service"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Replicator interface {
-	Replicate(ctx context.Context) (service.ReplicationResult, error)
+	Replicate(ctx context.Context, msg *model.Message) (service.ReplicationResult, error)
 }
 
-func Replicate(svc Replicator) http.Handler {
+// pushRequest is the body of a Pub/Sub push request.
+// See https://cloud.google.com/pubsub/docs/push#receive_push
+type pushRequest struct {
+	Message struct {
+		Attributes  map[string]string `json:"attributes"`
+		Data        []byte            `json:"data"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// parsePushRequest parses a Pub/Sub push request. Subscriptions with payload
+// unwrapping enabled deliver the message data as the body and the attributes
+// as headers.
+func parsePushRequest(h http.Header, body []byte) (*model.Message, error) {
+	if id := h.Get("x-goog-pubsub-message-id"); id != "" {
+		msg := &model.Message{
+			ID:         id,
+			Attributes: make(map[string]string),
+			Data:       body,
+		}
+		if t, err := time.Parse(time.RFC3339Nano, h.Get("x-goog-pubsub-publish-time")); err == nil {
+			msg.PublishTime = t
+		}
+		for k, v := range h {
+			k = strings.ToLower(k)
+			if len(v) == 0 || strings.HasPrefix(k, "x-goog-") || k == "authorization" {
+				continue
+			}
+			msg.Attributes[k] = v[0]
+		}
+		return msg, nil
+	}
+
+	req := &pushRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal push request: %w", err)
+	}
+	if req.Message.MessageID == "" {
+		return nil, errors.New("push request without message ID")
+	}
+
+	return &model.Message{
+		ID:           req.Message.MessageID,
+		Attributes:   req.Message.Attributes,
+		Data:         req.Message.Data,
+		PublishTime:  req.Message.PublishTime,
+		Subscription: req.Subscription,
+	}, nil
+}
+
+func Replicate(svc Replicator, opts ...Option) http.Handler {
+	options := newOptions(opts...)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		w.WriteHeader(http.StatusOK)
+		ctx := r.Context()
+		logger := zerolog.Ctx(ctx)
+
+		body, ok := push.ReadBody(w, r)
+		if !ok {
+			return
+		}
+
+		msg, err := parsePushRequest(r.Header, body)
+		if err != nil {
+			logger.Err(err).Msg("failed to parse push request")
+			w.WriteHeader(options.deadLetter(ctx, &service.DeadLetter{
+				Reason: fmt.Sprintf("failed to parse push request: %v", err),
+				Class:  service.ErrorClassPermanent,
+				Data:   body,
+			}))
+			return
+		}
+
+		code, _ := replicate(ctx, svc, options, msg)
+		options.writeStatus(w, code)
 	})
 }
+
+// ReplicateMessage returns a MessageHandler replicating changes pulled from a
+// Pub/Sub subscription.
+func ReplicateMessage(svc Replicator, opts ...Option) MessageHandler {
+	options := newOptions(opts...)
+
+	return func(ctx context.Context, msg *model.Message) bool {
+		code, _ := replicate(ctx, svc, options, msg)
+		return push.Acknowledges(code)
+	}
+}
+
+// startReplicateSpan starts the consumer span of the replication of msg. It is
+// parented by the span that propagated the change, extracted from the message
+// attributes, so a single trace follows a change from its source region to
+// every target region. The span delivering the message, if any, is linked.
+func startReplicateSpan(ctx context.Context, msg *model.Message) (context.Context, trace.Span) {
+	delivery := trace.SpanContextFromContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Attributes))
+
+	attrs := []attribute.KeyValue{
+		semconv.MessagingSystemGCPPubSub,
+		semconv.MessagingOperationTypeProcess,
+		semconv.MessagingOperationName("replicate"),
+		semconv.MessagingMessageID(msg.ID),
+	}
+	name := "replicate"
+	if msg.Subscription != "" {
+		attrs = append(attrs,
+			semconv.MessagingDestinationName(msg.Subscription),
+			semconv.MessagingDestinationSubscriptionName(msg.Subscription),
+		)
+		name += " " + msg.Subscription
+	}
+
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	}
+	if delivery.IsValid() && !delivery.Equal(trace.SpanContextFromContext(ctx)) {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: delivery}))
+	}
+	return otel.Tracer("github.com/joaopenteado/firesync/internal/handler").Start(ctx, name, opts...)
+}
+
+// replicate replicates a change and returns the status code to reply with,
+// along with the cause of the failure if it did not succeed.
+func replicate(ctx context.Context, svc Replicator, options *options, msg *model.Message) (code int, err error) {
+	ctx, span := startReplicateSpan(ctx, msg)
+	defer func() {
+		if err != nil && !errors.Is(err, errPaused) {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+		span.End()
+	}()
+	logger := zerolog.Ctx(ctx)
+
+	if options.isDuplicate(ctx, dedupScopeReplicate, msg.ID) {
+		logger.Debug().Str("message_id", msg.ID).Msg("duplicate message, skipping")
+		return options.ackStatus(http.StatusNoContent), nil
+	}
+
+	release, err := options.acquire(ctx, msg.Attributes["document-path"])
+	if err != nil {
+		return http.StatusTooManyRequests, err
+	}
+	defer release()
+
+	result, err := svc.Replicate(ctx, msg)
+	if err != nil {
+		class := service.ClassifyError(err)
+		logger.Error().Err(err).
+			Stringer("error_class", class).
+			Msg("replication failed")
+
+		if class == service.ErrorClassPermanent {
+			return options.deadLetter(ctx, &service.DeadLetter{
+				Reason:     fmt.Sprintf("replication failed: %v", err),
+				Class:      class,
+				Attributes: msg.Attributes,
+				Data:       msg.Data,
+			}), err
+		}
+		return errorStatus(class), err
+	}
+
+	switch result {
+	case service.ReplicationResultSuccess:
+		options.markProcessed(ctx, dedupScopeReplicate, msg.ID)
+		return options.ackStatus(http.StatusAccepted), nil
+
+	case service.ReplicationResultSkipped:
+		options.markProcessed(ctx, dedupScopeReplicate, msg.ID)
+		return options.ackStatus(http.StatusNoContent), nil
+
+	case service.ReplicationResultPaused:
+		return http.StatusServiceUnavailable, errPaused
+
+	case service.ReplicationResultError:
+		logger.Error().Msg("replication failed")
+		return http.StatusInternalServerError, errors.New("replication failed")
+
+	default:
+		logger.Error().Stringer("result", result).Msg("unhandled replication result")
+		return http.StatusInternalServerError, fmt.Errorf("unhandled replication result %s", result)
+	}
+}
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stubReplicator is a test implementation of the Replicator interface.
+type stubReplicator struct {
+	result service.ReplicationResult
+	err    error
+	msg    *model.Message
+}
+
+func (s *stubReplicator) Replicate(ctx context.Context, msg *model.Message) (service.ReplicationResult, error) {
+	s.msg = msg
+	return s.result, s.err
+}
+
+func pushBody(t *testing.T, id string, attrs map[string]string, data []byte) []byte {
+	t.Helper()
+	req := &pushRequest{Subscription: "projects/p/subscriptions/s"}
+	req.Message.MessageID = id
+	req.Message.Attributes = attrs
+	req.Message.Data = data
+	req.Message.PublishTime = time.Unix(1, 0).UTC()
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return b
+}
+
+func TestParsePushRequest(t *testing.T) {
+	t.Run("wrapped", func(t *testing.T) {
+		body := pushBody(t, "42", map[string]string{"event-type": "created"}, []byte("data"))
+		msg, err := parsePushRequest(http.Header{}, body)
+		if err != nil {
+			t.Fatalf("parsePushRequest() unexpected error: %v", err)
+		}
+		if msg.ID != "42" || msg.Attributes["event-type"] != "created" || string(msg.Data) != "data" ||
+			!msg.PublishTime.Equal(time.Unix(1, 0)) || msg.Subscription != "projects/p/subscriptions/s" {
+			t.Fatalf("parsePushRequest() = %+v", msg)
+		}
+	})
+
+	t.Run("unwrapped", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("X-Goog-Pubsub-Message-Id", "42")
+		h.Set("X-Goog-Pubsub-Publish-Time", time.Unix(1, 0).UTC().Format(time.RFC3339Nano))
+		h.Set("Authorization", "Bearer tok")
+		h.Set("Event-Type", "created")
+		msg, err := parsePushRequest(h, []byte("data"))
+		if err != nil {
+			t.Fatalf("parsePushRequest() unexpected error: %v", err)
+		}
+		if msg.ID != "42" || string(msg.Data) != "data" || !msg.PublishTime.Equal(time.Unix(1, 0)) {
+			t.Fatalf("parsePushRequest() = %+v", msg)
+		}
+		if len(msg.Attributes) != 1 || msg.Attributes["event-type"] != "created" {
+			t.Fatalf("attributes = %v", msg.Attributes)
+		}
+	})
+
+	for name, body := range map[string][]byte{
+		"malformed":  []byte("{"),
+		"missing id": pushBody(t, "", nil, nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parsePushRequest(http.Header{}, body); err == nil {
+				t.Fatalf("parsePushRequest() expected error")
+			}
+		})
+	}
+}
+
+func TestReplicate_StatusCodes(t *testing.T) {
+	body := pushBody(t, "42", nil, nil)
+	tests := []struct {
+		name   string
+		result service.ReplicationResult
+		err    error
+		opts   []Option
+		want   int
+	}{
+		{"success", service.ReplicationResultSuccess, nil, nil, http.StatusAccepted},
+		{"success forced 200", service.ReplicationResultSuccess, nil, []Option{WithHTTP200Acknowledgement(true)}, http.StatusOK},
+		{"skipped", service.ReplicationResultSkipped, nil, nil, http.StatusNoContent},
+		{"error result", service.ReplicationResultError, nil, nil, http.StatusInternalServerError},
+		{"transient error", service.ReplicationResultError, status.Error(codes.Unavailable, "unavailable"), nil, http.StatusServiceUnavailable},
+		{"contention error", service.ReplicationResultError, status.Error(codes.Aborted, "aborted"), nil, http.StatusConflict},
+		{"permanent error", service.ReplicationResultError, &service.Error{Class: service.ErrorClassPermanent, Err: context.Canceled}, nil, http.StatusOK},
+		{"paused", service.ReplicationResultPaused, nil, nil, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &stubReplicator{result: tt.result, err: tt.err}
+			handler := Replicate(svc, tt.opts...)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if svc.msg == nil || svc.msg.ID != "42" {
+				t.Fatalf("service called with %+v", svc.msg)
+			}
+		})
+	}
+}
+
+func TestReplicate_ParseError(t *testing.T) {
+	svc := &stubReplicator{}
+	sink := &stubDeadLetterSink{}
+	handler := Replicate(svc, WithDeadLetterSink(sink))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{"))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if svc.msg != nil {
+		t.Fatalf("service should not be called on parse errors")
+	}
+	if sink.dl == nil || string(sink.dl.Data) != "{" {
+		t.Fatalf("unexpected dead letter: %+v", sink.dl)
+	}
+}
+
+func TestReplicate_Deduplication(t *testing.T) {
+	body := pushBody(t, "42", nil, nil)
+	dedup := &stubDeduplicator{}
+	svc := &stubReplicator{result: service.ReplicationResultSuccess}
+	handler := Replicate(svc, WithDeduplicator(dedup))
+
+	for i, want := range []int{http.StatusAccepted, http.StatusNoContent} {
+		svc.msg = nil
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		if rr.Code != want {
+			t.Fatalf("delivery %d: status = %d, want %d", i, rr.Code, want)
+		}
+		if (svc.msg != nil) != (i == 0) {
+			t.Fatalf("delivery %d: service called = %v", i, svc.msg != nil)
+		}
+	}
+}
+
+func TestReplicateMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  service.ReplicationResult
+		err     error
+		wantAck bool
+	}{
+		{"success", service.ReplicationResultSuccess, nil, true},
+		{"skipped", service.ReplicationResultSkipped, nil, true},
+		{"transient error", service.ReplicationResultError, status.Error(codes.Unavailable, "unavailable"), false},
+		{"permanent error", service.ReplicationResultError, &service.Error{Class: service.ErrorClassPermanent, Err: context.Canceled}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &stubReplicator{result: tt.result, err: tt.err}
+			h := ReplicateMessage(svc, WithHTTP200Acknowledgement(true))
+			if got := h(context.Background(), &model.Message{ID: "42"}); got != tt.wantAck {
+				t.Fatalf("ack = %v, want %v", got, tt.wantAck)
+			}
+		})
+	}
+}
+
+func TestReplicate_TraceContext(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevTP, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	// the change was propagated in the source region
+	producerCtx, producer := tp.Tracer("test").Start(context.Background(), "propagate")
+	member, _ := baggage.NewMember("tenant", "acme")
+	bag, _ := baggage.New(member)
+	attrs := map[string]string{}
+	otel.GetTextMapPropagator().Inject(baggage.ContextWithBaggage(producerCtx, bag), propagation.MapCarrier(attrs))
+	producer.End()
+
+	// and delivered to the target region by a push request
+	deliveryCtx, delivery := tp.Tracer("test").Start(context.Background(), "POST /v1/replicate")
+	var gotBaggage string
+	h := Replicate(replicatorFunc(func(ctx context.Context, msg *model.Message) (service.ReplicationResult, error) {
+		gotBaggage = baggage.FromContext(ctx).Member("tenant").Value()
+		return service.ReplicationResultSuccess, nil
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/v1/replicate", bytes.NewReader(pushBody(t, "42", attrs, nil))).WithContext(deliveryCtx)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	delivery.End()
+
+	var span sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.SpanKind() == trace.SpanKindConsumer {
+			span = s
+		}
+	}
+	if span == nil {
+		t.Fatalf("no consumer span recorded")
+	}
+	if span.Parent().SpanID() != producer.SpanContext().SpanID() || span.SpanContext().TraceID() != producer.SpanContext().TraceID() {
+		t.Fatalf("consumer span parent = %v, want the producer span %v", span.Parent(), producer.SpanContext())
+	}
+	if links := span.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != delivery.SpanContext().SpanID() {
+		t.Fatalf("consumer span links = %v, want the delivery span", links)
+	}
+	if gotBaggage != "acme" {
+		t.Fatalf("baggage tenant = %q, want acme", gotBaggage)
+	}
+
+	want := map[attribute.Key]string{
+		semconv.MessagingSystemKey:                      "gcp_pubsub",
+		semconv.MessagingMessageIDKey:                   "42",
+		semconv.MessagingDestinationNameKey:             "projects/p/subscriptions/s",
+		semconv.MessagingDestinationSubscriptionNameKey: "projects/p/subscriptions/s",
+	}
+	got := make(map[attribute.Key]string)
+	for _, kv := range span.Attributes() {
+		got[kv.Key] = kv.Value.Emit()
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("attribute %s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+type replicatorFunc func(ctx context.Context, msg *model.Message) (service.ReplicationResult, error)
+
+func (f replicatorFunc) Replicate(ctx context.Context, msg *model.Message) (service.ReplicationResult, error) {
+	return f(ctx, msg)
+}
+
+func TestReplicate_ConcurrencyLimit(t *testing.T) {
+	body := pushBody(t, "42", map[string]string{"document-path": "users/1"}, nil)
+	svc := &stubReplicator{result: service.ReplicationResultSuccess}
+	limiter := &stubLimiter{err: errors.New("limit reached")}
+	handler := Replicate(svc, WithConcurrencyLimiter(limiter, time.Second))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("status = %d, Retry-After = %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if limiter.path != "users/1" || svc.msg != nil {
+		t.Fatalf("limited path = %q, service called = %v", limiter.path, svc.msg != nil)
+	}
+}
@@ -0,0 +1,44 @@
+package health
+
+import (
+	"context"
+	"errors"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+	"github.com/joaopenteado/firesync/internal/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FirestoreChecker probes the database by reading a document that usually
+// doesn't exist, which is the cheapest round trip available.
+func FirestoreChecker(db *firestore.Client) Checker {
+	return CheckerFunc("firestore", func(ctx context.Context) error {
+		_, err := db.Collection(model.InternalCollectionPrefix + "health").Doc("probe").Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// PubSubTopicChecker probes that topic exists and can be reached. Checking
+// that it exists requires the pubsub.topics.get permission, which
+// roles/pubsub.publisher lacks; a permission denied error still proves Cloud
+// Pub/Sub can be reached, so it passes.
+func PubSubTopicChecker(topic *pubsub.Topic) Checker {
+	return CheckerFunc("pubsub", func(ctx context.Context) error {
+		ok, err := topic.Exists(ctx)
+		if status.Code(err) == codes.PermissionDenied {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("topic " + topic.String() + " not found")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+package health
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func newTestClient(t *testing.T, opts ...pstest.ServerReactorOption) *pubsub.Client {
+	t.Helper()
+	srv := pstest.NewServer(opts...)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	client, err := pubsub.NewClient(context.Background(), "p", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestPubSubTopicChecker(t *testing.T) {
+	ctx := context.Background()
+
+	client := newTestClient(t)
+	checker := PubSubTopicChecker(client.Topic("firesync"))
+	if err := checker.Check(ctx); err == nil {
+		t.Fatalf("expected error for a missing topic")
+	}
+	if _, err := client.CreateTopic(ctx, "firesync"); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	if err := checker.Check(ctx); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	// publishers without pubsub.topics.get are ready
+	denied := newTestClient(t, pstest.WithErrorInjection("GetTopic", codes.PermissionDenied, "denied"))
+	if err := PubSubTopicChecker(denied.Topic("firesync")).Check(ctx); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	invalid := newTestClient(t, pstest.WithErrorInjection("GetTopic", codes.InvalidArgument, "invalid"))
+	if err := PubSubTopicChecker(invalid.Topic("firesync")).Check(ctx); err == nil {
+		t.Fatalf("expected error for an invalid request")
+	}
+}
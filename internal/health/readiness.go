@@ -0,0 +1,215 @@
+// Package health reports whether the service is ready to receive traffic.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultCheckTimeout bounds how long a single checker may take.
+const DefaultCheckTimeout = 2 * time.Second
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusShutdown    = "shutting_down"
+)
+
+// Checker probes a dependency of the service.
+type Checker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type funcChecker struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func (c funcChecker) Name() string                    { return c.name }
+func (c funcChecker) Check(ctx context.Context) error { return c.check(ctx) }
+
+// CheckerFunc returns a Checker named name that runs check.
+func CheckerFunc(name string, check func(ctx context.Context) error) Checker {
+	return funcChecker{name: name, check: check}
+}
+
+// CheckResult is the status of a single dependency.
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the body of a readiness response.
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Readiness is an http.Handler reporting whether every checker succeeds.
+// Results are cached for a short time, so frequent probes don't hammer the
+// dependencies.
+type Readiness struct {
+	checkers []Checker
+	cacheTTL time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+
+	shuttingDown atomic.Bool
+
+	checking singleflight.Group
+
+	mu        sync.Mutex
+	report    *Report
+	checkedAt time.Time
+}
+
+func NewReadiness(cacheTTL time.Duration, checkers ...Checker) *Readiness {
+	return &Readiness{
+		checkers: checkers,
+		cacheTTL: cacheTTL,
+		timeout:  DefaultCheckTimeout,
+		now:      time.Now,
+	}
+}
+
+// Shutdown marks the service as not ready, so load balancers stop routing new
+// requests to it while it drains.
+func (r *Readiness) Shutdown() {
+	r.shuttingDown.Store(true)
+}
+
+// Drain marks the service as not ready and waits for delay while requests are
+// still served, so probes see it as not ready and load balancers stop routing
+// to it before the server stops accepting connections. It returns early with
+// the context's error if ctx is done first.
+func (r *Readiness) Drain(ctx context.Context, delay time.Duration) error {
+	r.Shutdown()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check runs the checkers, or returns the cached report if it is recent
+// enough. Concurrent callers share a single run, which is detached from their
+// contexts, so a caller giving up doesn't fail the report of the others; it
+// gets an unavailable report instead.
+func (r *Readiness) Check(ctx context.Context) *Report {
+	if r.shuttingDown.Load() {
+		return &Report{Status: StatusShutdown}
+	}
+
+	r.mu.Lock()
+	if r.report != nil && r.now().Sub(r.checkedAt) < r.cacheTTL {
+		report := r.report
+		r.mu.Unlock()
+		return report
+	}
+	r.mu.Unlock()
+
+	ch := r.checking.DoChan("check", func() (any, error) {
+		report, cacheable := r.run(context.WithoutCancel(ctx))
+		if cacheable {
+			r.mu.Lock()
+			r.report = report
+			r.checkedAt = r.now()
+			r.mu.Unlock()
+		}
+		return report, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(*Report)
+	case <-ctx.Done():
+		return &Report{Status: StatusUnavailable}
+	}
+}
+
+// run runs every checker, and reports whether the report may be cached: a
+// checker running out of time says nothing about the dependency for the next
+// probes.
+func (r *Readiness) run(ctx context.Context) (*Report, bool) {
+	report := &Report{
+		Status: StatusOK,
+		Checks: make(map[string]CheckResult, len(r.checkers)),
+	}
+	cacheable := true
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, c := range r.checkers {
+		wg.Add(1)
+		go func(c Checker) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, r.timeout)
+			defer cancel()
+
+			result := CheckResult{Status: StatusOK}
+			err := c.Check(ctx)
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).
+					Str("checker", c.Name()).
+					Msg("readiness check failed")
+				result = CheckResult{Status: StatusUnavailable, Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.Name()] = result
+			if result.Status != StatusOK {
+				report.Status = StatusUnavailable
+			}
+			if isContextError(err) {
+				cacheable = false
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return report, cacheable
+}
+
+func isContextError(err error) bool {
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded:
+		return true
+	}
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Check(req.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		zerolog.Ctx(req.Context()).Err(err).Msg("failed to write readiness report")
+	}
+}
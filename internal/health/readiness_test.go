@@ -0,0 +1,146 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness_ServeHTTP(t *testing.T) {
+	var calls int
+	fsErr := error(nil)
+	now := time.Unix(0, 0)
+
+	r := NewReadiness(5*time.Second,
+		CheckerFunc("firestore", func(context.Context) error { calls++; return fsErr }),
+		CheckerFunc("pubsub", func(context.Context) error { return nil }),
+	)
+	r.now = func() time.Time { return now }
+
+	probe := func() (int, Report) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var report Report
+		if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+			t.Fatalf("json.Decode: %v", err)
+		}
+		return rr.Code, report
+	}
+
+	code, report := probe()
+	if code != http.StatusOK || report.Status != StatusOK || report.Checks["pubsub"].Status != StatusOK {
+		t.Fatalf("probe = %d %+v, want ready", code, report)
+	}
+
+	// cached
+	fsErr = errors.New("unreachable")
+	if code, _ := probe(); code != http.StatusOK || calls != 1 {
+		t.Fatalf("probe = %d after %d calls, want cached result", code, calls)
+	}
+
+	now = now.Add(5 * time.Second)
+	code, report = probe()
+	if code != http.StatusServiceUnavailable || report.Status != StatusUnavailable {
+		t.Fatalf("probe = %d %+v, want unavailable", code, report)
+	}
+	if got := report.Checks["firestore"]; got.Status != StatusUnavailable || got.Error != "unreachable" {
+		t.Fatalf("firestore check = %+v", got)
+	}
+	if got := report.Checks["pubsub"]; got.Status != StatusOK {
+		t.Fatalf("pubsub check = %+v", got)
+	}
+
+	fsErr = nil
+	now = now.Add(5 * time.Second)
+	r.Shutdown()
+	code, report = probe()
+	if code != http.StatusServiceUnavailable || report.Status != StatusShutdown {
+		t.Fatalf("probe = %d %+v, want shutting down", code, report)
+	}
+}
+
+func TestReadiness_CheckTimeout(t *testing.T) {
+	var calls int
+	slow := true
+	r := NewReadiness(time.Minute, CheckerFunc("slow", func(ctx context.Context) error {
+		calls++
+		if !slow {
+			return nil
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	r.timeout = time.Millisecond
+
+	if report := r.Check(context.Background()); report.Status != StatusUnavailable {
+		t.Fatalf("Check() = %+v, want unavailable", report)
+	}
+
+	// timeouts aren't cached
+	slow = false
+	if report := r.Check(context.Background()); report.Status != StatusOK || calls != 2 {
+		t.Fatalf("Check() = %+v after %d calls, want ok", report, calls)
+	}
+}
+
+func TestReadiness_CheckCanceled(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var checkErr error
+	r := NewReadiness(time.Minute, CheckerFunc("firestore", func(ctx context.Context) error {
+		close(started)
+		<-release
+		checkErr = ctx.Err()
+		return checkErr
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *Report)
+	go func() { done <- r.Check(ctx) }()
+	<-started
+	cancel()
+	if report := <-done; report.Status != StatusUnavailable {
+		t.Fatalf("Check() = %+v, want unavailable", report)
+	}
+
+	// the probe outlives the canceled caller and its report is cached
+	close(release)
+	report := r.Check(context.Background())
+	if report.Status != StatusOK || checkErr != nil {
+		t.Fatalf("Check() = %+v, checker error %v, want ok", report, checkErr)
+	}
+}
+
+func TestReadiness_Drain(t *testing.T) {
+	r := NewReadiness(0, CheckerFunc("firestore", func(context.Context) error { return nil }))
+
+	done := make(chan error)
+	go func() { done <- r.Drain(context.Background(), 50*time.Millisecond) }()
+
+	// probes see the service as not ready while it is still serving
+	deadline := time.Now().Add(time.Second)
+	for r.Check(context.Background()).Status != StatusShutdown {
+		if time.Now().After(deadline) {
+			t.Fatalf("service still ready while draining")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Drain() returned %v before the delay", err)
+	default:
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Drain() unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Drain(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Drain() error = %v, want %v", err, context.Canceled)
+	}
+}
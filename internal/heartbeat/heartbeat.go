@@ -0,0 +1,212 @@
+// Package heartbeat measures end-to-end replication lag, even without user
+// writes.
+//
+// Every region periodically writes its heartbeat document, which is
+// propagated and replicated like any other document. Every region also reads
+// the heartbeats replicated from the others, recording how old they are. A
+// stalled pipeline shows up as heartbeats that keep getting older.
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/api/iterator"
+)
+
+// Heartbeat is the document a region writes periodically.
+type Heartbeat struct {
+	// Timestamp is when the heartbeat was written in the source region.
+	Timestamp time.Time `firestore:"ts"`
+
+	// Source is the database of the region that wrote the heartbeat
+	// (e.g. projects/$ID/databases/$DB)
+	Source string `firestore:"src"`
+}
+
+// Store reads and writes heartbeats.
+type Store interface {
+	// Write writes the heartbeat of its source region.
+	Write(ctx context.Context, hb *Heartbeat) error
+
+	// ReadAll reads the heartbeats of every region, as replicated so far.
+	ReadAll(ctx context.Context) ([]*Heartbeat, error)
+}
+
+type firestoreStore struct {
+	coll *firestore.CollectionRef
+}
+
+// NewFirestoreStore returns a Store keeping heartbeats in the
+// _firesync_heartbeat collection of db.
+func NewFirestoreStore(db *firestore.Client) Store {
+	return &firestoreStore{coll: db.Collection(model.HeartbeatCollection)}
+}
+
+func (s *firestoreStore) Write(ctx context.Context, hb *Heartbeat) error {
+	_, err := s.coll.Doc(DocumentID(hb.Source)).Set(ctx, hb)
+	return err
+}
+
+func (s *firestoreStore) ReadAll(ctx context.Context) ([]*Heartbeat, error) {
+	var heartbeats []*Heartbeat
+	it := s.coll.Documents(ctx)
+	defer it.Stop()
+	for {
+		snap, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return heartbeats, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		hb := &Heartbeat{}
+		if err := snap.DataTo(hb); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal heartbeat %s: %w", snap.Ref.ID, err)
+		}
+		heartbeats = append(heartbeats, hb)
+	}
+}
+
+// DocumentID returns the ID of the heartbeat document of a source database,
+// {project}:{database}.
+func DocumentID(source string) string {
+	projectID, databaseID, err := model.ParseDatabaseName(source)
+	if err != nil {
+		return source
+	}
+	return projectID + ":" + databaseID
+}
+
+type heartbeatMetrics struct {
+	HeartbeatAge metric.Float64ObservableGauge
+}
+
+func newHeartbeatMetrics(meter metric.Meter, h *Heartbeater) heartbeatMetrics {
+	HeartbeatAge, err := meter.Float64ObservableGauge("firesync.replication.heartbeat_age",
+		metric.WithDescription("The age of the latest heartbeat replicated from the source database to the target database. It grows past the heartbeat interval when replication stalls."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.replication.heartbeat_age").
+			Msg("failed to create metric")
+	}
+
+	// the callback is registered apart from the gauge, which the heartbeaters
+	// of every served database share
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		for source, age := range h.ages() {
+			o.ObserveFloat64(HeartbeatAge, age.Seconds(), metric.WithAttributes(
+				attribute.String("source", source),
+				attribute.String("target", h.source),
+			))
+		}
+		return nil
+	}, HeartbeatAge)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.replication.heartbeat_age").
+			Msg("failed to register metric callback")
+	}
+
+	return heartbeatMetrics{
+		HeartbeatAge: HeartbeatAge,
+	}
+}
+
+// Heartbeater writes the heartbeat of the local region and monitors the
+// heartbeats replicated from the others.
+type Heartbeater struct {
+	store    Store
+	source   string
+	interval time.Duration
+	now      func() time.Time
+	metrics  heartbeatMetrics
+
+	mu       sync.Mutex
+	received map[string]time.Time
+}
+
+// New returns a Heartbeater for the region of the source database. Every
+// instance writes the heartbeat, which is harmless: the latest write wins.
+func New(store Store, source string, interval time.Duration, meter metric.Meter) *Heartbeater {
+	h := &Heartbeater{
+		store:    store,
+		source:   source,
+		interval: interval,
+		now:      time.Now,
+		received: make(map[string]time.Time),
+	}
+	h.metrics = newHeartbeatMetrics(meter, h)
+	return h
+}
+
+// Run writes and reads heartbeats every interval until ctx is canceled.
+// Failures are logged and retried on the next tick.
+func (h *Heartbeater) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.tick(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Heartbeater) tick(ctx context.Context) {
+	logger := zerolog.Ctx(ctx)
+
+	if err := h.store.Write(ctx, &Heartbeat{Timestamp: h.now(), Source: h.source}); err != nil {
+		logger.Warn().Err(err).Msg("failed to write heartbeat")
+	}
+
+	heartbeats, err := h.store.ReadAll(ctx)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to read heartbeats")
+		return
+	}
+	h.observe(heartbeats)
+}
+
+// observe records the latest heartbeats replicated from other regions.
+func (h *Heartbeater) observe(heartbeats []*Heartbeat) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, hb := range heartbeats {
+		if hb.Source == h.source || hb.Source == "" {
+			continue
+		}
+		if hb.Timestamp.After(h.received[hb.Source]) {
+			h.received[hb.Source] = hb.Timestamp
+		}
+	}
+}
+
+// ages returns the age of the latest heartbeat from each source region.
+func (h *Heartbeater) ages() map[string]time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	ages := make(map[string]time.Duration, len(h.received))
+	for source, ts := range h.received {
+		ages[source] = now.Sub(ts)
+	}
+	return ages
+}
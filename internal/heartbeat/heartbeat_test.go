@@ -0,0 +1,131 @@
+package heartbeat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+type memoryStore struct {
+	heartbeats map[string]*Heartbeat
+}
+
+func (s *memoryStore) Write(ctx context.Context, hb *Heartbeat) error {
+	s.heartbeats[DocumentID(hb.Source)] = hb
+	return nil
+}
+
+func (s *memoryStore) ReadAll(ctx context.Context) ([]*Heartbeat, error) {
+	heartbeats := make([]*Heartbeat, 0, len(s.heartbeats))
+	for _, hb := range s.heartbeats {
+		heartbeats = append(heartbeats, hb)
+	}
+	return heartbeats, nil
+}
+
+// collectAges returns the heartbeat ages recorded by reader, by
+// source->target.
+func collectAges(t *testing.T, reader sdkmetric.Reader) map[string]float64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Collect() unexpected error: %v", err)
+	}
+	ages := make(map[string]float64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "firesync.replication.heartbeat_age" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Gauge[float64]).DataPoints {
+				source, _ := dp.Attributes.Value(attribute.Key("source"))
+				target, _ := dp.Attributes.Value(attribute.Key("target"))
+				ages[source.AsString()+"->"+target.AsString()] = dp.Value
+			}
+		}
+	}
+	return ages
+}
+
+func TestDocumentID(t *testing.T) {
+	if got := DocumentID("projects/p/databases/(default)"); got != "p:(default)" {
+		t.Fatalf("DocumentID() = %q", got)
+	}
+}
+
+func TestHeartbeater(t *testing.T) {
+	const (
+		local  = "projects/p/databases/a"
+		remote = "projects/p/databases/b"
+	)
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	now := time.Unix(1000, 0)
+	store := &memoryStore{heartbeats: map[string]*Heartbeat{
+		DocumentID(remote): {Timestamp: now.Add(-5 * time.Second), Source: remote},
+	}}
+	h := New(store, local, time.Minute, meter)
+	h.now = func() time.Time { return now }
+
+	h.tick(context.Background())
+
+	if hb := store.heartbeats[DocumentID(local)]; hb == nil || !hb.Timestamp.Equal(now) {
+		t.Fatalf("local heartbeat = %+v, want written now", hb)
+	}
+
+	ages := func() map[string]float64 {
+		t.Helper()
+		return collectAges(t, reader)
+	}
+
+	got := ages()
+	if len(got) != 1 || got[remote+"->"+local] != 5 {
+		t.Fatalf("heartbeat ages = %v, want 5s from the remote region only", got)
+	}
+
+	// without new heartbeats, the age keeps growing
+	now = now.Add(time.Minute)
+	if got := ages(); got[remote+"->"+local] != 65 {
+		t.Fatalf("heartbeat ages = %v, want 65s", got)
+	}
+
+	// an older heartbeat, e.g. from a lagging read, doesn't reset the age
+	store.heartbeats[DocumentID(remote)] = &Heartbeat{Timestamp: now.Add(-2 * time.Minute), Source: remote}
+	h.tick(context.Background())
+	if got := ages(); got[remote+"->"+local] != 65 {
+		t.Fatalf("heartbeat ages = %v, want 65s", got)
+	}
+}
+
+func TestHeartbeater_ServedDatabases(t *testing.T) {
+	const (
+		primary = "projects/p/databases/a"
+		pooled  = "projects/p/databases/c"
+		remote  = "projects/q/databases/a"
+	)
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	// every served database runs its own heartbeater on the same meter
+	now := time.Unix(1000, 0)
+	for i, database := range []string{primary, pooled} {
+		store := &memoryStore{heartbeats: map[string]*Heartbeat{
+			DocumentID(remote): {Timestamp: now.Add(-time.Duration(i+1) * time.Second), Source: remote},
+		}}
+		h := New(store, database, time.Minute, meter)
+		h.now = func() time.Time { return now }
+		h.tick(context.Background())
+	}
+
+	got := collectAges(t, reader)
+	if len(got) != 2 || got[remote+"->"+primary] != 1 || got[remote+"->"+pooled] != 2 {
+		t.Fatalf("heartbeat ages = %v, want one per served database", got)
+	}
+}
@@ -0,0 +1,212 @@
+// Package limiter bounds the number of requests processed concurrently,
+// globally and per document, shedding the excess instead of piling up
+// contending Firestore transactions.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+var (
+	// ErrGlobalLimit is returned when the global in-flight limit is reached.
+	ErrGlobalLimit = errors.New("global concurrency limit reached")
+
+	// ErrDocumentLimit is returned when the in-flight limit of a document is
+	// reached.
+	ErrDocumentLimit = errors.New("document concurrency limit reached")
+)
+
+// DefaultShards is the default number of document shards. Documents whose
+// path hashes to the same shard share its limit.
+const DefaultShards = 1024
+
+type Config struct {
+	// Global is the maximum number of requests in flight. Zero disables the
+	// global limit.
+	Global int
+
+	// PerDocument is the maximum number of requests in flight per document
+	// shard. Zero disables the per document limit.
+	PerDocument int
+
+	// Shards is the number of document shards. Defaults to DefaultShards.
+	Shards int
+
+	// QueueTimeout is how long a request waits for a slot before being shed.
+	// Zero sheds requests over the limit right away.
+	QueueTimeout time.Duration
+}
+
+type limiterMetrics struct {
+	InFlight   metric.Int64UpDownCounter
+	QueueDepth metric.Int64UpDownCounter
+	ShedCount  metric.Int64Counter
+}
+
+func newLimiterMetrics(meter metric.Meter) limiterMetrics {
+	InFlight, err := meter.Int64UpDownCounter("firesync.concurrency.in_flight",
+		metric.WithDescription("The number of requests being processed."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.concurrency.in_flight").
+			Msg("failed to create metric")
+		InFlight = noop.Int64UpDownCounter{}
+	}
+
+	QueueDepth, err := meter.Int64UpDownCounter("firesync.concurrency.queue_depth",
+		metric.WithDescription("The number of requests waiting for a concurrency slot."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.concurrency.queue_depth").
+			Msg("failed to create metric")
+		QueueDepth = noop.Int64UpDownCounter{}
+	}
+
+	ShedCount, err := meter.Int64Counter("firesync.concurrency.shed_count",
+		metric.WithDescription("The total number of requests rejected for exceeding a concurrency limit."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.concurrency.shed_count").
+			Msg("failed to create metric")
+		ShedCount = noop.Int64Counter{}
+	}
+
+	return limiterMetrics{
+		InFlight:   InFlight,
+		QueueDepth: QueueDepth,
+		ShedCount:  ShedCount,
+	}
+}
+
+// semaphore is a counting semaphore. A nil semaphore is unlimited.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+type Limiter struct {
+	global       semaphore
+	documents    []semaphore
+	queueTimeout time.Duration
+	metrics      limiterMetrics
+}
+
+func New(cfg Config, meter metric.Meter) *Limiter {
+	l := &Limiter{
+		global:       newSemaphore(cfg.Global),
+		queueTimeout: cfg.QueueTimeout,
+		metrics:      newLimiterMetrics(meter),
+	}
+
+	if cfg.PerDocument > 0 {
+		shards := cfg.Shards
+		if shards <= 0 {
+			shards = DefaultShards
+		}
+		l.documents = make([]semaphore, shards)
+		for i := range l.documents {
+			l.documents[i] = newSemaphore(cfg.PerDocument)
+		}
+	}
+
+	return l
+}
+
+func (l *Limiter) document(path string) semaphore {
+	if l.documents == nil {
+		return nil
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(path))
+	return l.documents[h.Sum32()%uint32(len(l.documents))]
+}
+
+// acquire takes a slot of s, waiting until done is closed at most.
+func (l *Limiter) acquire(ctx context.Context, s semaphore, done <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+
+	l.metrics.QueueDepth.Add(ctx, 1)
+	defer l.metrics.QueueDepth.Add(ctx, -1)
+
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Acquire takes a slot for processing the document at path, waiting up to
+// the queue timeout for one to free up. It returns ErrDocumentLimit or
+// ErrGlobalLimit if the request should be shed, otherwise the returned
+// function must be called once processing is done.
+func (l *Limiter) Acquire(ctx context.Context, path string) (release func(), err error) {
+	done := make(chan struct{})
+	if l.queueTimeout > 0 {
+		timer := time.AfterFunc(l.queueTimeout, func() { close(done) })
+		defer timer.Stop()
+	} else {
+		close(done)
+	}
+
+	// take the document slot first, so requests contending for the same
+	// document don't hold global slots while they wait
+	doc := l.document(path)
+	if !l.acquire(ctx, doc, done) {
+		l.shed(ctx, "document")
+		return nil, ErrDocumentLimit
+	}
+
+	if !l.acquire(ctx, l.global, done) {
+		doc.release()
+		l.shed(ctx, "global")
+		return nil, ErrGlobalLimit
+	}
+
+	l.metrics.InFlight.Add(ctx, 1)
+	return func() {
+		l.metrics.InFlight.Add(ctx, -1)
+		l.global.release()
+		doc.release()
+	}, nil
+}
+
+func (l *Limiter) shed(ctx context.Context, limit string) {
+	l.metrics.ShedCount.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("limit", limit),
+	))
+}
@@ -0,0 +1,87 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+func TestLimiter_Global(t *testing.T) {
+	ctx := context.Background()
+	l := New(Config{Global: 2}, noop.Meter{})
+
+	r1, err := l.Acquire(ctx, "users/1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	r2, err := l.Acquire(ctx, "users/2")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := l.Acquire(ctx, "users/3"); !errors.Is(err, ErrGlobalLimit) {
+		t.Fatalf("Acquire() error = %v, want %v", err, ErrGlobalLimit)
+	}
+
+	r1()
+	r3, err := l.Acquire(ctx, "users/3")
+	if err != nil {
+		t.Fatalf("Acquire after release: %v", err)
+	}
+	r2()
+	r3()
+}
+
+func TestLimiter_PerDocument(t *testing.T) {
+	ctx := context.Background()
+	l := New(Config{PerDocument: 1, Shards: 1 << 16}, noop.Meter{})
+
+	release, err := l.Acquire(ctx, "users/1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := l.Acquire(ctx, "users/1"); !errors.Is(err, ErrDocumentLimit) {
+		t.Fatalf("Acquire() error = %v, want %v", err, ErrDocumentLimit)
+	}
+	other, err := l.Acquire(ctx, "users/2")
+	if err != nil {
+		t.Fatalf("Acquire(other document): %v", err)
+	}
+	other()
+	release()
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	ctx := context.Background()
+	l := New(Config{Global: 1, QueueTimeout: time.Second}, noop.Meter{})
+
+	release, err := l.Acquire(ctx, "users/1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	// a slot freed up while queued is taken
+	time.AfterFunc(10*time.Millisecond, release)
+	queued, err := l.Acquire(ctx, "users/2")
+	if err != nil {
+		t.Fatalf("queued Acquire: %v", err)
+	}
+
+	// otherwise the request is shed once the timeout expires
+	l.queueTimeout = 10 * time.Millisecond
+	if _, err := l.Acquire(ctx, "users/3"); !errors.Is(err, ErrGlobalLimit) {
+		t.Fatalf("Acquire() error = %v, want %v", err, ErrGlobalLimit)
+	}
+	queued()
+}
+
+func TestLimiter_Unlimited(t *testing.T) {
+	l := New(Config{}, noop.Meter{})
+	for i := 0; i < 100; i++ {
+		if _, err := l.Acquire(context.Background(), "users/1"); err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+	}
+}
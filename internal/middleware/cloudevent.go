@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"mime"
 	"net/http"
 
 	"github.com/rs/zerolog"
@@ -9,7 +10,28 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
+// CloudEvent returns a middleware that enriches the request's logger and span
+// with the attributes of the CloudEvent it carries. Binary mode requests are
+// passed through. Structured mode requests are converted to binary mode, and
+// each event of a batched mode request is passed to next as a binary mode
+// request of its own. See https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/http-protocol-binding.md
 func CloudEvent(next http.Handler) http.Handler {
+	next = enrichCloudEvent(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case structuredContentType:
+			serveStructured(next, w, r)
+		case batchContentType:
+			serveBatch(next, w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func enrichCloudEvent(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		ceDict := zerolog.Dict()
@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/joaopenteado/firesync/internal/push"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	structuredContentType = "application/cloudevents+json"
+	batchContentType      = "application/cloudevents-batch+json"
+)
+
+// binaryEvent is a CloudEvent in binary mode.
+type binaryEvent struct {
+	header http.Header
+	data   []byte
+}
+
+// parseStructuredEvent converts a structured mode CloudEvent to binary mode.
+func parseStructuredEvent(raw []byte) (*binaryEvent, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cloudevent: %w", err)
+	}
+
+	event := &binaryEvent{header: make(http.Header)}
+	for name, value := range fields {
+		if name == "data" || name == "data_base64" {
+			continue
+		}
+
+		var attr interface{}
+		if err := json.Unmarshal(value, &attr); err != nil {
+			return nil, fmt.Errorf("invalid cloudevent attribute %q: %w", name, err)
+		}
+		switch v := attr.(type) {
+		case string:
+			event.header.Set("ce-"+name, v)
+		case bool:
+			event.header.Set("ce-"+name, strconv.FormatBool(v))
+		case float64:
+			event.header.Set("ce-"+name, strconv.FormatFloat(v, 'f', -1, 64))
+		case nil:
+		default:
+			return nil, fmt.Errorf("invalid cloudevent attribute %q: unsupported type %T", name, v)
+		}
+	}
+
+	for _, name := range []string{"id", "source", "specversion", "type"} {
+		if event.header.Get("ce-"+name) == "" {
+			return nil, fmt.Errorf("missing required cloudevent attribute %q", name)
+		}
+	}
+
+	contentType := event.header.Get("ce-datacontenttype")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	event.header.Set("Content-Type", contentType)
+
+	if data, ok := fields["data_base64"]; ok {
+		var encoded string
+		if err := json.Unmarshal(data, &encoded); err != nil {
+			return nil, fmt.Errorf("invalid cloudevent data_base64: %w", err)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cloudevent data_base64: %w", err)
+		}
+		event.data = decoded
+	} else if data, ok := fields["data"]; ok {
+		event.data = data
+
+		// non JSON data is encoded as a JSON string
+		if !isJSONMediaType(contentType) {
+			var s string
+			if err := json.Unmarshal(data, &s); err != nil {
+				return nil, fmt.Errorf("invalid cloudevent data for %s: %w", contentType, err)
+			}
+			event.data = []byte(s)
+		}
+	}
+
+	return event, nil
+}
+
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// binaryRequest returns a copy of r carrying event in binary mode.
+func binaryRequest(r *http.Request, event *binaryEvent) *http.Request {
+	req := r.Clone(r.Context())
+	for k, v := range event.header {
+		req.Header[k] = v
+	}
+	req.Body = io.NopCloser(bytes.NewReader(event.data))
+	req.ContentLength = int64(len(event.data))
+	return req
+}
+
+func serveStructured(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	body, ok := push.ReadBody(w, r)
+	if !ok {
+		return
+	}
+
+	event, err := parseStructuredEvent(body)
+	if err != nil {
+		// leave it to the handler, which dead-letters unsupported requests
+		zerolog.Ctx(r.Context()).Warn().Err(err).Msg("failed to parse structured cloudevent")
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	next.ServeHTTP(w, binaryRequest(r, event))
+}
+
+// batchResponseWriter records the response to a single event of a batch.
+type batchResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *batchResponseWriter) Header() http.Header { return w.header }
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *batchResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// serveBatch passes each event of a batched mode request to next. The batch
+// is acknowledged only if every event is, otherwise it is answered with the
+// status of the first failed event so the whole batch is retried: a push
+// request carries a single Pub/Sub message, so there is no way to report the
+// status of each event.
+//
+// Redeliveries rely on deduplication (DEDUP_STORE) to skip the events that
+// were already processed. Without it they are processed again, which
+// last-writer-wins keeps correct but repeats their Firestore transactions and
+// may publish them again.
+func serveBatch(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := zerolog.Ctx(ctx)
+
+	body, ok := push.ReadBody(w, r)
+	if !ok {
+		return
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal(body, &raws); err != nil {
+		logger.Warn().Err(err).Msg("failed to parse cloudevent batch")
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer("github.com/joaopenteado/firesync/internal/middleware")
+
+	var (
+		failed *batchResponseWriter
+		code   int
+	)
+	for i, raw := range raws {
+		rw := &batchResponseWriter{header: make(http.Header)}
+
+		event, err := parseStructuredEvent(raw)
+		if err != nil {
+			logger.Warn().Err(err).Int("batch_index", i).Msg("failed to parse batched cloudevent")
+			// pass it through as is, so the handler dead-letters it
+			event = &binaryEvent{
+				header: http.Header{"Content-Type": []string{structuredContentType}},
+				data:   raw,
+			}
+		}
+
+		eventCtx, span := tracer.Start(ctx, "cloudevent")
+		next.ServeHTTP(rw, binaryRequest(r.WithContext(eventCtx), event))
+		span.End()
+
+		if rw.code == 0 {
+			rw.code = http.StatusOK
+		}
+		if !push.Acknowledges(rw.code) {
+			if failed == nil {
+				failed = rw
+			}
+			continue
+		}
+		if code == 0 {
+			code = rw.code
+		} else if rw.code != code {
+			code = http.StatusOK
+		}
+	}
+
+	if failed != nil {
+		if retryAfter := failed.header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(failed.code)
+		return
+	}
+	if code == 0 {
+		code = http.StatusOK // empty batch
+	}
+	w.WriteHeader(code)
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/auth"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// UnaryLogger is the gRPC counterpart of Logger, adding the zerolog logger to
+// the context of unary calls. Ensure that the tracing stats handler is
+// installed so the call context carries the span.
+func UnaryLogger(logger zerolog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(withGRPCLogger(ctx, logger, info.FullMethod), req)
+	}
+}
+
+// StreamLogger is the gRPC counterpart of Logger, adding the zerolog logger to
+// the context of streaming calls.
+func StreamLogger(logger zerolog.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := withGRPCLogger(ss.Context(), logger, info.FullMethod)
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func withGRPCLogger(ctx context.Context, logger zerolog.Logger, method string) context.Context {
+	l := logger.With().Ctx(ctx).Str("grpc_method", method).Logger()
+	return l.WithContext(ctx)
+}
+
+// UnaryRecoverer is the gRPC counterpart of Recoverer, failing unary calls
+// that panic with codes.Internal. Ensure that it runs after UnaryLogger.
+func UnaryRecoverer(meter metric.Meter) grpc.UnaryServerInterceptor {
+	panicCount := newPanicCounter(meter, "firesync.grpc.panic_count")
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res any, err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				reportPanic(ctx, rec, panicCount, attribute.String("rpc.method", info.FullMethod))
+				res, err = nil, status.Error(codes.Internal, "internal error")
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// StreamRecoverer is the gRPC counterpart of Recoverer for streaming calls,
+// see UnaryRecoverer. Ensure that it runs after StreamLogger.
+func StreamRecoverer(meter metric.Meter) grpc.StreamServerInterceptor {
+	panicCount := newPanicCounter(meter, "firesync.grpc.panic_count")
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				reportPanic(ss.Context(), rec, panicCount, attribute.String("rpc.method", info.FullMethod))
+				err = status.Error(codes.Internal, "internal error")
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// UnaryTimeout is the gRPC counterpart of Timeout, cancelling the context of
+// unary calls after d. Streams are long-lived, so their messages are bounded
+// by the handler instead.
+func UnaryTimeout(d time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// UnaryOIDC is the gRPC counterpart of OIDC, rejecting unary calls without a
+// valid OIDC bearer token in their authorization metadata. Tokens that fail
+// the email allowlist are rejected with codes.PermissionDenied, any other
+// failure with codes.Unauthenticated.
+func UnaryOIDC(verifier TokenVerifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticateGRPC(ctx, verifier)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamOIDC is the gRPC counterpart of OIDC for streaming calls, see
+// UnaryOIDC.
+func StreamOIDC(verifier TokenVerifier) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateGRPC(ss.Context(), verifier)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func authenticateGRPC(ctx context.Context, verifier TokenVerifier) (context.Context, error) {
+	var authz string
+	if v := metadata.ValueFromIncomingContext(ctx, "authorization"); len(v) > 0 {
+		authz = v[0]
+	}
+
+	ctx, err := verifyBearerToken(ctx, verifier, authz)
+	switch {
+	case errors.Is(err, auth.ErrEmailNotAllowed):
+		return nil, status.Error(codes.PermissionDenied, "principal not allowed")
+	case err != nil:
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing bearer token")
+	}
+	return ctx, nil
+}
@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/auth"
+	"github.com/rs/zerolog"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// stubServerStream is a grpc.ServerStream carrying a context.
+type stubServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *stubServerStream) Context() context.Context { return s.ctx }
+
+func TestUnaryOIDC(t *testing.T) {
+	tests := []struct {
+		name      string
+		authz     string
+		err       error
+		want      codes.Code
+		wantToken string
+	}{
+		{"valid", "Bearer tok", nil, codes.OK, "tok"},
+		{"missing metadata", "", nil, codes.Unauthenticated, ""},
+		{"not bearer", "Basic dXNlcjpwYXNz", nil, codes.Unauthenticated, ""},
+		{"invalid token", "Bearer tok", auth.ErrInvalidSignature, codes.Unauthenticated, "tok"},
+		{"email not allowed", "Bearer tok", auth.ErrEmailNotAllowed, codes.PermissionDenied, "tok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &stubVerifier{err: tt.err}
+			ctx := context.Background()
+			if tt.authz != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", tt.authz))
+			}
+
+			called := false
+			_, err := UnaryOIDC(v)(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+				called = true
+				return nil, nil
+			})
+
+			if status.Code(err) != tt.want {
+				t.Fatalf("code = %v, want %v", status.Code(err), tt.want)
+			}
+			if called != (tt.want == codes.OK) {
+				t.Fatalf("handler called = %v", called)
+			}
+			if v.token != tt.wantToken {
+				t.Fatalf("verified token = %q, want %q", v.token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestStreamOIDC(t *testing.T) {
+	v := &stubVerifier{}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer tok"))
+
+	called := false
+	err := StreamOIDC(v)(nil, &stubServerStream{ctx: ctx}, &grpc.StreamServerInfo{}, func(srv any, ss grpc.ServerStream) error {
+		called = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamOIDC: %v", err)
+	}
+	if !called || v.token != "tok" {
+		t.Fatalf("handler called = %v, verified token = %q", called, v.token)
+	}
+
+	err = StreamOIDC(v)(nil, &stubServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{}, func(srv any, ss grpc.ServerStream) error {
+		t.Fatalf("handler called without a token")
+		return nil
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("code = %v, want Unauthenticated", status.Code(err))
+	}
+}
+
+func TestUnaryLogger(t *testing.T) {
+	logger := zerolog.New(zerolog.NewTestWriter(t))
+	_, err := UnaryLogger(logger)(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/firesync.v1.FireSync/Replicate"}, func(ctx context.Context, req any) (any, error) {
+		if zerolog.Ctx(ctx).GetLevel() == zerolog.Disabled {
+			t.Fatalf("context without logger")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("UnaryLogger: %v", err)
+	}
+}
+
+func TestUnaryRecoverer(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	ctx, span := tracer.Start(t.Context(), "call")
+	info := &grpc.UnaryServerInfo{FullMethod: "/firesync.v1.FireSync/Replicate"}
+	_, err := UnaryLogger(zerolog.New(&buf))(ctx, nil, info, func(ctx context.Context, req any) (any, error) {
+		return UnaryRecoverer(noop.Meter{})(ctx, req, info, func(context.Context, any) (any, error) {
+			panic("tombstone without document")
+		})
+	})
+	span.End()
+
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("code = %v, want Internal", status.Code(err))
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry is not structured: %q", buf.String())
+	}
+	if entry["level"] != "error" || entry["message"] != "panic: tombstone without document" || entry["grpc_method"] != info.FullMethod {
+		t.Fatalf("log entry = %v", entry)
+	}
+	if stack, _ := entry["stack_trace"].(string); !strings.Contains(stack, "goroutine") {
+		t.Fatalf("stack_trace = %q", stack)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Status().Code != otelcodes.Error {
+		t.Fatalf("span not marked as errored: %+v", spans)
+	}
+}
+
+func TestStreamRecoverer(t *testing.T) {
+	err := StreamRecoverer(noop.Meter{})(nil, &stubServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{}, func(srv any, ss grpc.ServerStream) error {
+		panic("tombstone without document")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("code = %v, want Internal", status.Code(err))
+	}
+}
+
+func TestUnaryTimeout(t *testing.T) {
+	_, err := UnaryTimeout(time.Minute)(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+			t.Fatalf("deadline = %v, %v", deadline, ok)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("UnaryTimeout: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Timeout returns a middleware that cancels the request context after d.
+// Unlike chi's Timeout, it leaves the response to the handler, which reports
+// the canceled work as a transient failure so Pub/Sub redelivers it.
+func Timeout(d time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// MaxBytes returns a middleware that limits request bodies to n bytes.
+// Requests declaring a larger Content-Length are rejected with 413 Request
+// Entity Too Large right away, otherwise reading past the limit fails with an
+// *http.MaxBytesError.
+func MaxBytes(n int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
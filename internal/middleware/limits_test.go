@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	var deadline time.Time
+	h := Timeout(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	if deadline.IsZero() || time.Until(deadline) > time.Minute {
+		t.Fatalf("deadline = %v", deadline)
+	}
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the handler's status", rr.Code)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          []byte
+		contentLength int64
+		want          int
+	}{
+		{"within limit", []byte("1234"), 4, http.StatusOK},
+		{"content length too large", []byte("12345"), 5, http.StatusRequestEntityTooLarge},
+		{"chunked body too large", []byte("12345"), -1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := MaxBytes(4)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := io.ReadAll(r.Body); err != nil {
+					var maxErr *http.MaxBytesError
+					if !errors.As(err, &maxErr) {
+						t.Fatalf("read error = %v, want *http.MaxBytesError", err)
+					}
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
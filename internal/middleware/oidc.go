@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/joaopenteado/firesync/internal/auth"
+	"github.com/rs/zerolog"
+)
+
+// TokenVerifier verifies a bearer token and returns its claims.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (*auth.Claims, error)
+}
+
+// OIDC returns a middleware that rejects requests without a valid OIDC bearer
+// token, such as the ones Pub/Sub push subscriptions attach when configured
+// with a service account. Tokens that fail the email allowlist are rejected
+// with 403 Forbidden, any other failure with 401 Unauthorized.
+func OIDC(verifier TokenVerifier) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, err := verifyBearerToken(r.Context(), verifier, r.Header.Get("Authorization"))
+			switch {
+			case errors.Is(err, errMissingBearerToken):
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			case errors.Is(err, auth.ErrEmailNotAllowed):
+				w.WriteHeader(http.StatusForbidden)
+				return
+			case err != nil:
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+var errMissingBearerToken = errors.New("missing bearer token")
+
+// verifyBearerToken verifies the bearer token of an Authorization header value
+// and returns ctx with a logger identifying the token's principal.
+func verifyBearerToken(ctx context.Context, verifier TokenVerifier, authz string) (context.Context, error) {
+	logger := zerolog.Ctx(ctx)
+
+	token, ok := strings.CutPrefix(authz, "Bearer ")
+	if !ok || token == "" {
+		logger.Warn().Msg("missing bearer token")
+		return ctx, errMissingBearerToken
+	}
+
+	claims, err := verifier.Verify(ctx, token)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to verify bearer token")
+		return ctx, err
+	}
+
+	l := logger.With().Str("principal", claims.Email).Logger()
+	return l.WithContext(ctx), nil
+}
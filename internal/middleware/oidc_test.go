@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joaopenteado/firesync/internal/auth"
+)
+
+type stubVerifier struct {
+	token string
+	err   error
+}
+
+func (s *stubVerifier) Verify(ctx context.Context, token string) (*auth.Claims, error) {
+	s.token = token
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &auth.Claims{Email: "pusher@p.iam.gserviceaccount.com"}, nil
+}
+
+func TestOIDC(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		err       error
+		want      int
+		wantToken string
+	}{
+		{"valid", "Bearer tok", nil, http.StatusOK, "tok"},
+		{"missing header", "", nil, http.StatusUnauthorized, ""},
+		{"not bearer", "Basic dXNlcjpwYXNz", nil, http.StatusUnauthorized, ""},
+		{"invalid token", "Bearer tok", auth.ErrInvalidSignature, http.StatusUnauthorized, "tok"},
+		{"email not allowed", "Bearer tok", auth.ErrEmailNotAllowed, http.StatusForbidden, "tok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &stubVerifier{err: tt.err}
+			called := false
+			h := OIDC(v)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/replicate", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Fatalf("next called = %v", called)
+			}
+			if v.token != tt.wantToken {
+				t.Fatalf("verified token = %q, want %q", v.token, tt.wantToken)
+			}
+		})
+	}
+}
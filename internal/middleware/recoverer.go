@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Recoverer returns a middleware that recovers from panics in the next
+// handlers. The panic and its stack are logged through the request's logger in
+// the format Error Reporting recognizes, recorded on the active span and
+// counted, and the request is answered with 500 Internal Server Error so
+// Pub/Sub retries the message. Ensure that this middleware runs after the
+// Logger and tracing middlewares.
+func Recoverer(meter metric.Meter) func(next http.Handler) http.Handler {
+	panicCount := newPanicCounter(meter, "firesync.http.panic_count")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if rec == http.ErrAbortHandler {
+					// deliberate abort, let net/http handle it
+					panic(rec)
+				}
+
+				reportPanic(r.Context(), rec, panicCount,
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+				)
+
+				w.WriteHeader(http.StatusInternalServerError)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func newPanicCounter(meter metric.Meter, name string) metric.Int64Counter {
+	panicCount, err := meter.Int64Counter(name,
+		metric.WithDescription("The total number of panics recovered while serving requests."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", name).
+			Msg("failed to create metric")
+		return noop.Int64Counter{}
+	}
+	return panicCount
+}
+
+// reportPanic logs a recovered panic and its stack through the context's
+// logger in the format Error Reporting recognizes, records it on the active
+// span and counts it.
+func reportPanic(ctx context.Context, rec any, panicCount metric.Int64Counter, attrs ...attribute.KeyValue) {
+	stack := debug.Stack()
+	err := fmt.Errorf("panic: %v", rec)
+
+	zerolog.Ctx(ctx).Error().
+		Str("stack_trace", fmt.Sprintf("%v\n\n%s", err, stack)).
+		Msg(err.Error())
+
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err, trace.WithAttributes(
+		attribute.String("exception.stacktrace", string(stack)),
+	))
+	span.SetStatus(codes.Error, err.Error())
+
+	panicCount.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
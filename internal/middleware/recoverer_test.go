@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRecoverer(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	handler := Logger(zerolog.New(&buf))(Recoverer(noop.Meter{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("tombstone without document")
+	})))
+
+	ctx, span := tracer.Start(t.Context(), "request")
+	req := httptest.NewRequest(http.MethodPost, "/v1/propagate", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	span.End()
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry is not structured: %q", buf.String())
+	}
+	if entry["level"] != "error" || entry["message"] != "panic: tombstone without document" {
+		t.Fatalf("log entry = %v", entry)
+	}
+	if stack, _ := entry["stack_trace"].(string); !strings.Contains(stack, "goroutine") {
+		t.Fatalf("stack_trace = %q", stack)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+		t.Fatalf("span not marked as errored: %+v", spans)
+	}
+	if events := spans[0].Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Fatalf("span events = %+v", events)
+	}
+}
+
+func TestRecoverer_ErrAbortHandler(t *testing.T) {
+	handler := Recoverer(noop.Meter{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Fatalf("recover() = %v, want http.ErrAbortHandler", rec)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
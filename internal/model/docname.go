@@ -2,11 +2,20 @@ package model
 
 import (
 	"fmt"
+	"path"
 	"strings"
 
 	"cloud.google.com/go/firestore"
 )
 
+// InternalCollectionPrefix prefixes the top-level collections FireSync keeps
+// its own state in, such as deduplication records.
+const InternalCollectionPrefix = "_firesync_"
+
+// HeartbeatCollection holds the heartbeat every region writes periodically,
+// one document per region.
+const HeartbeatCollection = InternalCollectionPrefix + "heartbeat"
+
 type DocumentName struct {
 	ProjectID  string
 	DatabaseID string
@@ -54,6 +63,17 @@ func NewDocumentFromPath(path string) *DocumentName {
 	}
 }
 
+// ParseDatabaseName splits a database resource name,
+// projects/{project_id}/databases/{database_id}, into its project and database
+// IDs.
+func ParseDatabaseName(name string) (projectID, databaseID string, err error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "databases" || parts[1] == "" || parts[3] == "" {
+		return "", "", fmt.Errorf("invalid database name %q, expected projects/{project_id}/databases/{database_id}", name)
+	}
+	return parts[1], parts[3], nil
+}
+
 func (d *DocumentName) Ref(db *firestore.Client) *firestore.DocumentRef {
 	return db.Doc(d.Path)
 }
@@ -68,6 +88,62 @@ func (d *DocumentName) TombstonePath() string {
 	return fmt.Sprintf("%s/%s", TombstoneCollection, TombstoneID(d.Path))
 }
 
+// SubtreeTombstonePath returns the path for the subtree tombstone covering
+// every document nested under the document name.
+func (d *DocumentName) SubtreeTombstonePath() string {
+	return fmt.Sprintf("%s/%s", TombstoneCollection, SubtreeTombstoneID(d.Path))
+}
+
+// Ancestors returns the names of the documents the document is nested under,
+// from the outermost to the innermost.
+// Example: [users/123] for users/123/sessions/abc
+func (d *DocumentName) Ancestors() []DocumentName {
+	segments := strings.Split(d.Path, "/")
+	if len(segments) < 4 {
+		return nil
+	}
+
+	ancestors := make([]DocumentName, 0, len(segments)/2-1)
+	for i := 2; i < len(segments)-1; i += 2 {
+		ancestors = append(ancestors, DocumentName{
+			ProjectID:  d.ProjectID,
+			DatabaseID: d.DatabaseID,
+			Path:       strings.Join(segments[:i], "/"),
+		})
+	}
+	return ancestors
+}
+
+// IsInternal reports whether the document belongs to one of the collections
+// FireSync keeps its own state in, which are never replicated. Heartbeats are
+// the exception, they are replicated to measure replication lag.
+func (d *DocumentName) IsInternal() bool {
+	return strings.HasPrefix(d.Path, InternalCollectionPrefix) && !d.IsHeartbeat()
+}
+
+// IsHeartbeat reports whether the document is the heartbeat of a region.
+func (d *DocumentName) IsHeartbeat() bool {
+	return strings.HasPrefix(d.Path, HeartbeatCollection+"/")
+}
+
+// CollectionPath returns the path of the collection containing the document.
+// Example: users/123/sessions for users/123/sessions/abc
+func (d *DocumentName) CollectionPath() string {
+	idx := strings.LastIndexByte(d.Path, '/')
+	if idx == -1 {
+		return ""
+	}
+	return d.Path[:idx]
+}
+
+// MatchesCollection reports whether the document's collection path matches the
+// given pattern. Patterns use path.Match syntax, so a `*` matches exactly one
+// path segment (e.g. users/*/sessions). Malformed patterns never match.
+func (d *DocumentName) MatchesCollection(pattern string) bool {
+	matched, err := path.Match(pattern, d.CollectionPath())
+	return err == nil && matched
+}
+
 func (d *DocumentName) String() string {
 	return fmt.Sprintf("projects/%s/databases/%s/documents/%s", d.ProjectID, d.DatabaseID, d.Path)
 }
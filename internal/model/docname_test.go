@@ -80,3 +80,88 @@ func TestDocumentName_String(t *testing.T) {
 		t.Errorf("DocumentName.String() = %q, want %q", got, want)
 	}
 }
+
+func TestDocumentName_CollectionPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"users/123", "users"},
+		{"users/123/sessions/abc", "users/123/sessions"},
+		{"users", ""},
+	}
+	for _, tt := range tests {
+		d := &DocumentName{Path: tt.path}
+		if got := d.CollectionPath(); got != tt.want {
+			t.Errorf("CollectionPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDocumentName_MatchesCollection(t *testing.T) {
+	tests := []struct {
+		path    string
+		pattern string
+		want    bool
+	}{
+		{"users/123", "users", true},
+		{"users/123", "orders", false},
+		{"users/123/sessions/abc", "users/*/sessions", true},
+		{"users/123/sessions/abc", "users", false},
+		{"users/123/sessions/abc", "*/*/sessions", true},
+		{"users/123", "[", false},
+	}
+	for _, tt := range tests {
+		d := &DocumentName{Path: tt.path}
+		if got := d.MatchesCollection(tt.pattern); got != tt.want {
+			t.Errorf("MatchesCollection(%q, %q) = %v, want %v", tt.path, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestDocumentName_Ancestors(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"users/1", nil},
+		{"users/1/sessions/a", []string{"users/1"}},
+		{"users/1/sessions/a/events/x", []string{"users/1", "users/1/sessions/a"}},
+	}
+	for _, tt := range tests {
+		d := &DocumentName{ProjectID: "p", DatabaseID: "d", Path: tt.path}
+		got := d.Ancestors()
+		if len(got) != len(tt.want) {
+			t.Fatalf("Ancestors(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+		for i, a := range got {
+			if a.Path != tt.want[i] || a.ProjectID != "p" || a.DatabaseID != "d" {
+				t.Errorf("Ancestors(%q)[%d] = %v, want path %q", tt.path, i, a, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestDocumentName_SubtreeTombstonePath(t *testing.T) {
+	d := &DocumentName{Path: "users/1"}
+	if d.SubtreeTombstonePath() == d.TombstonePath() {
+		t.Fatalf("subtree tombstone path collides with tombstone path")
+	}
+	want := TombstoneCollection + "/" + SubtreeTombstoneID("users/1")
+	if got := d.SubtreeTombstonePath(); got != want {
+		t.Errorf("SubtreeTombstonePath() = %q, want %q", got, want)
+	}
+}
+
+func TestParseDatabaseName(t *testing.T) {
+	projectID, databaseID, err := ParseDatabaseName("projects/p/databases/(default)")
+	if err != nil || projectID != "p" || databaseID != "(default)" {
+		t.Fatalf("ParseDatabaseName() = %q, %q, %v", projectID, databaseID, err)
+	}
+
+	for _, name := range []string{"", "p/d", "projects/p/databases/", "projects/p/collections/d", "projects/p/databases/d/documents/users/1"} {
+		if _, _, err := ParseDatabaseName(name); err == nil {
+			t.Errorf("ParseDatabaseName(%q) expected an error", name)
+		}
+	}
+}
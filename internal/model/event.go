@@ -18,6 +18,7 @@ const (
 	EventTypeDeleted
 	EventTypeReplicated
 	EventTypeTombstone
+	EventTypeInternal
 )
 
 func (e EventType) String() string {
@@ -34,16 +35,48 @@ func (e EventType) String() string {
 		return "replicated"
 	case EventTypeTombstone:
 		return "tombstone"
+	case EventTypeInternal:
+		return "internal"
 	default:
 		return fmt.Sprintf("unknown (%d)", e)
 	}
 }
 
+// ParseEventType is the inverse of EventType.String.
+func ParseEventType(s string) EventType {
+	for t := EventTypeCreated; t <= EventTypeInternal; t++ {
+		if t.String() == s {
+			return t
+		}
+	}
+	return EventTypeUnknown
+}
+
 type Event struct {
 	Type      EventType
 	Name      DocumentName
 	Timestamp time.Time
 	Data      *firestoredata.DocumentEventData
+
+	// Subtree is set on delete events that also delete every document nested
+	// under the deleted document.
+	Subtree bool
+
+	// Expiration is when the tombstone of a replicated delete event expires,
+	// as decided by the source region.
+	Expiration time.Time
+
+	// TTLRule is the rule that produced Expiration.
+	TTLRule string
+
+	// SchemaVersion is the schema version of the document data, as published
+	// by the source region.
+	SchemaVersion int
+}
+
+// Source returns the name of the database the event originated from.
+func (e *Event) Source() string {
+	return fmt.Sprintf("projects/%s/databases/%s", e.Name.ProjectID, e.Name.DatabaseID)
 }
 
 func ParseEvent(event *firestoredata.DocumentEventData, eventTime time.Time) (*Event, error) {
@@ -70,6 +103,15 @@ func ParseEvent(event *firestoredata.DocumentEventData, eventTime time.Time) (*E
 			}, nil
 		}
 
+		if docName.IsInternal() {
+			return &Event{
+				Type:      EventTypeInternal,
+				Name:      *docName,
+				Timestamp: eventTime,
+				Data:      event,
+			}, nil
+		}
+
 		return &Event{
 			Type:      EventTypeDeleted,
 			Name:      *docName,
@@ -93,6 +135,15 @@ func ParseEvent(event *firestoredata.DocumentEventData, eventTime time.Time) (*E
 		}, nil
 	}
 
+	if docName.IsInternal() {
+		return &Event{
+			Type:      EventTypeInternal,
+			Name:      *docName,
+			Timestamp: doc.UpdateTime.AsTime(),
+			Data:      event,
+		}, nil
+	}
+
 	if event.GetOldValue() == nil {
 		// if no old value, this is a create event
 
@@ -123,6 +123,36 @@ func TestParseEvent(t *testing.T) {
 			wantName:  DocumentName{ProjectID: "p", DatabaseID: "d", Path: "_firesync/abc"},
 			wantTime:  ts4,
 		},
+		{
+			name: "internal value",
+			event: &firestoredata.DocumentEventData{
+				Value: doc("projects/p/databases/d/documents/_firesync_dedup/abc", nil, ts1),
+			},
+			eventTime: ts2,
+			wantType:  EventTypeInternal,
+			wantName:  DocumentName{ProjectID: "p", DatabaseID: "d", Path: "_firesync_dedup/abc"},
+			wantTime:  ts1,
+		},
+		{
+			name: "internal delete",
+			event: &firestoredata.DocumentEventData{
+				OldValue: doc("projects/p/databases/d/documents/_firesync_dedup/abc", nil, ts1),
+			},
+			eventTime: ts4,
+			wantType:  EventTypeInternal,
+			wantName:  DocumentName{ProjectID: "p", DatabaseID: "d", Path: "_firesync_dedup/abc"},
+			wantTime:  ts4,
+		},
+		{
+			name: "heartbeat",
+			event: &firestoredata.DocumentEventData{
+				Value: doc("projects/p/databases/d/documents/_firesync_heartbeat/p:d", nil, ts1),
+			},
+			eventTime: ts2,
+			wantType:  EventTypeCreated,
+			wantName:  DocumentName{ProjectID: "p", DatabaseID: "d", Path: "_firesync_heartbeat/p:d"},
+			wantTime:  ts1,
+		},
 		{
 			name:      "no value nor old",
 			event:     &firestoredata.DocumentEventData{},
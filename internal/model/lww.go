@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// Supersedes reports whether a change made at ts in the src database wins over
+// a change made at otherTS in the otherSrc database under last-writer-wins
+// conflict resolution. Concurrent changes are ordered by their source so
+// every region picks the same winner.
+func Supersedes(ts time.Time, src string, otherTS time.Time, otherSrc string) bool {
+	return Priorities(nil).Supersedes(ts, src, otherTS, otherSrc)
+}
+
+// Priorities ranks source databases, by name, to break ties between
+// concurrent changes. Sources missing from it have priority zero.
+type Priorities map[string]int
+
+// Supersedes is like the package level Supersedes, but concurrent changes
+// from the source with the higher priority win. Sources with the same
+// priority are still ordered by name.
+func (p Priorities) Supersedes(ts time.Time, src string, otherTS time.Time, otherSrc string) bool {
+	if !ts.Equal(otherTS) {
+		return ts.After(otherTS)
+	}
+	if p[src] != p[otherSrc] {
+		return p[src] > p[otherSrc]
+	}
+	return src > otherSrc
+}
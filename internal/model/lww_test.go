@@ -0,0 +1,60 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSupersedes(t *testing.T) {
+	t1 := time.Unix(1, 0)
+	t2 := time.Unix(2, 0)
+	tests := []struct {
+		name     string
+		ts       time.Time
+		src      string
+		otherTS  time.Time
+		otherSrc string
+		want     bool
+	}{
+		{"newer", t2, "a", t1, "b", true},
+		{"older", t1, "b", t2, "a", false},
+		{"concurrent higher source", t1, "b", t1, "a", true},
+		{"concurrent lower source", t1, "a", t1, "b", false},
+		{"identical", t1, "a", t1, "a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Supersedes(tt.ts, tt.src, tt.otherTS, tt.otherSrc); got != tt.want {
+				t.Fatalf("Supersedes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriorities_Supersedes(t *testing.T) {
+	t1 := time.Unix(1, 0)
+	t2 := time.Unix(2, 0)
+	p := Priorities{"a": 10, "b": 10, "c": 5}
+	tests := []struct {
+		name     string
+		ts       time.Time
+		src      string
+		otherTS  time.Time
+		otherSrc string
+		want     bool
+	}{
+		{"newer lower priority", t2, "c", t1, "a", true},
+		{"older higher priority", t1, "a", t2, "c", false},
+		{"concurrent higher priority", t1, "a", t1, "c", true},
+		{"concurrent lower priority", t1, "c", t1, "a", false},
+		{"concurrent unranked", t1, "d", t1, "c", false},
+		{"concurrent same priority", t1, "b", t1, "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Supersedes(tt.ts, tt.src, tt.otherTS, tt.otherSrc); got != tt.want {
+				t.Fatalf("Supersedes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Message is a change published to Pub/Sub by the propagator of the source
+// region, as received by the replicator of a target region.
+type Message struct {
+	ID          string
+	Attributes  map[string]string
+	Data        []byte
+	PublishTime time.Time
+
+	// Subscription is the name of the subscription the message was delivered
+	// by, if known.
+	Subscription string
+}
+
+// ParseMessage parses a propagated change back into the event it was
+// published from.
+func ParseMessage(msg *Message) (*Event, error) {
+	attrs := msg.Attributes
+
+	data := &firestoredata.DocumentEventData{}
+	switch ct := attrs["content-type"]; ct {
+	case "application/protobuf":
+		if err := proto.Unmarshal(msg.Data, data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event data: %w", err)
+		}
+	case "application/json":
+		if err := protojson.Unmarshal(msg.Data, data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event data: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", ct)
+	}
+
+	eventType := ParseEventType(attrs["event-type"])
+	if eventType == EventTypeUnknown {
+		return nil, fmt.Errorf("unknown event type %q", attrs["event-type"])
+	}
+
+	eventTime, err := time.Parse(time.RFC3339Nano, attrs["event-time"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid event time: %w", err)
+	}
+
+	name := DocumentName{
+		ProjectID:  attrs["project-id"],
+		DatabaseID: attrs["database-id"],
+		Path:       attrs["document-path"],
+	}
+	if name.ProjectID == "" || name.DatabaseID == "" || name.Path == "" {
+		return nil, errors.New("missing document name attributes")
+	}
+	// document paths have an even number of segments
+	if parsed := NewDocumentFromPath(name.String()); parsed == nil || *parsed != name || strings.Count(name.Path, "/")%2 == 0 {
+		return nil, errors.New("invalid document name format")
+	}
+
+	event := &Event{
+		Type:      eventType,
+		Name:      name,
+		Timestamp: eventTime,
+		Data:      data,
+		Subtree:   attrs["subtree-delete"] == "true",
+		TTLRule:   attrs["tombstone-ttl-rule"],
+	}
+
+	if exp := attrs["tombstone-exp"]; exp != "" {
+		event.Expiration, err = time.Parse(time.RFC3339Nano, exp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tombstone expiration: %w", err)
+		}
+	}
+
+	// changes published before schema versioning have the initial version
+	if v := attrs["schema-version"]; v != "" {
+		event.SchemaVersion, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema version: %w", err)
+		}
+	}
+
+	return event, nil
+}
@@ -0,0 +1,165 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseMessage(t *testing.T) {
+	data := &firestoredata.DocumentEventData{
+		Value: doc("projects/p/databases/d/documents/users/1", nil, time.Unix(1, 0)),
+	}
+	protoData, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+	jsonData, err := protojson.Marshal(data)
+	if err != nil {
+		t.Fatalf("protojson.Marshal: %v", err)
+	}
+
+	attrs := func(kv ...string) map[string]string {
+		m := map[string]string{
+			"content-type":  "application/protobuf",
+			"event-type":    "created",
+			"event-time":    "2025-01-02T03:04:05.000000006Z",
+			"project-id":    "p",
+			"database-id":   "d",
+			"document-path": "users/1",
+		}
+		for i := 0; i < len(kv); i += 2 {
+			if kv[i+1] == "" {
+				delete(m, kv[i])
+				continue
+			}
+			m[kv[i]] = kv[i+1]
+		}
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		msg     *Message
+		want    *Event
+		wantErr string
+	}{
+		{
+			name: "protobuf",
+			msg:  &Message{Attributes: attrs(), Data: protoData},
+			want: &Event{
+				Type:      EventTypeCreated,
+				Name:      DocumentName{ProjectID: "p", DatabaseID: "d", Path: "users/1"},
+				Timestamp: time.Date(2025, 1, 2, 3, 4, 5, 6, time.UTC),
+			},
+		},
+		{
+			name: "json",
+			msg:  &Message{Attributes: attrs("content-type", "application/json"), Data: jsonData},
+			want: &Event{
+				Type:      EventTypeCreated,
+				Name:      DocumentName{ProjectID: "p", DatabaseID: "d", Path: "users/1"},
+				Timestamp: time.Date(2025, 1, 2, 3, 4, 5, 6, time.UTC),
+			},
+		},
+		{
+			name: "subtree delete",
+			msg: &Message{Attributes: attrs(
+				"event-type", "deleted",
+				"subtree-delete", "true",
+				"tombstone-ttl-rule", "users",
+				"tombstone-exp", "2025-01-03T00:00:00Z",
+			), Data: protoData},
+			want: &Event{
+				Type:       EventTypeDeleted,
+				Name:       DocumentName{ProjectID: "p", DatabaseID: "d", Path: "users/1"},
+				Timestamp:  time.Date(2025, 1, 2, 3, 4, 5, 6, time.UTC),
+				Subtree:    true,
+				TTLRule:    "users",
+				Expiration: time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "schema version",
+			msg:  &Message{Attributes: attrs("schema-version", "3"), Data: protoData},
+			want: &Event{
+				Type:          EventTypeCreated,
+				Name:          DocumentName{ProjectID: "p", DatabaseID: "d", Path: "users/1"},
+				Timestamp:     time.Date(2025, 1, 2, 3, 4, 5, 6, time.UTC),
+				SchemaVersion: 3,
+			},
+		},
+		{
+			name:    "unsupported content type",
+			msg:     &Message{Attributes: attrs("content-type", "text/plain"), Data: protoData},
+			wantErr: "unsupported content type",
+		},
+		{
+			name:    "malformed data",
+			msg:     &Message{Attributes: attrs("content-type", "application/json"), Data: []byte("{")},
+			wantErr: "failed to unmarshal event data",
+		},
+		{
+			name:    "unknown event type",
+			msg:     &Message{Attributes: attrs("event-type", "exploded"), Data: protoData},
+			wantErr: "unknown event type",
+		},
+		{
+			name:    "invalid event time",
+			msg:     &Message{Attributes: attrs("event-time", "yesterday"), Data: protoData},
+			wantErr: "invalid event time",
+		},
+		{
+			name:    "missing document path",
+			msg:     &Message{Attributes: attrs("document-path", ""), Data: protoData},
+			wantErr: "missing document name attributes",
+		},
+		{
+			name:    "invalid document path",
+			msg:     &Message{Attributes: attrs("document-path", "users"), Data: protoData},
+			wantErr: "invalid document name format",
+		},
+		{
+			name:    "invalid expiration",
+			msg:     &Message{Attributes: attrs("tombstone-exp", "never"), Data: protoData},
+			wantErr: "invalid tombstone expiration",
+		},
+		{
+			name:    "invalid schema version",
+			msg:     &Message{Attributes: attrs("schema-version", "v2"), Data: protoData},
+			wantErr: "invalid schema version",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMessage(tt.msg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseMessage() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMessage() unexpected error: %v", err)
+			}
+			if got.Type != tt.want.Type || got.Name != tt.want.Name || !got.Timestamp.Equal(tt.want.Timestamp) {
+				t.Fatalf("ParseMessage() = {%v %v %v}, want {%v %v %v}",
+					got.Type, got.Name, got.Timestamp, tt.want.Type, tt.want.Name, tt.want.Timestamp)
+			}
+			if got.Subtree != tt.want.Subtree || got.TTLRule != tt.want.TTLRule || !got.Expiration.Equal(tt.want.Expiration) {
+				t.Fatalf("ParseMessage() tombstone = {%v %q %v}, want {%v %q %v}",
+					got.Subtree, got.TTLRule, got.Expiration, tt.want.Subtree, tt.want.TTLRule, tt.want.Expiration)
+			}
+			if got.SchemaVersion != tt.want.SchemaVersion {
+				t.Fatalf("ParseMessage() schema version = %d, want %d", got.SchemaVersion, tt.want.SchemaVersion)
+			}
+			if got.Data.GetValue().GetName() != "projects/p/databases/d/documents/users/1" {
+				t.Fatalf("ParseMessage() data = %v", got.Data)
+			}
+		})
+	}
+}
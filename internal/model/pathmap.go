@@ -0,0 +1,63 @@
+package model
+
+import "strings"
+
+// PathMapping replicates the documents under a path of the source database to
+// another path, and possibly another database, in the target region.
+// Example: tenants/acme/users/1 is replicated to mirror/acme/users/1 with
+// the mapping from tenants to mirror.
+type PathMapping struct {
+	// SourceDatabase is the ID of the database changes must come from to be
+	// mapped. Changes from any database are mapped if empty.
+	SourceDatabase string
+
+	// Source is the path of the collection or document whose nested
+	// documents are mapped. Empty maps every document.
+	Source string
+
+	// TargetDatabase is the ID of the database mapped changes are replicated
+	// to. If empty, they are replicated as if they weren't mapped.
+	TargetDatabase string
+
+	// Target replaces Source in the mapped paths. It must be a collection
+	// path if Source is, and a document path (or empty) otherwise.
+	Target string
+}
+
+// PathMappings are evaluated in order, the first one matching a document
+// mapping it.
+type PathMappings []PathMapping
+
+// Map returns the database ID and path a document of the given database is
+// replicated to. Documents no mapping matches, and the internal ones, are
+// returned as is.
+func (m PathMappings) Map(databaseID, path string) (string, string) {
+	if strings.HasPrefix(path, InternalCollectionPrefix) {
+		return databaseID, path
+	}
+
+	for _, mapping := range m {
+		if mapping.SourceDatabase != "" && mapping.SourceDatabase != databaseID {
+			continue
+		}
+
+		var rest string
+		switch {
+		case mapping.Source == "":
+			rest = path
+		case strings.HasPrefix(path, mapping.Source+"/"):
+			rest = path[len(mapping.Source)+1:]
+		default:
+			continue
+		}
+
+		if mapping.TargetDatabase != "" {
+			databaseID = mapping.TargetDatabase
+		}
+		if mapping.Target == "" {
+			return databaseID, rest
+		}
+		return databaseID, mapping.Target + "/" + rest
+	}
+	return databaseID, path
+}
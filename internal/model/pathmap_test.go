@@ -0,0 +1,36 @@
+package model
+
+import "testing"
+
+func TestPathMappings_Map(t *testing.T) {
+	mappings := PathMappings{
+		{Source: "tenants/acme", TargetDatabase: "acme", Target: "tenants/acme"},
+		{Source: "flat/x", Target: ""},
+		{SourceDatabase: "a", Source: "tenants", Target: "mirror"},
+		{SourceDatabase: "b", TargetDatabase: "archive", Target: "regions/b"},
+	}
+	tests := []struct {
+		name       string
+		databaseID string
+		path       string
+		wantDB     string
+		wantPath   string
+	}{
+		{"database only", "a", "tenants/acme/users/1", "acme", "tenants/acme/users/1"},
+		{"prefix", "a", "tenants/initech/users/1", "a", "mirror/initech/users/1"},
+		{"prefix of another database", "c", "tenants/initech/users/1", "c", "tenants/initech/users/1"},
+		{"partial segment", "a", "tenantsx/1", "a", "tenantsx/1"},
+		{"whole database", "b", "users/1", "archive", "regions/b/users/1"},
+		{"internal", "b", "_firesync_heartbeat/p:b", "b", "_firesync_heartbeat/p:b"},
+		{"to root", "c", "flat/x/users/1", "c", "users/1"},
+		{"unmapped", "c", "users/1", "c", "users/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, p := mappings.Map(tt.databaseID, tt.path)
+			if db != tt.wantDB || p != tt.wantPath {
+				t.Fatalf("Map() = %q %q, want %q %q", db, p, tt.wantDB, tt.wantPath)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -32,6 +33,14 @@ type Tombstone struct {
 
 	// Expiration is the when the tombstone will be deleted by the TTL sweeper
 	Expiration *timestamppb.Timestamp `json:"exp" firestore:"exp"`
+
+	// TTLRule is the collection pattern of the rule that produced the
+	// expiration, or "default" when the global TTL was applied.
+	TTLRule string `json:"ttl_rule,omitempty" firestore:"ttl_rule,omitempty"`
+
+	// Subtree is set when the tombstone covers every document nested under
+	// Document rather than Document itself.
+	Subtree bool `json:"subtree,omitempty" firestore:"subtree,omitempty"`
 }
 
 func (t *Tombstone) ID() string {
@@ -49,6 +58,15 @@ func (t *Tombstone) ID() string {
 	return TombstoneID(t.Document.Path[idx+len(prefix):])
 }
 
+// ReplicatedDelete reports whether the delete of its document, made at
+// deleteTime in the database source, was applied by replication or repair
+// rather than by a client: those commit the tombstone of another database in
+// the same transaction as the delete, so the last update time of the
+// tombstone, written, is deleteTime.
+func (t *Tombstone) ReplicatedDelete(source string, written, deleteTime time.Time) bool {
+	return t.Source != source && written.Equal(deleteTime)
+}
+
 // TombstoneID generates a unique ID for a tombstone document.
 // Path is the raw path of the document, without the project or database prefixes.
 // Example: users/123
@@ -56,3 +74,10 @@ func TombstoneID(path string) string {
 	hash := sha256.Sum256([]byte(path))
 	return base64.RawURLEncoding.EncodeToString(hash[:])
 }
+
+// SubtreeTombstoneID generates a unique ID for the subtree tombstone covering
+// every document nested under the given path. The trailing separator keeps it
+// from colliding with the tombstone of the document itself.
+func SubtreeTombstoneID(path string) string {
+	return TombstoneID(path + "/")
+}
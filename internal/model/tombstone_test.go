@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/firestore"
 )
@@ -47,3 +48,25 @@ func TestTombstone_ID_Panics(t *testing.T) {
 		})
 	}
 }
+
+func TestTombstone_ReplicatedDelete(t *testing.T) {
+	deleted := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		src     string
+		written time.Time
+		want    bool
+	}{
+		{"replicated", "projects/p/databases/remote", deleted, true},
+		{"local", "projects/p/databases/local", deleted, false},
+		{"written before", "projects/p/databases/remote", deleted.Add(-time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &Tombstone{Source: tt.src}
+			if got := ts.ReplicatedDelete("projects/p/databases/local", tt.written, deleted); got != tt.want {
+				t.Fatalf("ReplicatedDelete() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ReferenceResolver resolves the document path of a reference value to a
+// document reference in the target database.
+type ReferenceResolver func(path string) *firestore.DocumentRef
+
+// DecodeFields converts the fields of a Firestore event document into values
+// the Firestore client can write. Reference values are resolved with ref, so
+// they point to documents of the target database instead of the source one.
+func DecodeFields(fields map[string]*firestoredata.Value, ref ReferenceResolver) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		val, err := DecodeValue(v, ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode field %q: %w", k, err)
+		}
+		data[k] = val
+	}
+	return data, nil
+}
+
+// DecodeValue converts a Firestore event value into a value the Firestore
+// client can write. See DecodeFields.
+func DecodeValue(v *firestoredata.Value, ref ReferenceResolver) (interface{}, error) {
+	switch val := v.GetValueType().(type) {
+	case nil, *firestoredata.Value_NullValue:
+		return nil, nil
+	case *firestoredata.Value_BooleanValue:
+		return val.BooleanValue, nil
+	case *firestoredata.Value_IntegerValue:
+		return val.IntegerValue, nil
+	case *firestoredata.Value_DoubleValue:
+		return val.DoubleValue, nil
+	case *firestoredata.Value_TimestampValue:
+		return val.TimestampValue.AsTime(), nil
+	case *firestoredata.Value_StringValue:
+		return val.StringValue, nil
+	case *firestoredata.Value_BytesValue:
+		return val.BytesValue, nil
+	case *firestoredata.Value_GeoPointValue:
+		return val.GeoPointValue, nil
+	case *firestoredata.Value_ReferenceValue:
+		name := NewDocumentFromPath(val.ReferenceValue)
+		if name == nil {
+			return nil, fmt.Errorf("invalid reference %q", val.ReferenceValue)
+		}
+		return ref(name.Path), nil
+	case *firestoredata.Value_ArrayValue:
+		values := make([]interface{}, len(val.ArrayValue.GetValues()))
+		for i, item := range val.ArrayValue.GetValues() {
+			decoded, err := DecodeValue(item, ref)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = decoded
+		}
+		return values, nil
+	case *firestoredata.Value_MapValue:
+		return DecodeFields(val.MapValue.GetFields(), ref)
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", val)
+	}
+}
+
+// EncodeFields converts document data, as returned by the Firestore client,
+// into the fields of a Firestore event document. It is the inverse of
+// DecodeFields, with references kept pointing to their own database.
+func EncodeFields(data map[string]interface{}) (map[string]*firestoredata.Value, error) {
+	fields := make(map[string]*firestoredata.Value, len(data))
+	for k, v := range data {
+		val, err := EncodeValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode field %q: %w", k, err)
+		}
+		fields[k] = val
+	}
+	return fields, nil
+}
+
+// EncodeValue converts a value returned by the Firestore client into a
+// Firestore event value. See EncodeFields.
+func EncodeValue(v interface{}) (*firestoredata.Value, error) {
+	switch val := v.(type) {
+	case nil:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_NullValue{}}, nil
+	case bool:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_BooleanValue{BooleanValue: val}}, nil
+	case int64:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_IntegerValue{IntegerValue: val}}, nil
+	case float64:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_DoubleValue{DoubleValue: val}}, nil
+	case time.Time:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_TimestampValue{TimestampValue: timestamppb.New(val)}}, nil
+	case string:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_StringValue{StringValue: val}}, nil
+	case []byte:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_BytesValue{BytesValue: val}}, nil
+	case *latlng.LatLng:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_GeoPointValue{GeoPointValue: val}}, nil
+	case *firestore.DocumentRef:
+		return &firestoredata.Value{ValueType: &firestoredata.Value_ReferenceValue{ReferenceValue: val.Path}}, nil
+	case []interface{}:
+		values := make([]*firestoredata.Value, len(val))
+		for i, item := range val {
+			encoded, err := EncodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = encoded
+		}
+		return &firestoredata.Value{ValueType: &firestoredata.Value_ArrayValue{ArrayValue: &firestoredata.ArrayValue{Values: values}}}, nil
+	case map[string]interface{}:
+		fields, err := EncodeFields(val)
+		if err != nil {
+			return nil, err
+		}
+		return &firestoredata.Value{ValueType: &firestoredata.Value_MapValue{MapValue: &firestoredata.MapValue{Fields: fields}}}, nil
+	case firestore.Vector64:
+		// vectors are stored as maps tagged with their type
+		values := make([]interface{}, len(val))
+		for i, f := range val {
+			values[i] = f
+		}
+		return EncodeValue(map[string]interface{}{
+			"__type__": "__vector__",
+			"value":    values,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", val)
+	}
+}
@@ -0,0 +1,122 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDecodeFields(t *testing.T) {
+	ref := func(path string) *firestore.DocumentRef { return &firestore.DocumentRef{Path: "target/" + path} }
+	ts := time.Unix(1_700_000_000, 5).UTC()
+	geo := &latlng.LatLng{Latitude: 1, Longitude: 2}
+
+	fields := map[string]*firestoredata.Value{
+		"null":   {ValueType: &firestoredata.Value_NullValue{}},
+		"bool":   {ValueType: &firestoredata.Value_BooleanValue{BooleanValue: true}},
+		"int":    {ValueType: &firestoredata.Value_IntegerValue{IntegerValue: 42}},
+		"double": {ValueType: &firestoredata.Value_DoubleValue{DoubleValue: 1.5}},
+		"time":   {ValueType: &firestoredata.Value_TimestampValue{TimestampValue: timestamppb.New(ts)}},
+		"string": {ValueType: &firestoredata.Value_StringValue{StringValue: "s"}},
+		"bytes":  {ValueType: &firestoredata.Value_BytesValue{BytesValue: []byte("b")}},
+		"geo":    {ValueType: &firestoredata.Value_GeoPointValue{GeoPointValue: geo}},
+		"ref":    {ValueType: &firestoredata.Value_ReferenceValue{ReferenceValue: "projects/p/databases/d/documents/users/2"}},
+		"array": {ValueType: &firestoredata.Value_ArrayValue{ArrayValue: &firestoredata.ArrayValue{Values: []*firestoredata.Value{
+			{ValueType: &firestoredata.Value_IntegerValue{IntegerValue: 1}},
+			{ValueType: &firestoredata.Value_StringValue{StringValue: "two"}},
+		}}}},
+		"map": {ValueType: &firestoredata.Value_MapValue{MapValue: &firestoredata.MapValue{Fields: map[string]*firestoredata.Value{
+			"nested": {ValueType: &firestoredata.Value_BooleanValue{BooleanValue: false}},
+		}}}},
+	}
+
+	got, err := DecodeFields(fields, ref)
+	if err != nil {
+		t.Fatalf("DecodeFields() unexpected error: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"null":   nil,
+		"bool":   true,
+		"int":    int64(42),
+		"double": 1.5,
+		"time":   ts,
+		"string": "s",
+		"bytes":  []byte("b"),
+		"geo":    geo,
+		"ref":    &firestore.DocumentRef{Path: "target/users/2"},
+		"array":  []interface{}{int64(1), "two"},
+		"map":    map[string]interface{}{"nested": false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DecodeFields() = %#v, want %#v", got, want)
+	}
+}
+
+func TestDecodeFields_InvalidReference(t *testing.T) {
+	fields := map[string]*firestoredata.Value{
+		"ref": {ValueType: &firestoredata.Value_ReferenceValue{ReferenceValue: "users/2"}},
+	}
+	_, err := DecodeFields(fields, func(string) *firestore.DocumentRef { return nil })
+	if err == nil || !strings.Contains(err.Error(), `invalid reference "users/2"`) {
+		t.Fatalf("DecodeFields() error = %v", err)
+	}
+}
+
+func TestEncodeFields(t *testing.T) {
+	ref := func(path string) *firestore.DocumentRef {
+		return &firestore.DocumentRef{Path: "projects/p/databases/d/documents/" + path}
+	}
+	data := map[string]interface{}{
+		"null":   nil,
+		"bool":   true,
+		"int":    int64(42),
+		"double": 1.5,
+		"time":   time.Unix(1_700_000_000, 5).UTC(),
+		"string": "s",
+		"bytes":  []byte("b"),
+		"geo":    &latlng.LatLng{Latitude: 1, Longitude: 2},
+		"ref":    ref("users/2"),
+		"array":  []interface{}{int64(1), "two"},
+		"map":    map[string]interface{}{"nested": false},
+	}
+
+	fields, err := EncodeFields(data)
+	if err != nil {
+		t.Fatalf("EncodeFields() unexpected error: %v", err)
+	}
+
+	// encoding then decoding must round-trip
+	got, err := DecodeFields(fields, ref)
+	if err != nil {
+		t.Fatalf("DecodeFields() unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Fatalf("round trip = %#v, want %#v", got, data)
+	}
+}
+
+func TestEncodeFields_Vector(t *testing.T) {
+	fields, err := EncodeFields(map[string]interface{}{"embedding": firestore.Vector64{1, 2}})
+	if err != nil {
+		t.Fatalf("EncodeFields() unexpected error: %v", err)
+	}
+
+	vector := fields["embedding"].GetMapValue().GetFields()
+	if vector["__type__"].GetStringValue() != "__vector__" || len(vector["value"].GetArrayValue().GetValues()) != 2 {
+		t.Fatalf("vector encoded as %v", fields["embedding"])
+	}
+}
+
+func TestEncodeFields_Unsupported(t *testing.T) {
+	_, err := EncodeFields(map[string]interface{}{"int": 1})
+	if err == nil || !strings.Contains(err.Error(), `failed to encode field "int"`) {
+		t.Fatalf("EncodeFields() error = %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Package push holds the request handling shared by the handlers and
+// middlewares serving Pub/Sub push requests.
+package push
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+// ReadBody reads the request body. On failure it replies with 413 Request
+// Entity Too Large if the body exceeds the limit set by http.MaxBytesReader,
+// or 400 Bad Request otherwise, and returns false.
+func ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		return body, true
+	}
+
+	logger := zerolog.Ctx(r.Context())
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		logger.Warn().Int64("limit", maxErr.Limit).Msg("request body too large")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	logger.Err(err).Msg("failed to read request body")
+	w.WriteHeader(http.StatusBadRequest)
+	return nil, false
+}
+
+// Acknowledges reports whether Pub/Sub push subscriptions treat a response
+// with the given status code as an acknowledgement.
+// See https://cloud.google.com/pubsub/docs/push#receive_push
+func Acknowledges(code int) bool {
+	switch code {
+	case http.StatusProcessing, http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,58 @@
+package push
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     func(w http.ResponseWriter) *http.Request
+		wantOK   bool
+		wantCode int
+	}{
+		{"ok", func(http.ResponseWriter) *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/", strings.NewReader("data"))
+		}, true, http.StatusOK},
+		{"too large", func(w http.ResponseWriter) *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("data"))
+			r.Body = http.MaxBytesReader(w, r.Body, 2)
+			return r
+		}, false, http.StatusRequestEntityTooLarge},
+		{"read error", func(http.ResponseWriter) *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/", iotest.ErrReader(errors.New("broken")))
+		}, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			body, ok := ReadBody(rr, tt.body(rr))
+			if ok != tt.wantOK || rr.Code != tt.wantCode {
+				t.Fatalf("ReadBody() = %v with status %d, want %v with %d", ok, rr.Code, tt.wantOK, tt.wantCode)
+			}
+			if ok && string(body) != "data" {
+				t.Fatalf("body = %q", body)
+			}
+		})
+	}
+}
+
+func TestAcknowledges(t *testing.T) {
+	for code, want := range map[int]bool{
+		http.StatusOK:                  true,
+		http.StatusAccepted:            true,
+		http.StatusNoContent:           true,
+		http.StatusConflict:            false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+	} {
+		if got := Acknowledges(code); got != want {
+			t.Errorf("Acknowledges(%d) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+// Package repair converges documents that diverged across the databases of a
+// FireSync deployment, such as the ones reported by the verify command.
+package repair
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/scan"
+	"github.com/joaopenteado/firesync/internal/verify"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Config struct {
+	// DryRun only reports the repairs that would be made.
+	DryRun bool
+
+	// Priorities break ties between concurrent changes, as configured on the
+	// replicators.
+	Priorities model.Priorities
+}
+
+type Result uint8
+
+const (
+	// ResultConsistent documents already had the same version in every
+	// database.
+	ResultConsistent Result = iota
+
+	// ResultRepaired documents had the winning version written to every
+	// database that lost.
+	ResultRepaired
+
+	// ResultConflict documents changed while being repaired, in at least one
+	// database. Live replication converges them instead.
+	ResultConflict
+)
+
+func (r Result) String() string {
+	switch r {
+	case ResultConsistent:
+		return "consistent"
+	case ResultRepaired:
+		return "repaired"
+	case ResultConflict:
+		return "conflict"
+	default:
+		return fmt.Sprintf("unknown (%d)", r)
+	}
+}
+
+// Summary counts the documents processed by a repair.
+type Summary struct {
+	Consistent int64 `json:"consistent"`
+	Repaired   int64 `json:"repaired"`
+	Conflicts  int64 `json:"conflicts"`
+	Failed     int64 `json:"failed"`
+}
+
+// Repairer writes the winning version of documents to the databases where it
+// lost.
+type Repairer struct {
+	dbs []verify.Database
+	cfg Config
+}
+
+func New(dbs []verify.Database, cfg Config) *Repairer {
+	return &Repairer{dbs: dbs, cfg: cfg}
+}
+
+// Run repairs the documents at paths one by one. Failures are counted and
+// logged, only canceling ctx stops the repair.
+func (r *Repairer) Run(ctx context.Context, paths []string) (Summary, error) {
+	var summary Summary
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+
+		logger := zerolog.Ctx(ctx).With().Str("document_path", p).Logger()
+		result, err := r.Repair(logger.WithContext(ctx), p)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to repair document")
+			summary.Failed++
+			continue
+		}
+
+		logger.Info().Stringer("result", result).Bool("dry_run", r.cfg.DryRun).Msg("document checked")
+		switch result {
+		case ResultConsistent:
+			summary.Consistent++
+		case ResultRepaired:
+			summary.Repaired++
+		case ResultConflict:
+			summary.Conflicts++
+		}
+	}
+	return summary, nil
+}
+
+// Repair decides the winning version of the document at p with the same
+// last-writer-wins rules as replication, and writes it to the databases where
+// it lost. The winner keeps its LWW timestamp and source, so live changes
+// still order correctly against it.
+//
+// Every write is conditioned on the document being unchanged since it was
+// read, so a repair never clobbers a concurrent live change.
+func (r *Repairer) Repair(ctx context.Context, p string) (Result, error) {
+	states := make([]*state, len(r.dbs))
+	for i, db := range r.dbs {
+		s, err := readState(ctx, db, p, r.cfg.Priorities)
+		if err != nil {
+			return 0, err
+		}
+		states[i] = s
+	}
+
+	winner, losers := decide(states, r.cfg.Priorities)
+	if len(losers) == 0 {
+		return ResultConsistent, nil
+	}
+
+	logger := zerolog.Ctx(ctx)
+	for _, i := range losers {
+		logger.Info().
+			Str("winner", r.dbs[winner].Name).
+			Str("loser", r.dbs[i].Name).
+			Bool("delete", states[winner].deleted).
+			Bool("dry_run", r.cfg.DryRun).
+			Msg("repairing document")
+	}
+	if r.cfg.DryRun {
+		return ResultRepaired, nil
+	}
+
+	result := ResultRepaired
+	for _, i := range losers {
+		err := r.write(ctx, r.dbs[i], states[winner], states[i])
+		if isConflict(err) {
+			logger.Warn().Err(err).Str("database", r.dbs[i].Name).Msg("document changed while being repaired, skipping")
+			result = ResultConflict
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to repair %s in %s: %w", p, r.dbs[i].Name, err)
+		}
+	}
+	return result, nil
+}
+
+// write writes the winning version to the database where loser was read.
+func (r *Repairer) write(ctx context.Context, db verify.Database, winner, loser *state) error {
+	doc := db.Client.Doc(loser.path)
+
+	if winner.deleted {
+		// the tombstone is committed with the delete, as the replicators do,
+		// so neither is left without the other and the propagator recognizes
+		// the delete as replicated
+		return db.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			return writeDelete(tx, db.Client, winner, loser, traceID(ctx))
+		})
+	}
+
+	data := rewriteReferences(winner.doc.Data(), db.Client).(map[string]interface{})
+	data["_firesync"] = &model.Metadata{
+		Timestamp: timestamppb.New(winner.version.ts),
+		Source:    winner.version.src,
+		Trace:     traceID(ctx),
+	}
+
+	if loser.doc == nil {
+		_, err := doc.Create(ctx, data)
+		return err
+	}
+	_, err := doc.Update(ctx, replaceFields(data, loser.doc.Data()), firestore.LastUpdateTime(loser.doc.UpdateTime))
+	return err
+}
+
+// transaction is the subset of *firestore.Transaction used to repair deletes.
+type transaction interface {
+	Create(dr *firestore.DocumentRef, data interface{}) error
+	Update(dr *firestore.DocumentRef, data []firestore.Update, opts ...firestore.Precondition) error
+	Delete(dr *firestore.DocumentRef, opts ...firestore.Precondition) error
+}
+
+// writeDelete writes the tombstone of the winner over the one of the loser and
+// deletes the document of the loser, if any, in tx.
+func writeDelete(tx transaction, client *firestore.Client, winner, loser *state, trace string) error {
+	tombstone := *winner.tombstone
+	tombstone.Document = client.Doc(loser.path)
+	tombstone.Trace = trace
+
+	name := model.DocumentName{Path: loser.path}
+	ref := client.Doc(name.TombstonePath())
+	var err error
+	if loser.tombstoneSnap == nil {
+		err = tx.Create(ref, &tombstone)
+	} else {
+		err = tx.Update(ref, tombstoneFields(&tombstone), firestore.LastUpdateTime(loser.tombstoneSnap.UpdateTime))
+	}
+	if err != nil || loser.doc == nil {
+		return err
+	}
+	return tx.Delete(tombstone.Document, firestore.LastUpdateTime(loser.doc.UpdateTime))
+}
+
+// version is the version of a document in one database, as ordered by
+// last-writer-wins.
+type version struct {
+	ts  time.Time
+	src string
+}
+
+func (v version) supersedes(other version, p model.Priorities) bool {
+	return p.Supersedes(v.ts, v.src, other.ts, other.src)
+}
+
+func (v version) equal(other version) bool {
+	return v.ts.Equal(other.ts) && v.src == other.src
+}
+
+// state is a document and its tombstone, as read from one database.
+type state struct {
+	path string
+
+	// doc and tombstoneSnap are nil if they don't exist.
+	doc           *firestore.DocumentSnapshot
+	tombstoneSnap *firestore.DocumentSnapshot
+	tombstone     *model.Tombstone
+
+	// hash is the content hash of doc.
+	hash string
+
+	// version is the latest of the document and its tombstone. It is unset if
+	// neither exist.
+	version version
+	set     bool
+
+	// deleted is set when the tombstone is the latest version.
+	deleted bool
+}
+
+func readState(ctx context.Context, db verify.Database, p string, priorities model.Priorities) (*state, error) {
+	name := model.DocumentName{Path: p}
+	snaps, err := db.Client.GetAll(ctx, []*firestore.DocumentRef{
+		db.Client.Doc(p),
+		db.Client.Doc(name.TombstonePath()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from %s: %w", p, db.Name, err)
+	}
+
+	s := &state{path: p}
+	if snaps[1].Exists() {
+		t := &model.Tombstone{}
+		if err := snaps[1].DataTo(t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tombstone of %s in %s: %w", p, db.Name, err)
+		}
+		s.tombstoneSnap, s.tombstone = snaps[1], t
+		s.version, s.set, s.deleted = version{ts: t.Timestamp.AsTime(), src: t.Source}, true, true
+	}
+
+	if snaps[0].Exists() {
+		doc := snaps[0]
+		hash, err := verify.ContentHash(doc.Data())
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s in %s: %w", p, db.Name, err)
+		}
+		s.doc, s.hash = doc, hash
+		if v := docVersion(doc, db.Name); !s.set || v.supersedes(s.version, priorities) {
+			s.version, s.set, s.deleted = v, true, false
+		}
+	}
+	return s, nil
+}
+
+// docVersion returns the version recorded in the FireSync metadata of doc.
+// Local changes the propagator has not stamped yet are versioned as it will
+// stamp them: by their update time, from the database they were read from.
+func docVersion(doc *firestore.DocumentSnapshot, database string) version {
+	md := struct {
+		Metadata *model.Metadata `firestore:"_firesync"`
+	}{}
+	if err := doc.DataTo(&md); err != nil || md.Metadata == nil || md.Metadata.Timestamp == nil {
+		return version{ts: doc.UpdateTime, src: database}
+	}
+	return version{ts: md.Metadata.Timestamp.AsTime(), src: md.Metadata.Source}
+}
+
+// decide returns the index of the state with the winning version and the
+// indexes of the states that differ from it. There are no losers if the
+// document doesn't exist anywhere.
+func decide(states []*state, priorities model.Priorities) (winner int, losers []int) {
+	winner = -1
+	for i, s := range states {
+		if s.set && (winner < 0 || s.version.supersedes(states[winner].version, priorities)) {
+			winner = i
+		}
+	}
+	if winner < 0 {
+		return -1, nil
+	}
+
+	w := states[winner]
+	for i, s := range states {
+		if i == winner {
+			continue
+		}
+		switch {
+		case !s.set, !s.version.equal(w.version), s.deleted != w.deleted:
+			losers = append(losers, i)
+		case w.deleted && s.doc != nil, !w.deleted && s.hash != w.hash:
+			// same version, but a delete that wasn't applied or content
+			// changed without being stamped
+			losers = append(losers, i)
+		}
+	}
+	return winner, losers
+}
+
+// replaceFields returns the updates replacing every field of existing with
+// the fields of data.
+func replaceFields(data, existing map[string]interface{}) []firestore.Update {
+	updates := make([]firestore.Update, 0, len(data)+len(existing))
+	for k, v := range data {
+		updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{k}, Value: v})
+	}
+	for k := range existing {
+		if _, ok := data[k]; !ok {
+			updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{k}, Value: firestore.Delete})
+		}
+	}
+	return updates
+}
+
+// tombstoneFields returns the updates replacing every field of a tombstone.
+func tombstoneFields(t *model.Tombstone) []firestore.Update {
+	orDelete := func(v interface{}, set bool) interface{} {
+		if !set {
+			return firestore.Delete
+		}
+		return v
+	}
+	return []firestore.Update{
+		{Path: "doc", Value: t.Document},
+		{Path: "ts", Value: t.Timestamp},
+		{Path: "src", Value: t.Source},
+		{Path: "trace", Value: orDelete(t.Trace, t.Trace != "")},
+		{Path: "exp", Value: t.Expiration},
+		{Path: "ttl_rule", Value: orDelete(t.TTLRule, t.TTLRule != "")},
+		{Path: "subtree", Value: orDelete(t.Subtree, t.Subtree)},
+	}
+}
+
+// rewriteReferences returns a copy of v with document references pointing to
+// the same paths in the database of db.
+func rewriteReferences(v interface{}, db *firestore.Client) interface{} {
+	switch val := v.(type) {
+	case *firestore.DocumentRef:
+		return db.Doc(scan.RelativePath(val.Path))
+	case []interface{}:
+		items := make([]interface{}, len(val))
+		for i, item := range val {
+			items[i] = rewriteReferences(item, db)
+		}
+		return items
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[k] = rewriteReferences(item, db)
+		}
+		return m
+	default:
+		return v
+	}
+}
+
+// isConflict reports whether a write failed because its precondition did.
+func isConflict(err error) bool {
+	switch status.Code(err) {
+	case codes.FailedPrecondition, codes.AlreadyExists, codes.NotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// ReadPaths reads the paths of the documents to repair, one per line, either
+// as plain paths or as findings written by the verify command. Duplicates are
+// dropped.
+func ReadPaths(r io.Reader) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		p := line
+		if strings.HasPrefix(line, "{") {
+			var finding verify.Finding
+			if err := json.Unmarshal([]byte(line), &finding); err != nil {
+				return nil, fmt.Errorf("line %d: invalid finding: %w", n, err)
+			}
+			p = finding.Path
+		}
+		if model.NewDocumentFromPath("projects/_/databases/_/documents/"+p) == nil || strings.Count(p, "/")%2 != 1 {
+			return nil, fmt.Errorf("line %d: invalid document path %q", n, p)
+		}
+
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read paths: %w", err)
+	}
+	return paths, nil
+}
@@ -0,0 +1,224 @@
+package repair
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joaopenteado/firesync/internal/model"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDecide(t *testing.T) {
+	const (
+		a = "projects/p/databases/a"
+		b = "projects/p/databases/b"
+	)
+	doc := &firestore.DocumentSnapshot{}
+	written := func(ts int64, src, hash string) *state {
+		return &state{doc: doc, hash: hash, version: version{ts: time.Unix(ts, 0), src: src}, set: true}
+	}
+	deleted := func(ts int64, src string) *state {
+		return &state{version: version{ts: time.Unix(ts, 0), src: src}, set: true, deleted: true}
+	}
+
+	tests := []struct {
+		name       string
+		states     []*state
+		priorities model.Priorities
+		wantWinner int
+		wantLosers []int
+	}{
+		{
+			name:       "consistent",
+			states:     []*state{written(1, a, "h"), written(1, a, "h")},
+			wantWinner: 0,
+		},
+		{
+			name:       "absent everywhere",
+			states:     []*state{{}, {}},
+			wantWinner: -1,
+		},
+		{
+			name:       "latest write wins",
+			states:     []*state{written(1, a, "h"), written(2, b, "x"), written(1, a, "h")},
+			wantWinner: 1,
+			wantLosers: []int{0, 2},
+		},
+		{
+			name:       "concurrent writes ordered by source",
+			states:     []*state{written(1, a, "h"), written(1, b, "x")},
+			wantWinner: 1,
+			wantLosers: []int{0},
+		},
+		{
+			name:       "concurrent writes ordered by priority",
+			states:     []*state{written(1, a, "h"), written(1, b, "x")},
+			priorities: model.Priorities{a: 1},
+			wantWinner: 0,
+			wantLosers: []int{1},
+		},
+		{
+			name:       "missing",
+			states:     []*state{written(1, a, "h"), {}},
+			wantWinner: 0,
+			wantLosers: []int{1},
+		},
+		{
+			name:       "newer delete wins",
+			states:     []*state{written(1, a, "h"), deleted(2, b)},
+			wantWinner: 1,
+			wantLosers: []int{0},
+		},
+		{
+			name: "delete not applied",
+			states: []*state{
+				deleted(2, b),
+				{doc: doc, version: version{ts: time.Unix(2, 0), src: b}, set: true, deleted: true},
+			},
+			wantWinner: 0,
+			wantLosers: []int{1},
+		},
+		{
+			name:       "unstamped content change",
+			states:     []*state{written(1, a, "h"), written(1, a, "x")},
+			wantWinner: 0,
+			wantLosers: []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			winner, losers := decide(tt.states, tt.priorities)
+			if winner != tt.wantWinner || !slices.Equal(losers, tt.wantLosers) {
+				t.Fatalf("decide() = %d, %v, want %d, %v", winner, losers, tt.wantWinner, tt.wantLosers)
+			}
+		})
+	}
+}
+
+func TestReplaceFields(t *testing.T) {
+	updates := replaceFields(
+		map[string]interface{}{"name": "a", "a.b": int64(1)},
+		map[string]interface{}{"name": "b", "stale": true},
+	)
+
+	got := make(map[string]interface{})
+	for _, u := range updates {
+		got[strings.Join(u.FieldPath, "/")] = u.Value
+	}
+	want := map[string]interface{}{"name": "a", "a.b": int64(1), "stale": firestore.Delete}
+	if len(got) != len(want) {
+		t.Fatalf("replaceFields() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("update of %q = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestReadPaths(t *testing.T) {
+	input := strings.Join([]string{
+		`{"path":"users/1","kind":"divergent","states":[]}`,
+		"",
+		"users/2/sessions/3",
+		"users/1",
+	}, "\n")
+
+	paths, err := ReadPaths(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ReadPaths() unexpected error: %v", err)
+	}
+	if want := []string{"users/1", "users/2/sessions/3"}; !slices.Equal(paths, want) {
+		t.Fatalf("ReadPaths() = %v, want %v", paths, want)
+	}
+
+	for _, input := range []string{"users", "{not json", "users/1/sessions"} {
+		if _, err := ReadPaths(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadPaths(%q) expected an error", input)
+		}
+	}
+}
+
+// recordingTx records the writes of a transaction.
+type recordingTx struct {
+	writes []string
+	src    string
+}
+
+func (tx *recordingTx) Create(dr *firestore.DocumentRef, data interface{}) error {
+	tx.writes = append(tx.writes, "create "+dr.Path)
+	tx.src = data.(*model.Tombstone).Source
+	return nil
+}
+
+func (tx *recordingTx) Update(dr *firestore.DocumentRef, data []firestore.Update, opts ...firestore.Precondition) error {
+	tx.writes = append(tx.writes, "update "+dr.Path)
+	for _, u := range data {
+		if u.Path == "src" {
+			tx.src = u.Value.(string)
+		}
+	}
+	return nil
+}
+
+func (tx *recordingTx) Delete(dr *firestore.DocumentRef, opts ...firestore.Precondition) error {
+	tx.writes = append(tx.writes, "delete "+dr.Path)
+	return nil
+}
+
+func TestWriteDelete(t *testing.T) {
+	const (
+		local  = "projects/p/databases/local"
+		remote = "projects/p/databases/remote"
+	)
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClientWithDatabase(context.Background(), "p", "local")
+	if err != nil {
+		t.Fatalf("firestore.NewClientWithDatabase: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	deletedAt := time.Unix(2, 0)
+	winner := &state{
+		tombstone: &model.Tombstone{Timestamp: timestamppb.New(deletedAt), Source: remote},
+		version:   version{ts: deletedAt, src: remote},
+		set:       true,
+		deleted:   true,
+	}
+	doc := &firestore.DocumentSnapshot{UpdateTime: time.Unix(1, 0)}
+	tombstone := &firestore.DocumentSnapshot{UpdateTime: time.Unix(1, 0)}
+	prefix := "projects/p/databases/local/documents/"
+	tombstonePath := prefix + model.TombstoneCollection + "/" + model.TombstoneID("users/1")
+
+	tests := []struct {
+		name       string
+		loser      *state
+		wantWrites []string
+	}{
+		{"live document", &state{path: "users/1", doc: doc}, []string{"create " + tombstonePath, "delete " + prefix + "users/1"}},
+		{"older tombstone", &state{path: "users/1", tombstoneSnap: tombstone, deleted: true}, []string{"update " + tombstonePath}},
+		{"older tombstone and live document", &state{path: "users/1", doc: doc, tombstoneSnap: tombstone}, []string{"update " + tombstonePath, "delete " + prefix + "users/1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &recordingTx{}
+			if err := writeDelete(tx, client, winner, tt.loser, ""); err != nil {
+				t.Fatalf("writeDelete() unexpected error: %v", err)
+			}
+			if !slices.Equal(tx.writes, tt.wantWrites) {
+				t.Fatalf("writes = %v, want %v", tx.writes, tt.wantWrites)
+			}
+
+			// the tombstone and the delete share the commit time of the
+			// transaction, so the propagator doesn't publish the delete again
+			commit := time.Now()
+			if written := (&model.Tombstone{Source: tx.src}); !written.ReplicatedDelete(local, commit, commit) {
+				t.Fatalf("repaired delete with tombstone from %q would be propagated", tx.src)
+			}
+		})
+	}
+}
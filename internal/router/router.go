@@ -9,23 +9,55 @@ import (
 	"github.com/joaopenteado/firesync/internal/middleware"
 	"github.com/riandyrn/otelchi"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
 )
 
 type Config struct {
+	// PropagateHandler and ReplicateHandler serve the /v1 endpoints. Nil
+	// handlers are not routed, e.g. in worker mode.
 	PropagateHandler http.Handler
 	ReplicateHandler http.Handler
 	ServiceName      string
 	TracingEnabled   bool
+
+	// Meter records the router's metrics. If nil, they are not recorded.
+	Meter metric.Meter
+
+	// RequestTimeout cancels the context of requests to the /v1 endpoints
+	// after the given duration. Zero disables the timeout.
+	RequestTimeout time.Duration
+
+	// MaxBodyBytes limits the size of request bodies to the /v1 endpoints.
+	// Zero disables the limit.
+	MaxBodyBytes int64
+
+	// ReadinessHandler, if set, serves the /readyz readiness probe.
+	ReadinessHandler http.Handler
+
+	// Authenticator, if set, authenticates requests to the /v1 and /admin
+	// endpoints.
+	Authenticator func(http.Handler) http.Handler
+
+	// PausesHandler, if set, serves the /admin/v1/pauses endpoint. It is only
+	// served with an Authenticator, never unauthenticated.
+	PausesHandler http.Handler
+
+	// MetricsHandler, if set, serves the /metrics endpoint, scraped by
+	// Prometheus. It is protected by the Authenticator if MetricsAuthEnabled.
+	MetricsHandler     http.Handler
+	MetricsAuthEnabled bool
 }
 
 func New(cfg Config) http.Handler {
 	r := chi.NewRouter()
 
+	meter := cfg.Meter
+	if meter == nil {
+		meter = noop.Meter{}
+	}
+
 	r.Use(
-		// TODO: use custom recoverer and health checks to integrate with otel
-		// and zerolog
-		chimiddleware.Recoverer,
-		chimiddleware.Timeout(10*time.Second),
 		chimiddleware.Heartbeat("/healthz"), // Liveness probe
 		middleware.Logger(log.Logger),
 	)
@@ -34,13 +66,53 @@ func New(cfg Config) http.Handler {
 		r.Use(otelchi.Middleware(cfg.ServiceName, otelchi.WithChiRoutes(r)))
 	}
 
+	// After logging and tracing, so panics are reported with the request's
+	// logger and span.
+	r.Use(middleware.Recoverer(meter))
+
+	if cfg.ReadinessHandler != nil {
+		r.Method(http.MethodGet, "/readyz", cfg.ReadinessHandler)
+	}
+
+	if cfg.MetricsHandler != nil {
+		metrics := cfg.MetricsHandler
+		if cfg.MetricsAuthEnabled && cfg.Authenticator != nil {
+			metrics = cfg.Authenticator(metrics)
+		}
+		r.Method(http.MethodGet, "/metrics", metrics)
+	}
+
 	r.Route("/v1", func(r chi.Router) {
+		if cfg.RequestTimeout > 0 {
+			r.Use(middleware.Timeout(cfg.RequestTimeout))
+		}
+		if cfg.MaxBodyBytes > 0 {
+			r.Use(middleware.MaxBytes(cfg.MaxBodyBytes))
+		}
+		if cfg.Authenticator != nil {
+			r.Use(cfg.Authenticator)
+		}
+
 		// Propagate receives CloudEvents from Eventarc/PubSub/Firestore
-		r.With(middleware.CloudEvent).
-			Method(http.MethodPost, "/propagate", cfg.PropagateHandler)
+		if cfg.PropagateHandler != nil {
+			r.With(middleware.CloudEvent).
+				Method(http.MethodPost, "/propagate", cfg.PropagateHandler)
+		}
 
-		r.Method(http.MethodPost, "/replicate", cfg.ReplicateHandler)
+		if cfg.ReplicateHandler != nil {
+			r.Method(http.MethodPost, "/replicate", cfg.ReplicateHandler)
+		}
 	})
 
+	if cfg.PausesHandler != nil && cfg.Authenticator != nil {
+		r.Route("/admin/v1", func(r chi.Router) {
+			if cfg.RequestTimeout > 0 {
+				r.Use(middleware.Timeout(cfg.RequestTimeout))
+			}
+			r.Use(cfg.Authenticator)
+			r.Handle("/pauses", cfg.PausesHandler)
+		})
+	}
+
 	return r
 }
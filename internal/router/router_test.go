@@ -0,0 +1,146 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/joaopenteado/firesync/internal/handler"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// requireToken rejects requests without a bearer token.
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestNew_Metrics(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("firesync_up 1\n"))
+	})
+
+	tests := []struct {
+		name        string
+		cfg         Config
+		token       bool
+		wantCode    int
+		wantMetrics bool
+	}{
+		{"disabled", Config{}, false, http.StatusNotFound, false},
+		{"public", Config{MetricsHandler: metrics, Authenticator: requireToken}, false, http.StatusOK, true},
+		{"auth without token", Config{MetricsHandler: metrics, Authenticator: requireToken, MetricsAuthEnabled: true}, false, http.StatusUnauthorized, false},
+		{"auth with token", Config{MetricsHandler: metrics, Authenticator: requireToken, MetricsAuthEnabled: true}, true, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.token {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			rr := httptest.NewRecorder()
+			New(tt.cfg).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("GET /metrics = %d, want %d", rr.Code, tt.wantCode)
+			}
+			if got := rr.Body.String() == "firesync_up 1\n"; got != tt.wantMetrics {
+				t.Fatalf("body = %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestNew_Pauses(t *testing.T) {
+	pauses := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		token    bool
+		wantCode int
+	}{
+		{"unauthenticated", Config{PausesHandler: pauses}, false, http.StatusNotFound},
+		{"without token", Config{PausesHandler: pauses, Authenticator: requireToken}, false, http.StatusUnauthorized},
+		{"with token", Config{PausesHandler: pauses, Authenticator: requireToken}, true, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/v1/pauses", nil)
+			if tt.token {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			rr := httptest.NewRecorder()
+			New(tt.cfg).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("GET /admin/v1/pauses = %d, want %d", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// panickingReplicator panics on the first message and replicates the others.
+type panickingReplicator struct {
+	calls atomic.Int32
+}
+
+func (r *panickingReplicator) Replicate(ctx context.Context, msg *model.Message) (service.ReplicationResult, error) {
+	if r.calls.Add(1) == 1 {
+		panic("tombstone without document")
+	}
+	return service.ReplicationResultSuccess, nil
+}
+
+func TestNewGRPC_Recoverer(t *testing.T) {
+	srv := NewGRPC(GRPCConfig{
+		Register: func(s grpc.ServiceRegistrar) {
+			handler.RegisterGRPC(s, nil, &panickingReplicator{})
+		},
+		RequestTimeout: time.Minute,
+	})
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	replicate := func() error {
+		return conn.Invoke(context.Background(), "/firesync.v1.FireSync/Replicate", &pubsubpb.PubsubMessage{MessageId: "1"}, &emptypb.Empty{})
+	}
+	if err := replicate(); status.Code(err) != codes.Internal {
+		t.Fatalf("Replicate() = %v, want Internal", err)
+	}
+	// the server survives the panic
+	if err := replicate(); err != nil {
+		t.Fatalf("Replicate: %v", err)
+	}
+}
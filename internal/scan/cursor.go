@@ -0,0 +1,49 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CursorStore saves the progress of scans by job name.
+type CursorStore interface {
+	// Load unmarshals the progress of job into v and reports whether it was
+	// found.
+	Load(ctx context.Context, job string, v any) (bool, error)
+	Save(ctx context.Context, job string, v any) error
+}
+
+type firestoreCursorStore struct {
+	coll *firestore.CollectionRef
+}
+
+// NewFirestoreCursorStore returns a CursorStore saving progress in the given
+// collection of db, one document per job. The collection should be an
+// internal one, so saving progress is never replicated.
+func NewFirestoreCursorStore(db *firestore.Client, collection string) CursorStore {
+	return &firestoreCursorStore{coll: db.Collection(collection)}
+}
+
+func (s *firestoreCursorStore) Load(ctx context.Context, job string, v any) (bool, error) {
+	snap, err := s.coll.Doc(job).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := snap.DataTo(v); err != nil {
+		return false, fmt.Errorf("failed to unmarshal cursor: %w", err)
+	}
+	return true, nil
+}
+
+func (s *firestoreCursorStore) Save(ctx context.Context, job string, v any) error {
+	_, err := s.coll.Doc(job).Set(ctx, v)
+	return err
+}
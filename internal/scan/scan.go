@@ -0,0 +1,214 @@
+// Package scan walks the documents of a Firestore database in a stable
+// order, so long running scans such as backfills and consistency checks can
+// be resumed from a cursor.
+//
+// Documents are walked depth-first, each collection in document ID order and
+// each document before its subcollections. The path of the last document
+// visited is therefore a cursor a later walk can resume after.
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joaopenteado/firesync/internal/model"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultBatchSize is the default number of documents visited at once.
+const DefaultBatchSize = 100
+
+// Walker walks the documents of a database.
+type Walker struct {
+	db          *firestore.Client
+	collections []string
+	batchSize   int
+}
+
+// NewWalker returns a Walker visiting the documents of db in collections
+// matching the given patterns, in path.Match syntax (e.g. users/*/sessions).
+// Without patterns, every collection is walked. FireSync's internal
+// collections are never walked.
+func NewWalker(db *firestore.Client, batchSize int, collections ...string) *Walker {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	return &Walker{
+		db:          db,
+		collections: collections,
+		batchSize:   batchSize,
+	}
+}
+
+// Walk calls visit with batches of the documents after the cursor, in walk
+// order. The cursor is the path of the last document visited by a previous
+// walk, relative to the database root, or empty to walk every document.
+// Batches may include documents that only exist as the parent of
+// subcollections.
+func (w *Walker) Walk(ctx context.Context, cursor string, visit func(ctx context.Context, refs []*firestore.DocumentRef) error) error {
+	wk := &walk{Walker: w, cursor: cursor, visit: visit}
+
+	colls, err := sortedCollections(w.db.Collections(ctx))
+	if err != nil {
+		return err
+	}
+	for _, coll := range colls {
+		if err := wk.collection(ctx, coll); err != nil {
+			return err
+		}
+	}
+	return wk.flush(ctx)
+}
+
+// isInternal reports whether a collection holds the state of FireSync rather
+// than documents: the tombstones and the internal collections, which are
+// never propagated. Heartbeats are propagated, but rewritten every interval,
+// so they aren't walked either.
+func isInternal(collPath string) bool {
+	return collPath == model.TombstoneCollection || strings.HasPrefix(collPath, model.InternalCollectionPrefix)
+}
+
+type walk struct {
+	*Walker
+	cursor string
+	batch  []*firestore.DocumentRef
+	visit  func(ctx context.Context, refs []*firestore.DocumentRef) error
+}
+
+func (w *walk) collection(ctx context.Context, coll *firestore.CollectionRef) error {
+	collPath := RelativePath(coll.Path)
+	if isInternal(collPath) || !w.mayContainMatches(collPath) || !w.pending(collPath) {
+		return nil
+	}
+	matches := w.matches(collPath)
+
+	it := coll.DocumentRefs(ctx)
+	for {
+		ref, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list documents of %s: %w", collPath, err)
+		}
+
+		docPath := RelativePath(ref.Path)
+		if !w.pending(docPath) {
+			continue
+		}
+
+		if matches && w.after(docPath) {
+			w.batch = append(w.batch, ref)
+			if len(w.batch) >= w.batchSize {
+				if err := w.flush(ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		if !w.mayContainMatches(docPath) {
+			continue
+		}
+		subs, err := sortedCollections(ref.Collections(ctx))
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			if err := w.collection(ctx, sub); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *walk) flush(ctx context.Context) error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	if err := w.visit(ctx, w.batch); err != nil {
+		return err
+	}
+	w.batch = nil
+	return nil
+}
+
+// after reports whether the document at p comes after the cursor.
+func (w *walk) after(p string) bool {
+	return w.cursor == "" || ComparePaths(p, w.cursor) > 0
+}
+
+// pending reports whether the subtree rooted at p holds any document after
+// the cursor.
+func (w *walk) pending(p string) bool {
+	return w.after(p) || strings.HasPrefix(w.cursor, p+"/")
+}
+
+// matches reports whether documents of the collection should be visited.
+func (w *Walker) matches(collPath string) bool {
+	if len(w.collections) == 0 {
+		return true
+	}
+	name := model.DocumentName{Path: collPath + "/_"}
+	for _, pattern := range w.collections {
+		if name.MatchesCollection(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayContainMatches reports whether p, or a collection nested under it, may
+// match one of the collection patterns, so the walk doesn't descend into
+// subtrees that can't contain any document to visit.
+func (w *Walker) mayContainMatches(p string) bool {
+	if len(w.collections) == 0 {
+		return true
+	}
+	segments := strings.Split(p, "/")
+	for _, pattern := range w.collections {
+		patternSegments := strings.Split(pattern, "/")
+		if len(patternSegments) < len(segments) {
+			continue
+		}
+		prefix := strings.Join(patternSegments[:len(segments)], "/")
+		if matched, err := path.Match(prefix, p); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ComparePaths orders paths the way they are walked: segment by segment, with
+// a path before every path nested under it.
+func ComparePaths(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// RelativePath returns the path of a document or collection relative to the
+// database root.
+func RelativePath(fullPath string) string {
+	if name := model.NewDocumentFromPath(fullPath); name != nil {
+		return name.Path
+	}
+	return fullPath
+}
+
+func sortedCollections(it *firestore.CollectionIterator) ([]*firestore.CollectionRef, error) {
+	colls, err := it.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	sort.Slice(colls, func(i, j int) bool { return colls[i].ID < colls[j].ID })
+	return colls, nil
+}
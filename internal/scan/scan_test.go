@@ -0,0 +1,101 @@
+package scan
+
+import "testing"
+
+func TestComparePaths(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"users/1", "users/1", 0},
+		{"users/1", "users/2", -1},
+		{"users/1", "users/1/sessions/a", -1},
+		{"users/1/sessions/a", "users/2", -1},
+		// segment-wise, unlike plain string comparison
+		{"users/1/sessions/a", "users/1-b", -1},
+		{"orders/1", "users/1", -1},
+	}
+	for _, tt := range tests {
+		got := ComparePaths(tt.a, tt.b)
+		if (got < 0) != (tt.want < 0) || (got > 0) != (tt.want > 0) {
+			t.Fatalf("ComparePaths(%q, %q) = %d, want sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestWalk_Pending(t *testing.T) {
+	b := &walk{Walker: NewWalker(nil, 0), cursor: "users/2/sessions/a"}
+
+	tests := []struct {
+		path         string
+		after, pends bool
+	}{
+		{"orders", false, false},
+		{"users", false, true},
+		{"users/1", false, false},
+		{"users/2", false, true},
+		{"users/2/sessions", false, true},
+		{"users/2/sessions/a", false, false},
+		{"users/2/sessions/b", true, true},
+		{"users/3", true, true},
+		{"zebras", true, true},
+	}
+	for _, tt := range tests {
+		if got := b.after(tt.path); got != tt.after {
+			t.Errorf("after(%q) = %v, want %v", tt.path, got, tt.after)
+		}
+		if got := b.pending(tt.path); got != tt.pends {
+			t.Errorf("pending(%q) = %v, want %v", tt.path, got, tt.pends)
+		}
+	}
+}
+
+func TestWalker_Matches(t *testing.T) {
+	b := NewWalker(nil, 0, "users/*/sessions", "orders")
+
+	tests := []struct {
+		path           string
+		matches, below bool
+	}{
+		{"orders", true, true},
+		{"users", false, true},
+		{"users/1", false, true},
+		{"users/1/sessions", true, true},
+		{"users/1/sessions/a", false, false},
+		{"users/1/devices", false, false},
+		{"products", false, false},
+	}
+	for _, tt := range tests {
+		if got := b.matches(tt.path); got != tt.matches {
+			t.Errorf("matches(%q) = %v, want %v", tt.path, got, tt.matches)
+		}
+		if got := b.mayContainMatches(tt.path); got != tt.below {
+			t.Errorf("mayContainMatches(%q) = %v, want %v", tt.path, got, tt.below)
+		}
+	}
+
+	all := NewWalker(nil, 0)
+	if !all.matches("products") || !all.mayContainMatches("products/1") {
+		t.Fatalf("walker without patterns must match every collection")
+	}
+}
+
+func TestIsInternal(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"_firesync", true},
+		{"_firesync_dedup", true},
+		{"_firesync_heartbeat", true},
+		{"_firesyncX", false},
+		{"_firesyncs", false},
+		{"users", false},
+		{"users/1/_firesync", false},
+	}
+	for _, tt := range tests {
+		if got := isInternal(tt.path); got != tt.want {
+			t.Errorf("isInternal(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
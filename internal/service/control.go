@@ -0,0 +1,278 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ControlCollection is the internal collection holding the runtime control
+	// state shared by every instance.
+	ControlCollection = model.InternalCollectionPrefix + "control"
+
+	// ControlStateID is the ID of the control state document.
+	ControlStateID = "state"
+)
+
+// Pause stops the propagation and replication of changes to documents in
+// collections matching a pattern.
+type Pause struct {
+	// Collection is the collection pattern, in path.Match syntax.
+	Collection string `firestore:"collection" json:"collection"`
+
+	// Reason is a free-form note on why the collection was paused.
+	Reason string `firestore:"reason,omitempty" json:"reason,omitempty"`
+
+	Since time.Time `firestore:"since" json:"since"`
+}
+
+// ControlState is the runtime control state, persisted in the
+// _firesync_control/state document.
+type ControlState struct {
+	Paused []Pause `firestore:"paused" json:"paused"`
+}
+
+// paused returns the pause matching the document, if any.
+func (s *ControlState) paused(name *model.DocumentName) (Pause, bool) {
+	for _, p := range s.Paused {
+		if name.MatchesCollection(p.Collection) {
+			return p, true
+		}
+	}
+	return Pause{}, false
+}
+
+// ControlStore persists the control state.
+type ControlStore interface {
+	Load(ctx context.Context) (*ControlState, error)
+
+	// Update atomically replaces the control state with the result of f.
+	Update(ctx context.Context, f func(*ControlState) error) (*ControlState, error)
+}
+
+type firestoreControlStore struct {
+	db  *firestore.Client
+	doc *firestore.DocumentRef
+}
+
+// NewFirestoreControlStore returns a ControlStore persisting the control state
+// in the _firesync_control/state document of db.
+func NewFirestoreControlStore(db *firestore.Client) *firestoreControlStore {
+	return &firestoreControlStore{
+		db:  db,
+		doc: db.Collection(ControlCollection).Doc(ControlStateID),
+	}
+}
+
+func (s *firestoreControlStore) Load(ctx context.Context) (*ControlState, error) {
+	snap, err := s.doc.Get(ctx)
+	return controlStateFromSnapshot(snap, err)
+}
+
+func (s *firestoreControlStore) Update(ctx context.Context, f func(*ControlState) error) (*ControlState, error) {
+	var state *ControlState
+	err := s.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var err error
+		state, err = controlStateFromSnapshot(tx.Get(s.doc))
+		if err != nil {
+			return err
+		}
+		if err := f(state); err != nil {
+			return err
+		}
+		return tx.Set(s.doc, state)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func controlStateFromSnapshot(snap *firestore.DocumentSnapshot, err error) (*ControlState, error) {
+	if status.Code(err) == codes.NotFound {
+		return &ControlState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &ControlState{}
+	if err := snap.DataTo(state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal control state: %w", err)
+	}
+	return state, nil
+}
+
+type controlMetrics struct {
+	PausedCollections metric.Int64ObservableGauge
+}
+
+func newControlMetrics(meter metric.Meter, c *Controller) controlMetrics {
+	PausedCollections, err := meter.Int64ObservableGauge("firesync.control.paused_collections",
+		metric.WithDescription("The collection patterns whose propagation and replication are paused, as last loaded by the instance."),
+		metric.WithUnit("1"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			for _, p := range c.cached() {
+				o.Observe(1, metric.WithAttributes(attribute.String("collection", p.Collection)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.control.paused_collections").
+			Msg("failed to create metric")
+	}
+
+	return controlMetrics{
+		PausedCollections: PausedCollections,
+	}
+}
+
+// Controller gives the propagator and replicator the runtime control state.
+// The state is cached for a short time, so pausing or resuming a collection
+// takes effect on every instance within the cache TTL.
+type Controller struct {
+	store   ControlStore
+	ttl     time.Duration
+	now     func() time.Time
+	metrics controlMetrics
+
+	mu       sync.Mutex
+	state    *ControlState
+	loadedAt time.Time
+}
+
+func NewController(store ControlStore, ttl time.Duration, meter metric.Meter) *Controller {
+	c := &Controller{
+		store: store,
+		ttl:   ttl,
+		now:   time.Now,
+	}
+	c.metrics = newControlMetrics(meter, c)
+	return c
+}
+
+// Paused returns the pause matching the document, if any. If the control
+// state can't be refreshed, the last state loaded is used.
+func (c *Controller) Paused(ctx context.Context, name *model.DocumentName) (Pause, bool, error) {
+	state, err := c.load(ctx)
+	if err != nil {
+		return Pause{}, false, err
+	}
+	p, paused := state.paused(name)
+	return p, paused, nil
+}
+
+func (c *Controller) load(ctx context.Context) (*ControlState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != nil && c.now().Sub(c.loadedAt) < c.ttl {
+		return c.state, nil
+	}
+
+	state, err := c.store.Load(ctx)
+	if err != nil {
+		if c.state == nil {
+			return nil, fmt.Errorf("failed to load control state: %w", err)
+		}
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to refresh control state, using the last one loaded")
+		return c.state, nil
+	}
+
+	c.state, c.loadedAt = state, c.now()
+	return state, nil
+}
+
+// cached returns the pauses of the last state loaded, without loading it.
+func (c *Controller) cached() []Pause {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == nil {
+		return nil
+	}
+	return c.state.Paused
+}
+
+func (c *Controller) set(state *ControlState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state, c.loadedAt = state, c.now()
+}
+
+// Pauses returns the collections currently paused, bypassing the cache.
+func (c *Controller) Pauses(ctx context.Context) ([]Pause, error) {
+	state, err := c.store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load control state: %w", err)
+	}
+	c.set(state)
+	return state.Paused, nil
+}
+
+// Pause pauses the collections matching pattern. Pausing a collection that is
+// already paused updates its reason.
+func (c *Controller) Pause(ctx context.Context, pattern, reason string) ([]Pause, error) {
+	state, err := c.store.Update(ctx, func(s *ControlState) error {
+		for i := range s.Paused {
+			if s.Paused[i].Collection == pattern {
+				s.Paused[i].Reason = reason
+				return nil
+			}
+		}
+		s.Paused = append(s.Paused, Pause{Collection: pattern, Reason: reason, Since: c.now()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to pause %s: %w", pattern, err)
+	}
+	c.set(state)
+	return state.Paused, nil
+}
+
+// Resume resumes the collections matching pattern and reports whether they
+// were paused. Changes nacked while the collection was paused are processed
+// as they are redelivered.
+func (c *Controller) Resume(ctx context.Context, pattern string) ([]Pause, bool, error) {
+	var found bool
+	state, err := c.store.Update(ctx, func(s *ControlState) error {
+		n := len(s.Paused)
+		s.Paused = slices.DeleteFunc(s.Paused, func(p Pause) bool { return p.Collection == pattern })
+		found = len(s.Paused) != n
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to resume %s: %w", pattern, err)
+	}
+	c.set(state)
+	return state.Paused, found, nil
+}
+
+// controlOption configures the controller on both the propagator and the
+// replicator.
+type controlOption struct{ c *Controller }
+
+func (o controlOption) apply(p *propagator) { p.controller = o.c }
+
+func (o controlOption) applyReplicator(r *replicator) { r.controller = o.c }
+
+// WithController has changes to paused collections left unprocessed, with a
+// paused result, so they are redelivered once the collection is resumed. A nil
+// controller never pauses. It can be passed to both NewPropagator and
+// NewReplicator.
+func WithController(c *Controller) controlOption {
+	return controlOption{c: c}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+type memoryControlStore struct {
+	state *ControlState
+	loads int
+	err   error
+}
+
+func (s *memoryControlStore) Load(ctx context.Context) (*ControlState, error) {
+	s.loads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &ControlState{Paused: append([]Pause(nil), s.state.Paused...)}, nil
+}
+
+func (s *memoryControlStore) Update(ctx context.Context, f func(*ControlState) error) (*ControlState, error) {
+	state, err := s.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := f(state); err != nil {
+		return nil, err
+	}
+	s.state = state
+	return state, nil
+}
+
+func TestController_Paused(t *testing.T) {
+	store := &memoryControlStore{state: &ControlState{Paused: []Pause{{Collection: "users/*/sessions"}}}}
+	c := NewController(store, time.Minute, noop.Meter{})
+	now := time.Unix(100, 0)
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	session := &model.DocumentName{Path: "users/1/sessions/2"}
+	user := &model.DocumentName{Path: "users/1"}
+
+	if p, paused, err := c.Paused(ctx, session); err != nil || !paused || p.Collection != "users/*/sessions" {
+		t.Fatalf("Paused(session) = %+v, %v, %v", p, paused, err)
+	}
+	if _, paused, err := c.Paused(ctx, user); err != nil || paused {
+		t.Fatalf("Paused(user) = %v, %v, want not paused", paused, err)
+	}
+	if store.loads != 1 {
+		t.Fatalf("loads = %d, want the state to be cached", store.loads)
+	}
+
+	// other instances' changes are seen once the cache expires, and the last
+	// state is kept if it can't be refreshed
+	store.state = &ControlState{}
+	store.err = errors.New("unavailable")
+	now = now.Add(time.Minute)
+	if _, paused, err := c.Paused(ctx, session); err != nil || !paused {
+		t.Fatalf("Paused() with a failed refresh = %v, %v, want the stale state", paused, err)
+	}
+
+	store.err = nil
+	if _, paused, err := c.Paused(ctx, session); err != nil || paused {
+		t.Fatalf("Paused() after refresh = %v, %v, want resumed", paused, err)
+	}
+}
+
+func TestController_LoadError(t *testing.T) {
+	c := NewController(&memoryControlStore{err: errors.New("unavailable")}, time.Minute, noop.Meter{})
+	if _, _, err := c.Paused(context.Background(), &model.DocumentName{Path: "users/1"}); err == nil {
+		t.Fatal("Paused() expected an error without a state loaded")
+	}
+}
+
+func TestController_PauseResume(t *testing.T) {
+	store := &memoryControlStore{state: &ControlState{}}
+	c := NewController(store, time.Hour, noop.Meter{})
+	ctx := context.Background()
+	name := &model.DocumentName{Path: "users/1"}
+
+	// prime the cache, pausing must take effect on this instance right away
+	if _, paused, _ := c.Paused(ctx, name); paused {
+		t.Fatal("users paused before pausing")
+	}
+
+	if _, err := c.Pause(ctx, "users", "migration"); err != nil {
+		t.Fatalf("Pause() unexpected error: %v", err)
+	}
+	paused, err := c.Pause(ctx, "users", "still migrating")
+	if err != nil || len(paused) != 1 || paused[0].Reason != "still migrating" {
+		t.Fatalf("Pause() again = %+v, %v, want the reason updated", paused, err)
+	}
+	if _, isPaused, _ := c.Paused(ctx, name); !isPaused {
+		t.Fatal("users not paused after pausing")
+	}
+
+	paused, found, err := c.Resume(ctx, "users")
+	if err != nil || !found || len(paused) != 0 {
+		t.Fatalf("Resume() = %+v, %v, %v", paused, found, err)
+	}
+	if _, isPaused, _ := c.Paused(ctx, name); isPaused {
+		t.Fatal("users paused after resuming")
+	}
+	if _, found, _ := c.Resume(ctx, "users"); found {
+		t.Fatal("Resume() found a collection that wasn't paused")
+	}
+}
+
+func TestPropagate_Paused(t *testing.T) {
+	topic := &mockTopic{}
+	tx := &mockTx{get: func(string) (DocumentSnapshot, error) {
+		t.Fatal("paused event should not be processed")
+		return nil, nil
+	}}
+	c := NewController(&memoryControlStore{state: &ControlState{Paused: []Pause{{Collection: "users"}}}}, time.Minute, noop.Meter{})
+	svc := NewPropagator(topic, &mockFirestore{tx: tx}, time.Second, noop.Meter{}, WithController(c))
+
+	res, err := svc.Propagate(context.Background(), sampleEvent(model.EventTypeUpdated, time.Now()))
+	if err != nil || res != PropagationResultPaused {
+		t.Fatalf("res=%v err=%v, want paused", res, err)
+	}
+	if topic.msg != nil {
+		t.Fatal("paused event was published")
+	}
+}
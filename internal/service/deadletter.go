@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// DeadLetter is a message that failed permanently and was acknowledged
+// without being processed.
+type DeadLetter struct {
+	// Reason describes why the message failed.
+	Reason string
+
+	// Class is the class of the failure.
+	Class ErrorClass
+
+	// Attributes are the attributes of the original message, e.g. the
+	// CloudEvent headers of a propagate request.
+	Attributes map[string]string
+
+	// Data is the payload of the original message.
+	Data []byte
+}
+
+// maxAttributeValueSize is the maximum size of a Pub/Sub attribute value.
+const maxAttributeValueSize = 1024
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+type deadLetterMetrics struct {
+	DeadLetterCount metric.Int64Counter
+}
+
+func newDeadLetterMetrics(meter metric.Meter) deadLetterMetrics {
+	DeadLetterCount, err := meter.Int64Counter("firesync.dead_letter.count",
+		metric.WithDescription("The total number of messages that failed permanently and were recorded in the dead-letter sink."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.dead_letter.count").
+			Msg("failed to create metric")
+		DeadLetterCount = noop.Int64Counter{}
+	}
+
+	return deadLetterMetrics{
+		DeadLetterCount: DeadLetterCount,
+	}
+}
+
+type deadLetterQueue struct {
+	topic   PubSubTopic
+	metrics deadLetterMetrics
+}
+
+// NewDeadLetterQueue returns a sink for permanently failed messages. Every
+// dead letter is logged, and also published to topic unless it is nil, so it
+// can be inspected and replayed later.
+func NewDeadLetterQueue(topic PubSubTopic, meter metric.Meter) *deadLetterQueue {
+	return &deadLetterQueue{
+		topic:   topic,
+		metrics: newDeadLetterMetrics(meter),
+	}
+}
+
+func (q *deadLetterQueue) Send(ctx context.Context, dl *DeadLetter) error {
+	zerolog.Ctx(ctx).Error().
+		Str("reason", dl.Reason).
+		Stringer("error_class", dl.Class).
+		Interface("attributes", dl.Attributes).
+		Int("data_size", len(dl.Data)).
+		Msg("dead letter")
+
+	if q.topic != nil {
+		attrs := make(map[string]string, len(dl.Attributes)+3)
+		for k, v := range dl.Attributes {
+			attrs[k] = v
+		}
+		attrs["dead-letter-reason"] = truncate(dl.Reason, maxAttributeValueSize)
+		attrs["dead-letter-class"] = dl.Class.String()
+		attrs["dead-letter-time"] = time.Now().Format(time.RFC3339Nano)
+
+		res := q.topic.Publish(ctx, &pubsub.Message{
+			Data:       dl.Data,
+			Attributes: attrs,
+		})
+		if _, err := res.Get(ctx); err != nil {
+			return fmt.Errorf("failed to publish dead letter: %w", err)
+		}
+	}
+
+	q.metrics.DeadLetterCount.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("class", dl.Class.String()),
+	))
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DedupCollection is the internal collection where the Firestore backed
+// deduplication store records processed message IDs.
+const DedupCollection = model.InternalCollectionPrefix + "dedup"
+
+// DedupStore remembers the keys of messages that were already processed.
+type DedupStore interface {
+	Seen(ctx context.Context, key string) (bool, error)
+	Record(ctx context.Context, key string) error
+}
+
+type memoryDedupEntry struct {
+	key string
+	exp time.Time
+}
+
+type memoryDedupStore struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+// NewMemoryDedupStore returns a DedupStore keeping the size most recently
+// recorded keys in memory for up to ttl.
+func NewMemoryDedupStore(size int, ttl time.Duration) *memoryDedupStore {
+	return &memoryDedupStore{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	if s.now().After(elem.Value.(*memoryDedupEntry).exp) {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+		return false, nil
+	}
+
+	s.lru.MoveToFront(elem)
+	return true, nil
+}
+
+func (s *memoryDedupStore) Record(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp := s.now().Add(s.ttl)
+	if elem, ok := s.entries[key]; ok {
+		elem.Value.(*memoryDedupEntry).exp = exp
+		s.lru.MoveToFront(elem)
+		return nil
+	}
+
+	s.entries[key] = s.lru.PushFront(&memoryDedupEntry{key: key, exp: exp})
+	for s.lru.Len() > s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryDedupEntry).key)
+	}
+	return nil
+}
+
+type firestoreDedupRecord struct {
+	Key        string    `firestore:"key"`
+	Expiration time.Time `firestore:"exp"`
+}
+
+type firestoreDedupStore struct {
+	db  *firestore.Client
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewFirestoreDedupStore returns a DedupStore that records keys in the
+// _firesync_dedup collection, so they are shared by every instance. Records
+// carry their expiration in the exp field, which should be configured as the
+// collection's TTL policy to have them cleaned up.
+func NewFirestoreDedupStore(db *firestore.Client, ttl time.Duration) *firestoreDedupStore {
+	return &firestoreDedupStore{
+		db:  db,
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+func dedupDocID(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func (s *firestoreDedupStore) doc(key string) *firestore.DocumentRef {
+	return s.db.Collection(DedupCollection).Doc(dedupDocID(key))
+}
+
+func (s *firestoreDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	snap, err := s.doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	record := &firestoreDedupRecord{}
+	if err := snap.DataTo(record); err != nil {
+		return false, fmt.Errorf("failed to unmarshal dedup record: %w", err)
+	}
+
+	// TTL policies delete expired documents eventually, not immediately
+	return s.now().Before(record.Expiration), nil
+}
+
+func (s *firestoreDedupStore) Record(ctx context.Context, key string) error {
+	_, err := s.doc(key).Set(ctx, &firestoreDedupRecord{
+		Key:        key,
+		Expiration: s.now().Add(s.ttl),
+	})
+	return err
+}
+
+type tieredDedupStore []DedupStore
+
+// NewTieredDedupStore returns a DedupStore that checks each store in order,
+// typically a fast local cache first and a shared store last. Keys are
+// recorded in every store.
+func NewTieredDedupStore(stores ...DedupStore) tieredDedupStore {
+	return tieredDedupStore(stores)
+}
+
+func (s tieredDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	for i, store := range s {
+		seen, err := store.Seen(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if seen {
+			// warm up the faster tiers
+			for _, prev := range s[:i] {
+				_ = prev.Record(ctx, key)
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s tieredDedupStore) Record(ctx context.Context, key string) error {
+	for _, store := range s {
+		if err := store.Record(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dedupMetrics struct {
+	DuplicateCount metric.Int64Counter
+}
+
+func newDedupMetrics(meter metric.Meter) dedupMetrics {
+	DuplicateCount, err := meter.Int64Counter("firesync.dedup.duplicate_count",
+		metric.WithDescription("The total number of redelivered messages that were acknowledged without being processed again."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.dedup.duplicate_count").
+			Msg("failed to create metric")
+		DuplicateCount = noop.Int64Counter{}
+	}
+
+	return dedupMetrics{
+		DuplicateCount: DuplicateCount,
+	}
+}
+
+// Deduplicator detects messages that were already processed, such as Pub/Sub
+// and Eventarc redeliveries.
+type Deduplicator struct {
+	store   DedupStore
+	metrics dedupMetrics
+}
+
+func NewDeduplicator(store DedupStore, meter metric.Meter) *Deduplicator {
+	return &Deduplicator{
+		store:   store,
+		metrics: newDedupMetrics(meter),
+	}
+}
+
+func dedupKey(scope, key string) string {
+	return scope + "/" + key
+}
+
+// IsDuplicate reports whether the message identified by key was already
+// processed within scope. Store failures are logged and the message is
+// treated as new, since processing is idempotent and only costlier.
+func (d *Deduplicator) IsDuplicate(ctx context.Context, scope, key string) bool {
+	if key == "" {
+		return false
+	}
+
+	seen, err := d.store.Seen(ctx, dedupKey(scope, key))
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str("dedup_key", key).
+			Msg("failed to check for duplicate message")
+		return false
+	}
+
+	if seen {
+		d.metrics.DuplicateCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("scope", scope),
+		))
+	}
+	return seen
+}
+
+// MarkProcessed records that the message identified by key was processed
+// within scope.
+func (d *Deduplicator) MarkProcessed(ctx context.Context, scope, key string) {
+	if key == "" {
+		return
+	}
+
+	if err := d.store.Record(ctx, dedupKey(scope, key)); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str("dedup_key", key).
+			Msg("failed to record processed message")
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	s := NewMemoryDedupStore(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	seen := func(key string) bool {
+		t.Helper()
+		ok, err := s.Seen(ctx, key)
+		if err != nil {
+			t.Fatalf("Seen(%q): %v", key, err)
+		}
+		return ok
+	}
+
+	if seen("a") {
+		t.Fatalf("a seen before being recorded")
+	}
+	_ = s.Record(ctx, "a")
+	_ = s.Record(ctx, "b")
+	if !seen("a") || !seen("b") {
+		t.Fatalf("recorded keys not seen")
+	}
+
+	// a was used more recently, so b is evicted
+	_ = seen("a")
+	_ = s.Record(ctx, "c")
+	if seen("b") {
+		t.Fatalf("least recently used key not evicted")
+	}
+	if !seen("a") || !seen("c") {
+		t.Fatalf("recent keys evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if seen("a") {
+		t.Fatalf("expired key seen")
+	}
+}
+
+type failingDedupStore struct{ err error }
+
+func (s failingDedupStore) Seen(context.Context, string) (bool, error) { return false, s.err }
+func (s failingDedupStore) Record(context.Context, string) error       { return s.err }
+
+func TestTieredDedupStore(t *testing.T) {
+	ctx := context.Background()
+	fast := NewMemoryDedupStore(10, time.Minute)
+	slow := NewMemoryDedupStore(10, time.Minute)
+	s := NewTieredDedupStore(fast, slow)
+
+	_ = slow.Record(ctx, "a")
+	if ok, err := s.Seen(ctx, "a"); err != nil || !ok {
+		t.Fatalf("Seen(a) = %v %v, want true", ok, err)
+	}
+	if ok, _ := fast.Seen(ctx, "a"); !ok {
+		t.Fatalf("fast tier not warmed up")
+	}
+
+	_ = s.Record(ctx, "b")
+	if ok, _ := slow.Seen(ctx, "b"); !ok {
+		t.Fatalf("key not recorded in every tier")
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	ctx := context.Background()
+	d := NewDeduplicator(NewMemoryDedupStore(10, time.Minute), noop.Meter{})
+
+	if d.IsDuplicate(ctx, "propagate", "1") {
+		t.Fatalf("new message reported as duplicate")
+	}
+	d.MarkProcessed(ctx, "propagate", "1")
+	if !d.IsDuplicate(ctx, "propagate", "1") {
+		t.Fatalf("processed message not reported as duplicate")
+	}
+	if d.IsDuplicate(ctx, "replicate", "1") {
+		t.Fatalf("scopes must not share keys")
+	}
+
+	d.MarkProcessed(ctx, "propagate", "")
+	if d.IsDuplicate(ctx, "propagate", "") {
+		t.Fatalf("messages without ID must never be duplicates")
+	}
+
+	// store failures fail open
+	d = NewDeduplicator(failingDedupStore{errors.New("unavailable")}, noop.Meter{})
+	if d.IsDuplicate(ctx, "propagate", "1") {
+		t.Fatalf("store failure reported as duplicate")
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorClass tells callers whether an operation that failed is worth retrying.
+type ErrorClass uint8
+
+const (
+	// ErrorClassUnknown errors could not be classified. They are retried.
+	ErrorClassUnknown ErrorClass = iota
+
+	// ErrorClassTransient errors are caused by temporary conditions, such as
+	// an unavailable backend or a timeout, and are likely to succeed on retry.
+	ErrorClassTransient
+
+	// ErrorClassContention errors are caused by concurrent transactions on the
+	// same documents and are likely to succeed on retry after a backoff.
+	ErrorClassContention
+
+	// ErrorClassPermanent errors will fail no matter how many times they are
+	// retried, such as malformed events or data.
+	ErrorClassPermanent
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassUnknown:
+		return "unknown"
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassContention:
+		return "contention"
+	case ErrorClassPermanent:
+		return "permanent"
+	default:
+		return fmt.Sprintf("unknown (%d)", c)
+	}
+}
+
+// Error is an error annotated with its class.
+type Error struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func permanent(err error) error {
+	return &Error{Class: ErrorClassPermanent, Err: err}
+}
+
+// ClassifyError returns the class of err. Errors explicitly classified by the
+// service layer take precedence, otherwise the class is derived from the gRPC
+// status code returned by the Google Cloud clients.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassUnknown
+	}
+
+	var svcErr *Error
+	if errors.As(err, &svcErr) {
+		return svcErr.Class
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ErrorClassTransient
+	}
+
+	switch status.Code(err) {
+	case codes.Aborted:
+		return ErrorClassContention
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Canceled, codes.Internal:
+		return ErrorClassTransient
+	case codes.InvalidArgument, codes.OutOfRange, codes.Unimplemented:
+		return ErrorClassPermanent
+	default:
+		return ErrorClassUnknown
+	}
+}
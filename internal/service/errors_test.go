@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ErrorClassUnknown},
+		{"plain", errors.New("boom"), ErrorClassUnknown},
+		{"permanent", permanent(errors.New("bad")), ErrorClassPermanent},
+		{"wrapped permanent", fmt.Errorf("tx: %w", permanent(errors.New("bad"))), ErrorClassPermanent},
+		{"aborted", status.Error(codes.Aborted, "contention"), ErrorClassContention},
+		{"wrapped aborted", fmt.Errorf("tx: %w", status.Error(codes.Aborted, "contention")), ErrorClassContention},
+		{"unavailable", status.Error(codes.Unavailable, "down"), ErrorClassTransient},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "slow"), ErrorClassTransient},
+		{"context deadline", fmt.Errorf("tx: %w", context.DeadlineExceeded), ErrorClassTransient},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad path"), ErrorClassPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Fatalf("ClassifyError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPropagate_UnmarshalTombstoneIsPermanent(t *testing.T) {
+	tx := &mockTx{
+		get: func(string) (DocumentSnapshot, error) {
+			return &mockSnap{exists: true, err: errors.New("cannot unmarshal")}, nil
+		},
+	}
+	svc := NewPropagator(&mockTopic{}, &mockFirestore{tx: tx}, time.Second, noop.Meter{})
+	evt := sampleEvent(model.EventTypeUpdated, time.Unix(1, 0))
+	_, err := svc.Propagate(context.Background(), evt)
+	if got := ClassifyError(err); got != ErrorClassPermanent {
+		t.Fatalf("ClassifyError(%v) = %v, want %v", err, got, ErrorClassPermanent)
+	}
+}
+
+func TestDeadLetterQueue_Send(t *testing.T) {
+	topic := &mockTopic{}
+	q := NewDeadLetterQueue(topic, noop.Meter{})
+	dl := &DeadLetter{
+		Reason:     "bad event",
+		Class:      ErrorClassPermanent,
+		Attributes: map[string]string{"ce-id": "1"},
+		Data:       []byte("payload"),
+	}
+	if err := q.Send(context.Background(), dl); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if topic.msg == nil {
+		t.Fatalf("dead letter not published")
+	}
+	if string(topic.msg.Data) != "payload" {
+		t.Fatalf("Data = %q", topic.msg.Data)
+	}
+	attrs := topic.msg.Attributes
+	if attrs["ce-id"] != "1" || attrs["dead-letter-reason"] != "bad event" || attrs["dead-letter-class"] != "permanent" {
+		t.Fatalf("unexpected attributes: %v", attrs)
+	}
+
+	topic.result = &mockResult{err: errors.New("publish failed")}
+	if err := q.Send(context.Background(), dl); err == nil {
+		t.Fatalf("expected publish error")
+	}
+
+	// without a topic, dead letters are only logged
+	if err := NewDeadLetterQueue(nil, noop.Meter{}).Send(context.Background(), dl); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
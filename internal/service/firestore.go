@@ -2,9 +2,14 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // FirestoreClient defines the subset of Firestore functionality required by the
@@ -22,6 +27,7 @@ type Transaction interface {
 	Update(path string, updates []Update, ts time.Time) error
 	Delete(path string, ts time.Time) error
 	Create(path string, data interface{}) error
+	Set(path string, data interface{}) error
 }
 
 // DocumentSnapshot is a wrapper around Firestore's DocumentSnapshot allowing it
@@ -29,6 +35,15 @@ type Transaction interface {
 type DocumentSnapshot interface {
 	Exists() bool
 	DataTo(interface{}) error
+	UpdateTime() time.Time
+}
+
+// descendantDeleter is implemented by FirestoreClients able to delete the
+// documents nested under a document.
+type descendantDeleter interface {
+	// DeleteDescendants deletes the documents nested under the document at
+	// path for which del returns true, and returns how many were deleted.
+	DeleteDescendants(ctx context.Context, path string, del func(DocumentSnapshot) bool) (int, error)
 }
 
 // Update mirrors firestore.Update but allows us to decouple from the Firestore
@@ -58,6 +73,79 @@ func (c *firestoreClientAdapter) RunTransaction(ctx context.Context, f func(cont
 
 func (c *firestoreClientAdapter) Doc(path string) *firestore.DocumentRef { return c.Client.Doc(path) }
 
+func (c *firestoreClientAdapter) DeleteDescendants(ctx context.Context, path string, del func(DocumentSnapshot) bool) (int, error) {
+	bw := c.Client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	err := walkDescendants(ctx, c.Client.Doc(path), func(snap *firestore.DocumentSnapshot) error {
+		if !del(&documentSnapshotAdapter{snap}) {
+			return nil
+		}
+		// the precondition keeps documents written since they were read
+		job, err := bw.Delete(snap.Ref, firestore.LastUpdateTime(snap.UpdateTime))
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	bw.End()
+
+	deleted := 0
+	for _, job := range jobs {
+		_, jobErr := job.Results()
+		switch status.Code(jobErr) {
+		case codes.OK:
+			deleted++
+		case codes.FailedPrecondition, codes.NotFound:
+		default:
+			if err == nil {
+				err = jobErr
+			}
+		}
+	}
+	return deleted, err
+}
+
+// walkDescendants calls f with the snapshot of every existing document nested
+// under doc, at any depth. Missing documents are walked through, since they
+// can still have subcollections.
+func walkDescendants(ctx context.Context, doc *firestore.DocumentRef, f func(*firestore.DocumentSnapshot) error) error {
+	collections := doc.Collections(ctx)
+	for {
+		coll, err := collections.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list collections of %s: %w", doc.Path, err)
+		}
+
+		refs := coll.DocumentRefs(ctx)
+		for {
+			ref, err := refs.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list documents of %s: %w", coll.Path, err)
+			}
+
+			snap, err := ref.Get(ctx)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if snap != nil && snap.Exists() {
+				if err := f(snap); err != nil {
+					return err
+				}
+			}
+			if err := walkDescendants(ctx, ref, f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // transactionAdapter adapts firestore.Transaction to our Transaction interface.
 type transactionAdapter struct {
 	*firestore.Transaction
@@ -65,11 +153,13 @@ type transactionAdapter struct {
 }
 
 func (t *transactionAdapter) Get(path string) (DocumentSnapshot, error) {
+	// Firestore returns a non-nil snapshot alongside NotFound errors, keep it
+	// so callers can rely on Exists.
 	snap, err := t.Transaction.Get(t.client.Doc(path))
-	if err != nil {
+	if snap == nil {
 		return nil, err
 	}
-	return &documentSnapshotAdapter{snap}, nil
+	return &documentSnapshotAdapter{snap}, err
 }
 
 func (t *transactionAdapter) Update(path string, updates []Update, ts time.Time) error {
@@ -88,9 +178,15 @@ func (t *transactionAdapter) Create(path string, data interface{}) error {
 	return t.Transaction.Create(t.client.Doc(path), data)
 }
 
+func (t *transactionAdapter) Set(path string, data interface{}) error {
+	return t.Transaction.Set(t.client.Doc(path), data)
+}
+
 // documentSnapshotAdapter adapts firestore.DocumentSnapshot to our interface.
 type documentSnapshotAdapter struct{ *firestore.DocumentSnapshot }
 
 func (s *documentSnapshotAdapter) Exists() bool { return s.DocumentSnapshot.Exists() }
 
 func (s *documentSnapshotAdapter) DataTo(v interface{}) error { return s.DocumentSnapshot.DataTo(v) }
+
+func (s *documentSnapshotAdapter) UpdateTime() time.Time { return s.DocumentSnapshot.UpdateTime }
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/singleflight"
+)
+
+// Services are the propagator and replicator of a single database.
+type Services struct {
+	// Propagator is nil if changes to the database aren't propagated, such as
+	// in standby regions; their events are skipped.
+	Propagator interface {
+		Propagate(ctx context.Context, event *model.Event) (PropagationResult, error)
+	}
+	Replicator interface {
+		Replicate(ctx context.Context, msg *model.Message) (ReplicationResult, error)
+	}
+
+	// Check, if set, probes the database for readiness checks.
+	Check func(ctx context.Context) error
+
+	// Close, if set, releases the resources of the services, such as their
+	// Firestore client.
+	Close func() error
+}
+
+// OpenFunc creates the services of the database with the given resource name,
+// projects/{project_id}/databases/{database_id}.
+type OpenFunc func(ctx context.Context, database string) (*Services, error)
+
+type poolMetrics struct {
+	OpenDatabases metric.Int64ObservableGauge
+}
+
+func newPoolMetrics(meter metric.Meter, p *Pool) poolMetrics {
+	OpenDatabases, err := meter.Int64ObservableGauge("firesync.pool.open_databases",
+		metric.WithDescription("The databases whose services are open in the instance, out of the ones it serves."),
+		metric.WithUnit("1"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			for _, database := range p.open() {
+				o.Observe(1, metric.WithAttributes(attribute.String("database", database)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.pool.open_databases").
+			Msg("failed to create metric")
+	}
+
+	return poolMetrics{
+		OpenDatabases: OpenDatabases,
+	}
+}
+
+// Pool serves several databases from a single instance, routing every event
+// to the services of the database it belongs to. The services of a database
+// are opened on its first event or readiness check, and are kept until the
+// pool is closed.
+//
+// Changes are propagated by the services of their source database. Replicated
+// changes are applied to the served database with the same ID as their source
+// database, so the replicas of a database must share its ID, in the project of
+// their region, unless a path mapping maps them to another one. A pool serving
+// a single database routes every event to it.
+type Pool struct {
+	openFunc  OpenFunc
+	databases []string
+	byID      map[string]string
+	metrics   poolMetrics
+
+	pathMappings model.PathMappings
+
+	// opening deduplicates concurrent opens of a database, which happen
+	// outside mu so a slow database doesn't hold up the others.
+	opening singleflight.Group
+
+	mu       sync.Mutex
+	services map[string]*Services
+	closed   bool
+}
+
+type poolOption interface {
+	applyPool(*Pool)
+}
+
+// NewPool returns a pool serving the databases with the given resource names.
+// Their database IDs must be unique.
+func NewPool(databases []string, open OpenFunc, meter metric.Meter, opts ...poolOption) (*Pool, error) {
+	if len(databases) == 0 {
+		return nil, errors.New("no databases")
+	}
+
+	byID := make(map[string]string, len(databases))
+	for _, database := range databases {
+		_, id, err := model.ParseDatabaseName(database)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := byID[id]; ok {
+			return nil, fmt.Errorf("databases %s and %s have the same id", other, database)
+		}
+		byID[id] = database
+	}
+
+	p := &Pool{
+		openFunc:  open,
+		databases: databases,
+		byID:      byID,
+		services:  make(map[string]*Services, len(databases)),
+	}
+	for _, opt := range opts {
+		opt.applyPool(p)
+	}
+	p.metrics = newPoolMetrics(meter, p)
+	return p, nil
+}
+
+// Propagate propagates the event with the services of its source database.
+func (p *Pool) Propagate(ctx context.Context, event *model.Event) (PropagationResult, error) {
+	database := event.Source()
+	if len(p.databases) == 1 {
+		database = p.databases[0]
+	} else if p.byID[event.Name.DatabaseID] != database {
+		return PropagationResultError, permanent(fmt.Errorf("database %s is not served", database))
+	}
+
+	svc, err := p.get(ctx, database)
+	if err != nil {
+		return PropagationResultError, err
+	}
+	if svc.Propagator == nil {
+		zerolog.Ctx(ctx).Debug().Str("database", database).Msg("database isn't propagated, skipping event")
+		return PropagationResultSkipped, nil
+	}
+	return svc.Propagator.Propagate(ctx, event)
+}
+
+// Replicate replicates the message with the services of the served database
+// with the same ID as its source database, or the one it is mapped to.
+func (p *Pool) Replicate(ctx context.Context, msg *model.Message) (ReplicationResult, error) {
+	database := p.databases[0]
+	if len(p.databases) > 1 {
+		id, _ := p.pathMappings.Map(msg.Attributes["database-id"], msg.Attributes["document-path"])
+		var ok bool
+		if database, ok = p.byID[id]; !ok {
+			return ReplicationResultError, permanent(fmt.Errorf("no served database has the id %q", id))
+		}
+	}
+
+	svc, err := p.get(ctx, database)
+	if err != nil {
+		return ReplicationResultError, err
+	}
+	return svc.Replicator.Replicate(ctx, msg)
+}
+
+// Check probes a served database, opening its services if needed.
+func (p *Pool) Check(ctx context.Context, database string) error {
+	svc, err := p.get(ctx, database)
+	if err != nil {
+		return err
+	}
+	if svc.Check == nil {
+		return nil
+	}
+	return svc.Check(ctx)
+}
+
+// get returns the services of a served database, opening them if needed.
+// Concurrent callers share a single open of the database.
+func (p *Pool) get(ctx context.Context, database string) (*Services, error) {
+	if svc, ok := p.lookup(database); ok {
+		return svc, nil
+	}
+
+	v, err, _ := p.opening.Do(database, func() (any, error) {
+		if svc, ok := p.lookup(database); ok {
+			return svc, nil
+		}
+
+		svc, err := p.openFunc(ctx, database)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database %s: %w", database, err)
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.closed {
+			if svc.Close != nil {
+				err = svc.Close()
+			}
+			return nil, errors.Join(fmt.Errorf("database %s opened after the pool was closed", database), err)
+		}
+		p.services[database] = svc
+		zerolog.Ctx(ctx).Debug().Str("database", database).Msg("database opened")
+		return svc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Services), nil
+}
+
+// lookup returns the services of a database if they are open.
+func (p *Pool) lookup(database string) (*Services, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	svc, ok := p.services[database]
+	return svc, ok
+}
+
+// open returns the names of the databases whose services are open.
+func (p *Pool) open() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	databases := make([]string, 0, len(p.services))
+	for database := range p.services {
+		databases = append(databases, database)
+	}
+	return databases
+}
+
+// Close closes the services of every open database. Databases still being
+// opened are closed as soon as they are.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+
+	var errs error
+	for database, svc := range p.services {
+		if svc.Close == nil {
+			continue
+		}
+		if err := svc.Close(); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed to close database %s: %w", database, err))
+		}
+	}
+	clear(p.services)
+	return errs
+}
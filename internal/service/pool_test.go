@@ -0,0 +1,282 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// recordingServices records the database of the services that handled each
+// event.
+type recordingServices struct {
+	database string
+	handled  *[]string
+}
+
+func (s *recordingServices) Propagate(context.Context, *model.Event) (PropagationResult, error) {
+	*s.handled = append(*s.handled, s.database)
+	return PropagationResultSuccess, nil
+}
+
+func (s *recordingServices) Replicate(context.Context, *model.Message) (ReplicationResult, error) {
+	*s.handled = append(*s.handled, s.database)
+	return ReplicationResultSuccess, nil
+}
+
+// nopReplicator replicates every message successfully, and is safe for
+// concurrent use.
+type nopReplicator struct{}
+
+func (nopReplicator) Replicate(context.Context, *model.Message) (ReplicationResult, error) {
+	return ReplicationResultSuccess, nil
+}
+
+func newTestPool(t *testing.T, databases ...string) (*Pool, *[]string, *[]string) {
+	t.Helper()
+	var opened, handled, closed []string
+	pool, err := NewPool(databases, func(ctx context.Context, database string) (*Services, error) {
+		opened = append(opened, database)
+		s := &recordingServices{database: database, handled: &handled}
+		return &Services{
+			Propagator: s,
+			Replicator: s,
+			Close: func() error {
+				closed = append(closed, database)
+				return nil
+			},
+		}, nil
+	}, noop.Meter{})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := pool.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		slices.Sort(opened)
+		slices.Sort(closed)
+		if !slices.Equal(opened, closed) {
+			t.Errorf("opened %v, closed %v", opened, closed)
+		}
+	})
+	return pool, &handled, &opened
+}
+
+func TestNewPool_Invalid(t *testing.T) {
+	tests := map[string][]string{
+		"none":         nil,
+		"invalid name": {"acme"},
+		"same id":      {"projects/a/databases/acme", "projects/b/databases/acme"},
+	}
+	for name, databases := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewPool(databases, nil, noop.Meter{}); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestPool_Propagate(t *testing.T) {
+	pool, handled, opened := newTestPool(t, "projects/p/databases/a", "projects/p/databases/b")
+	event := func(projectID, databaseID string) *model.Event {
+		return &model.Event{Name: model.DocumentName{ProjectID: projectID, DatabaseID: databaseID, Path: "users/1"}}
+	}
+
+	for _, e := range []*model.Event{event("p", "b"), event("p", "a"), event("p", "b")} {
+		if res, err := pool.Propagate(context.Background(), e); err != nil || res != PropagationResultSuccess {
+			t.Fatalf("Propagate() = %v %v", res, err)
+		}
+	}
+	if want := []string{"projects/p/databases/b", "projects/p/databases/a", "projects/p/databases/b"}; !slices.Equal(*handled, want) {
+		t.Fatalf("handled = %v, want %v", *handled, want)
+	}
+	if len(*opened) != 2 {
+		t.Fatalf("opened = %v, want each database once", *opened)
+	}
+
+	for _, e := range []*model.Event{event("p", "c"), event("other", "a")} {
+		res, err := pool.Propagate(context.Background(), e)
+		if res != PropagationResultError || ClassifyError(err) != ErrorClassPermanent {
+			t.Fatalf("Propagate(%s) = %v %v, want permanent error", e.Source(), res, err)
+		}
+	}
+}
+
+func TestPool_PropagateStandby(t *testing.T) {
+	pool, err := NewPool([]string{"projects/p/databases/a"}, func(ctx context.Context, database string) (*Services, error) {
+		return &Services{}, nil
+	}, noop.Meter{})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	event := &model.Event{Name: model.DocumentName{ProjectID: "p", DatabaseID: "a", Path: "users/1"}}
+	if res, err := pool.Propagate(context.Background(), event); err != nil || res != PropagationResultSkipped {
+		t.Fatalf("Propagate() = %v %v, want skipped", res, err)
+	}
+}
+
+func TestPool_Replicate(t *testing.T) {
+	msg := func(databaseID string) *model.Message {
+		return &model.Message{Attributes: map[string]string{"project-id": "remote", "database-id": databaseID}}
+	}
+
+	pool, handled, _ := newTestPool(t, "projects/p/databases/a", "projects/p/databases/b")
+	for _, id := range []string{"a", "b"} {
+		if res, err := pool.Replicate(context.Background(), msg(id)); err != nil || res != ReplicationResultSuccess {
+			t.Fatalf("Replicate() = %v %v", res, err)
+		}
+	}
+	if want := []string{"projects/p/databases/a", "projects/p/databases/b"}; !slices.Equal(*handled, want) {
+		t.Fatalf("handled = %v, want %v", *handled, want)
+	}
+	res, err := pool.Replicate(context.Background(), msg("c"))
+	if res != ReplicationResultError || ClassifyError(err) != ErrorClassPermanent {
+		t.Fatalf("Replicate() = %v %v, want permanent error", res, err)
+	}
+
+	// a single database replicates every change
+	single, handled, _ := newTestPool(t, "projects/p/databases/a")
+	if _, err := single.Replicate(context.Background(), msg("other")); err != nil {
+		t.Fatalf("Replicate: %v", err)
+	}
+	if _, err := single.Propagate(context.Background(), &model.Event{Name: model.DocumentName{ProjectID: "x", DatabaseID: "y"}}); err != nil {
+		t.Fatalf("Propagate: %v", err)
+	}
+	if want := []string{"projects/p/databases/a", "projects/p/databases/a"}; !slices.Equal(*handled, want) {
+		t.Fatalf("handled = %v, want %v", *handled, want)
+	}
+}
+
+func TestPool_ReplicatePathMappings(t *testing.T) {
+	var handled []string
+	pool, err := NewPool([]string{"projects/p/databases/a", "projects/p/databases/mirror"}, func(ctx context.Context, database string) (*Services, error) {
+		s := &recordingServices{database: database, handled: &handled}
+		return &Services{Propagator: s, Replicator: s}, nil
+	}, noop.Meter{}, WithPathMappings(model.PathMapping{Source: "tenants", TargetDatabase: "mirror", Target: "tenants"}))
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	for _, p := range []string{"tenants/acme", "users/1"} {
+		msg := &model.Message{Attributes: map[string]string{"database-id": "a", "document-path": p}}
+		if _, err := pool.Replicate(context.Background(), msg); err != nil {
+			t.Fatalf("Replicate: %v", err)
+		}
+	}
+	if want := []string{"projects/p/databases/mirror", "projects/p/databases/a"}; !slices.Equal(handled, want) {
+		t.Fatalf("handled = %v, want %v", handled, want)
+	}
+}
+
+func TestPool_OpenOutsideLock(t *testing.T) {
+	var opens atomic.Int32
+	release := make(chan struct{})
+	pool, err := NewPool([]string{"projects/p/databases/a", "projects/p/databases/b"}, func(ctx context.Context, database string) (*Services, error) {
+		opens.Add(1)
+		if database == "projects/p/databases/a" {
+			<-release
+		}
+		return &Services{Replicator: nopReplicator{}}, nil
+	}, noop.Meter{})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	msg := func(databaseID string) *model.Message {
+		return &model.Message{Attributes: map[string]string{"database-id": databaseID}}
+	}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pool.Replicate(context.Background(), msg("a")); err != nil {
+				t.Errorf("Replicate(a): %v", err)
+			}
+		}()
+	}
+
+	// b opens while a is still opening
+	if _, err := pool.Replicate(context.Background(), msg("b")); err != nil {
+		t.Fatalf("Replicate(b): %v", err)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := opens.Load(); n != 2 {
+		t.Fatalf("opens = %d, want each database once", n)
+	}
+}
+
+func TestPool_OpenAfterClose(t *testing.T) {
+	opened := make(chan struct{})
+	release := make(chan struct{})
+	var closed atomic.Bool
+	pool, err := NewPool([]string{"projects/p/databases/a"}, func(ctx context.Context, database string) (*Services, error) {
+		close(opened)
+		<-release
+		return &Services{Close: func() error {
+			closed.Store(true)
+			return nil
+		}}, nil
+	}, noop.Meter{})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := pool.Replicate(context.Background(), &model.Message{})
+		errc <- err
+	}()
+	<-opened
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	close(release)
+
+	if err := <-errc; err == nil {
+		t.Fatalf("expected error for a database opened after the pool was closed")
+	}
+	if !closed.Load() {
+		t.Fatalf("database opened after the pool was closed wasn't closed")
+	}
+}
+
+func TestPool_Check(t *testing.T) {
+	const (
+		a = "projects/p/databases/a"
+		b = "projects/p/databases/b"
+	)
+	errUnreachable := errors.New("unreachable")
+	pool, err := NewPool([]string{a, b}, func(ctx context.Context, database string) (*Services, error) {
+		svc := &Services{Replicator: nopReplicator{}}
+		if database == b {
+			svc.Check = func(context.Context) error { return errUnreachable }
+		}
+		return svc, nil
+	}, noop.Meter{})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	ctx := context.Background()
+	if err := pool.Check(ctx, a); err != nil {
+		t.Fatalf("Check(%s) = %v", a, err)
+	}
+	if err := pool.Check(ctx, b); !errors.Is(err, errUnreachable) {
+		t.Fatalf("Check(%s) = %v, want %v", b, err, errUnreachable)
+	}
+	if got := pool.open(); len(got) != 2 {
+		t.Fatalf("open databases = %v, want both", got)
+	}
+}
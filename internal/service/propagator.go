@@ -3,9 +3,11 @@ package service
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
 	"github.com/joaopenteado/firesync/internal/model"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -23,6 +25,7 @@ import (
 
 type propagationMetrics struct {
 	PropagationEventCount metric.Int64Counter
+	PropagationErrorCount metric.Int64Counter
 	PropagationLatency    metric.Int64Histogram
 }
 
@@ -38,6 +41,17 @@ func newPropagationMetrics(meter metric.Meter) propagationMetrics {
 		PropagationEventCount = noop.Int64Counter{}
 	}
 
+	PropagationErrorCount, err := meter.Int64Counter("firesync.propagation.error_count",
+		metric.WithDescription("The total number of changes that failed to propagate, by error class."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.propagation.error_count").
+			Msg("failed to create metric")
+		PropagationErrorCount = noop.Int64Counter{}
+	}
+
 	PropagationLatency, err := meter.Int64Histogram("firesync.propagation.latency",
 		metric.WithDescription("The latency of propagating changes to the Pub/Sub topic, from the moment the change happened in the source database to the moment the change was propagated to the Pub/Sub topic."),
 		metric.WithUnit("ms"),
@@ -51,6 +65,7 @@ func newPropagationMetrics(meter metric.Meter) propagationMetrics {
 
 	return propagationMetrics{
 		PropagationEventCount: PropagationEventCount,
+		PropagationErrorCount: PropagationErrorCount,
 		PropagationLatency:    PropagationLatency,
 	}
 }
@@ -60,7 +75,37 @@ type propagator struct {
 	db      FirestoreClient
 	metrics propagationMetrics
 
-	tombstoneTTL time.Duration
+	tombstoneTTL      time.Duration
+	tombstoneTTLRules []TombstoneTTLRule
+
+	subtreeDeleteCollections subtreeCollections
+
+	// priorities break ties between concurrent deletes and writes of the
+	// documents under subtree tombstones.
+	priorities model.Priorities
+
+	controller *Controller
+
+	transformer            Transformer
+	schemaVersion          int
+	publishedSchemaVersion int
+}
+
+type propagatorOption interface {
+	apply(*propagator)
+}
+
+type funcPropagatorOption func(*propagator)
+
+func (f funcPropagatorOption) apply(p *propagator) { f(p) }
+
+// WithTombstoneTTLRules overrides the tombstone TTL for documents in
+// collections matching the given rules. Rules are evaluated in order and the
+// first match wins; unmatched documents use the default TTL.
+func WithTombstoneTTLRules(rules ...TombstoneTTLRule) propagatorOption {
+	return funcPropagatorOption(func(p *propagator) {
+		p.tombstoneTTLRules = append(p.tombstoneTTLRules, rules...)
+	})
 }
 
 type PropagationResult uint
@@ -70,6 +115,10 @@ const (
 	PropagationResultSuccess
 	PropagationResultSkipped
 	PropagationResultError
+
+	// PropagationResultPaused events belong to a paused collection and were
+	// left unprocessed, to be redelivered once it is resumed.
+	PropagationResultPaused
 )
 
 func (r PropagationResult) String() string {
@@ -82,18 +131,24 @@ func (r PropagationResult) String() string {
 		return "skipped"
 	case PropagationResultError:
 		return "error"
+	case PropagationResultPaused:
+		return "paused"
 	default:
 		return fmt.Sprintf("unknown (%d)", r)
 	}
 }
 
-func NewPropagator(topic PubSubTopic, db FirestoreClient, tombstoneTTL time.Duration, meter metric.Meter) *propagator {
-	return &propagator{
+func NewPropagator(topic PubSubTopic, db FirestoreClient, tombstoneTTL time.Duration, meter metric.Meter, opts ...propagatorOption) *propagator {
+	svc := &propagator{
 		topic:        topic,
 		db:           db,
 		metrics:      newPropagationMetrics(meter),
 		tombstoneTTL: tombstoneTTL,
 	}
+	for _, opt := range opts {
+		opt.apply(svc)
+	}
+	return svc
 }
 
 func (svc *propagator) Propagate(ctx context.Context, event *model.Event) (result PropagationResult, err error) {
@@ -105,19 +160,43 @@ func (svc *propagator) Propagate(ctx context.Context, event *model.Event) (resul
 		Logger()
 	ctx = logger.WithContext(ctx)
 
+	database := attribute.String("database", event.Source())
 	defer func() {
 		svc.metrics.PropagationEventCount.Add(ctx, 1, metric.WithAttributes(
 			attribute.String("result", result.String()),
+			database,
 		))
 
 		if result == PropagationResultSuccess {
-			svc.metrics.PropagationLatency.Record(ctx, time.Since(event.Timestamp).Milliseconds())
+			svc.metrics.PropagationLatency.Record(ctx, time.Since(event.Timestamp).Milliseconds(), metric.WithAttributes(database))
+		}
+
+		if err != nil {
+			svc.metrics.PropagationErrorCount.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("class", ClassifyError(err).String()),
+				database,
+			))
 		}
 	}()
 
+	switch event.Type {
+	case model.EventTypeCreated, model.EventTypeUpdated, model.EventTypeDeleted:
+		if svc.controller == nil {
+			break
+		}
+		pause, paused, err := svc.controller.Paused(ctx, &event.Name)
+		if err != nil {
+			return PropagationResultError, err
+		}
+		if paused {
+			logger.Debug().Str("paused_collection", pause.Collection).Msg("collection paused, leaving the event for redelivery")
+			return PropagationResultPaused, nil
+		}
+	}
+
 	var shouldPropagate bool
 	switch event.Type {
-	case model.EventTypeReplicated, model.EventTypeTombstone:
+	case model.EventTypeReplicated, model.EventTypeTombstone, model.EventTypeInternal:
 		shouldPropagate = false
 
 	case model.EventTypeCreated:
@@ -130,7 +209,7 @@ func (svc *propagator) Propagate(ctx context.Context, event *model.Event) (resul
 		shouldPropagate, err = svc.processDeleteEvent(ctx, event)
 
 	default:
-		return PropagationResultUnknown, fmt.Errorf("unknown event type: %s", event.Type)
+		return PropagationResultUnknown, permanent(fmt.Errorf("unknown event type: %s", event.Type))
 	}
 
 	if err != nil {
@@ -142,18 +221,40 @@ func (svc *propagator) Propagate(ctx context.Context, event *model.Event) (resul
 		return PropagationResultSkipped, nil
 	}
 
-	marshaledRawEvent, err := proto.Marshal(event.Data)
+	data := event.Data
+	if svc.transformer != nil && svc.schemaVersion != svc.publishedSchemaVersion && data.GetValue() != nil {
+		data = proto.Clone(data).(*firestoredata.DocumentEventData)
+		if data.Value.Fields == nil {
+			data.Value.Fields = make(map[string]*firestoredata.Value)
+		}
+		if err := svc.transformer.Transform(&event.Name, data.Value.Fields, svc.schemaVersion, svc.publishedSchemaVersion); err != nil {
+			return PropagationResultError, permanent(fmt.Errorf("failed to transform document: %w", err))
+		}
+	}
+
+	marshaledRawEvent, err := proto.Marshal(data)
 	if err != nil {
-		return PropagationResultError, fmt.Errorf("failed to marshal event: %w", err)
+		return PropagationResultError, permanent(fmt.Errorf("failed to marshal event: %w", err))
 	}
 
 	attrs := map[string]string{
-		"content-type":  "application/protobuf",
-		"event-time":    event.Timestamp.Format(time.RFC3339Nano),
-		"event-type":    event.Type.String(),
-		"project-id":    event.Name.ProjectID,
-		"database-id":   event.Name.DatabaseID,
-		"document-path": event.Name.Path,
+		"content-type":   "application/protobuf",
+		"event-time":     event.Timestamp.Format(time.RFC3339Nano),
+		"event-type":     event.Type.String(),
+		"project-id":     event.Name.ProjectID,
+		"database-id":    event.Name.DatabaseID,
+		"document-path":  event.Name.Path,
+		"schema-version": strconv.Itoa(svc.publishedSchemaVersion),
+	}
+	if event.Type == model.EventTypeDeleted {
+		// replicate the tombstone as recorded by this region, so it expires
+		// at the same time everywhere
+		ttl, ttlRule := svc.tombstoneTTLFor(&event.Name)
+		attrs["tombstone-exp"] = event.Timestamp.Add(ttl).Format(time.RFC3339Nano)
+		attrs["tombstone-ttl-rule"] = ttlRule
+		if svc.subtreeDeleteCollections.matches(&event.Name) {
+			attrs["subtree-delete"] = "true"
+		}
 	}
 	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(attrs))
 
@@ -186,7 +287,7 @@ func (svc *propagator) processCreateEvent(ctx context.Context, event *model.Even
 		if snap.Exists() {
 			tombstone := &model.Tombstone{}
 			if err := snap.DataTo(tombstone); err != nil {
-				return fmt.Errorf("failed to unmarshal tombstone: %w", err)
+				return permanent(fmt.Errorf("failed to unmarshal tombstone: %w", err))
 			}
 
 			if tombstone.Timestamp.AsTime().After(event.Timestamp) {
@@ -204,6 +305,22 @@ func (svc *propagator) processCreateEvent(ctx context.Context, event *model.Even
 			// collector
 		}
 
+		// a parent document might have been deleted recursively after this
+		// document was created
+		newer, err := svc.subtreeDeleteCollections.hasNewerTombstone(tx, event, svc.priorities)
+		if err != nil {
+			return err
+		}
+		if newer {
+			logger.Debug().Msg("newer subtree tombstone exists, skipping propagation and deleting the document")
+			err = tx.Delete(event.Name.Path, event.Timestamp)
+			if status.Code(err) == codes.FailedPrecondition {
+				logger.Debug().Msg("stale event, skipping propagation")
+				return nil
+			}
+			return err
+		}
+
 		metadata := &model.Metadata{
 			Timestamp: timestamppb.New(event.Timestamp),
 			Source:    fmt.Sprintf("projects/%s/databases/%s", event.Name.ProjectID, event.Name.DatabaseID),
@@ -240,27 +357,60 @@ func (svc *propagator) processCreateEvent(ctx context.Context, event *model.Even
 func (svc *propagator) processDeleteEvent(ctx context.Context, event *model.Event) (shouldPropagate bool, err error) {
 	logger := zerolog.Ctx(ctx)
 
+	ttl, ttlRule := svc.tombstoneTTLFor(&event.Name)
 	tombstone := &model.Tombstone{
 		Document:   svc.db.Doc(event.Name.Path),
 		Timestamp:  timestamppb.New(event.Timestamp),
 		Source:     fmt.Sprintf("projects/%s/databases/%s", event.Name.ProjectID, event.Name.DatabaseID),
 		Trace:      trace.SpanContextFromContext(ctx).TraceID().String(),
-		Expiration: timestamppb.New(event.Timestamp.Add(svc.tombstoneTTL)),
+		Expiration: timestamppb.New(event.Timestamp.Add(ttl)),
+		TTLRule:    ttlRule,
 	}
+	subtree := svc.subtreeDeleteCollections.matches(&event.Name)
 
 	err = svc.db.RunTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+		// Firestore transactions require all reads to happen before writes.
+
 		// check if a new document has been created
 		snap, err := tx.Get(event.Name.Path)
 		if err != nil && status.Code(err) != codes.NotFound {
 			return err
 		}
 
-		if snap.Exists() {
+		// check if a more recent tombstone exists
+		tombstoneSnap, err := tx.Get(event.Name.TombstonePath())
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		var subtreeSnap DocumentSnapshot
+		if subtree {
+			subtreeSnap, err = tx.Get(event.Name.SubtreeTombstonePath())
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+		}
+
+		var existing *model.Tombstone
+		if tombstoneSnap != nil && tombstoneSnap.Exists() {
+			existing = &model.Tombstone{}
+			if err := tombstoneSnap.DataTo(existing); err != nil {
+				return permanent(fmt.Errorf("failed to unmarshal tombstone: %w", err))
+			}
+
+			// replicated deletes aren't new changes
+			if existing.ReplicatedDelete(tombstone.Source, tombstoneSnap.UpdateTime(), event.Timestamp) {
+				logger.Debug().Str("source", existing.Source).Msg("replicated delete, skipping propagation")
+				return nil
+			}
+		}
+
+		if snap != nil && snap.Exists() {
 			var ts time.Time
 			md := struct {
 				Metadata *model.Metadata `firestore:"_firesync"`
 			}{}
-			if err := snap.DataTo(&md); err != nil {
+			if err := snap.DataTo(&md); err != nil || md.Metadata == nil {
 				// create change might have not been propagated yet
 				// use the create time of the document
 				ts = event.Timestamp
@@ -284,19 +434,14 @@ func (svc *propagator) processDeleteEvent(ctx context.Context, event *model.Even
 			}
 		}
 
-		// check if a more recent tombstone exists
-		snap, err = tx.Get(event.Name.TombstonePath())
-		if err != nil && status.Code(err) != codes.NotFound {
-			return err
-		}
-
-		if snap.Exists() {
-			tombstone := &model.Tombstone{}
-			if err := snap.DataTo(tombstone); err != nil {
-				return fmt.Errorf("failed to unmarshal tombstone: %w", err)
+		if subtree {
+			if err := writeSubtreeTombstone(tx, event, tombstone, subtreeSnap, svc.priorities); err != nil {
+				return err
 			}
+		}
 
-			if tombstone.Timestamp.AsTime().After(event.Timestamp) {
+		if existing != nil {
+			if existing.Timestamp.AsTime().After(event.Timestamp) {
 				logger.Debug().Msg("newer tombstone already exists, skipping propagation")
 				return nil
 			}
@@ -318,6 +463,10 @@ func (svc *propagator) processDeleteEvent(ctx context.Context, event *model.Even
 					Path:  "exp",
 					Value: tombstone.Expiration,
 				},
+				{
+					Path:  "ttl_rule",
+					Value: tombstone.TTLRule,
+				},
 			}, event.Timestamp)
 			if status.Code(err) == codes.FailedPrecondition {
 				logger.Debug().Msg("stale event, skipping propagation")
@@ -359,7 +508,7 @@ func (svc *propagator) processUpdateEvent(ctx context.Context, event *model.Even
 		if snap.Exists() {
 			tombstone := &model.Tombstone{}
 			if err := snap.DataTo(tombstone); err != nil {
-				return fmt.Errorf("failed to unmarshal tombstone: %w", err)
+				return permanent(fmt.Errorf("failed to unmarshal tombstone: %w", err))
 			}
 
 			if tombstone.Timestamp.AsTime().After(event.Timestamp) {
@@ -376,6 +525,25 @@ func (svc *propagator) processUpdateEvent(ctx context.Context, event *model.Even
 			}
 		}
 
+		// a parent document might have been deleted recursively after this
+		// update happened
+		newer, err := svc.subtreeDeleteCollections.hasNewerTombstone(tx, event, svc.priorities)
+		if err != nil {
+			return err
+		}
+		if newer {
+			logger.Debug().Msg("newer subtree tombstone exists, skipping propagation and deleting the document")
+			err := tx.Delete(event.Name.Path, event.Timestamp)
+			if status.Code(err) == codes.FailedPrecondition {
+				logger.Debug().Msg("stale event, skipping propagation")
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to delete document: %w", err)
+			}
+			return nil
+		}
+
 		metadata := &model.Metadata{
 			Timestamp: timestamppb.New(event.Timestamp),
 			Source:    fmt.Sprintf("projects/%s/databases/%s", event.Name.ProjectID, event.Name.DatabaseID),
@@ -58,6 +58,7 @@ type mockTx struct {
 	update func(string, []Update, time.Time) error
 	delete func(string, time.Time) error
 	create func(string, interface{}) error
+	set    func(string, interface{}) error
 }
 
 func (m *mockTx) Get(p string) (DocumentSnapshot, error) {
@@ -85,14 +86,24 @@ func (m *mockTx) Create(p string, data interface{}) error {
 	return nil
 }
 
+func (m *mockTx) Set(p string, data interface{}) error {
+	if m.set != nil {
+		return m.set(p, data)
+	}
+	return nil
+}
+
 type mockSnap struct {
-	exists bool
-	data   interface{}
-	err    error
+	exists     bool
+	data       interface{}
+	err        error
+	updateTime time.Time
 }
 
 func (s *mockSnap) Exists() bool { return s.exists }
 
+func (s *mockSnap) UpdateTime() time.Time { return s.updateTime }
+
 func (s *mockSnap) DataTo(dst interface{}) error {
 	if s.err != nil {
 		return s.err
@@ -258,3 +269,217 @@ func TestProcessDeleteEvent_TombstoneNewer(t *testing.T) {
 		t.Fatalf("should not propagate")
 	}
 }
+
+func TestProcessDeleteEvent_ReplicatedDelete(t *testing.T) {
+	// the replicator applies a delete made at t0 in another database, and
+	// commits it at t1
+	t0, t1 := time.Unix(2, 0), time.Unix(5, 0)
+	docs := map[string]*mockSnap{
+		defaultName.Path: {exists: true, updateTime: time.Unix(1, 0), data: &docMetadata{Metadata: &model.Metadata{
+			Timestamp: timestamppb.New(time.Unix(1, 0)),
+			Source:    defaultName.String(),
+		}}},
+	}
+	store := func(writes *int) *mockTx {
+		return &mockTx{
+			get: func(p string) (DocumentSnapshot, error) {
+				if snap, ok := docs[p]; ok {
+					return snap, nil
+				}
+				return &mockSnap{exists: false}, nil
+			},
+			delete: func(p string, _ time.Time) error {
+				*writes++
+				delete(docs, p)
+				return nil
+			},
+			set: func(p string, data interface{}) error {
+				*writes++
+				docs[p] = &mockSnap{exists: true, data: data, updateTime: t1}
+				return nil
+			},
+			update: func(string, []Update, time.Time) error {
+				*writes++
+				return nil
+			},
+			create: func(string, interface{}) error {
+				*writes++
+				return nil
+			},
+		}
+	}
+
+	var replicated int
+	replicator := NewReplicator(noop.Meter{}, &mockFirestore{tx: store(&replicated)})
+	msg := sampleMessage(t, model.EventTypeDeleted, t0, "database-id", "remote")
+	if res, err := replicator.Replicate(context.Background(), msg); err != nil || res != ReplicationResultSuccess {
+		t.Fatalf("Replicate() = %v %v", res, err)
+	}
+	if replicated != 2 {
+		t.Fatalf("replicator writes = %d, want the delete and the tombstone", replicated)
+	}
+
+	// the delete fires a local event at t1, which isn't a new change
+	var propagated int
+	svc := NewPropagator(&mockTopic{}, &mockFirestore{tx: store(&propagated)}, time.Second, noop.Meter{})
+	ok, err := svc.processDeleteEvent(context.Background(), sampleEvent(model.EventTypeDeleted, t1))
+	if err != nil || ok || propagated != 0 {
+		t.Fatalf("processDeleteEvent() = %v %v with %d writes, want the replicated delete skipped", ok, err, propagated)
+	}
+	if tomb := docs[defaultName.TombstonePath()].data.(*model.Tombstone); !tomb.Timestamp.AsTime().Equal(t0) || tomb.Source != "projects/p/databases/remote" {
+		t.Fatalf("tombstone = %v from %s, want the replicated one", tomb.Timestamp.AsTime(), tomb.Source)
+	}
+
+	// a later local delete of a recreated document is a new change
+	ok, err = svc.processDeleteEvent(context.Background(), sampleEvent(model.EventTypeDeleted, time.Unix(7, 0)))
+	if err != nil || !ok {
+		t.Fatalf("processDeleteEvent() = %v %v, want propagate", ok, err)
+	}
+}
+
+func TestProcessDeleteEvent_TombstoneTTLRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		wantTTL  time.Duration
+		wantRule string
+	}{
+		{"default", "users/1", time.Hour, DefaultTombstoneTTLRule},
+		{"first match", "users/1/sessions/a", time.Minute, "users/*/sessions"},
+		{"second rule", "devices/1", 30 * 24 * time.Hour, "devices"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created *model.Tombstone
+			tx := &mockTx{
+				get: func(string) (DocumentSnapshot, error) { return &mockSnap{exists: false}, nil },
+				create: func(p string, data interface{}) error {
+					created = data.(*model.Tombstone)
+					return nil
+				},
+			}
+			svc := NewPropagator(&mockTopic{}, &mockFirestore{tx: tx}, time.Hour, noop.Meter{},
+				WithTombstoneTTLRules(
+					TombstoneTTLRule{Pattern: "users/*/sessions", TTL: time.Minute},
+					TombstoneTTLRule{Pattern: "devices", TTL: 30 * 24 * time.Hour},
+				),
+			)
+			ts := time.Unix(1, 0)
+			evt := sampleEvent(model.EventTypeDeleted, ts)
+			evt.Name.Path = tt.path
+			if _, err := svc.processDeleteEvent(context.Background(), evt); err != nil {
+				t.Fatalf("err=%v", err)
+			}
+			if created == nil {
+				t.Fatalf("tombstone not created")
+			}
+			if got := created.Expiration.AsTime().Sub(ts); got != tt.wantTTL {
+				t.Errorf("ttl = %v, want %v", got, tt.wantTTL)
+			}
+			if created.TTLRule != tt.wantRule {
+				t.Errorf("rule = %q, want %q", created.TTLRule, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestProcessDeleteEvent_SubtreeTombstone(t *testing.T) {
+	var subtree *model.Tombstone
+	tx := &mockTx{
+		get: func(string) (DocumentSnapshot, error) { return &mockSnap{exists: false}, nil },
+		set: func(p string, data interface{}) error {
+			if p != defaultName.SubtreeTombstonePath() {
+				t.Fatalf("set path = %q, want %q", p, defaultName.SubtreeTombstonePath())
+			}
+			subtree = data.(*model.Tombstone)
+			return nil
+		},
+	}
+	svc := NewPropagator(&mockTopic{}, &mockFirestore{tx: tx}, time.Second, noop.Meter{}, WithSubtreeDeleteCollections("users"))
+	evt := sampleEvent(model.EventTypeDeleted, time.Unix(1, 0))
+	ok, err := svc.processDeleteEvent(context.Background(), evt)
+	if err != nil || !ok {
+		t.Fatalf("want propagate true got %v %v", ok, err)
+	}
+	if subtree == nil || !subtree.Subtree {
+		t.Fatalf("subtree tombstone not written: %+v", subtree)
+	}
+}
+
+func TestProcessDeleteEvent_SubtreeTombstoneNewer(t *testing.T) {
+	newer := &model.Tombstone{Timestamp: timestamppb.New(time.Unix(2, 0)), Subtree: true}
+	tx := &mockTx{
+		get: func(p string) (DocumentSnapshot, error) {
+			if p == defaultName.SubtreeTombstonePath() {
+				return &mockSnap{exists: true, data: newer}, nil
+			}
+			return &mockSnap{exists: false}, nil
+		},
+		set: func(p string, data interface{}) error {
+			t.Fatalf("newer subtree tombstone must not be overwritten")
+			return nil
+		},
+	}
+	svc := NewPropagator(&mockTopic{}, &mockFirestore{tx: tx}, time.Second, noop.Meter{}, WithSubtreeDeleteCollections("users"))
+	evt := sampleEvent(model.EventTypeDeleted, time.Unix(1, 0))
+	if _, err := svc.processDeleteEvent(context.Background(), evt); err != nil {
+		t.Fatalf("err=%v", err)
+	}
+}
+
+func TestProcessWriteEvents_SubtreeTombstoneNewer(t *testing.T) {
+	parent := model.DocumentName{ProjectID: "p", DatabaseID: "d", Path: "users/1"}
+	subtree := &model.Tombstone{Timestamp: timestamppb.New(time.Unix(2, 0)), Subtree: true}
+
+	for _, typ := range []model.EventType{model.EventTypeCreated, model.EventTypeUpdated} {
+		t.Run(typ.String(), func(t *testing.T) {
+			var deleted string
+			tx := &mockTx{
+				get: func(p string) (DocumentSnapshot, error) {
+					if p == parent.SubtreeTombstonePath() {
+						return &mockSnap{exists: true, data: subtree}, nil
+					}
+					return &mockSnap{exists: false}, nil
+				},
+				update: func(p string, u []Update, ts time.Time) error {
+					t.Fatalf("document must not be stamped")
+					return nil
+				},
+				delete: func(p string, ts time.Time) error {
+					deleted = p
+					return nil
+				},
+			}
+			svc := NewPropagator(&mockTopic{}, &mockFirestore{tx: tx}, time.Second, noop.Meter{}, WithSubtreeDeleteCollections("users"))
+			evt := sampleEvent(typ, time.Unix(1, 0))
+			evt.Name.Path = "users/1/orders/5"
+
+			var ok bool
+			var err error
+			if typ == model.EventTypeCreated {
+				ok, err = svc.processCreateEvent(context.Background(), evt)
+			} else {
+				ok, err = svc.processUpdateEvent(context.Background(), evt)
+			}
+			if err != nil || ok {
+				t.Fatalf("want propagate false err nil got %v %v", ok, err)
+			}
+			if deleted != evt.Name.Path {
+				t.Fatalf("deleted = %q, want %q", deleted, evt.Name.Path)
+			}
+		})
+	}
+}
+
+func TestPropagate_SubtreeDeleteAttribute(t *testing.T) {
+	topic := &mockTopic{}
+	tx := &mockTx{get: func(string) (DocumentSnapshot, error) { return &mockSnap{exists: false}, nil }}
+	svc := NewPropagator(topic, &mockFirestore{tx: tx}, time.Second, noop.Meter{}, WithSubtreeDeleteCollections("users"))
+	evt := sampleEvent(model.EventTypeDeleted, time.Unix(1, 0))
+	if _, err := svc.Propagate(context.Background(), evt); err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	if got := topic.msg.Attributes["subtree-delete"]; got != "true" {
+		t.Fatalf("subtree-delete attribute = %q, want true", got)
+	}
+}
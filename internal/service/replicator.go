@@ -2,12 +2,22 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type replicationMetrics struct {
@@ -45,8 +55,71 @@ func newReplicationMetrics(meter metric.Meter) replicationMetrics {
 }
 
 type replicator struct {
-	metrics   replicationMetrics
-	firestore *firestore.Client
+	metrics replicationMetrics
+	db      FirestoreClient
+
+	subtreeDeleteCollections subtreeCollections
+
+	controller *Controller
+
+	// priorities break ties between concurrent changes.
+	priorities model.Priorities
+
+	// database is the name of the database changes are replicated to.
+	database string
+
+	pathMappings model.PathMappings
+
+	transformer   Transformer
+	schemaVersion int
+}
+
+type replicatorOption interface {
+	applyReplicator(*replicator)
+}
+
+type prioritiesOption model.Priorities
+
+func (o prioritiesOption) apply(p *propagator) { p.priorities = model.Priorities(o) }
+
+func (o prioritiesOption) applyReplicator(r *replicator) { r.priorities = model.Priorities(o) }
+
+type databaseNameOption string
+
+func (o databaseNameOption) applyReplicator(r *replicator) { r.database = string(o) }
+
+// WithDatabaseName names the database the replicator writes to, recorded as
+// the database attribute of its metrics.
+func WithDatabaseName(name string) databaseNameOption {
+	return databaseNameOption(name)
+}
+
+// pathMappingsOption configures path mappings on both the replicator, which
+// rewrites the paths, and the pool, which routes the changes mapped to another
+// database.
+type pathMappingsOption model.PathMappings
+
+func (o pathMappingsOption) applyReplicator(r *replicator) {
+	r.pathMappings = append(r.pathMappings, o...)
+}
+
+func (o pathMappingsOption) applyPool(p *Pool) {
+	p.pathMappings = append(p.pathMappings, o...)
+}
+
+// WithPathMappings replicates documents to the paths they are mapped to,
+// along with their tombstones and the references they hold. It can be passed
+// to both NewReplicator and NewPool.
+func WithPathMappings(mappings ...model.PathMapping) pathMappingsOption {
+	return pathMappingsOption(mappings)
+}
+
+// WithPriorities breaks ties between concurrent changes in favor of the source
+// database with the higher priority, instead of only by name. Every region
+// must be configured with the same priorities to pick the same winner. It can
+// be passed to both NewPropagator and NewReplicator.
+func WithPriorities(p model.Priorities) prioritiesOption {
+	return prioritiesOption(p)
 }
 
 type ReplicationResult uint8
@@ -55,6 +128,10 @@ const (
 	ReplicationResultSuccess ReplicationResult = iota
 	ReplicationResultSkipped
 	ReplicationResultError
+
+	// ReplicationResultPaused changes belong to a paused collection and were
+	// left unprocessed, to be redelivered once it is resumed.
+	ReplicationResultPaused
 )
 
 func (r ReplicationResult) String() string {
@@ -65,18 +142,309 @@ func (r ReplicationResult) String() string {
 		return "skipped"
 	case ReplicationResultError:
 		return "error"
+	case ReplicationResultPaused:
+		return "paused"
 	default:
 		return fmt.Sprintf("unknown (%d)", r)
 	}
 }
 
-func NewReplicator(meter metric.Meter, firestore *firestore.Client) *replicator {
-	return &replicator{
-		metrics:   newReplicationMetrics(meter),
-		firestore: firestore,
+func NewReplicator(meter metric.Meter, db FirestoreClient, opts ...replicatorOption) *replicator {
+	svc := &replicator{
+		metrics: newReplicationMetrics(meter),
+		db:      db,
+	}
+	for _, opt := range opts {
+		opt.applyReplicator(svc)
 	}
+	return svc
 }
 
-func (svc *replicator) Replicate(ctx context.Context) (ReplicationResult, error) {
-	return ReplicationResultSkipped, nil
+// Replicate applies a change propagated by another region to the local
+// database, resolving conflicts with local changes using last-writer-wins.
+func (svc *replicator) Replicate(ctx context.Context, msg *model.Message) (result ReplicationResult, err error) {
+	logger := zerolog.Ctx(ctx).With().
+		Str("message_id", msg.ID).
+		Logger()
+	ctx = logger.WithContext(ctx)
+
+	database := attribute.String("database", svc.database)
+	event, err := model.ParseMessage(msg)
+	if err != nil {
+		svc.metrics.ReplicationEventCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("result", ReplicationResultError.String()),
+			database,
+		))
+		return ReplicationResultError, permanent(fmt.Errorf("failed to parse message: %w", err))
+	}
+
+	// The source database is kept, as it versions the change.
+	source := event.Name
+	sourcePath := event.Name.Path
+	_, event.Name.Path = svc.pathMappings.Map(event.Name.DatabaseID, event.Name.Path)
+
+	logCtx := logger.With().
+		Stringer("event_type", event.Type).
+		Str("project_id", event.Name.ProjectID).
+		Str("database_id", event.Name.DatabaseID).
+		Str("document_path", event.Name.Path)
+	if event.Name.Path != sourcePath {
+		logCtx = logCtx.Str("source_document_path", sourcePath)
+	}
+	logger = logCtx.Logger()
+	ctx = logger.WithContext(ctx)
+
+	defer func() {
+		svc.metrics.ReplicationEventCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("result", result.String()),
+			database,
+		))
+
+		if result == ReplicationResultSuccess {
+			svc.metrics.ReplicationLatency.Record(ctx, time.Since(event.Timestamp).Milliseconds(), metric.WithAttributes(database))
+		}
+	}()
+
+	switch event.Type {
+	case model.EventTypeCreated, model.EventTypeUpdated, model.EventTypeDeleted:
+		if svc.controller == nil {
+			break
+		}
+		pause, paused, err := svc.controller.Paused(ctx, &event.Name)
+		if err != nil {
+			return ReplicationResultError, err
+		}
+		if paused {
+			logger.Debug().Str("paused_collection", pause.Collection).Msg("collection paused, leaving the change for redelivery")
+			return ReplicationResultPaused, nil
+		}
+	}
+
+	var replicated bool
+	switch event.Type {
+	case model.EventTypeCreated, model.EventTypeUpdated:
+		// migrations match the collections of the source database
+		if err := svc.transform(&source, event); err != nil {
+			return ReplicationResultError, err
+		}
+		replicated, err = svc.applyWrite(ctx, event)
+
+	case model.EventTypeDeleted:
+		replicated, err = svc.applyDelete(ctx, event)
+
+	default:
+		logger.Debug().Msg("event type is not replicated, skipping")
+		return ReplicationResultSkipped, nil
+	}
+
+	if err != nil {
+		return ReplicationResultError, fmt.Errorf("failed to replicate event: %w", err)
+	}
+
+	if !replicated {
+		logger.Debug().Msg("event replication skipped")
+		return ReplicationResultSkipped, nil
+	}
+
+	logger.Debug().Msg("event replicated")
+	return ReplicationResultSuccess, nil
+}
+
+// localVersion returns the timestamp and source of the last change applied to
+// a local document, falling back to its update time for local changes the
+// propagator has not stamped yet.
+func localVersion(snap DocumentSnapshot) (time.Time, string) {
+	md := struct {
+		Metadata *model.Metadata `firestore:"_firesync"`
+	}{}
+	if err := snap.DataTo(&md); err != nil || md.Metadata == nil || md.Metadata.Timestamp == nil {
+		return snap.UpdateTime(), ""
+	}
+	return md.Metadata.Timestamp.AsTime(), md.Metadata.Source
+}
+
+// transform converts the document of a write event from the schema version it
+// was published with to the local one.
+func (svc *replicator) transform(source *model.DocumentName, event *model.Event) error {
+	if svc.transformer == nil || event.SchemaVersion == svc.schemaVersion {
+		return nil
+	}
+	doc := event.Data.GetValue()
+	if doc == nil {
+		return nil
+	}
+	if doc.Fields == nil {
+		doc.Fields = make(map[string]*firestoredata.Value)
+	}
+	if err := svc.transformer.Transform(source, doc.Fields, event.SchemaVersion, svc.schemaVersion); err != nil {
+		return permanent(fmt.Errorf("failed to transform document from schema version %d: %w", event.SchemaVersion, err))
+	}
+	return nil
+}
+
+// resolver resolves the references of documents from the source database to
+// the documents they are replicated to.
+func (svc *replicator) resolver(databaseID string) model.ReferenceResolver {
+	if len(svc.pathMappings) == 0 {
+		return svc.db.Doc
+	}
+	return func(p string) *firestore.DocumentRef {
+		_, p = svc.pathMappings.Map(databaseID, p)
+		return svc.db.Doc(p)
+	}
+}
+
+func (svc *replicator) applyWrite(ctx context.Context, event *model.Event) (replicated bool, err error) {
+	logger := zerolog.Ctx(ctx)
+
+	doc := event.Data.GetValue()
+	if doc == nil {
+		return false, permanent(errors.New("write event without a document value"))
+	}
+
+	data, err := model.DecodeFields(doc.GetFields(), svc.resolver(event.Name.DatabaseID))
+	if err != nil {
+		return false, permanent(err)
+	}
+	data["_firesync"] = &model.Metadata{
+		Timestamp: timestamppb.New(event.Timestamp),
+		Source:    event.Source(),
+		Trace:     trace.SpanContextFromContext(ctx).TraceID().String(),
+	}
+
+	err = svc.db.RunTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+		replicated = false
+
+		snap, err := tx.Get(event.Name.Path)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		tombstoneSnap, err := tx.Get(event.Name.TombstonePath())
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		newer, err := svc.subtreeDeleteCollections.hasNewerTombstone(tx, event, svc.priorities)
+		if err != nil {
+			return err
+		}
+		if newer {
+			logger.Debug().Msg("newer subtree tombstone exists, skipping replication")
+			return nil
+		}
+
+		if tombstoneSnap != nil && tombstoneSnap.Exists() {
+			tombstone := &model.Tombstone{}
+			if err := tombstoneSnap.DataTo(tombstone); err != nil {
+				return permanent(fmt.Errorf("failed to unmarshal tombstone: %w", err))
+			}
+			if !svc.priorities.Supersedes(event.Timestamp, event.Source(), tombstone.Timestamp.AsTime(), tombstone.Source) {
+				logger.Debug().Msg("newer tombstone exists, skipping replication")
+				return nil
+			}
+		}
+
+		if snap != nil && snap.Exists() {
+			ts, src := localVersion(snap)
+			if !svc.priorities.Supersedes(event.Timestamp, event.Source(), ts, src) {
+				logger.Debug().Msg("newer document exists, skipping replication")
+				return nil
+			}
+		}
+
+		if err := tx.Set(event.Name.Path, data); err != nil {
+			return fmt.Errorf("failed to set document: %w", err)
+		}
+
+		replicated = true
+		return nil
+	})
+
+	return replicated, err
+}
+
+func (svc *replicator) applyDelete(ctx context.Context, event *model.Event) (replicated bool, err error) {
+	logger := zerolog.Ctx(ctx)
+
+	tombstone := &model.Tombstone{
+		Document:  svc.db.Doc(event.Name.Path),
+		Timestamp: timestamppb.New(event.Timestamp),
+		Source:    event.Source(),
+		Trace:     trace.SpanContextFromContext(ctx).TraceID().String(),
+		TTLRule:   event.TTLRule,
+	}
+	if !event.Expiration.IsZero() {
+		tombstone.Expiration = timestamppb.New(event.Expiration)
+	}
+
+	err = svc.db.RunTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+		replicated = false
+
+		snap, err := tx.Get(event.Name.Path)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		tombstoneSnap, err := tx.Get(event.Name.TombstonePath())
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		var subtreeSnap DocumentSnapshot
+		if event.Subtree {
+			subtreeSnap, err = tx.Get(event.Name.SubtreeTombstonePath())
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+		}
+
+		if tombstoneSnap != nil && tombstoneSnap.Exists() {
+			existing := &model.Tombstone{}
+			if err := tombstoneSnap.DataTo(existing); err != nil {
+				return permanent(fmt.Errorf("failed to unmarshal tombstone: %w", err))
+			}
+			if !svc.priorities.Supersedes(event.Timestamp, event.Source(), existing.Timestamp.AsTime(), existing.Source) {
+				logger.Debug().Msg("newer tombstone already exists, skipping replication")
+				return nil
+			}
+		}
+
+		if snap != nil && snap.Exists() {
+			ts, src := localVersion(snap)
+			if !svc.priorities.Supersedes(event.Timestamp, event.Source(), ts, src) {
+				logger.Debug().Msg("newer document exists, skipping replication")
+				return nil
+			}
+
+			if err := tx.Delete(event.Name.Path, snap.UpdateTime()); err != nil {
+				return fmt.Errorf("failed to delete document: %w", err)
+			}
+		}
+
+		if event.Subtree {
+			if err := writeSubtreeTombstone(tx, event, tombstone, subtreeSnap, svc.priorities); err != nil {
+				return err
+			}
+		}
+
+		// committed with the delete, so the propagator recognizes its local
+		// delete event as replicated
+		if err := tx.Set(event.Name.TombstonePath(), tombstone); err != nil {
+			return fmt.Errorf("failed to set tombstone: %w", err)
+		}
+
+		replicated = true
+		return nil
+	})
+	if err != nil || !event.Subtree {
+		return replicated, err
+	}
+
+	// the nested documents are deleted even if the tombstone was already
+	// recorded, so a redelivery retries a failed deletion
+	if err := svc.deleteDescendants(ctx, event); err != nil {
+		return replicated, fmt.Errorf("failed to delete nested documents: %w", err)
+	}
+	return replicated, nil
 }
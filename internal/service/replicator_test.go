@@ -0,0 +1,367 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/joaopenteado/firesync/internal/model"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const remoteSource = "projects/p/databases/d"
+
+type docMetadata = struct {
+	Metadata *model.Metadata `firestore:"_firesync"`
+}
+
+func sampleMessage(t *testing.T, typ model.EventType, ts time.Time, attrs ...string) *model.Message {
+	t.Helper()
+	data, err := proto.Marshal(&firestoredata.DocumentEventData{
+		Value: &firestoredata.Document{
+			Name: defaultName.String(),
+			Fields: map[string]*firestoredata.Value{
+				"name":      {ValueType: &firestoredata.Value_StringValue{StringValue: "ada"}},
+				"_firesync": {ValueType: &firestoredata.Value_MapValue{MapValue: &firestoredata.MapValue{}}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("proto.Marshal: %v", err)
+	}
+
+	msg := &model.Message{
+		ID: "1",
+		Attributes: map[string]string{
+			"content-type":  "application/protobuf",
+			"event-type":    typ.String(),
+			"event-time":    ts.Format(time.RFC3339Nano),
+			"project-id":    defaultName.ProjectID,
+			"database-id":   defaultName.DatabaseID,
+			"document-path": defaultName.Path,
+		},
+		Data: data,
+	}
+	for i := 0; i < len(attrs); i += 2 {
+		msg.Attributes[attrs[i]] = attrs[i+1]
+	}
+	return msg
+}
+
+func TestReplicate_InvalidMessage(t *testing.T) {
+	svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: &mockTx{}})
+	msg := sampleMessage(t, model.EventTypeCreated, time.Unix(1, 0), "content-type", "text/plain")
+	res, err := svc.Replicate(context.Background(), msg)
+	if res != ReplicationResultError || ClassifyError(err) != ErrorClassPermanent {
+		t.Fatalf("want permanent error got %v %v", res, err)
+	}
+}
+
+func TestReplicate_SkipTypes(t *testing.T) {
+	svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: &mockTx{}})
+	msg := sampleMessage(t, model.EventTypeReplicated, time.Unix(1, 0))
+	res, err := svc.Replicate(context.Background(), msg)
+	if err != nil || res != ReplicationResultSkipped {
+		t.Fatalf("want skipped got %v %v", res, err)
+	}
+}
+
+func TestReplicate_Write(t *testing.T) {
+	older := &docMetadata{Metadata: &model.Metadata{Timestamp: timestamppb.New(time.Unix(1, 0)), Source: remoteSource}}
+	newer := &docMetadata{Metadata: &model.Metadata{Timestamp: timestamppb.New(time.Unix(3, 0)), Source: remoteSource}}
+	newerTombstone := &model.Tombstone{Timestamp: timestamppb.New(time.Unix(3, 0)), Source: remoteSource}
+
+	tests := []struct {
+		name      string
+		doc       DocumentSnapshot
+		tombstone DocumentSnapshot
+		want      ReplicationResult
+	}{
+		{"missing", &mockSnap{}, &mockSnap{}, ReplicationResultSuccess},
+		{"older replica", &mockSnap{exists: true, data: older}, &mockSnap{}, ReplicationResultSuccess},
+		{"older local change", &mockSnap{exists: true, data: &docMetadata{}, updateTime: time.Unix(1, 0)}, &mockSnap{}, ReplicationResultSuccess},
+		{"newer replica", &mockSnap{exists: true, data: newer}, &mockSnap{}, ReplicationResultSkipped},
+		{"newer local change", &mockSnap{exists: true, data: &docMetadata{}, updateTime: time.Unix(3, 0)}, &mockSnap{}, ReplicationResultSkipped},
+		{"newer tombstone", &mockSnap{}, &mockSnap{exists: true, data: newerTombstone}, ReplicationResultSkipped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written map[string]interface{}
+			tx := &mockTx{
+				get: func(p string) (DocumentSnapshot, error) {
+					if p == defaultName.TombstonePath() {
+						return tt.tombstone, nil
+					}
+					return tt.doc, nil
+				},
+				set: func(p string, data interface{}) error {
+					if p != defaultName.Path {
+						t.Fatalf("set path = %q, want %q", p, defaultName.Path)
+					}
+					written = data.(map[string]interface{})
+					return nil
+				},
+			}
+			svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: tx})
+			res, err := svc.Replicate(context.Background(), sampleMessage(t, model.EventTypeUpdated, time.Unix(2, 0)))
+			if err != nil || res != tt.want {
+				t.Fatalf("Replicate() = %v %v, want %v", res, err, tt.want)
+			}
+			if tt.want != ReplicationResultSuccess {
+				if written != nil {
+					t.Fatalf("document must not be written")
+				}
+				return
+			}
+
+			if written["name"] != "ada" {
+				t.Fatalf("written = %v", written)
+			}
+			md := written["_firesync"].(*model.Metadata)
+			if !md.Timestamp.AsTime().Equal(time.Unix(2, 0)) || md.Source != remoteSource {
+				t.Fatalf("metadata = %+v", md)
+			}
+		})
+	}
+}
+
+func TestReplicate_WritePriorities(t *testing.T) {
+	// a concurrent change from a source ordered after the event's
+	concurrent := &docMetadata{Metadata: &model.Metadata{Timestamp: timestamppb.New(time.Unix(2, 0)), Source: "projects/p/databases/z"}}
+
+	tests := []struct {
+		name       string
+		priorities model.Priorities
+		want       ReplicationResult
+	}{
+		{"by name", nil, ReplicationResultSkipped},
+		{"higher priority", model.Priorities{remoteSource: 1}, ReplicationResultSuccess},
+		{"lower priority", model.Priorities{"projects/p/databases/z": 1}, ReplicationResultSkipped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &mockTx{
+				get: func(p string) (DocumentSnapshot, error) {
+					if p == defaultName.TombstonePath() {
+						return &mockSnap{}, nil
+					}
+					return &mockSnap{exists: true, data: concurrent}, nil
+				},
+				set: func(string, interface{}) error { return nil },
+			}
+			svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: tx}, WithPriorities(tt.priorities))
+			res, err := svc.Replicate(context.Background(), sampleMessage(t, model.EventTypeUpdated, time.Unix(2, 0)))
+			if err != nil || res != tt.want {
+				t.Fatalf("Replicate() = %v %v, want %v", res, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicate_PathMappings(t *testing.T) {
+	mapped := model.DocumentName{ProjectID: "p", DatabaseID: "d", Path: "mirror/d/users/1"}
+	msg := sampleMessage(t, model.EventTypeUpdated, time.Unix(2, 0))
+	msg.Data, _ = proto.Marshal(&firestoredata.DocumentEventData{
+		Value: &firestoredata.Document{
+			Name: defaultName.String(),
+			Fields: map[string]*firestoredata.Value{
+				"friend": {ValueType: &firestoredata.Value_ReferenceValue{ReferenceValue: "projects/p/databases/d/documents/users/2"}},
+			},
+		},
+	})
+
+	var (
+		reads   []string
+		written map[string]interface{}
+	)
+	tx := &mockTx{
+		get: func(p string) (DocumentSnapshot, error) {
+			reads = append(reads, p)
+			return &mockSnap{}, nil
+		},
+		set: func(p string, data interface{}) error {
+			if p != mapped.Path {
+				t.Fatalf("set path = %q, want %q", p, mapped.Path)
+			}
+			written = data.(map[string]interface{})
+			return nil
+		},
+	}
+	svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: tx}, WithPathMappings(
+		model.PathMapping{SourceDatabase: "other", Source: "users", Target: "elsewhere"},
+		model.PathMapping{Source: "users", Target: "mirror/d/users"},
+	))
+	res, err := svc.Replicate(context.Background(), msg)
+	if err != nil || res != ReplicationResultSuccess {
+		t.Fatalf("Replicate() = %v %v", res, err)
+	}
+
+	if want := []string{mapped.Path, mapped.TombstonePath()}; !slices.Equal(reads, want) {
+		t.Fatalf("reads = %v, want %v", reads, want)
+	}
+	if ref := written["friend"].(*firestore.DocumentRef); ref.Path != "mirror/d/users/2" {
+		t.Fatalf("friend = %q, want the mapped reference", ref.Path)
+	}
+	if md := written["_firesync"].(*model.Metadata); md.Source != remoteSource {
+		t.Fatalf("source = %q, want the unmapped source database", md.Source)
+	}
+}
+
+func TestReplicate_Delete(t *testing.T) {
+	var deleted string
+	var tombstone *model.Tombstone
+	tx := &mockTx{
+		get: func(p string) (DocumentSnapshot, error) {
+			if p == defaultName.Path {
+				return &mockSnap{exists: true, data: &docMetadata{}, updateTime: time.Unix(1, 0)}, nil
+			}
+			return &mockSnap{}, nil
+		},
+		delete: func(p string, ts time.Time) error {
+			if !ts.Equal(time.Unix(1, 0)) {
+				t.Fatalf("delete precondition = %v, want document update time", ts)
+			}
+			deleted = p
+			return nil
+		},
+		set: func(p string, data interface{}) error {
+			if p != defaultName.TombstonePath() {
+				t.Fatalf("set path = %q, want %q", p, defaultName.TombstonePath())
+			}
+			tombstone = data.(*model.Tombstone)
+			return nil
+		},
+	}
+	svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: tx})
+	msg := sampleMessage(t, model.EventTypeDeleted, time.Unix(2, 0),
+		"tombstone-exp", time.Unix(100, 0).Format(time.RFC3339Nano),
+		"tombstone-ttl-rule", "users",
+	)
+	res, err := svc.Replicate(context.Background(), msg)
+	if err != nil || res != ReplicationResultSuccess {
+		t.Fatalf("want success got %v %v", res, err)
+	}
+	if deleted != defaultName.Path {
+		t.Fatalf("deleted = %q, want %q", deleted, defaultName.Path)
+	}
+	if tombstone == nil || tombstone.Source != remoteSource || tombstone.TTLRule != "users" ||
+		!tombstone.Expiration.AsTime().Equal(time.Unix(100, 0)) {
+		t.Fatalf("tombstone = %+v", tombstone)
+	}
+}
+
+func TestReplicate_DeleteStale(t *testing.T) {
+	tx := &mockTx{
+		get: func(p string) (DocumentSnapshot, error) {
+			if p == defaultName.Path {
+				return &mockSnap{exists: true, data: &docMetadata{}, updateTime: time.Unix(3, 0)}, nil
+			}
+			return &mockSnap{}, nil
+		},
+		delete: func(string, time.Time) error {
+			t.Fatalf("newer document must not be deleted")
+			return nil
+		},
+		set: func(string, interface{}) error {
+			t.Fatalf("tombstone must not be written")
+			return nil
+		},
+	}
+	svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: tx})
+	res, err := svc.Replicate(context.Background(), sampleMessage(t, model.EventTypeDeleted, time.Unix(2, 0)))
+	if err != nil || res != ReplicationResultSkipped {
+		t.Fatalf("want skipped got %v %v", res, err)
+	}
+}
+
+// mockDescendantFirestore is a mockFirestore holding documents nested under
+// the deleted one.
+type mockDescendantFirestore struct {
+	mockFirestore
+	descendants map[string]DocumentSnapshot
+	deleted     []string
+}
+
+func (m *mockDescendantFirestore) DeleteDescendants(ctx context.Context, path string, del func(DocumentSnapshot) bool) (int, error) {
+	for p, snap := range m.descendants {
+		if strings.HasPrefix(p, path+"/") && del(snap) {
+			m.deleted = append(m.deleted, p)
+		}
+	}
+	return len(m.deleted), nil
+}
+
+func TestReplicate_SubtreeDeleteDescendants(t *testing.T) {
+	tombstones := make(map[string]interface{})
+	tx := &mockTx{
+		get: func(p string) (DocumentSnapshot, error) {
+			if data, ok := tombstones[p]; ok {
+				return &mockSnap{exists: true, data: data}, nil
+			}
+			return &mockSnap{}, nil
+		},
+		set: func(p string, data interface{}) error {
+			tombstones[p] = data
+			return nil
+		},
+	}
+	db := &mockDescendantFirestore{
+		mockFirestore: mockFirestore{tx: tx},
+		descendants: map[string]DocumentSnapshot{
+			defaultName.Path + "/orders/1": &mockSnap{exists: true, data: &docMetadata{}, updateTime: time.Unix(1, 0)},
+			defaultName.Path + "/orders/2": &mockSnap{exists: true, data: &docMetadata{}, updateTime: time.Unix(3, 0)},
+		},
+	}
+	svc := NewReplicator(noop.Meter{}, db, WithSubtreeDeleteCollections("users"))
+	msg := sampleMessage(t, model.EventTypeDeleted, time.Unix(2, 0), "subtree-delete", "true")
+
+	res, err := svc.Replicate(context.Background(), msg)
+	if err != nil || res != ReplicationResultSuccess {
+		t.Fatalf("Replicate() = %v %v", res, err)
+	}
+	if want := []string{defaultName.Path + "/orders/1"}; !slices.Equal(db.deleted, want) {
+		t.Fatalf("deleted = %v, want only the documents older than the delete %v", db.deleted, want)
+	}
+
+	// redeliveries retry the deletion even though the tombstone exists
+	db.deleted = nil
+	if res, err := svc.Replicate(context.Background(), msg); err != nil || res != ReplicationResultSkipped {
+		t.Fatalf("Replicate() = %v %v", res, err)
+	}
+	if len(db.deleted) != 1 {
+		t.Fatalf("deleted = %v, want the deletion retried", db.deleted)
+	}
+}
+
+func TestSubtreeCollections_HasNewerTombstonePriorities(t *testing.T) {
+	const other = "projects/p/databases/other"
+	subtree := &model.Tombstone{Timestamp: timestamppb.New(time.Unix(1, 0)), Source: other, Subtree: true}
+	tx := &mockTx{get: func(p string) (DocumentSnapshot, error) {
+		return &mockSnap{exists: true, data: subtree}, nil
+	}}
+	evt := sampleEvent(model.EventTypeUpdated, time.Unix(1, 0))
+	evt.Name.Path = "users/1/orders/5"
+
+	tests := []struct {
+		name       string
+		priorities model.Priorities
+		want       bool
+	}{
+		{"tombstone source has priority", model.Priorities{other: 1}, true},
+		{"event source has priority", model.Priorities{remoteSource: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := subtreeCollections{"users"}.hasNewerTombstone(tx, evt, tt.priorities)
+			if err != nil || got != tt.want {
+				t.Fatalf("hasNewerTombstone() = %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// subtreeCollections are the collection patterns whose document deletes also
+// delete every document nested under them.
+type subtreeCollections []string
+
+// subtreeDeleteOption configures subtree delete collections on both the
+// propagator and the replicator, which must agree on them.
+type subtreeDeleteOption subtreeCollections
+
+func (o subtreeDeleteOption) apply(p *propagator) {
+	p.subtreeDeleteCollections = append(p.subtreeDeleteCollections, o...)
+}
+
+func (o subtreeDeleteOption) applyReplicator(r *replicator) {
+	r.subtreeDeleteCollections = append(r.subtreeDeleteCollections, o...)
+}
+
+// WithSubtreeDeleteCollections enables recursive delete propagation for
+// documents in collections matching the given patterns. Deleting such a
+// document also writes a subtree tombstone, against which later writes to any
+// document nested under it are resolved. It can be passed to both
+// NewPropagator and NewReplicator.
+func WithSubtreeDeleteCollections(patterns ...string) subtreeDeleteOption {
+	return subtreeDeleteOption(patterns)
+}
+
+// matches reports whether deleting the given document should also delete
+// every document nested under it.
+func (c subtreeCollections) matches(name *model.DocumentName) bool {
+	for _, pattern := range c {
+		if name.MatchesCollection(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNewerTombstone reports whether any ancestor of the event's document
+// has been deleted recursively after the event happened, breaking ties with
+// priorities. Only ancestors in subtree delete collections are checked, since
+// no other ancestor can have a subtree tombstone.
+func (c subtreeCollections) hasNewerTombstone(tx Transaction, event *model.Event, priorities model.Priorities) (bool, error) {
+	if len(c) == 0 {
+		return false, nil
+	}
+
+	for _, ancestor := range event.Name.Ancestors() {
+		if !c.matches(&ancestor) {
+			continue
+		}
+
+		snap, err := tx.Get(ancestor.SubtreeTombstonePath())
+		if err != nil && status.Code(err) != codes.NotFound {
+			return false, err
+		}
+		if snap == nil || !snap.Exists() {
+			continue
+		}
+
+		tombstone := &model.Tombstone{}
+		if err := snap.DataTo(tombstone); err != nil {
+			return false, permanent(fmt.Errorf("failed to unmarshal subtree tombstone: %w", err))
+		}
+
+		if !priorities.Supersedes(event.Timestamp, event.Source(), tombstone.Timestamp.AsTime(), tombstone.Source) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// writeSubtreeTombstone records the recursive deletion of the event's document
+// unless a newer subtree tombstone already exists, breaking ties with
+// priorities. snap is the current subtree tombstone, read earlier in the
+// transaction.
+func writeSubtreeTombstone(tx Transaction, event *model.Event, tombstone *model.Tombstone, snap DocumentSnapshot, priorities model.Priorities) error {
+	if snap != nil && snap.Exists() {
+		existing := &model.Tombstone{}
+		if err := snap.DataTo(existing); err != nil {
+			return permanent(fmt.Errorf("failed to unmarshal subtree tombstone: %w", err))
+		}
+
+		if !priorities.Supersedes(tombstone.Timestamp.AsTime(), tombstone.Source, existing.Timestamp.AsTime(), existing.Source) {
+			return nil
+		}
+	}
+
+	subtree := *tombstone
+	subtree.Subtree = true
+	if err := tx.Set(event.Name.SubtreeTombstonePath(), &subtree); err != nil {
+		return fmt.Errorf("failed to set subtree tombstone: %w", err)
+	}
+	return nil
+}
+
+// deleteDescendants deletes the local documents nested under the event's
+// document that the subtree delete supersedes. The region the delete comes
+// from propagates one delete event per nested document, but regions that
+// missed some of them would otherwise keep the documents until repaired.
+// Documents written after the delete are kept, and so are the ones changing
+// while they are deleted.
+func (svc *replicator) deleteDescendants(ctx context.Context, event *model.Event) error {
+	deleter, ok := svc.db.(descendantDeleter)
+	if !ok {
+		return nil
+	}
+
+	deleted, err := deleter.DeleteDescendants(ctx, event.Name.Path, func(snap DocumentSnapshot) bool {
+		ts, src := localVersion(snap)
+		return svc.priorities.Supersedes(event.Timestamp, event.Source(), ts, src)
+	})
+	if deleted > 0 {
+		zerolog.Ctx(ctx).Debug().Int("deleted", deleted).Msg("deleted documents nested under the subtree delete")
+	}
+	return err
+}
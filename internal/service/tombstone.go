@@ -0,0 +1,31 @@
+package service
+
+import (
+	"time"
+
+	"github.com/joaopenteado/firesync/internal/model"
+)
+
+// DefaultTombstoneTTLRule is the rule name recorded on tombstones whose TTL
+// did not come from any collection override.
+const DefaultTombstoneTTLRule = "default"
+
+// TombstoneTTLRule overrides the tombstone TTL for documents whose collection
+// path matches Pattern. See model.DocumentName.MatchesCollection for the
+// pattern syntax.
+type TombstoneTTLRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// tombstoneTTLFor returns the TTL for the tombstone of the given document, along
+// with the name of the rule that produced it. Rules are evaluated in order and
+// the first match wins.
+func (svc *propagator) tombstoneTTLFor(name *model.DocumentName) (time.Duration, string) {
+	for _, rule := range svc.tombstoneTTLRules {
+		if name.MatchesCollection(rule.Pattern) {
+			return rule.TTL, rule.Pattern
+		}
+	}
+	return svc.tombstoneTTL, DefaultTombstoneTTLRule
+}
@@ -0,0 +1,321 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/joaopenteado/firesync/internal/model"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Transformer converts the fields of documents between schema versions, so
+// regions running different versions of an application can replicate to each
+// other during a rolling schema migration.
+type Transformer interface {
+	// Transform converts the fields of the named document in place, from the
+	// schema version it was written with to the one it is read with.
+	Transform(name *model.DocumentName, fields map[string]*firestoredata.Value, from, to int) error
+}
+
+// FieldTransform is a single declarative change to the fields of a document.
+// Fields are named by their path, where a dot separates the fields of nested
+// maps (e.g. address.city).
+type FieldTransform interface {
+	TransformFields(fields map[string]*firestoredata.Value) error
+}
+
+type fieldTransformFunc func(fields map[string]*firestoredata.Value) error
+
+func (f fieldTransformFunc) TransformFields(fields map[string]*firestoredata.Value) error {
+	return f(fields)
+}
+
+// RenameField moves the value of a field to another one, replacing its value.
+// Documents without the field are left as is.
+func RenameField(from, to string) FieldTransform {
+	return fieldTransformFunc(func(fields map[string]*firestoredata.Value) error {
+		v, ok := fieldValue(fields, from)
+		if !ok {
+			return nil
+		}
+		deleteField(fields, from)
+		return setField(fields, to, v)
+	})
+}
+
+// DropField deletes a field.
+func DropField(field string) FieldTransform {
+	return fieldTransformFunc(func(fields map[string]*firestoredata.Value) error {
+		deleteField(fields, field)
+		return nil
+	})
+}
+
+// DefaultField sets a field missing from the document to value.
+func DefaultField(field string, value *firestoredata.Value) FieldTransform {
+	return fieldTransformFunc(func(fields map[string]*firestoredata.Value) error {
+		if _, ok := fieldValue(fields, field); ok {
+			return nil
+		}
+		return setField(fields, field, value)
+	})
+}
+
+// Value types a field can be converted to.
+const (
+	ValueTypeString    = "string"
+	ValueTypeInteger   = "integer"
+	ValueTypeDouble    = "double"
+	ValueTypeBoolean   = "boolean"
+	ValueTypeTimestamp = "timestamp"
+)
+
+// ConvertField converts the value of a field to another type: integers and
+// doubles to each other, strings to and from the other types, parsing
+// timestamps as RFC 3339. Missing and null fields are left as is, values that
+// can't be converted fail the transform.
+func ConvertField(field, typ string) FieldTransform {
+	return fieldTransformFunc(func(fields map[string]*firestoredata.Value) error {
+		v, ok := fieldValue(fields, field)
+		if !ok || v.GetValueType() == nil {
+			return nil
+		}
+		if _, null := v.GetValueType().(*firestoredata.Value_NullValue); null {
+			return nil
+		}
+
+		converted, err := convertValue(v, typ)
+		if err != nil {
+			return fmt.Errorf("failed to convert field %s: %w", field, err)
+		}
+		return setField(fields, field, converted)
+	})
+}
+
+func convertValue(v *firestoredata.Value, typ string) (*firestoredata.Value, error) {
+	switch typ {
+	case ValueTypeString:
+		var s string
+		switch val := v.GetValueType().(type) {
+		case *firestoredata.Value_StringValue:
+			return v, nil
+		case *firestoredata.Value_IntegerValue:
+			s = strconv.FormatInt(val.IntegerValue, 10)
+		case *firestoredata.Value_DoubleValue:
+			s = strconv.FormatFloat(val.DoubleValue, 'g', -1, 64)
+		case *firestoredata.Value_BooleanValue:
+			s = strconv.FormatBool(val.BooleanValue)
+		case *firestoredata.Value_TimestampValue:
+			s = val.TimestampValue.AsTime().Format(time.RFC3339Nano)
+		default:
+			return nil, fmt.Errorf("can't convert %T to a string", val)
+		}
+		return &firestoredata.Value{ValueType: &firestoredata.Value_StringValue{StringValue: s}}, nil
+
+	case ValueTypeInteger:
+		var i int64
+		switch val := v.GetValueType().(type) {
+		case *firestoredata.Value_IntegerValue:
+			return v, nil
+		case *firestoredata.Value_DoubleValue:
+			i = int64(val.DoubleValue)
+		case *firestoredata.Value_StringValue:
+			var err error
+			if i, err = strconv.ParseInt(val.StringValue, 10, 64); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("can't convert %T to an integer", val)
+		}
+		return &firestoredata.Value{ValueType: &firestoredata.Value_IntegerValue{IntegerValue: i}}, nil
+
+	case ValueTypeDouble:
+		var f float64
+		switch val := v.GetValueType().(type) {
+		case *firestoredata.Value_DoubleValue:
+			return v, nil
+		case *firestoredata.Value_IntegerValue:
+			f = float64(val.IntegerValue)
+		case *firestoredata.Value_StringValue:
+			var err error
+			if f, err = strconv.ParseFloat(val.StringValue, 64); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("can't convert %T to a double", val)
+		}
+		return &firestoredata.Value{ValueType: &firestoredata.Value_DoubleValue{DoubleValue: f}}, nil
+
+	case ValueTypeBoolean:
+		var b bool
+		switch val := v.GetValueType().(type) {
+		case *firestoredata.Value_BooleanValue:
+			return v, nil
+		case *firestoredata.Value_StringValue:
+			var err error
+			if b, err = strconv.ParseBool(val.StringValue); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("can't convert %T to a boolean", val)
+		}
+		return &firestoredata.Value{ValueType: &firestoredata.Value_BooleanValue{BooleanValue: b}}, nil
+
+	case ValueTypeTimestamp:
+		switch val := v.GetValueType().(type) {
+		case *firestoredata.Value_TimestampValue:
+			return v, nil
+		case *firestoredata.Value_StringValue:
+			ts, err := time.Parse(time.RFC3339Nano, val.StringValue)
+			if err != nil {
+				return nil, err
+			}
+			return &firestoredata.Value{ValueType: &firestoredata.Value_TimestampValue{TimestampValue: timestamppb.New(ts)}}, nil
+		default:
+			return nil, fmt.Errorf("can't convert %T to a timestamp", val)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown value type %q", typ)
+	}
+}
+
+// fieldValue returns the value of the field at path.
+func fieldValue(fields map[string]*firestoredata.Value, path string) (*firestoredata.Value, bool) {
+	name, rest, nested := strings.Cut(path, ".")
+	v, ok := fields[name]
+	if !ok || !nested {
+		return v, ok
+	}
+	m := v.GetMapValue()
+	if m == nil {
+		return nil, false
+	}
+	return fieldValue(m.GetFields(), rest)
+}
+
+// setField sets the field at path, creating the maps it is nested in.
+func setField(fields map[string]*firestoredata.Value, path string, v *firestoredata.Value) error {
+	name, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		fields[name] = v
+		return nil
+	}
+
+	parent, ok := fields[name]
+	if !ok {
+		parent = &firestoredata.Value{ValueType: &firestoredata.Value_MapValue{MapValue: &firestoredata.MapValue{}}}
+		fields[name] = parent
+	}
+	m := parent.GetMapValue()
+	if m == nil {
+		return fmt.Errorf("field %s is not a map", name)
+	}
+	if m.Fields == nil {
+		m.Fields = make(map[string]*firestoredata.Value)
+	}
+	return setField(m.Fields, rest, v)
+}
+
+// deleteField deletes the field at path, if it exists.
+func deleteField(fields map[string]*firestoredata.Value, path string) {
+	name, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		delete(fields, name)
+		return
+	}
+	if m := fields[name].GetMapValue(); m != nil {
+		deleteField(m.GetFields(), rest)
+	}
+}
+
+// Migration changes the schema of the documents in the collections matching
+// a pattern from the version before Version to Version.
+type Migration struct {
+	// Collection is the collection pattern, in path.Match syntax.
+	Collection string
+
+	Version int
+
+	// Upgrade converts documents from the previous version to Version.
+	Upgrade []FieldTransform
+
+	// Downgrade converts documents from Version to the previous version.
+	Downgrade []FieldTransform
+}
+
+// Migrations is a Transformer applying the migrations between two versions in
+// order: the upgrades of the versions after from up to to, or the downgrades
+// of the versions from from down to after to. Several migrations of the same
+// version are applied in the order they are declared.
+type Migrations []Migration
+
+func (m Migrations) Transform(name *model.DocumentName, fields map[string]*firestoredata.Value, from, to int) error {
+	for v := from; v != to; {
+		upgrade := v < to
+		version := v
+		if upgrade {
+			version = v + 1
+		}
+
+		for _, migration := range m {
+			if migration.Version != version || !name.MatchesCollection(migration.Collection) {
+				continue
+			}
+			transforms := migration.Downgrade
+			if upgrade {
+				transforms = migration.Upgrade
+			}
+			for _, t := range transforms {
+				if err := t.TransformFields(fields); err != nil {
+					return fmt.Errorf("failed to migrate %s to version %d: %w", migration.Collection, version, err)
+				}
+			}
+		}
+
+		if upgrade {
+			v++
+		} else {
+			v--
+		}
+	}
+	return nil
+}
+
+// schemaOption configures the schema of the documents on both the propagator
+// and the replicator.
+type schemaOption struct {
+	transformer Transformer
+	version     int
+}
+
+func (o schemaOption) apply(p *propagator) {
+	p.transformer, p.schemaVersion, p.publishedSchemaVersion = o.transformer, o.version, o.version
+}
+
+func (o schemaOption) applyReplicator(r *replicator) {
+	r.transformer, r.schemaVersion = o.transformer, o.version
+}
+
+// WithSchema sets the schema version of the documents of the local database,
+// and the transformer converting them from and to the versions of the other
+// regions. Changes are published with their schema version, and replicated
+// changes are converted to the local one. A nil transformer replicates changes
+// as they are, whatever their version. It can be passed to both NewPropagator
+// and NewReplicator.
+func WithSchema(t Transformer, version int) schemaOption {
+	return schemaOption{transformer: t, version: version}
+}
+
+// WithPublishedSchemaVersion publishes changes converted to another schema
+// version than the local one. During a rolling migration, upgraded regions can
+// keep publishing the previous version until every region is upgraded. It must
+// be passed after WithSchema.
+func WithPublishedSchemaVersion(version int) propagatorOption {
+	return funcPropagatorOption(func(p *propagator) {
+		p.publishedSchemaVersion = version
+	})
+}
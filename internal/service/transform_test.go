@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googleapis/google-cloudevents-go/cloud/firestoredata"
+	"github.com/joaopenteado/firesync/internal/model"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func str(s string) *firestoredata.Value {
+	return &firestoredata.Value{ValueType: &firestoredata.Value_StringValue{StringValue: s}}
+}
+
+func integer(i int64) *firestoredata.Value {
+	return &firestoredata.Value{ValueType: &firestoredata.Value_IntegerValue{IntegerValue: i}}
+}
+
+func mapValue(fields map[string]*firestoredata.Value) *firestoredata.Value {
+	return &firestoredata.Value{ValueType: &firestoredata.Value_MapValue{MapValue: &firestoredata.MapValue{Fields: fields}}}
+}
+
+func equalFields(a, b map[string]*firestoredata.Value) bool {
+	return proto.Equal(mapValue(a), mapValue(b))
+}
+
+func TestFieldTransforms(t *testing.T) {
+	ts := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name      string
+		transform FieldTransform
+		fields    map[string]*firestoredata.Value
+		want      map[string]*firestoredata.Value
+		wantErr   string
+	}{
+		{
+			name:      "rename",
+			transform: RenameField("name", "display_name"),
+			fields:    map[string]*firestoredata.Value{"name": str("ada"), "display_name": str("old")},
+			want:      map[string]*firestoredata.Value{"display_name": str("ada")},
+		},
+		{
+			name:      "rename missing field",
+			transform: RenameField("name", "display_name"),
+			fields:    map[string]*firestoredata.Value{"other": str("ada")},
+			want:      map[string]*firestoredata.Value{"other": str("ada")},
+		},
+		{
+			name:      "rename into nested map",
+			transform: RenameField("city", "address.city"),
+			fields:    map[string]*firestoredata.Value{"city": str("Lisbon")},
+			want:      map[string]*firestoredata.Value{"address": mapValue(map[string]*firestoredata.Value{"city": str("Lisbon")})},
+		},
+		{
+			name:      "rename into non-map",
+			transform: RenameField("city", "address.city"),
+			fields:    map[string]*firestoredata.Value{"city": str("Lisbon"), "address": str("Rua")},
+			wantErr:   "not a map",
+		},
+		{
+			name:      "drop nested",
+			transform: DropField("address.city"),
+			fields:    map[string]*firestoredata.Value{"address": mapValue(map[string]*firestoredata.Value{"city": str("Lisbon"), "zip": str("1000")})},
+			want:      map[string]*firestoredata.Value{"address": mapValue(map[string]*firestoredata.Value{"zip": str("1000")})},
+		},
+		{
+			name:      "default missing field",
+			transform: DefaultField("locale", str("en")),
+			fields:    map[string]*firestoredata.Value{},
+			want:      map[string]*firestoredata.Value{"locale": str("en")},
+		},
+		{
+			name:      "default existing field",
+			transform: DefaultField("locale", str("en")),
+			fields:    map[string]*firestoredata.Value{"locale": str("pt")},
+			want:      map[string]*firestoredata.Value{"locale": str("pt")},
+		},
+		{
+			name:      "convert string to integer",
+			transform: ConvertField("age", ValueTypeInteger),
+			fields:    map[string]*firestoredata.Value{"age": str("42")},
+			want:      map[string]*firestoredata.Value{"age": integer(42)},
+		},
+		{
+			name:      "convert integer to string",
+			transform: ConvertField("age", ValueTypeString),
+			fields:    map[string]*firestoredata.Value{"age": integer(42)},
+			want:      map[string]*firestoredata.Value{"age": str("42")},
+		},
+		{
+			name:      "convert integer to double",
+			transform: ConvertField("total", ValueTypeDouble),
+			fields:    map[string]*firestoredata.Value{"total": integer(3)},
+			want:      map[string]*firestoredata.Value{"total": {ValueType: &firestoredata.Value_DoubleValue{DoubleValue: 3}}},
+		},
+		{
+			name:      "convert string to timestamp",
+			transform: ConvertField("at", ValueTypeTimestamp),
+			fields:    map[string]*firestoredata.Value{"at": str("2025-01-02T03:04:05Z")},
+			want:      map[string]*firestoredata.Value{"at": {ValueType: &firestoredata.Value_TimestampValue{TimestampValue: timestamppb.New(ts)}}},
+		},
+		{
+			name:      "convert null",
+			transform: ConvertField("age", ValueTypeInteger),
+			fields:    map[string]*firestoredata.Value{"age": {ValueType: &firestoredata.Value_NullValue{}}},
+			want:      map[string]*firestoredata.Value{"age": {ValueType: &firestoredata.Value_NullValue{}}},
+		},
+		{
+			name:      "convert invalid value",
+			transform: ConvertField("age", ValueTypeInteger),
+			fields:    map[string]*firestoredata.Value{"age": str("old")},
+			wantErr:   "failed to convert field age",
+		},
+		{
+			name:      "convert unsupported type",
+			transform: ConvertField("active", ValueTypeTimestamp),
+			fields:    map[string]*firestoredata.Value{"active": {ValueType: &firestoredata.Value_BooleanValue{BooleanValue: true}}},
+			wantErr:   "can't convert",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.transform.TransformFields(tt.fields)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("TransformFields() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TransformFields() unexpected error: %v", err)
+			}
+			if !equalFields(tt.fields, tt.want) {
+				t.Fatalf("fields = %v, want %v", tt.fields, tt.want)
+			}
+		})
+	}
+}
+
+var testMigrations = Migrations{
+	{
+		Collection: "users",
+		Version:    1,
+		Upgrade:    []FieldTransform{RenameField("name", "display_name")},
+		Downgrade:  []FieldTransform{RenameField("display_name", "name")},
+	},
+	{
+		Collection: "users",
+		Version:    2,
+		Upgrade:    []FieldTransform{DefaultField("locale", str("en"))},
+		Downgrade:  []FieldTransform{DropField("locale")},
+	},
+	{
+		Collection: "orders",
+		Version:    2,
+		Upgrade:    []FieldTransform{DropField("name")},
+	},
+}
+
+func TestMigrations_Transform(t *testing.T) {
+	users := &model.DocumentName{ProjectID: "p", DatabaseID: "d", Path: "users/1"}
+	tests := []struct {
+		name     string
+		from, to int
+		fields   map[string]*firestoredata.Value
+		want     map[string]*firestoredata.Value
+	}{
+		{
+			name: "same version",
+			from: 1, to: 1,
+			fields: map[string]*firestoredata.Value{"name": str("ada")},
+			want:   map[string]*firestoredata.Value{"name": str("ada")},
+		},
+		{
+			name: "upgrade",
+			from: 0, to: 2,
+			fields: map[string]*firestoredata.Value{"name": str("ada")},
+			want:   map[string]*firestoredata.Value{"display_name": str("ada"), "locale": str("en")},
+		},
+		{
+			name: "downgrade",
+			from: 2, to: 0,
+			fields: map[string]*firestoredata.Value{"display_name": str("ada"), "locale": str("pt")},
+			want:   map[string]*firestoredata.Value{"name": str("ada")},
+		},
+		{
+			name: "partial upgrade",
+			from: 1, to: 2,
+			fields: map[string]*firestoredata.Value{"name": str("ada")},
+			want:   map[string]*firestoredata.Value{"name": str("ada"), "locale": str("en")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := testMigrations.Transform(users, tt.fields, tt.from, tt.to); err != nil {
+				t.Fatalf("Transform() unexpected error: %v", err)
+			}
+			if !equalFields(tt.fields, tt.want) {
+				t.Fatalf("fields = %v, want %v", tt.fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestPropagate_SchemaVersion(t *testing.T) {
+	topic := &mockTopic{result: &mockResult{id: "1"}}
+	tx := &mockTx{
+		get:    func(string) (DocumentSnapshot, error) { return &mockSnap{exists: false}, nil },
+		update: func(p string, u []Update, ts time.Time) error { return nil },
+	}
+	svc := NewPropagator(topic, &mockFirestore{tx: tx}, time.Second, noop.Meter{},
+		WithSchema(testMigrations, 2), WithPublishedSchemaVersion(1))
+
+	evt := sampleEvent(model.EventTypeCreated, time.Now())
+	evt.Data.Value.Fields = map[string]*firestoredata.Value{"display_name": str("ada"), "locale": str("en")}
+	original := proto.Clone(evt.Data)
+
+	res, err := svc.Propagate(context.Background(), evt)
+	if err != nil || res != PropagationResultSuccess {
+		t.Fatalf("Propagate() = %v %v", res, err)
+	}
+	if got := topic.msg.Attributes["schema-version"]; got != "1" {
+		t.Fatalf("schema-version attribute = %q, want 1", got)
+	}
+
+	published := &firestoredata.DocumentEventData{}
+	if err := proto.Unmarshal(topic.msg.Data, published); err != nil {
+		t.Fatalf("proto.Unmarshal: %v", err)
+	}
+	if want := map[string]*firestoredata.Value{"display_name": str("ada")}; !equalFields(published.GetValue().GetFields(), want) {
+		t.Fatalf("published fields = %v, want %v", published.GetValue().GetFields(), want)
+	}
+	if !proto.Equal(evt.Data, original) {
+		t.Fatalf("event data = %v, want it unmodified", evt.Data)
+	}
+}
+
+func TestReplicate_SchemaVersion(t *testing.T) {
+	var written map[string]interface{}
+	tx := &mockTx{
+		get: func(string) (DocumentSnapshot, error) { return &mockSnap{}, nil },
+		set: func(p string, data interface{}) error {
+			written = data.(map[string]interface{})
+			return nil
+		},
+	}
+	svc := NewReplicator(noop.Meter{}, &mockFirestore{tx: tx}, WithSchema(testMigrations, 2))
+
+	res, err := svc.Replicate(context.Background(), sampleMessage(t, model.EventTypeCreated, time.Unix(1, 0)))
+	if err != nil || res != ReplicationResultSuccess {
+		t.Fatalf("Replicate() = %v %v", res, err)
+	}
+	if written["display_name"] != "ada" || written["locale"] != "en" || written["name"] != nil {
+		t.Fatalf("written = %v, want the upgraded document", written)
+	}
+
+	// changes of the local version are replicated as they are
+	msg := sampleMessage(t, model.EventTypeCreated, time.Unix(2, 0), "schema-version", "2")
+	if res, err := svc.Replicate(context.Background(), msg); err != nil || res != ReplicationResultSuccess {
+		t.Fatalf("Replicate() = %v %v", res, err)
+	}
+	if written["name"] != "ada" || written["locale"] != nil {
+		t.Fatalf("written = %v, want the document as is", written)
+	}
+
+	svc = NewReplicator(noop.Meter{}, &mockFirestore{tx: tx}, WithSchema(Migrations{{
+		Collection: "users",
+		Version:    1,
+		Upgrade:    []FieldTransform{ConvertField("name", ValueTypeInteger)},
+	}}, 1))
+	res, err = svc.Replicate(context.Background(), sampleMessage(t, model.EventTypeCreated, time.Unix(3, 0)))
+	if ClassifyError(err) != ErrorClassPermanent || res != ReplicationResultError {
+		t.Fatalf("Replicate() = %v %v, want a permanent error", res, err)
+	}
+}
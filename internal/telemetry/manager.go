@@ -3,6 +3,7 @@ package telemetry
 import (
 	"context"
 	"errors"
+	"net/http"
 
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel/metric"
@@ -17,6 +18,27 @@ import (
 type Manager struct {
 	tp *sdktrace.TracerProvider
 	mp *sdkmetric.MeterProvider
+
+	// metricsHandler serves the metrics to Prometheus scrapes, if they are
+	// exported with the prometheus exporter.
+	metricsHandler http.Handler
+}
+
+// Supported OTLP protocols, as named by OTEL_EXPORTER_OTLP_PROTOCOL. The OTLP
+// exporters don't encode JSON, so http/json is not supported.
+const (
+	OTLPProtocolGRPC         = "grpc"
+	OTLPProtocolHTTPProtobuf = "http/protobuf"
+)
+
+// otlpProtocol returns the protocol of a signal, which overrides the one of
+// every signal if set, and whether it is supported.
+func otlpProtocol(signal, all string) (string, bool) {
+	protocol := all
+	if signal != "" {
+		protocol = signal
+	}
+	return protocol, protocol == OTLPProtocolGRPC || protocol == OTLPProtocolHTTPProtobuf
 }
 
 type Options struct {
@@ -28,6 +50,8 @@ type Options struct {
 	TracingExporter            string
 	MetricsExporter            string
 	OTLPProtocol               string
+	OTLPTracesProtocol         string
+	OTLPMetricsProtocol        string
 	ConsoleExporterPrettyPrint bool
 	TraceSampleRatio           float64
 }
@@ -69,11 +93,12 @@ func (m *Manager) initTracerProvider(ctx context.Context, res *resource.Resource
 	case "console":
 		exporter, err = NewStdoutTraceExporter(opts.ConsoleExporterPrettyPrint)
 	case "otlp":
-		if opts.OTLPProtocol != "grpc" {
-			log.Warn().Str("otlp_protocol", opts.OTLPProtocol).Msg("unsupported otlp protocol: tracing will be disabled")
+		protocol, ok := otlpProtocol(opts.OTLPTracesProtocol, opts.OTLPProtocol)
+		if !ok {
+			log.Warn().Str("otlp_protocol", protocol).Msg("unsupported otlp protocol, expected grpc or http/protobuf: tracing will be disabled")
 			return
 		}
-		exporter, err = NewOTLPTraceExporter(ctx)
+		exporter, err = NewOTLPTraceExporter(ctx, protocol)
 	default:
 		log.Warn().Str("tracing_exporter", opts.TracingExporter).Msg("unsupported tracing exporter: tracing will be disabled")
 		return
@@ -100,14 +125,28 @@ func (m *Manager) initMetricProvider(ctx context.Context, res *resource.Resource
 	var err error
 
 	switch opts.MetricsExporter {
+	case "prometheus":
+		// scraped rather than exported periodically
+		var reader sdkmetric.Reader
+		reader, m.metricsHandler, err = NewPrometheusMetricReader()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to create prometheus metric reader: metrics will be disabled")
+			return
+		}
+		m.mp = sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(reader),
+			sdkmetric.WithResource(res),
+		)
+		return
 	case "console":
 		me, err = NewStdoutMetricExporter(opts.ConsoleExporterPrettyPrint)
 	case "otlp":
-		if opts.OTLPProtocol != "grpc" {
-			log.Warn().Str("otlp_protocol", opts.OTLPProtocol).Msg("unsupported otlp protocol: metrics will be disabled")
+		protocol, ok := otlpProtocol(opts.OTLPMetricsProtocol, opts.OTLPProtocol)
+		if !ok {
+			log.Warn().Str("otlp_protocol", protocol).Msg("unsupported otlp protocol, expected grpc or http/protobuf: metrics will be disabled")
 			return
 		}
-		me, err = NewOTLPMetricExporter(ctx)
+		me, err = NewOTLPMetricExporter(ctx, protocol)
 	case "googlecloudmetrics":
 		me, err = NewCloudMonitoringMetricExporter(opts.ProjectID)
 	default:
@@ -142,6 +181,12 @@ func (m *Manager) MeterProvider() metric.MeterProvider {
 	return m.mp
 }
 
+// MetricsHandler returns the handler serving the metrics to Prometheus scrapes,
+// or nil if they are not exported with the prometheus exporter.
+func (m *Manager) MetricsHandler() http.Handler {
+	return m.metricsHandler
+}
+
 func (m *Manager) Shutdown(ctx context.Context) error {
 	var err error
 	if m.tp != nil {
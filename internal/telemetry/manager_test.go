@@ -0,0 +1,27 @@
+package telemetry
+
+import "testing"
+
+func TestOTLPProtocol(t *testing.T) {
+	tests := []struct {
+		name, signal, all string
+		want              string
+		wantOK            bool
+	}{
+		{"all", "", "grpc", "grpc", true},
+		{"signal override", "http/protobuf", "grpc", "http/protobuf", true},
+		{"signal override to grpc", "grpc", "http/protobuf", "grpc", true},
+		{"json", "", "http/json", "http/json", false},
+		{"json override", "http/json", "grpc", "http/json", false},
+		{"supported override", "grpc", "http/json", "grpc", true},
+		{"unknown", "", "thrift", "thrift", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := otlpProtocol(tt.signal, tt.all)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("otlpProtocol(%q, %q) = %q, %v, want %q, %v", tt.signal, tt.all, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
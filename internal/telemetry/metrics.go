@@ -2,9 +2,15 @@ package telemetry
 
 import (
 	"context"
+	"net/http"
 
 	mexporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
 	"go.opentelemetry.io/otel/sdk/metric"
 )
@@ -13,10 +19,34 @@ func NewCloudMonitoringMetricExporter(projectID string) (metric.Exporter, error)
 	return mexporter.New(mexporter.WithProjectID(projectID))
 }
 
-func NewOTLPMetricExporter(ctx context.Context) (metric.Exporter, error) {
+// NewOTLPMetricExporter returns an OTLP metric exporter over gRPC or
+// HTTP/protobuf.
+func NewOTLPMetricExporter(ctx context.Context, protocol string) (metric.Exporter, error) {
+	if protocol == OTLPProtocolHTTPProtobuf {
+		return otlpmetrichttp.New(ctx)
+	}
 	return otlpmetricgrpc.New(ctx)
 }
 
+// NewPrometheusMetricReader returns a metric reader collecting the instruments
+// when scraped, and the handler serving them in the Prometheus exposition
+// format along with the Go runtime and process metrics.
+func NewPrometheusMetricReader() (metric.Reader, http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collectors.NewGoCollector()); err != nil {
+		return nil, nil, err
+	}
+	if err := registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
+}
+
 // NewStdoutMetricExporter returns a stdout metric exporter for local
 // development.
 func NewStdoutMetricExporter(prettyPrint bool) (metric.Exporter, error) {
@@ -0,0 +1,47 @@
+package telemetry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func TestNewPrometheusMetricReader(t *testing.T) {
+	reader, handler, err := NewPrometheusMetricReader()
+	if err != nil {
+		t.Fatalf("NewPrometheusMetricReader: %v", err)
+	}
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { mp.Shutdown(context.Background()) })
+
+	counter, err := mp.Meter("firesync").Int64Counter("firesync.test.count")
+	if err != nil {
+		t.Fatalf("Int64Counter: %v", err)
+	}
+	counter.Add(context.Background(), 3)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", rr.Code)
+	}
+	body, _ := io.ReadAll(rr.Body)
+
+	for _, want := range []string{"firesync_test_count_total", "go_goroutines"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape is missing %s:\n%s", want, body)
+		}
+	}
+	var recorded bool
+	for _, line := range strings.Split(string(body), "\n") {
+		recorded = recorded || strings.HasPrefix(line, "firesync_test_count_total{") && strings.HasSuffix(line, "} 3")
+	}
+	if !recorded {
+		t.Errorf("scrape is missing the recorded value:\n%s", body)
+	}
+}
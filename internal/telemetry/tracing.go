@@ -6,33 +6,57 @@ import (
 	"os"
 
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/oauth"
 )
 
-// NewCloudTraceExporter returns a Google Cloud Trace OTLP exporter.
-func NewCloudTraceExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
-	creds, err := oauth.NewApplicationDefault(ctx, "https://www.googleapis.com/auth/trace.append")
+const cloudTraceScope = "https://www.googleapis.com/auth/trace.append"
+
+// cloudTraceEndpoint is the Cloud Trace OTLP endpoint, replaced by tests.
+var cloudTraceEndpoint = "https://telemetry.googleapis.com:443/v1/traces"
+
+// NewCloudTraceExporter returns a Google Cloud Trace OTLP exporter over the
+// given protocol, authenticated with the application default credentials.
+func NewCloudTraceExporter(ctx context.Context, protocol string) (sdktrace.SpanExporter, error) {
+	if protocol == OTLPProtocolHTTPProtobuf {
+		client, err := google.DefaultClient(ctx, cloudTraceScope)
+		if err != nil {
+			return nil, err
+		}
+
+		return otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpointURL(cloudTraceEndpoint),
+			otlptracehttp.WithHTTPClient(client),
+		)
+	}
+
+	creds, err := oauth.NewApplicationDefault(ctx, cloudTraceScope)
 	if err != nil {
 		return nil, err
 	}
 
 	return otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpointURL("https://telemetry.googleapis.com:443/v1/traces"),
+		otlptracegrpc.WithEndpointURL(cloudTraceEndpoint),
 		otlptracegrpc.WithDialOption(grpc.WithPerRPCCredentials(creds)),
 	)
 }
 
-// NewOTLPTraceExporter returns an OTLP gRPC trace exporter for services like Uptrace.
-func NewOTLPTraceExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+// NewOTLPTraceExporter returns an OTLP trace exporter over gRPC or
+// HTTP/protobuf for services like Uptrace.
+func NewOTLPTraceExporter(ctx context.Context, protocol string) (sdktrace.SpanExporter, error) {
 	endpoint := getFirstEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT")
 
 	if url, err := url.Parse(endpoint); err == nil && url.Hostname() == "telemetry.googleapis.com" {
-		return NewCloudTraceExporter(ctx)
+		return NewCloudTraceExporter(ctx, protocol)
 	}
 
+	if protocol == OTLPProtocolHTTPProtobuf {
+		return otlptracehttp.New(ctx)
+	}
 	return otlptracegrpc.New(ctx)
 }
 
@@ -0,0 +1,96 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// writeServiceAccount writes service account credentials exchanging their
+// tokens at tokenURL, and returns their path.
+func writeServiceAccount(t *testing.T, tokenURL string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "p",
+		"private_key_id": "k",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"client_email":   "firesync@p.iam.gserviceaccount.com",
+		"token_uri":      tokenURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(file, creds, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestNewCloudTraceExporter_HTTP(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []*http.Request
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+			return
+		}
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer srv.Close()
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", writeServiceAccount(t, srv.URL+"/token"))
+	endpoint := cloudTraceEndpoint
+	cloudTraceEndpoint = srv.URL + "/v1/traces"
+	t.Cleanup(func() { cloudTraceEndpoint = endpoint })
+
+	ctx := context.Background()
+	exporter, err := NewCloudTraceExporter(ctx, OTLPProtocolHTTPProtobuf)
+	if err != nil {
+		t.Fatalf("NewCloudTraceExporter: %v", err)
+	}
+	if err := exporter.ExportSpans(ctx, tracetest.SpanStubs{{Name: "replicate"}}.Snapshots()); err != nil {
+		t.Fatalf("ExportSpans: %v", err)
+	}
+	if err := exporter.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("requests = %d, want 1", len(requests))
+	}
+	r := requests[0]
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		t.Fatalf("request = %s %s, want POST /v1/traces", r.Method, r.URL.Path)
+	}
+	if got := r.Header.Get("Content-Type"); got != "application/x-protobuf" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer token" {
+		t.Fatalf("Authorization = %q, want the application default credentials", got)
+	}
+}
@@ -0,0 +1,514 @@
+// Package verify checks that the databases of a FireSync deployment have
+// converged, comparing the content and FireSync metadata of every document
+// across them.
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/joaopenteado/firesync/internal/scan"
+	"github.com/rs/zerolog"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// CursorCollection is the internal collection verification cursors are saved
+// in, in the reference database.
+const CursorCollection = model.InternalCollectionPrefix + "verify"
+
+// Database is one of the databases to compare.
+type Database struct {
+	// Name is the database resource name, projects/{project}/databases/{id}.
+	Name   string
+	Client *firestore.Client
+}
+
+type Config struct {
+	// Job names the verification, whose cursor is saved under that name.
+	Job string
+
+	// Collections restricts the verification to documents in collections
+	// matching the given patterns, in path.Match syntax. Empty verifies every
+	// collection.
+	Collections []string
+
+	// BatchSize is how many documents are read at once. The cursor is saved
+	// after every batch. Zero means scan.DefaultBatchSize.
+	BatchSize int
+
+	// SampleRate is the fraction of documents verified, in (0, 1]. Documents
+	// are sampled by a hash of their path, so every database and resumed run
+	// agree on the sample. Zero verifies every document.
+	SampleRate float64
+
+	// ProgressInterval is how often progress is logged. Zero disables
+	// progress reports.
+	ProgressInterval time.Duration
+
+	// Restart ignores the saved cursor and starts over.
+	Restart bool
+}
+
+// Kind classifies a document compared across databases.
+type Kind string
+
+const (
+	// KindConsistent documents are identical in every database.
+	KindConsistent Kind = "consistent"
+
+	// KindMissing documents exist in the reference database but not in some
+	// other database.
+	KindMissing Kind = "missing"
+
+	// KindExtra documents don't exist in the reference database but exist in
+	// some other database.
+	KindExtra Kind = "extra"
+
+	// KindDivergent documents exist in every database but their content or
+	// FireSync metadata differ, or their tombstones differ.
+	KindDivergent Kind = "divergent"
+)
+
+// Version identifies a write by its LWW timestamp and source database.
+type Version struct {
+	Timestamp time.Time `json:"ts"`
+	Source    string    `json:"src"`
+}
+
+// State is the state of a document in one database.
+type State struct {
+	Database string `json:"database"`
+	Exists   bool   `json:"exists"`
+
+	// Hash is the hash of the document's content, excluding its FireSync
+	// metadata.
+	Hash       string     `json:"hash,omitempty"`
+	UpdateTime *time.Time `json:"update_time,omitempty"`
+
+	// Metadata is the version recorded in the document's FireSync metadata.
+	Metadata *Version `json:"metadata,omitempty"`
+
+	// Tombstone is the version of the document's tombstone, if any.
+	Tombstone *Version `json:"tombstone,omitempty"`
+}
+
+// Finding is a document that differs across databases. It is reported as a
+// JSON line.
+type Finding struct {
+	Path   string  `json:"path"`
+	Kind   Kind    `json:"kind"`
+	States []State `json:"states"`
+}
+
+// Summary counts the documents verified, across resumed runs.
+type Summary struct {
+	Scanned    int64 `firestore:"scanned" json:"scanned"`
+	Consistent int64 `firestore:"consistent" json:"consistent"`
+	Missing    int64 `firestore:"missing" json:"missing"`
+	Extra      int64 `firestore:"extra" json:"extra"`
+	Divergent  int64 `firestore:"divergent" json:"divergent"`
+}
+
+// Inconsistent returns the number of documents that differ across databases.
+func (s Summary) Inconsistent() int64 {
+	return s.Missing + s.Extra + s.Divergent
+}
+
+func (s *Summary) add(kind Kind) {
+	s.Scanned++
+	switch kind {
+	case KindConsistent:
+		s.Consistent++
+	case KindMissing:
+		s.Missing++
+	case KindExtra:
+		s.Extra++
+	case KindDivergent:
+		s.Divergent++
+	}
+}
+
+// Cursor is the saved progress of a verification. Every database is walked in
+// turn, to find the documents that only exist in some of them.
+type Cursor struct {
+	// Database is the index of the database being walked.
+	Database int `firestore:"database"`
+
+	// Path is the path of the last document verified in that database,
+	// relative to the database root.
+	Path string `firestore:"path"`
+
+	// Done is set once every database was walked.
+	Done bool `firestore:"done"`
+
+	Summary Summary `firestore:"summary"`
+
+	Updated time.Time `firestore:"updated"`
+}
+
+// Verifier compares the documents of several databases.
+type Verifier struct {
+	dbs     []Database
+	cursors scan.CursorStore
+	cfg     Config
+
+	cursor     Cursor
+	lastReport time.Time
+}
+
+// New returns a Verifier comparing dbs, the first of which is the reference
+// database findings are classified against.
+func New(dbs []Database, cursors scan.CursorStore, cfg Config) *Verifier {
+	return &Verifier{
+		dbs:     dbs,
+		cursors: cursors,
+		cfg:     cfg,
+	}
+}
+
+// Run verifies every matching document after the saved cursor, writing a
+// JSON line to w for each finding. If it fails or ctx is canceled, running
+// again resumes after the last batch that completed; findings of the batch
+// that was interrupted may be reported twice.
+func (v *Verifier) Run(ctx context.Context, w io.Writer) (Summary, error) {
+	logger := zerolog.Ctx(ctx)
+
+	if !v.cfg.Restart {
+		found, err := v.cursors.Load(ctx, v.cfg.Job, &v.cursor)
+		if err != nil {
+			return Summary{}, fmt.Errorf("failed to load cursor: %w", err)
+		}
+		if found && v.cursor.Done {
+			logger.Info().Str("job", v.cfg.Job).Msg("verification already complete")
+			return v.cursor.Summary, nil
+		}
+		if found && v.cursor.Database >= len(v.dbs) {
+			return Summary{}, fmt.Errorf("cursor of job %q was saved for more databases, restart it", v.cfg.Job)
+		}
+		if found {
+			logger.Info().
+				Str("job", v.cfg.Job).
+				Str("database", v.dbs[v.cursor.Database].Name).
+				Str("cursor", v.cursor.Path).
+				Msg("resuming verification")
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	v.lastReport = time.Now()
+
+	for ; v.cursor.Database < len(v.dbs); v.cursor.Database, v.cursor.Path = v.cursor.Database+1, "" {
+		i := v.cursor.Database
+		walker := scan.NewWalker(v.dbs[i].Client, v.cfg.BatchSize, v.cfg.Collections...)
+		err := walker.Walk(ctx, v.cursor.Path, func(ctx context.Context, refs []*firestore.DocumentRef) error {
+			if err := v.verify(ctx, i, refs, enc); err != nil {
+				return err
+			}
+			v.cursor.Path = scan.RelativePath(refs[len(refs)-1].Path)
+			return v.save(ctx)
+		})
+		if err != nil {
+			return v.cursor.Summary, err
+		}
+	}
+
+	v.cursor.Done = true
+	if err := v.save(ctx); err != nil {
+		return v.cursor.Summary, err
+	}
+	v.report(ctx, "verification finished")
+	return v.cursor.Summary, nil
+}
+
+// verify compares a batch of documents walked in the database at index
+// walked.
+func (v *Verifier) verify(ctx context.Context, walked int, refs []*firestore.DocumentRef, enc *json.Encoder) error {
+	paths := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		p := scan.RelativePath(ref.Path)
+		if v.sampled(p) {
+			paths = append(paths, p)
+		}
+	}
+
+	states, err := Inspect(ctx, v.dbs, paths)
+	if err != nil {
+		return err
+	}
+
+	for k, p := range paths {
+		if !states[k][walked].Exists || existsIn(states[k][:walked]) {
+			// a parent-only document, or verified while walking an earlier
+			// database
+			continue
+		}
+
+		kind := Classify(states[k])
+		v.cursor.Summary.add(kind)
+		if kind == KindConsistent {
+			continue
+		}
+		if err := enc.Encode(&Finding{Path: p, Kind: kind, States: states[k]}); err != nil {
+			return fmt.Errorf("failed to write finding: %w", err)
+		}
+	}
+
+	if v.cfg.ProgressInterval > 0 && time.Since(v.lastReport) >= v.cfg.ProgressInterval {
+		v.report(ctx, "verification progress")
+		v.lastReport = time.Now()
+	}
+	return nil
+}
+
+func (v *Verifier) save(ctx context.Context) error {
+	v.cursor.Updated = time.Now()
+	if err := v.cursors.Save(ctx, v.cfg.Job, &v.cursor); err != nil {
+		return fmt.Errorf("failed to save cursor: %w", err)
+	}
+	return nil
+}
+
+func (v *Verifier) report(ctx context.Context, msg string) {
+	s := v.cursor.Summary
+	zerolog.Ctx(ctx).Info().
+		Str("job", v.cfg.Job).
+		Int("database", v.cursor.Database).
+		Str("cursor", v.cursor.Path).
+		Int64("scanned", s.Scanned).
+		Int64("consistent", s.Consistent).
+		Int64("missing", s.Missing).
+		Int64("extra", s.Extra).
+		Int64("divergent", s.Divergent).
+		Msg(msg)
+}
+
+// sampled reports whether the document at p is part of the sample.
+func (v *Verifier) sampled(p string) bool {
+	if v.cfg.SampleRate <= 0 || v.cfg.SampleRate >= 1 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(p))
+	return float64(binary.BigEndian.Uint64(sum[:8])) < v.cfg.SampleRate*math.MaxUint64
+}
+
+func existsIn(states []State) bool {
+	for _, s := range states {
+		if s.Exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Inspect reads the state of the documents at paths in every database. The
+// result is indexed by path, then database.
+func Inspect(ctx context.Context, dbs []Database, paths []string) ([][]State, error) {
+	states := make([][]State, len(paths))
+	for k := range states {
+		states[k] = make([]State, len(dbs))
+	}
+	if len(paths) == 0 {
+		return states, nil
+	}
+
+	for i, db := range dbs {
+		// every document is read along with its tombstone
+		refs := make([]*firestore.DocumentRef, 0, 2*len(paths))
+		for _, p := range paths {
+			name := model.DocumentName{Path: p}
+			refs = append(refs, db.Client.Doc(p), db.Client.Doc(name.TombstonePath()))
+		}
+
+		snaps, err := db.Client.GetAll(ctx, refs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read documents from %s: %w", db.Name, err)
+		}
+
+		for k := range paths {
+			state, err := newState(db.Name, snaps[2*k], snaps[2*k+1])
+			if err != nil {
+				return nil, fmt.Errorf("failed to inspect %s in %s: %w", paths[k], db.Name, err)
+			}
+			states[k][i] = state
+		}
+	}
+	return states, nil
+}
+
+func newState(database string, doc, tombstone *firestore.DocumentSnapshot) (State, error) {
+	state := State{Database: database}
+
+	if tombstone.Exists() {
+		t := &model.Tombstone{}
+		if err := tombstone.DataTo(t); err != nil {
+			return state, fmt.Errorf("failed to unmarshal tombstone: %w", err)
+		}
+		// expired tombstones are deleted by the TTL policy at different
+		// times in every database, and no longer count
+		if t.Expiration == nil || t.Expiration.AsTime().After(time.Now()) {
+			state.Tombstone = &Version{Timestamp: t.Timestamp.AsTime(), Source: t.Source}
+		}
+	}
+
+	if !doc.Exists() {
+		return state, nil
+	}
+
+	data := doc.Data()
+	hash, err := ContentHash(data)
+	if err != nil {
+		return state, err
+	}
+	state.Exists = true
+	state.Hash = hash
+	state.UpdateTime = &doc.UpdateTime
+	state.Metadata = metadataVersion(data)
+	return state, nil
+}
+
+// metadataVersion returns the version recorded in the FireSync metadata of
+// document data, if any.
+func metadataVersion(data map[string]interface{}) *Version {
+	md, ok := data["_firesync"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	ts, _ := md["ts"].(time.Time)
+	src, _ := md["src"].(string)
+	return &Version{Timestamp: ts, Source: src}
+}
+
+// Classify compares the states of a document across databases, the first of
+// which is the reference.
+func Classify(states []State) Kind {
+	ref := states[0]
+	for _, s := range states[1:] {
+		switch {
+		case !ref.Exists && s.Exists:
+			return KindExtra
+		case ref.Exists && !s.Exists:
+			return KindMissing
+		}
+	}
+
+	for _, s := range states[1:] {
+		// a missing or older tombstone lets a late write resurrect the
+		// document in that database
+		if !sameVersion(s.Tombstone, ref.Tombstone) {
+			return KindDivergent
+		}
+		if ref.Exists && (s.Hash != ref.Hash || !sameVersion(s.Metadata, ref.Metadata)) {
+			return KindDivergent
+		}
+	}
+	return KindConsistent
+}
+
+func sameVersion(a, b *Version) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Timestamp.Equal(b.Timestamp) && a.Source == b.Source
+}
+
+// ContentHash returns a hash of document data, excluding its FireSync
+// metadata. References are hashed by their path relative to the database
+// root, since replication points them to the target database.
+func ContentHash(data map[string]interface{}) (string, error) {
+	h := sha256.New()
+	if err := hashMap(h, data, true); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashMap(h hash.Hash, m map[string]interface{}, root bool) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if root && k == "_firesync" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hashTag(h, 'm', uint64(len(keys)))
+	for _, k := range keys {
+		hashString(h, k)
+		if err := hashValue(h, m[k]); err != nil {
+			return fmt.Errorf("field %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func hashValue(h hash.Hash, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		hashTag(h, 'n', 0)
+	case bool:
+		var b uint64
+		if val {
+			b = 1
+		}
+		hashTag(h, 'b', b)
+	case int64:
+		hashTag(h, 'i', uint64(val))
+	case float64:
+		hashTag(h, 'd', math.Float64bits(val))
+	case time.Time:
+		hashTag(h, 't', uint64(val.UnixNano()))
+	case string:
+		hashTag(h, 's', 0)
+		hashString(h, val)
+	case []byte:
+		hashTag(h, 'y', uint64(len(val)))
+		h.Write(val)
+	case *latlng.LatLng:
+		hashTag(h, 'g', math.Float64bits(val.GetLatitude()))
+		hashTag(h, 'g', math.Float64bits(val.GetLongitude()))
+	case *firestore.DocumentRef:
+		hashTag(h, 'r', 0)
+		hashString(h, scan.RelativePath(val.Path))
+	case []interface{}:
+		hashTag(h, 'a', uint64(len(val)))
+		for _, item := range val {
+			if err := hashValue(h, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		return hashMap(h, val, false)
+	case firestore.Vector64:
+		hashTag(h, 'v', uint64(len(val)))
+		for _, f := range val {
+			hashTag(h, 'd', math.Float64bits(f))
+		}
+	default:
+		return fmt.Errorf("unsupported value type %T", val)
+	}
+	return nil
+}
+
+func hashTag(h hash.Hash, tag byte, n uint64) {
+	var buf [9]byte
+	buf[0] = tag
+	binary.BigEndian.PutUint64(buf[1:], n)
+	h.Write(buf[:])
+}
+
+func hashString(h hash.Hash, s string) {
+	hashTag(h, 'l', uint64(len(s)))
+	io.WriteString(h, s)
+}
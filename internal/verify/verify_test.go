@@ -0,0 +1,156 @@
+package verify
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestClassify(t *testing.T) {
+	v1 := &Version{Timestamp: time.Unix(1, 0), Source: "projects/p/databases/a"}
+	v2 := &Version{Timestamp: time.Unix(2, 0), Source: "projects/p/databases/b"}
+
+	tests := []struct {
+		name   string
+		states []State
+		want   Kind
+	}{
+		{
+			name:   "consistent",
+			states: []State{{Exists: true, Hash: "h", Metadata: v1}, {Exists: true, Hash: "h", Metadata: v1}},
+			want:   KindConsistent,
+		},
+		{
+			name:   "absent everywhere",
+			states: []State{{Tombstone: v1}, {Tombstone: v1}},
+			want:   KindConsistent,
+		},
+		{
+			name:   "tombstone missing",
+			states: []State{{Tombstone: v1}, {}},
+			want:   KindDivergent,
+		},
+		{
+			name:   "older tombstone",
+			states: []State{{Tombstone: v2}, {Tombstone: v1}},
+			want:   KindDivergent,
+		},
+		{
+			name:   "tombstone from another source",
+			states: []State{{Tombstone: v1}, {Tombstone: &Version{Timestamp: v1.Timestamp, Source: v2.Source}}},
+			want:   KindDivergent,
+		},
+		{
+			name:   "tombstone under a recreated document",
+			states: []State{{Exists: true, Hash: "h", Metadata: v2, Tombstone: v1}, {Exists: true, Hash: "h", Metadata: v2}},
+			want:   KindDivergent,
+		},
+		{
+			name:   "missing",
+			states: []State{{Exists: true, Hash: "h"}, {Exists: true, Hash: "h"}, {Tombstone: v2}},
+			want:   KindMissing,
+		},
+		{
+			name:   "extra",
+			states: []State{{}, {Exists: true, Hash: "h"}},
+			want:   KindExtra,
+		},
+		{
+			name:   "different content",
+			states: []State{{Exists: true, Hash: "h", Metadata: v1}, {Exists: true, Hash: "x", Metadata: v1}},
+			want:   KindDivergent,
+		},
+		{
+			name:   "different metadata",
+			states: []State{{Exists: true, Hash: "h", Metadata: v1}, {Exists: true, Hash: "h", Metadata: v2}},
+			want:   KindDivergent,
+		},
+		{
+			name:   "metadata only in one database",
+			states: []State{{Exists: true, Hash: "h", Metadata: v1}, {Exists: true, Hash: "h"}},
+			want:   KindDivergent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.states); got != tt.want {
+				t.Fatalf("Classify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	hash := func(data map[string]interface{}) string {
+		t.Helper()
+		h, err := ContentHash(data)
+		if err != nil {
+			t.Fatalf("ContentHash() unexpected error: %v", err)
+		}
+		return h
+	}
+
+	base := map[string]interface{}{
+		"name": "a",
+		"tags": []interface{}{"x", int64(1)},
+		"at":   time.Unix(1, 0),
+	}
+
+	withMetadata := map[string]interface{}{
+		"name":      "a",
+		"tags":      []interface{}{"x", int64(1)},
+		"at":        time.Unix(1, 0),
+		"_firesync": map[string]interface{}{"src": "projects/p/databases/a"},
+	}
+	if hash(base) != hash(withMetadata) {
+		t.Error("FireSync metadata changed the hash")
+	}
+
+	for name, other := range map[string]map[string]interface{}{
+		"value":    {"name": "b", "tags": []interface{}{"x", int64(1)}, "at": time.Unix(1, 0)},
+		"type":     {"name": "a", "tags": []interface{}{"x", 1.0}, "at": time.Unix(1, 0)},
+		"order":    {"name": "a", "tags": []interface{}{int64(1), "x"}, "at": time.Unix(1, 0)},
+		"field":    {"name": "a", "tags": []interface{}{"x", int64(1)}},
+		"metadata": {"name": "a", "tags": []interface{}{"x", int64(1)}, "at": time.Unix(1, 0), "nested": map[string]interface{}{"_firesync": true}},
+	} {
+		if hash(base) == hash(other) {
+			t.Errorf("%s change did not change the hash", name)
+		}
+	}
+
+	// replicated references point to the target database
+	refA := &firestore.DocumentRef{Path: "projects/p/databases/a/documents/users/1"}
+	refB := &firestore.DocumentRef{Path: "projects/p/databases/b/documents/users/1"}
+	if hash(map[string]interface{}{"ref": refA}) != hash(map[string]interface{}{"ref": refB}) {
+		t.Error("references to the same path hashed differently")
+	}
+
+	if _, err := ContentHash(map[string]interface{}{"n": 1}); err == nil {
+		t.Error("ContentHash() expected an error for an unsupported type")
+	}
+}
+
+func TestVerifier_Sampled(t *testing.T) {
+	v := New(nil, nil, Config{SampleRate: 0.1})
+
+	sampled := 0
+	for i := range 10000 {
+		p := fmt.Sprintf("users/%d", i)
+		if v.sampled(p) {
+			sampled++
+		}
+		if v.sampled(p) != v.sampled(p) {
+			t.Fatalf("sampling of %s is not deterministic", p)
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Fatalf("sampled %d of 10000 documents at rate 0.1", sampled)
+	}
+
+	all := New(nil, nil, Config{})
+	if !all.sampled("users/1") {
+		t.Fatal("documents should all be sampled without a sample rate")
+	}
+}
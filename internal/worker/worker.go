@@ -0,0 +1,131 @@
+// Package worker consumes Pub/Sub subscriptions with streaming pull, as an
+// alternative to push subscriptions for deployments without public ingress.
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/joaopenteado/firesync/internal/handler"
+	"github.com/joaopenteado/firesync/internal/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// Subscription abstracts a Pub/Sub subscription. It is satisfied by
+// *pubsub.Subscription, whose ReceiveSettings control flow.
+type Subscription interface {
+	ID() string
+	Receive(ctx context.Context, f func(context.Context, *pubsub.Message)) error
+}
+
+type workerMetrics struct {
+	MessageCount metric.Int64Counter
+}
+
+func newWorkerMetrics(meter metric.Meter) workerMetrics {
+	MessageCount, err := meter.Int64Counter("firesync.worker.message_count",
+		metric.WithDescription("The total number of messages pulled from Pub/Sub subscriptions."),
+		metric.WithUnit("1"),
+	)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("metric", "firesync.worker.message_count").
+			Msg("failed to create metric")
+		MessageCount = noop.Int64Counter{}
+	}
+
+	return workerMetrics{
+		MessageCount: MessageCount,
+	}
+}
+
+type consumer struct {
+	sub     Subscription
+	handler handler.MessageHandler
+}
+
+// Worker feeds messages pulled from Pub/Sub subscriptions to message handlers,
+// acknowledging them according to the handlers' results.
+type Worker struct {
+	consumers []consumer
+	metrics   workerMetrics
+}
+
+func New(meter metric.Meter) *Worker {
+	return &Worker{
+		metrics: newWorkerMetrics(meter),
+	}
+}
+
+// Handle registers h to process the messages of sub.
+func (w *Worker) Handle(sub Subscription, h handler.MessageHandler) {
+	w.consumers = append(w.consumers, consumer{sub: sub, handler: h})
+}
+
+// Run pulls messages until ctx is done, then stops pulling and waits for the
+// messages being processed to finish. Their processing is not canceled along
+// with ctx, so the caller is expected to bound the wait with its shutdown
+// timeout. Run returns early if any subscription fails permanently.
+func (w *Worker) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, c := range w.consumers {
+		wg.Add(1)
+		go func(c consumer) {
+			defer wg.Done()
+			err := c.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+				// the receive context is canceled on shutdown, while messages
+				// being processed should be drained instead
+				if w.process(context.WithoutCancel(ctx), c, msg) {
+					msg.Ack()
+				} else {
+					msg.Nack()
+				}
+			})
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("failed to receive from subscription %s: %w", c.sub.ID(), err)
+				})
+				cancel()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+func (w *Worker) process(ctx context.Context, c consumer, msg *pubsub.Message) (ack bool) {
+	logger := zerolog.Ctx(ctx).With().
+		Str("subscription", c.sub.ID()).
+		Str("message_id", msg.ID).
+		Logger()
+	ctx = logger.WithContext(ctx)
+
+	defer func() {
+		w.metrics.MessageCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("subscription", c.sub.ID()),
+			attribute.Bool("ack", ack),
+		))
+	}()
+
+	return c.handler(ctx, &model.Message{
+		ID:           msg.ID,
+		Attributes:   msg.Attributes,
+		Data:         msg.Data,
+		PublishTime:  msg.PublishTime,
+		Subscription: c.sub.ID(),
+	})
+}
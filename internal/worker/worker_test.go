@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/joaopenteado/firesync/internal/model"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// fakeSubscription delivers msgs and then blocks until the receive context is
+// canceled, like a streaming pull with no more messages available.
+type fakeSubscription struct {
+	msgs []*pubsub.Message
+	err  error
+}
+
+func (s *fakeSubscription) ID() string { return "sub" }
+
+func (s *fakeSubscription) Receive(ctx context.Context, f func(context.Context, *pubsub.Message)) error {
+	if s.err != nil {
+		return s.err
+	}
+	var wg sync.WaitGroup
+	for _, msg := range s.msgs {
+		wg.Add(1)
+		go func(msg *pubsub.Message) {
+			defer wg.Done()
+			f(ctx, msg)
+		}(msg)
+	}
+	<-ctx.Done()
+	wg.Wait()
+	return nil
+}
+
+func TestWorker_Run(t *testing.T) {
+	sub := &fakeSubscription{msgs: []*pubsub.Message{
+		{ID: "1", Attributes: map[string]string{"event-type": "created"}, Data: []byte("a")},
+		{ID: "2", Data: []byte("b")},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{}, len(sub.msgs))
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	got := map[string]*model.Message{}
+	var canceled bool
+
+	w := New(noop.Meter{})
+	w.Handle(sub, func(ctx context.Context, msg *model.Message) bool {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		got[msg.ID] = msg
+		canceled = canceled || ctx.Err() != nil
+		return msg.ID == "1"
+	})
+
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	for range sub.msgs {
+		<-started
+	}
+
+	// shutdown while messages are in flight, they must be drained
+	cancel()
+	select {
+	case <-done:
+		t.Fatalf("Run returned before in-flight messages were drained")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run() unexpected error: %v", err)
+	}
+	if canceled {
+		t.Fatalf("processing context canceled on shutdown")
+	}
+	if len(got) != 2 || got["1"].Attributes["event-type"] != "created" || string(got["2"].Data) != "b" {
+		t.Fatalf("handled messages = %v", got)
+	}
+}
+
+func TestWorker_RunError(t *testing.T) {
+	w := New(noop.Meter{})
+	w.Handle(&fakeSubscription{err: errors.New("subscription not found")}, func(context.Context, *model.Message) bool { return true })
+	w.Handle(&fakeSubscription{}, func(context.Context, *model.Message) bool { return true })
+
+	if err := w.Run(context.Background()); err == nil {
+		t.Fatalf("Run() expected error")
+	}
+}